@@ -0,0 +1,53 @@
+package capnp
+
+import "context"
+
+// CallMetadata is a set of key-value pairs attached to a single method
+// call or its response, analogous to gRPC metadata, e.g. for passing
+// trace IDs.  The Cap'n Proto RPC protocol has no field for call
+// metadata, so it is only delivered to capabilities implemented in the
+// same process, such as those created with the server package.
+type CallMetadata map[string]string
+
+type callMetadataKey struct{}
+
+// callMetadata is the value stored in a context under callMetadataKey.
+type callMetadata struct {
+	in, out CallMetadata
+}
+
+// ContextWithCallMetadata returns a context carrying the call metadata
+// from r, to be passed to the application code that handles r.  It is
+// intended for ClientHook implementations; the application code reads
+// the metadata with IncomingCallMetadata and SetResponseMetadata.
+func ContextWithCallMetadata(ctx context.Context, r Recv) context.Context {
+	if r.Metadata == nil && r.ResponseMetadata == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, callMetadataKey{}, callMetadata{
+		in:  r.Metadata,
+		out: r.ResponseMetadata,
+	})
+}
+
+// IncomingCallMetadata returns the metadata that the caller attached to
+// the call being handled with ctx, or nil if there is none.  The
+// returned map must not be modified.
+func IncomingCallMetadata(ctx context.Context) CallMetadata {
+	md, _ := ctx.Value(callMetadataKey{}).(callMetadata)
+	return md.in
+}
+
+// SetResponseMetadata sets key to value in the response metadata of the
+// call being handled with ctx.  It reports false if the caller did not
+// ask for response metadata, in which case the value is discarded.
+// SetResponseMetadata must not be called concurrently for the same call,
+// nor after the call returns.
+func SetResponseMetadata(ctx context.Context, key, value string) bool {
+	md, _ := ctx.Value(callMetadataKey{}).(callMetadata)
+	if md.out == nil {
+		return false
+	}
+	md.out[key] = value
+	return true
+}
@@ -16,28 +16,31 @@ func Canonicalize(s Struct) ([]byte, error) {
 	if err := msg.SetRoot(root.ToPtr()); err != nil {
 		return nil, errorf("canonicalize: %v", err)
 	}
-	if err := fillCanonicalStruct(root, s); err != nil {
+	if err := fillCanonicalStruct(root, s, true); err != nil {
 		return nil, annotatef(err, "canonicalize")
 	}
 	return seg.Data(), nil
 }
 
-func canonicalPtr(dst *Segment, p Ptr) (Ptr, error) {
+// canonicalPtr copies the object p points to into dst's message,
+// placing its children in depth-first order.  If trim is false, structs
+// keep their sizes instead of having trailing zeroes removed.
+func canonicalPtr(dst *Segment, p Ptr, trim bool) (Ptr, error) {
 	if !p.IsValid() {
 		return Ptr{}, nil
 	}
 	switch p.flags.ptrType() {
 	case structPtrType:
-		ss, err := NewStruct(dst, canonicalStructSize(p.Struct()))
+		ss, err := NewStruct(dst, copyStructSize(p.Struct(), trim))
 		if err != nil {
 			return Ptr{}, errorf("struct: %v", err)
 		}
-		if err := fillCanonicalStruct(ss, p.Struct()); err != nil {
+		if err := fillCanonicalStruct(ss, p.Struct(), trim); err != nil {
 			return Ptr{}, err
 		}
 		return ss.ToPtr(), nil
 	case listPtrType:
-		ll, err := canonicalList(dst, p.List())
+		ll, err := canonicalList(dst, p.List(), trim)
 		if err != nil {
 			return Ptr{}, err
 		}
@@ -50,14 +53,14 @@ func canonicalPtr(dst *Segment, p Ptr) (Ptr, error) {
 	}
 }
 
-func fillCanonicalStruct(dst, s Struct) error {
+func fillCanonicalStruct(dst, s Struct, trim bool) error {
 	copy(dst.seg.slice(dst.off, dst.size.DataSize), s.seg.slice(s.off, s.size.DataSize))
 	for i := uint16(0); i < dst.size.PointerCount; i++ {
 		p, err := s.Ptr(i)
 		if err != nil {
 			return annotatef(err, "struct pointer %d", i)
 		}
-		cp, err := canonicalPtr(dst.seg, p)
+		cp, err := canonicalPtr(dst.seg, p, trim)
 		if err != nil {
 			return annotatef(err, "struct pointer %d", i)
 		}
@@ -68,6 +71,15 @@ func fillCanonicalStruct(dst, s Struct) error {
 	return nil
 }
 
+// copyStructSize returns the size of a copy of s: its canonical size if
+// trim is true, and its own size otherwise.
+func copyStructSize(s Struct, trim bool) ObjectSize {
+	if !trim {
+		return s.size
+	}
+	return canonicalStructSize(s)
+}
+
 func canonicalStructSize(s Struct) ObjectSize {
 	if !s.IsValid() {
 		return ObjectSize{}
@@ -89,7 +101,7 @@ func canonicalStructSize(s Struct) ObjectSize {
 	return sz
 }
 
-func canonicalList(dst *Segment, l List) (List, error) {
+func canonicalList(dst *Segment, l List, trim bool) (List, error) {
 	if !l.IsValid() {
 		return List{}, nil
 	}
@@ -120,9 +132,9 @@ func canonicalList(dst *Segment, l List) (List, error) {
 		for i := 0; i < l.Len(); i++ {
 			p, err := PointerList(l).At(i)
 			if err != nil {
-				return List{}, errorf("list element %d: %v", i, err)
+				return List{}, annotatef(err, "list element %d", i)
 			}
-			cp, err := canonicalPtr(dst, p)
+			cp, err := canonicalPtr(dst, p, trim)
 			if err != nil {
 				return List{}, annotatef(err, "list element %d", i)
 			}
@@ -134,14 +146,17 @@ func canonicalList(dst *Segment, l List) (List, error) {
 	}
 
 	// Struct/composite list
-	var elemSize ObjectSize
-	for i := 0; i < l.Len(); i++ {
-		sz := canonicalStructSize(l.Struct(i))
-		if sz.DataSize > elemSize.DataSize {
-			elemSize.DataSize = sz.DataSize
-		}
-		if sz.PointerCount > elemSize.PointerCount {
-			elemSize.PointerCount = sz.PointerCount
+	elemSize := l.size
+	if trim {
+		elemSize = ObjectSize{}
+		for i := 0; i < l.Len(); i++ {
+			sz := canonicalStructSize(l.Struct(i))
+			if sz.DataSize > elemSize.DataSize {
+				elemSize.DataSize = sz.DataSize
+			}
+			if sz.PointerCount > elemSize.PointerCount {
+				elemSize.PointerCount = sz.PointerCount
+			}
 		}
 	}
 	cl, err := NewCompositeList(dst, elemSize, l.length)
@@ -149,7 +164,7 @@ func canonicalList(dst *Segment, l List) (List, error) {
 		return List{}, errorf("list: %v", err)
 	}
 	for i := 0; i < cl.Len(); i++ {
-		if err := fillCanonicalStruct(cl.Struct(i), l.Struct(i)); err != nil {
+		if err := fillCanonicalStruct(cl.Struct(i), l.Struct(i), trim); err != nil {
 			return List{}, annotatef(err, "list element %d", i)
 		}
 	}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 
 	"capnproto.org/go/capnp/v3/flowcontrol"
@@ -114,9 +115,10 @@ type ClientKind = struct {
 }
 
 type client struct {
-	creatorFunc int
-	creatorFile string
-	creatorLine int
+	creatorFunc  int
+	creatorFile  string
+	creatorLine  int
+	creatorStack []uintptr // only recorded if clientLeakHook != nil
 
 	mu       sync.Mutex // protects the struct
 	limiter  flowcontrol.FlowLimiter
@@ -135,6 +137,10 @@ type clientHook struct {
 	// Place for callers to attach arbitrary metadata to the client.
 	metadata Metadata
 
+	// debug records reference call sites in capnpdebug builds.  It is
+	// protected by mu.
+	debug refDebug
+
 	// done is closed when refs == 0 and calls == 0.
 	done chan struct{}
 
@@ -165,10 +171,9 @@ func NewClient(hook ClientHook) Client {
 	}
 	h.resolvedHook = h
 	c := Client{client: &client{h: h}}
-	if clientLeakFunc != nil {
-		c.creatorFunc = 1
-		_, c.creatorFile, c.creatorLine, _ = runtime.Caller(1)
-		c.setFinalizer()
+	h.debug.add(c.client, 1)
+	if clientLeakFunc != nil || clientLeakHook != nil {
+		c.setupLeakReporting(1)
 	}
 	return c
 }
@@ -192,10 +197,9 @@ func NewPromisedClient(hook ClientHook) (Client, *ClientPromise) {
 		metadata:   *NewMetadata(),
 	}
 	c := Client{client: &client{h: h}}
-	if clientLeakFunc != nil {
-		c.creatorFunc = 2
-		_, c.creatorFile, c.creatorLine, _ = runtime.Caller(1)
-		c.setFinalizer()
+	h.debug.add(c.client, 1)
+	if clientLeakFunc != nil || clientLeakHook != nil {
+		c.setupLeakReporting(2)
 	}
 	return c, &ClientPromise{h: h}
 }
@@ -418,7 +422,34 @@ func (c Client) IsSame(c2 Client) bool {
 	return h1 == h2
 }
 
+// A ClientID identifies a capability.  ClientIDs are comparable, so
+// they can be used as map keys.  The zero ClientID identifies the null
+// client.
+type ClientID struct {
+	h *clientHook
+}
+
+// Identity returns an ID that is the same for every reference to the
+// capability that c refers to, i.e. for every Client that IsSame
+// reports is the same as c.  Null clients share the zero ClientID.
+// Like IsSame, Identity can change when c resolves: use Resolve first
+// if this is an issue.  If c is released, then Identity panics.
+//
+// A ClientID does not hold a reference to the capability, so it does
+// not keep the capability from being shut down.
+func (c Client) Identity() ClientID {
+	h, released, _ := c.peek()
+	if released {
+		panic("Identity on released client")
+	}
+	return ClientID{h}
+}
+
 // Resolve blocks until the capability is fully resolved or the Context is Done.
+// Unlike making a call, Resolve does not send anything to the capability.
+// If c is nil or has already settled to a capability, null, or an error,
+// Resolve returns nil immediately.  If ctx is done first, Resolve returns
+// ctx.Err() and c remains usable.
 func (c Client) Resolve(ctx context.Context) error {
 	for {
 		h, released, resolved := c.peek()
@@ -458,12 +489,11 @@ func (c Client) AddRef() Client {
 		return Client{}
 	}
 	c.h.refs++
-	c.h.mu.Unlock()
 	d := Client{client: &client{h: c.h}}
-	if clientLeakFunc != nil {
-		d.creatorFunc = 3
-		_, d.creatorFile, d.creatorLine, _ = runtime.Caller(1)
-		d.setFinalizer()
+	c.h.debug.add(d.client, 1)
+	c.h.mu.Unlock()
+	if clientLeakFunc != nil || clientLeakHook != nil {
+		d.setupLeakReporting(3)
 	}
 	return d
 }
@@ -496,11 +526,61 @@ func (c Client) State() ClientState {
 	}
 }
 
+// IsLocal reports whether c has resolved to a capability that is
+// hosted in this process, such as a *server.Server, rather than one
+// imported from another vat or a wrapper around other clients.  It
+// returns false if c is nil, an unresolved promise, or released.  Use
+// rpc.OriginConn to find the connection an imported capability came
+// from.
+func (c Client) IsLocal() bool {
+	h, resolved, _, finish := c.startCall()
+	defer finish()
+	if h == nil || !resolved {
+		return false
+	}
+	lh, ok := h.(localHook)
+	return ok && lh.IsLocal()
+}
+
+// localHook is implemented by ClientHooks that host a capability in
+// this process.
+type localHook interface {
+	IsLocal() bool
+}
+
 // A Brand is an opaque value used to identify a capability.
 type Brand struct {
 	Value interface{}
 }
 
+// Brand returns the brand of the hook that c refers to, as in
+// c.State().Brand.  It returns the zero Brand if c is nil, has resolved
+// to null, or has been released.
+func (c Client) Brand() Brand {
+	return c.State().Brand
+}
+
+// BrandAs returns b's value as a T, reporting whether it is one.  A
+// ClientHook can attach any value to the capability it implements by
+// returning it from Brand, and BrandAs recovers it:
+//
+//	type myBrand struct{ name string }
+//
+//	func (h *myHook) Brand() capnp.Brand {
+//		return capnp.Brand{Value: myBrand{h.name}}
+//	}
+//
+//	if mb, ok := capnp.BrandAs[myBrand](c.Brand()); ok {
+//		// c is implemented by a *myHook.
+//	}
+//
+// Using an unexported type for the value, as server.IsServer does,
+// keeps other packages from forging the brand.
+func BrandAs[T any](b Brand) (T, bool) {
+	v, ok := b.Value.(T)
+	return v, ok
+}
+
 // ClientState is a snapshot of a client's identity.
 type ClientState struct {
 	// Brand is the value returned from the hook's Brand method.
@@ -516,6 +596,64 @@ type ClientState struct {
 	Metadata *Metadata
 }
 
+// Snapshot reports the current resolution state of the client without
+// making a call.  The snapshot is a point-in-time view: a client that
+// is a promise may resolve, possibly to null or to an error, right
+// after Snapshot returns.  The snapshot of a released client is the
+// same as that of a nil client.
+func (c Client) Snapshot() ClientSnapshot {
+	h, resolved, _, finish := c.startCall()
+	defer finish()
+	if h == nil {
+		return ClientSnapshot{resolved: true}
+	}
+	snap := ClientSnapshot{
+		resolved: resolved,
+		valid:    true,
+		brand:    h.Brand(),
+	}
+	if ec, ok := h.(errorClient); ok {
+		snap.err = ec.e
+	}
+	return snap
+}
+
+// A ClientSnapshot is the resolution state of a client at the time
+// Client.Snapshot was called.
+type ClientSnapshot struct {
+	resolved bool
+	valid    bool
+	brand    Brand
+	err      error
+}
+
+// IsResolved reports whether the client had resolved, i.e. whether it
+// referred to something other than an unresolved promise.
+func (s ClientSnapshot) IsResolved() bool {
+	return s.resolved
+}
+
+// IsNull reports whether the client was nil, had resolved to null, or
+// had been released.
+func (s ClientSnapshot) IsNull() bool {
+	return !s.valid
+}
+
+// IsErr returns the error that the client had resolved to, or nil if
+// the client was not an ErrorClient.
+func (s ClientSnapshot) IsErr() error {
+	return s.err
+}
+
+// Brand returns the brand of the hook that the client referred to.  If
+// the client was an unresolved promise, this is the brand of the promise
+// hook, not of the capability it will resolve to.  Pass the brand to
+// server.IsServer to find out whether the client referred to a local
+// server.
+func (s ClientSnapshot) Brand() Brand {
+	return s.brand
+}
+
 // String returns a string that identifies this capability for debugging
 // purposes.  Its format should not be depended on: in particular, it
 // should not be used to compare clients.  Use IsSame to compare clients
@@ -557,6 +695,26 @@ func (c Client) String() string {
 // Release has no effect if c has already been released, or if c is
 // nil or resolved to null.
 func (c Client) Release() {
+	c.release(nil)
+}
+
+// ReleaseWithReason is like Release, but if this is the last reference
+// to the capability and reason is not nil, the capability's ClientHook
+// is shut down by calling its ShutdownWithReason(error) method, if it
+// has one, instead of Shutdown.  This lets an implementation such as
+// *server.Server tell an orderly release apart from one caused by, for
+// example, a dropped connection.
+func (c Client) ReleaseWithReason(reason error) {
+	c.release(reason)
+}
+
+// reasonShutdowner is implemented by ClientHooks that accept the reason
+// passed to ReleaseWithReason.
+type reasonShutdowner interface {
+	ShutdownWithReason(reason error)
+}
+
+func (c Client) release(reason error) {
 	if c.client == nil {
 		return
 	}
@@ -575,6 +733,7 @@ func (c Client) Release() {
 	h := c.h
 	c.h = nil
 	h.refs--
+	h.debug.remove(c.client)
 	if h.refs > 0 {
 		h.mu.Unlock()
 		c.mu.Unlock()
@@ -586,7 +745,11 @@ func (c Client) Release() {
 	h.mu.Unlock()
 	c.mu.Unlock()
 	<-h.done
-	h.Shutdown()
+	if rs, ok := h.ClientHook.(reasonShutdowner); ok && reason != nil {
+		rs.ShutdownWithReason(reason)
+	} else {
+		h.Shutdown()
+	}
 	c.GetFlowLimiter().Release()
 }
 
@@ -625,6 +788,35 @@ func SetClientLeakFunc(f func(msg string)) {
 	clientLeakFunc = f
 }
 
+var clientLeakHook func(string)
+
+// SetClientLeakHook sets a callback for reporting Clients that went out
+// of scope without being released, like SetClientLeakFunc, but the
+// callback receives the full stack trace of the call that created the
+// leaked Client.  Recording a stack trace for every Client is expensive,
+// so this is intended for debugging.  Passing nil disables it.
+//
+// SetClientLeakHook must not be called after any calls to NewClient or
+// NewPromisedClient.
+func SetClientLeakHook(f func(trace string)) {
+	clientLeakHook = f
+}
+
+// setupLeakReporting records where c was created and arranges for the
+// leak callbacks to be called if c is garbage collected before it is
+// released.  It must be called directly by the function that created
+// c, and only if clientLeakFunc or clientLeakHook is set.
+func (c Client) setupLeakReporting(creatorFunc int) {
+	c.creatorFunc = creatorFunc
+	_, c.creatorFile, c.creatorLine, _ = runtime.Caller(2)
+	if clientLeakHook != nil {
+		var pcs [64]uintptr
+		n := runtime.Callers(2, pcs[:])
+		c.creatorStack = append([]uintptr(nil), pcs[:n]...)
+	}
+	c.setFinalizer()
+}
+
 func (c Client) setFinalizer() {
 	runtime.SetFinalizer(c.client, finalizeClient)
 }
@@ -654,8 +846,26 @@ func finalizeClient(c *client) {
 		msg = fmt.Sprintf("leaked client created by %s on %s:%d", fname, c.creatorFile, c.creatorLine)
 	}
 
-	// finalizeClient will only be called if clientLeakFunc != nil.
-	go clientLeakFunc(msg)
+	// finalizeClient will only be called if one of the leak callbacks is set.
+	if clientLeakFunc != nil {
+		go clientLeakFunc(msg)
+	}
+	if clientLeakHook != nil {
+		var sb strings.Builder
+		sb.WriteString(msg)
+		sb.WriteString("\n")
+		frames := runtime.CallersFrames(c.creatorStack)
+		for {
+			f, more := frames.Next()
+			if f.Function != "" {
+				fmt.Fprintf(&sb, "%s\n\t%s:%d\n", f.Function, f.File, f.Line)
+			}
+			if !more {
+				break
+			}
+		}
+		go clientLeakHook(sb.String())
+	}
 }
 
 // A ClientPromise resolves the identity of a client created by NewPromisedClient.
@@ -709,6 +919,7 @@ func (cp *ClientPromise) Fulfill(c Client) {
 	rh = resolveHook(cp.h) // swaps mutex on cp.h for mutex on rh
 	if rh != nil {
 		rh.refs += refs
+		cp.h.debug.moveTo(&rh.debug)
 		rh.mu.Unlock()
 	}
 	<-cp.h.done
@@ -741,12 +952,11 @@ func (wc *WeakClient) AddRef() (c Client, ok bool) {
 		return Client{}, false
 	}
 	wc.h.refs++
-	wc.h.mu.Unlock()
 	c = Client{client: &client{h: wc.h}}
-	if clientLeakFunc != nil {
-		c.creatorFunc = 3
-		_, c.creatorFile, c.creatorLine, _ = runtime.Caller(1)
-		c.setFinalizer()
+	wc.h.debug.add(c.client, 1)
+	wc.h.mu.Unlock()
+	if clientLeakFunc != nil || clientLeakHook != nil {
+		c.setupLeakReporting(3)
 	}
 	return c, true
 }
@@ -754,6 +964,8 @@ func (wc *WeakClient) AddRef() (c Client, ok bool) {
 // A ClientHook represents a Cap'n Proto capability.  Application code
 // should not pass around ClientHooks; applications should pass around
 // Clients.  A ClientHook must be safe to use from multiple goroutines.
+// A ClientHook may also implement a Refs method to report the clients
+// it holds; see DetectClientCycle.
 //
 // Calls must be delivered to the capability in the order they are made.
 // This guarantee is based on the concept of a capability
@@ -805,6 +1017,15 @@ type Send struct {
 
 	// ArgsSize specifies the size of the struct to pass to PlaceArgs.
 	ArgsSize ObjectSize
+
+	// Metadata is passed to the capability along with the arguments.
+	// It may be nil.
+	Metadata CallMetadata
+
+	// If ResponseMetadata is not nil, the capability may add entries
+	// to it before the call returns.  The caller must not access it
+	// until the answer resolves.
+	ResponseMetadata CallMetadata
 }
 
 // Recv is the input to ClientHook.Recv.
@@ -822,6 +1043,11 @@ type Recv struct {
 
 	// Returner manages the results.
 	Returner Returner
+
+	// Metadata and ResponseMetadata are the call metadata from Send.
+	// See ContextWithCallMetadata.
+	Metadata         CallMetadata
+	ResponseMetadata CallMetadata
 }
 
 // AllocResults allocates a result struct.  It is the same as calling
@@ -906,7 +1132,10 @@ type errorClient struct {
 	e error
 }
 
-// ErrorClient returns a Client that always returns error e.
+// ErrorClient returns a Client that always returns error e.  Every
+// call on it fails with e, as do calls pipelined on its results, so it
+// can stand in for a capability that could not be obtained.  Answers
+// annotate e with the method that was called, but errors.Is reports it.
 // An ErrorClient does not need to be released: it is a sentinel like a
 // nil Client.
 //
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 )
@@ -603,6 +605,203 @@ func TestWeakPromisedClient(t *testing.T) {
 	}
 }
 
+func TestClientSnapshot(t *testing.T) {
+	{
+		snap := Client{}.Snapshot()
+		if !snap.IsResolved() || !snap.IsNull() || snap.IsErr() != nil {
+			t.Errorf("Client{}.Snapshot() = %+v; want resolved null", snap)
+		}
+	}
+	{
+		e := errors.New("boo")
+		snap := ErrorClient(e).Snapshot()
+		if !snap.IsResolved() || snap.IsNull() || snap.IsErr() != e {
+			t.Errorf("ErrorClient(e).Snapshot() = %+v; want resolved, not null, with error e", snap)
+		}
+	}
+	{
+		a := &dummyHook{brand: Brand{Value: "a"}}
+		b := &dummyHook{brand: Brand{Value: "b"}}
+		ca, pa := NewPromisedClient(a)
+		defer ca.Release()
+		snap := ca.Snapshot()
+		if snap.IsResolved() {
+			t.Error("unresolved promise: IsResolved() = true; want false")
+		}
+		if snap.IsNull() {
+			t.Error("unresolved promise: IsNull() = true; want false")
+		}
+		if got := snap.Brand().Value; got != "a" {
+			t.Errorf("unresolved promise: Brand().Value = %#v; want \"a\"", got)
+		}
+
+		pa.Fulfill(NewClient(b))
+		snap = ca.Snapshot()
+		if !snap.IsResolved() {
+			t.Error("fulfilled promise: IsResolved() = false; want true")
+		}
+		if snap.IsErr() != nil {
+			t.Errorf("fulfilled promise: IsErr() = %v; want nil", snap.IsErr())
+		}
+		if got := snap.Brand().Value; got != "b" {
+			t.Errorf("fulfilled promise: Brand().Value = %#v; want \"b\"", got)
+		}
+	}
+}
+
+func TestBrandAs(t *testing.T) {
+	type tag struct{ name string }
+	c := NewClient(&dummyHook{brand: Brand{Value: tag{"custom"}}})
+	defer c.Release()
+
+	if got, ok := BrandAs[tag](c.Brand()); !ok || got.name != "custom" {
+		t.Errorf("BrandAs[tag](c.Brand()) = %+v, %t; want {custom}, true", got, ok)
+	}
+	if got, ok := BrandAs[string](c.Brand()); ok {
+		t.Errorf("BrandAs[string](c.Brand()) = %q, true; want false", got)
+	}
+	if _, ok := BrandAs[tag](Client{}.Brand()); ok {
+		t.Error("BrandAs[tag](Client{}.Brand()) = _, true; want false")
+	}
+}
+
+func TestClientIdentity(t *testing.T) {
+	a := NewClient(new(dummyHook))
+	defer a.Release()
+	b := NewClient(new(dummyHook))
+	defer b.Release()
+
+	set := make(map[ClientID]Client)
+	for i := 0; i < 3; i++ {
+		c := a.AddRef()
+		defer c.Release()
+		set[c.Identity()] = c
+	}
+	if len(set) != 1 {
+		t.Errorf("%d entries for copies of one client; want 1", len(set))
+	}
+	if _, ok := set[b.Identity()]; ok {
+		t.Error("distinct client has the same identity")
+	}
+	set[b.Identity()] = b
+	if len(set) != 2 {
+		t.Errorf("%d entries after adding distinct client; want 2", len(set))
+	}
+	if (Client{}).Identity() != (ClientID{}) {
+		t.Error("null client identity is not the zero ClientID")
+	}
+	if ErrorClient(errors.New("x")).Identity() == (ClientID{}) {
+		t.Error("error client has the null identity")
+	}
+}
+
+func TestErrorClient(t *testing.T) {
+	e := errors.New("operation failed")
+	c := ErrorClient(e)
+	defer c.Release()
+
+	ans, release := c.SendCall(context.Background(), Send{})
+	defer release()
+	if _, err := ans.Struct(); !errors.Is(err, e) {
+		t.Errorf("call returned %v; want %v", err, e)
+	}
+	pc := ans.Future().Field(0, nil).Client()
+	defer pc.Release()
+	pans, prelease := pc.SendCall(context.Background(), Send{})
+	defer prelease()
+	if _, err := pans.Struct(); !errors.Is(err, e) {
+		t.Errorf("pipelined call returned %v; want %v", err, e)
+	}
+
+	ret := new(dummyReturner)
+	c.RecvCall(context.Background(), Recv{
+		Args:        newEmptyStruct(),
+		ReleaseArgs: func() {},
+		Returner:    ret,
+	})
+	if !ret.returned || ret.err != e {
+		t.Errorf("RecvCall returned %v; want %v", ret.err, e)
+	}
+}
+
+func TestClientResolve(t *testing.T) {
+	t.Run("Settled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		c := NewClient(new(dummyHook))
+		defer c.Release()
+		for _, c := range []Client{{}, c, ErrorClient(errors.New("boo"))} {
+			if err := c.Resolve(ctx); err != nil {
+				t.Errorf("%v.Resolve(cancelled ctx) = %v; want nil", c, err)
+			}
+		}
+	})
+	t.Run("Delayed", func(t *testing.T) {
+		ca, pa := NewPromisedClient(new(dummyHook))
+		defer ca.Release()
+		fulfilled := make(chan struct{})
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			close(fulfilled)
+			pa.Fulfill(NewClient(new(dummyHook)))
+		}()
+		if err := ca.Resolve(context.Background()); err != nil {
+			t.Fatal("Resolve:", err)
+		}
+		select {
+		case <-fulfilled:
+		default:
+			t.Error("Resolve returned before promise was fulfilled")
+		}
+		if !ca.Snapshot().IsResolved() {
+			t.Error("client not resolved after Resolve returned")
+		}
+	})
+	t.Run("Cancelled", func(t *testing.T) {
+		ca, pa := NewPromisedClient(new(dummyHook))
+		defer ca.Release()
+		defer pa.Fulfill(Client{})
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := ca.Resolve(ctx); err != context.DeadlineExceeded {
+			t.Errorf("Resolve(expiring ctx) = %v; want %v", err, context.DeadlineExceeded)
+		}
+		if ca.Snapshot().IsResolved() {
+			t.Error("client resolved without being fulfilled")
+		}
+	})
+}
+
+func TestClientLeakHook(t *testing.T) {
+	traces := make(chan string, 1)
+	SetClientLeakHook(func(trace string) {
+		select {
+		case traces <- trace:
+		default:
+		}
+	})
+	defer SetClientLeakHook(nil)
+
+	leakClient()
+	for i := 0; i < 100; i++ {
+		runtime.GC()
+		select {
+		case trace := <-traces:
+			if !strings.Contains(trace, "leakClient") {
+				t.Errorf("leak trace does not mention leakClient:\n%s", trace)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.Fatal("leak hook not called after dropping an unreleased client")
+}
+
+//go:noinline
+func leakClient() {
+	NewClient(new(dummyHook))
+}
+
 func mustMarshal(t *testing.T, msg *Message) []byte {
 	data, err := msg.Marshal()
 	if err != nil {
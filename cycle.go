@@ -0,0 +1,75 @@
+package capnp
+
+// refsHook is implemented by ClientHooks that can report the clients
+// that they hold references to.  See DetectClientCycle.
+type refsHook interface {
+	// Refs returns the clients that the capability holds.  The caller
+	// does not own the returned clients and must not release them.
+	Refs() []Client
+}
+
+// DetectClientCycle reports whether the capabilities reachable from
+// root hold references to each other in a cycle, which keeps all of
+// them from being shut down even after every other reference is
+// released.  If it finds a cycle, it returns the IDs of the
+// capabilities in it, in the order that they refer to each other.
+//
+// DetectClientCycle is meant for tracking down leaks.  It follows the
+// references reported by hooks that implement an optional method:
+//
+//	Refs() []Client
+//
+// which returns the clients that the capability holds, without
+// transferring ownership.  Capabilities whose hooks do not implement
+// Refs, such as imports from a remote vat, are treated as holding no
+// references.  Unresolved promises are followed as far as they have
+// resolved.  The result is a snapshot: the graph may change while
+// DetectClientCycle walks it.
+func DetectClientCycle(root Client) ([]ClientID, bool) {
+	d := cycleDetector{state: make(map[*clientHook]int)}
+	return d.visit(root)
+}
+
+type cycleDetector struct {
+	// state is 1 for hooks on the current path and 2 for hooks whose
+	// references have all been visited.
+	state map[*clientHook]int
+	path  []*clientHook
+}
+
+func (d *cycleDetector) visit(c Client) ([]ClientID, bool) {
+	h, released, _ := c.peek()
+	if h == nil || released {
+		return nil, false
+	}
+	switch d.state[h] {
+	case 1:
+		var cycle []ClientID
+		for i := len(d.path) - 1; i >= 0; i-- {
+			if d.path[i] == h {
+				for _, p := range d.path[i:] {
+					cycle = append(cycle, ClientID{p})
+				}
+				break
+			}
+		}
+		return cycle, true
+	case 2:
+		return nil, false
+	}
+	rh, ok := h.ClientHook.(refsHook)
+	if !ok {
+		d.state[h] = 2
+		return nil, false
+	}
+	d.state[h] = 1
+	d.path = append(d.path, h)
+	for _, ref := range rh.Refs() {
+		if cycle, ok := d.visit(ref); ok {
+			return cycle, true
+		}
+	}
+	d.path = d.path[:len(d.path)-1]
+	d.state[h] = 2
+	return nil, false
+}
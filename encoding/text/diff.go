@@ -0,0 +1,331 @@
+package text
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"capnproto.org/go/capnp/v3"
+	"capnproto.org/go/capnp/v3/internal/schema"
+)
+
+// A FieldDiff is a value that differs between two messages.
+type FieldDiff struct {
+	// Path locates the value from the root struct, as in
+	// "foo.bar[3].baz".  For a union whose variants differ, Path is the
+	// path of the struct or group that holds the union.
+	Path string
+
+	// A and B are the text representations of the value in each
+	// message.  For a union whose variants differ, they are of the form
+	// "name = value".  A list element that only one of the lists has is
+	// the empty string in the other.
+	A, B string
+}
+
+// Diff compares two structs of the type typeID field by field, using
+// the schema in the default registry, and returns the values that
+// differ.  Lists are compared element by element.  Capabilities and
+// opaque pointers are only compared for whether they are null.
+func Diff(typeID uint64, a, b capnp.Struct) ([]FieldDiff, error) {
+	d := new(differ)
+	d.enc = NewEncoder(&d.buf)
+	if err := d.diffStruct("", typeID, a, b); err != nil {
+		return nil, err
+	}
+	return d.diffs, nil
+}
+
+// A differ accumulates the differences between two messages.
+type differ struct {
+	enc   *Encoder // writes to buf
+	buf   bytes.Buffer
+	diffs []FieldDiff
+}
+
+// format returns the text written by f to d.enc.
+func (d *differ) format(f func() error) (string, error) {
+	d.buf.Reset()
+	if err := f(); err != nil {
+		return "", err
+	}
+	return d.buf.String(), nil
+}
+
+func (d *differ) add(path, a, b string) {
+	d.diffs = append(d.diffs, FieldDiff{Path: path, A: a, B: b})
+}
+
+func (d *differ) diffStruct(path string, typeID uint64, a, b capnp.Struct) error {
+	n, err := d.enc.nodes.Find(typeID)
+	if err != nil {
+		return err
+	}
+	if !n.IsValid() || n.Which() != schema.Node_Which_structNode {
+		return fmt.Errorf("cannot find struct type %#x", typeID)
+	}
+	var discA, discB uint16
+	if n.StructNode().DiscriminantCount() > 0 {
+		off := capnp.DataOffset(n.StructNode().DiscriminantOffset() * 2)
+		discA, discB = a.Uint16(off), b.Uint16(off)
+	}
+	fields := codeOrderFields(n.StructNode())
+	if discA != discB {
+		va, err := d.variant(a, fields, discA)
+		if err != nil {
+			return err
+		}
+		vb, err := d.variant(b, fields, discB)
+		if err != nil {
+			return err
+		}
+		d.add(path, va, vb)
+	}
+	for _, f := range fields {
+		if !(f.Which() == schema.Field_Which_slot || f.Which() == schema.Field_Which_group) {
+			continue
+		}
+		if dv := f.DiscriminantValue(); dv != schema.Field_noDiscriminant && (dv != discA || discA != discB) {
+			continue
+		}
+		name, err := f.Name()
+		if err != nil {
+			return err
+		}
+		fpath := name
+		if path != "" {
+			fpath = path + "." + name
+		}
+		if err := d.diffField(fpath, a, b, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// variant formats the union member of s that disc selects.
+func (d *differ) variant(s capnp.Struct, fields []schema.Field, disc uint16) (string, error) {
+	for _, f := range fields {
+		if f.DiscriminantValue() != disc {
+			continue
+		}
+		name, err := f.Name()
+		if err != nil {
+			return "", err
+		}
+		return d.format(func() error {
+			d.enc.w.WriteString(name + " = ")
+			return d.marshalField(s, f)
+		})
+	}
+	return strconv.Itoa(int(disc)), nil
+}
+
+func (d *differ) marshalField(s capnp.Struct, f schema.Field) error {
+	if f.Which() == schema.Field_Which_group {
+		return d.enc.marshalStruct(f.Group().TypeId(), s)
+	}
+	return d.enc.marshalFieldValue(s, f)
+}
+
+func (d *differ) diffField(path string, a, b capnp.Struct, f schema.Field) error {
+	if f.Which() == schema.Field_Which_group {
+		return d.diffStruct(path, f.Group().TypeId(), a, b)
+	}
+	typ, err := f.Slot().Type()
+	if err != nil {
+		return err
+	}
+	switch typ.Which() {
+	case schema.Type_Which_structType:
+		pa, pb, err := d.fieldPtrs(a, b, f)
+		if err != nil {
+			return err
+		}
+		dv, _ := f.Slot().DefaultValue()
+		def, _ := dv.StructValue()
+		if !pa.IsValid() {
+			pa = def
+		}
+		if !pb.IsValid() {
+			pb = def
+		}
+		return d.diffStruct(path, typ.StructType().TypeId(), pa.Struct(), pb.Struct())
+	case schema.Type_Which_list:
+		elem, err := typ.List().ElementType()
+		if err != nil {
+			return err
+		}
+		pa, pb, err := d.fieldPtrs(a, b, f)
+		if err != nil {
+			return err
+		}
+		dv, _ := f.Slot().DefaultValue()
+		def, _ := dv.List()
+		if !pa.IsValid() {
+			pa = def
+		}
+		if !pb.IsValid() {
+			pb = def
+		}
+		return d.diffList(path, elem, pa.List(), pb.List())
+	}
+	va, err := d.format(func() error { return d.enc.marshalFieldValue(a, f) })
+	if err != nil {
+		return err
+	}
+	vb, err := d.format(func() error { return d.enc.marshalFieldValue(b, f) })
+	if err != nil {
+		return err
+	}
+	if va != vb {
+		d.add(path, va, vb)
+	}
+	return nil
+}
+
+func (d *differ) fieldPtrs(a, b capnp.Struct, f schema.Field) (pa, pb capnp.Ptr, err error) {
+	i := uint16(f.Slot().Offset())
+	if pa, err = a.Ptr(i); err != nil {
+		return capnp.Ptr{}, capnp.Ptr{}, err
+	}
+	if pb, err = b.Ptr(i); err != nil {
+		return capnp.Ptr{}, capnp.Ptr{}, err
+	}
+	return pa, pb, nil
+}
+
+func (d *differ) diffList(path string, elem schema.Type, a, b capnp.List) error {
+	n := a.Len()
+	if b.Len() > n {
+		n = b.Len()
+	}
+	for i := 0; i < n; i++ {
+		epath := path + "[" + strconv.Itoa(i) + "]"
+		if i >= a.Len() || i >= b.Len() {
+			// Added or removed element.
+			var va, vb string
+			var err error
+			if i < a.Len() {
+				va, err = d.formatElem(elem, a, i)
+			} else {
+				vb, err = d.formatElem(elem, b, i)
+			}
+			if err != nil {
+				return err
+			}
+			d.add(epath, va, vb)
+			continue
+		}
+		switch elem.Which() {
+		case schema.Type_Which_structType:
+			if err := d.diffStruct(epath, elem.StructType().TypeId(), a.Struct(i), b.Struct(i)); err != nil {
+				return err
+			}
+			continue
+		case schema.Type_Which_list:
+			ee, err := elem.List().ElementType()
+			if err != nil {
+				return err
+			}
+			pa, err := capnp.PointerList(a).At(i)
+			if err != nil {
+				return err
+			}
+			pb, err := capnp.PointerList(b).At(i)
+			if err != nil {
+				return err
+			}
+			if err := d.diffList(epath, ee, pa.List(), pb.List()); err != nil {
+				return err
+			}
+			continue
+		}
+		va, err := d.formatElem(elem, a, i)
+		if err != nil {
+			return err
+		}
+		vb, err := d.formatElem(elem, b, i)
+		if err != nil {
+			return err
+		}
+		if va != vb {
+			d.add(epath, va, vb)
+		}
+	}
+	return nil
+}
+
+// formatElem returns the text representation of l's i'th element.
+func (d *differ) formatElem(elem schema.Type, l capnp.List, i int) (string, error) {
+	return d.format(func() error {
+		enc := d.enc
+		switch elem.Which() {
+		case schema.Type_Which_void:
+			enc.w.WriteString(voidMarker)
+		case schema.Type_Which_bool:
+			enc.marshalBool(capnp.BitList(l).At(i))
+		case schema.Type_Which_int8:
+			enc.marshalInt(int64(capnp.Int8List(l).At(i)))
+		case schema.Type_Which_int16:
+			enc.marshalInt(int64(capnp.Int16List(l).At(i)))
+		case schema.Type_Which_int32:
+			enc.marshalInt(int64(capnp.Int32List(l).At(i)))
+		case schema.Type_Which_int64:
+			enc.marshalInt(capnp.Int64List(l).At(i))
+		case schema.Type_Which_uint8:
+			enc.marshalUint(uint64(capnp.UInt8List(l).At(i)))
+		case schema.Type_Which_uint16:
+			enc.marshalUint(uint64(capnp.UInt16List(l).At(i)))
+		case schema.Type_Which_uint32:
+			enc.marshalUint(uint64(capnp.UInt32List(l).At(i)))
+		case schema.Type_Which_uint64:
+			enc.marshalUint(capnp.UInt64List(l).At(i))
+		case schema.Type_Which_float32:
+			enc.marshalFloat32(capnp.Float32List(l).At(i))
+		case schema.Type_Which_float64:
+			enc.marshalFloat64(capnp.Float64List(l).At(i))
+		case schema.Type_Which_data:
+			b, err := capnp.DataList(l).At(i)
+			if err != nil {
+				return err
+			}
+			enc.marshalText(b)
+		case schema.Type_Which_text:
+			b, err := capnp.TextList(l).BytesAt(i)
+			if err != nil {
+				return err
+			}
+			enc.marshalText(b)
+		case schema.Type_Which_structType:
+			return enc.marshalStruct(elem.StructType().TypeId(), l.Struct(i))
+		case schema.Type_Which_list:
+			ee, err := elem.List().ElementType()
+			if err != nil {
+				return err
+			}
+			p, err := capnp.PointerList(l).At(i)
+			if err != nil {
+				return err
+			}
+			return enc.marshalList(ee, p.List())
+		case schema.Type_Which_enum:
+			return enc.marshalEnum(elem.Enum().TypeId(), capnp.UInt16List(l).At(i))
+		case schema.Type_Which_interface:
+			p, err := capnp.PointerList(l).At(i)
+			if err != nil {
+				return err
+			}
+			if p.IsValid() {
+				enc.w.WriteString(interfaceMarker)
+			} else {
+				enc.w.WriteString(interfaceNullMarker)
+			}
+		case schema.Type_Which_anyPointer:
+			enc.w.WriteString(anyPointerMarker)
+		default:
+			return fmt.Errorf("unknown list type %v", elem.Which())
+		}
+		return nil
+	})
+}
@@ -0,0 +1,111 @@
+package text_test
+
+import (
+	"reflect"
+	"testing"
+
+	"capnproto.org/go/capnp/v3"
+	"capnproto.org/go/capnp/v3/encoding/text"
+	air "capnproto.org/go/capnp/v3/internal/aircraftlib"
+)
+
+func TestDiff(t *testing.T) {
+	newDates := func(months ...uint8) air.Z {
+		_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		z, err := air.NewRootZ(seg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := z.NewZdatevec(int32(len(months)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, m := range months {
+			l.At(i).SetYear(2015)
+			l.At(i).SetMonth(m)
+			l.At(i).SetDay(27)
+		}
+		return z
+	}
+	newF64 := func(f float64) air.Z {
+		_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		z, err := air.NewRootZ(seg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.SetF64(f)
+		return z
+	}
+	newText := func(s string) air.Z {
+		_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		z, err := air.NewRootZ(seg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := z.SetText(s); err != nil {
+			t.Fatal(err)
+		}
+		return z
+	}
+
+	tests := []struct {
+		name string
+		a, b air.Z
+		want []text.FieldDiff
+	}{
+		{
+			name: "Equal",
+			a:    newDates(1, 2, 3, 4),
+			b:    newDates(1, 2, 3, 4),
+		},
+		{
+			name: "NestedListElement",
+			a:    newDates(1, 2, 3, 4),
+			b:    newDates(1, 2, 3, 5),
+			want: []text.FieldDiff{{Path: "zdatevec[3].month", A: "4", B: "5"}},
+		},
+		{
+			name: "AddedElement",
+			a:    newDates(1),
+			b:    newDates(1, 2),
+			want: []text.FieldDiff{{Path: "zdatevec[1]", B: "(year = 2015, month = 2, day = 27)"}},
+		},
+		{
+			name: "RemovedElement",
+			a:    newDates(1, 2),
+			b:    newDates(1),
+			want: []text.FieldDiff{{Path: "zdatevec[1]", A: "(year = 2015, month = 2, day = 27)"}},
+		},
+		{
+			name: "SameVariant",
+			a:    newF64(1.5),
+			b:    newF64(2.5),
+			want: []text.FieldDiff{{Path: "f64", A: "1.5", B: "2.5"}},
+		},
+		{
+			name: "VariantChange",
+			a:    newF64(1.5),
+			b:    newText("hi"),
+			want: []text.FieldDiff{{Path: "", A: "f64 = 1.5", B: `text = "hi"`}},
+		},
+	}
+	for _, test := range tests {
+		got, err := text.Diff(air.Z_TypeID, capnp.Struct(test.a), capnp.Struct(test.b))
+		if err != nil {
+			t.Errorf("%s: Diff(...): %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: Diff(...) = %q; want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -11,6 +11,11 @@ var (
 // TODO(someday):  progressively remove exported functions and instead
 //                 rely on package 'exc'.
 
+// ExceptionType is the type of a Cap'n Proto exception, such as
+// exc.Overloaded.  The type of an exception is sent to the caller with
+// an RPC return.
+type ExceptionType = exc.Type
+
 // Unimplemented returns an error that formats as the given text and
 // will report true when passed to IsUnimplemented.
 func Unimplemented(s string) error {
@@ -33,6 +38,18 @@ func IsDisconnected(e error) bool {
 	return exc.TypeOf(e) == exc.Disconnected
 }
 
+// Overloaded returns an error that formats as the given text and
+// will report true when passed to IsOverloaded.
+func Overloaded(s string) error {
+	return exc.New(exc.Overloaded, "", s)
+}
+
+// IsOverloaded reports whether e indicates a failure due to a lack of
+// resources, after which the caller may retry later.
+func IsOverloaded(e error) bool {
+	return exc.TypeOf(e) == exc.Overloaded
+}
+
 func errorf(format string, args ...interface{}) error {
 	return capnperr.Failedf(format, args...)
 }
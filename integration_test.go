@@ -13,6 +13,7 @@ import (
 	"capnproto.org/go/capnp/v3"
 	air "capnproto.org/go/capnp/v3/internal/aircraftlib"
 	"capnproto.org/go/capnp/v3/internal/capnptool"
+	"capnproto.org/go/capnp/v3/internal/schema"
 )
 
 // A marshalTest tests whether a message can be encoded then read by the
@@ -943,6 +944,62 @@ func TestZDataAccessors(t *testing.T) {
 	}
 }
 
+// TestFlatInterop checks UnmarshalFlat and MarshalFlat against a
+// single-segment message in the stream format, which for a single
+// segment is the layout of capnp::messageToFlatArray.  When the capnp
+// tool is installed, the message is produced by the C++ implementation:
+//
+//	capnp encode internal/aircraftlib/aircraft.capnp Counter <<< '(size = 42, words = "hi")'
+//
+// Otherwise the test uses the hand-written bytes below, which were
+// derived from the encoding spec rather than from the tool.
+func TestFlatInterop(t *testing.T) {
+	t.Parallel()
+	in := mustEncodeTestMessage(t, "Counter", `(size = 42, words = "hi")`, []byte{
+		0, 0, 0, 0, 6, 0, 0, 0,
+		0, 0, 0, 0, 1, 0, 3, 0,
+		42, 0, 0, 0, 0, 0, 0, 0,
+		9, 0, 0, 0, 26, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0,
+		104, 105, 0, 0, 0, 0, 0, 0,
+	})
+	msg, err := capnp.UnmarshalFlat(in)
+	if err != nil {
+		t.Fatal("UnmarshalFlat:", err)
+	}
+	c, err := air.ReadRootCounter(msg)
+	if err != nil {
+		t.Fatal("ReadRootCounter:", err)
+	}
+	if c.Size() != 42 {
+		t.Errorf("Counter.size = %d; want 42", c.Size())
+	}
+	if words, err := c.Words(); err != nil || words != "hi" {
+		t.Errorf("Counter.words = %q, %v; want \"hi\"", words, err)
+	}
+
+	msg, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = air.NewRootCounter(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetSize(42)
+	if err := c.SetWords("hi"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := msg.MarshalFlat()
+	if err != nil {
+		t.Fatal("MarshalFlat:", err)
+	}
+	if !bytes.Equal(out, in) {
+		t.Errorf("MarshalFlat =\n%s\nwant:\n%s", hex.Dump(out), hex.Dump(in))
+	}
+}
+
 func TestReadListInStruct(t *testing.T) {
 	t.Parallel()
 	in := mustEncodeTestMessage(t, "Nester1Capn", "(strs = [\"furiosa\", \"max\"])", []byte{
@@ -2013,6 +2070,73 @@ func TestPointerDepthDefenseAcrossStructsAndLists(t *testing.T) {
 	}
 }
 
+func TestDepthLimitRecursiveOps(t *testing.T) {
+	t.Parallel()
+
+	// newChain builds a chain of n structs, each pointing to the next.
+	newChain := func(n int) capnp.Struct {
+		_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, err := capnp.NewRootStruct(seg, capnp.ObjectSize{PointerCount: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		curr := root
+		for i := 1; i < n; i++ {
+			next, err := capnp.NewStruct(seg, capnp.ObjectSize{PointerCount: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := curr.SetPtr(0, next.ToPtr()); err != nil {
+				t.Fatal(err)
+			}
+			curr = next
+		}
+		return root
+	}
+
+	ops := []struct {
+		name string
+		f    func(a, b capnp.Struct) error
+	}{
+		{"CopyFrom", func(a, b capnp.Struct) error {
+			_, seg, _ := capnp.NewMessage(capnp.SingleSegment(nil))
+			dst, err := capnp.NewRootStruct(seg, a.Size())
+			if err != nil {
+				return err
+			}
+			return dst.CopyFrom(a)
+		}},
+		{"SetRoot", func(a, b capnp.Struct) error {
+			msg, _, _ := capnp.NewMessage(capnp.SingleSegment(nil))
+			return msg.SetRoot(a.ToPtr())
+		}},
+		{"Walk", func(a, b capnp.Struct) error {
+			return capnp.Walk(a.ToPtr(), func(capnp.Ptr) error { return nil })
+		}},
+		{"Equal", func(a, b capnp.Struct) error {
+			_, err := capnp.Equal(a.ToPtr(), b.ToPtr())
+			return err
+		}},
+		{"Canonicalize", func(a, b capnp.Struct) error {
+			_, err := capnp.Canonicalize(a)
+			return err
+		}},
+	}
+	shallowA, shallowB := newChain(32), newChain(32)
+	deepA, deepB := newChain(1000), newChain(1000)
+	for _, op := range ops {
+		if err := op.f(shallowA, shallowB); err != nil {
+			t.Errorf("%s on a chain of 32 structs: %v", op.name, err)
+		}
+		if err := op.f(deepA, deepB); !errors.Is(err, capnp.ErrDepthLimit) {
+			t.Errorf("%s on a chain of 1000 structs = %v; want %v", op.name, err, capnp.ErrDepthLimit)
+		}
+	}
+}
+
 func TestHasPointerInUnion(t *testing.T) {
 	t.Parallel()
 	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
@@ -2038,6 +2162,44 @@ func TestHasPointerInUnion(t *testing.T) {
 	}
 }
 
+func TestDataFieldAliasesSegment(t *testing.T) {
+	t.Parallel()
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatal("NewMessage:", err)
+	}
+	z, err := air.NewRootZ(seg)
+	if err != nil {
+		t.Fatal("NewRootZ:", err)
+	}
+	if err := z.SetBlob([]byte("hello")); err != nil {
+		t.Fatal("z.SetBlob:", err)
+	}
+
+	b, err := capnp.Struct(z).DataField(0)
+	if err != nil {
+		t.Fatal("DataField(0):", err)
+	}
+	if string(b) != "hello" {
+		t.Fatalf("DataField(0) = %q; want \"hello\"", b)
+	}
+	b[0] = 'j'
+	blob, err := z.Blob()
+	if err != nil {
+		t.Fatal("z.Blob():", err)
+	}
+	if string(blob) != "jello" {
+		t.Errorf("z.Blob() after modifying DataField(0) = %q; want \"jello\"", blob)
+	}
+
+	if err := z.SetBlob(nil); err != nil {
+		t.Fatal("z.SetBlob(nil):", err)
+	}
+	if b, err := capnp.Struct(z).DataField(0); err != nil || b != nil {
+		t.Errorf("DataField(0) of null pointer = %v, %v; want nil, <nil>", b, err)
+	}
+}
+
 func TestSetNilBlob(t *testing.T) {
 	t.Parallel()
 	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
@@ -2268,3 +2430,62 @@ func BenchmarkSmallMessage_SingleSegment(b *testing.B) {
 func BenchmarkSmallMessage_MultiSegment(b *testing.B) {
 	benchmarkSmallMessage(b, func() capnp.Arena { return capnp.MultiSegment(nil) })
 }
+
+func TestStructWhich(t *testing.T) {
+	t.Parallel()
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Aircraft's discriminant is at offset 0.
+	a, err := air.NewAircraft(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aircraftTests := []struct {
+		set  func() error
+		want air.Aircraft_Which
+	}{
+		{func() error { _, err := a.NewF16(); return err }, air.Aircraft_Which_f16},
+		{func() error { _, err := a.NewB737(); return err }, air.Aircraft_Which_b737},
+		{func() error { _, err := a.NewA320(); return err }, air.Aircraft_Which_a320},
+		{func() error { a.SetVoid(); return nil }, air.Aircraft_Which_void},
+	}
+	for _, test := range aircraftTests {
+		if err := test.set(); err != nil {
+			t.Fatalf("set %v: %v", test.want, err)
+		}
+		if got := capnp.Struct(a).Which(0); got != uint16(test.want) {
+			t.Errorf("after set %v: Which(0) = %d; want %d", test.want, got, uint16(test.want))
+		}
+	}
+
+	// Node's discriminant is at offset 6, after id and
+	// displayNamePrefixLength.
+	n, err := schema.NewNode(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const nodeOffset = 6
+	nodeTests := []struct {
+		set  func()
+		want schema.Node_Which
+	}{
+		{n.SetStructNode, schema.Node_Which_structNode},
+		{n.SetEnum, schema.Node_Which_enum},
+		{n.SetInterface, schema.Node_Which_interface},
+		{n.SetConst, schema.Node_Which_const},
+		{n.SetAnnotation, schema.Node_Which_annotation},
+		{n.SetFile, schema.Node_Which_file},
+	}
+	for _, test := range nodeTests {
+		test.set()
+		if got := capnp.Struct(n).Which(nodeOffset); got != uint16(test.want) {
+			t.Errorf("after set %v: Which(%d) = %d; want %d", test.want, nodeOffset, got, uint16(test.want))
+		}
+		if got, ok := capnp.Struct(n).Discriminant(nodeOffset); !ok || got != uint16(test.want) {
+			t.Errorf("after set %v: Discriminant(%d) = %d, %t; want %d, true", test.want, nodeOffset, got, ok, uint16(test.want))
+		}
+	}
+}
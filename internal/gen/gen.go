@@ -50,6 +50,79 @@ func (l {{.}}) primitiveElem(i int, expectedSize ObjectSize) (address, error) {
 }
 `))
 
+// A primitiveList describes a list type whose elements are stored as
+// consecutive little-endian values.
+type primitiveList struct {
+	Name string // list type name
+	Elem string // Go element type
+	Size int    // element size in bytes
+	Put  string // statement that stores v into b
+	Get  string // expression that loads an element from b
+}
+
+var primitiveTpl = template.Must(template.New("list-gen-primitive").Parse(`
+// New{{.Name}}FromSlice creates a new list of {{.Elem}} holding a copy
+// of vs, preferring placement in s.
+func New{{.Name}}FromSlice(s *Segment, vs []{{.Elem}}) ({{.Name}}, error) {
+	if len(vs) >= 1<<29 {
+		return {{.Name}}{}, errorf("new list: length out of range")
+	}
+	l, err := newPrimitiveList(s, {{.Size}}, int32(len(vs)))
+	if err != nil {
+		return {{.Name}}{}, err
+	}
+	data := l.seg.slice(l.off, Size({{.Size}}*len(vs)))
+	for i, v := range vs {
+		b := data[i*{{.Size}}:]
+		{{.Put}}
+	}
+	return {{.Name}}(l), nil
+}
+
+// ToSlice returns a newly allocated slice holding the elements of l.
+func (l {{.Name}}) ToSlice() []{{.Elem}} {
+	if data, ok := List(l).primitiveData({{.Size}}); ok {
+		vs := make([]{{.Elem}}, l.Len())
+		for i := range vs {
+			b := data[i*{{.Size}}:]
+			vs[i] = {{.Get}}
+		}
+		return vs
+	}
+	// Empty, invalid, or not stored as consecutive {{.Elem}} values.
+	vs := make([]{{.Elem}}, l.Len())
+	for i := range vs {
+		vs[i] = l.At(i)
+	}
+	return vs
+}
+
+// Equal reports whether l and other have the same length and equal
+// elements, compared with ==.  A null list is equal to an empty list.
+func (l {{.Name}}) Equal(other {{.Name}}) bool {
+	n := l.Len()
+	if other.Len() != n {
+		return false
+	}
+	for i := 0; i < n; i++ {
+		if l.At(i) != other.At(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// Contains reports whether some element of l is equal to v.
+func (l {{.Name}}) Contains(v {{.Elem}}) bool {
+	for i, n := 0, l.Len(); i < n; i++ {
+		if l.At(i) == v {
+			return true
+		}
+	}
+	return false
+}
+`))
+
 func main() {
 	listTypes := []string{
 		"VoidList",
@@ -70,6 +143,31 @@ func main() {
 		}...)
 	}
 
+	primitiveLists := []primitiveList{
+		{"Int8List", "int8", 1, "b[0] = uint8(v)", "int8(b[0])"},
+		{"UInt8List", "uint8", 1, "b[0] = v", "b[0]"},
+		{"Float32List", "float32", 4, "binary.LittleEndian.PutUint32(b, math.Float32bits(v))", "math.Float32frombits(binary.LittleEndian.Uint32(b))"},
+		{"Float64List", "float64", 8, "binary.LittleEndian.PutUint64(b, math.Float64bits(v))", "math.Float64frombits(binary.LittleEndian.Uint64(b))"},
+	}
+	for _, bits := range []int{16, 32, 64} {
+		primitiveLists = append(primitiveLists, []primitiveList{
+			{
+				Name: fmt.Sprintf("Int%vList", bits),
+				Elem: fmt.Sprintf("int%v", bits),
+				Size: bits / 8,
+				Put:  fmt.Sprintf("binary.LittleEndian.PutUint%v(b, uint%v(v))", bits, bits),
+				Get:  fmt.Sprintf("int%v(binary.LittleEndian.Uint%v(b))", bits, bits),
+			},
+			{
+				Name: fmt.Sprintf("UInt%vList", bits),
+				Elem: fmt.Sprintf("uint%v", bits),
+				Size: bits / 8,
+				Put:  fmt.Sprintf("binary.LittleEndian.PutUint%v(b, v)", bits),
+				Get:  fmt.Sprintf("binary.LittleEndian.Uint%v(b)", bits),
+			},
+		}...)
+	}
+
 	f, err := os.Create("list-gen.go")
 	chkfatal(err)
 
@@ -78,10 +176,18 @@ func main() {
 		// Code generated by ./internal/gen/gen.go. DO NOT EDIT.
 
 		package capnp
+
+		import (
+			"encoding/binary"
+			"math"
+		)
 	`)
 	for _, typ := range listTypes {
 		chkfatal(tpl.Execute(bw, typ))
 	}
+	for _, pl := range primitiveLists {
+		chkfatal(primitiveTpl.Execute(bw, pl))
+	}
 	chkfatal(bw.Flush())
 	chkfatal(f.Close())
 	chkfatal(exec.Command("gofmt", "-w", "list-gen.go").Run())
@@ -2,6 +2,11 @@
 
 package capnp
 
+import (
+	"encoding/binary"
+	"math"
+)
+
 func (l VoidList) IsValid() bool {
 	return List(l).IsValid()
 }
@@ -577,3 +582,613 @@ func (l UInt64List) ToPtr() Ptr {
 func (l UInt64List) primitiveElem(i int, expectedSize ObjectSize) (address, error) {
 	return List(l).primitiveElem(i, expectedSize)
 }
+
+// NewInt8ListFromSlice creates a new list of int8 holding a copy
+// of vs, preferring placement in s.
+func NewInt8ListFromSlice(s *Segment, vs []int8) (Int8List, error) {
+	if len(vs) >= 1<<29 {
+		return Int8List{}, errorf("new list: length out of range")
+	}
+	l, err := newPrimitiveList(s, 1, int32(len(vs)))
+	if err != nil {
+		return Int8List{}, err
+	}
+	data := l.seg.slice(l.off, Size(1*len(vs)))
+	for i, v := range vs {
+		b := data[i*1:]
+		b[0] = uint8(v)
+	}
+	return Int8List(l), nil
+}
+
+// ToSlice returns a newly allocated slice holding the elements of l.
+func (l Int8List) ToSlice() []int8 {
+	if data, ok := List(l).primitiveData(1); ok {
+		vs := make([]int8, l.Len())
+		for i := range vs {
+			b := data[i*1:]
+			vs[i] = int8(b[0])
+		}
+		return vs
+	}
+	// Empty, invalid, or not stored as consecutive int8 values.
+	vs := make([]int8, l.Len())
+	for i := range vs {
+		vs[i] = l.At(i)
+	}
+	return vs
+}
+
+// Equal reports whether l and other have the same length and equal
+// elements, compared with ==.  A null list is equal to an empty list.
+func (l Int8List) Equal(other Int8List) bool {
+	n := l.Len()
+	if other.Len() != n {
+		return false
+	}
+	for i := 0; i < n; i++ {
+		if l.At(i) != other.At(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// Contains reports whether some element of l is equal to v.
+func (l Int8List) Contains(v int8) bool {
+	for i, n := 0, l.Len(); i < n; i++ {
+		if l.At(i) == v {
+			return true
+		}
+	}
+	return false
+}
+
+// NewUInt8ListFromSlice creates a new list of uint8 holding a copy
+// of vs, preferring placement in s.
+func NewUInt8ListFromSlice(s *Segment, vs []uint8) (UInt8List, error) {
+	if len(vs) >= 1<<29 {
+		return UInt8List{}, errorf("new list: length out of range")
+	}
+	l, err := newPrimitiveList(s, 1, int32(len(vs)))
+	if err != nil {
+		return UInt8List{}, err
+	}
+	data := l.seg.slice(l.off, Size(1*len(vs)))
+	for i, v := range vs {
+		b := data[i*1:]
+		b[0] = v
+	}
+	return UInt8List(l), nil
+}
+
+// ToSlice returns a newly allocated slice holding the elements of l.
+func (l UInt8List) ToSlice() []uint8 {
+	if data, ok := List(l).primitiveData(1); ok {
+		vs := make([]uint8, l.Len())
+		for i := range vs {
+			b := data[i*1:]
+			vs[i] = b[0]
+		}
+		return vs
+	}
+	// Empty, invalid, or not stored as consecutive uint8 values.
+	vs := make([]uint8, l.Len())
+	for i := range vs {
+		vs[i] = l.At(i)
+	}
+	return vs
+}
+
+// Equal reports whether l and other have the same length and equal
+// elements, compared with ==.  A null list is equal to an empty list.
+func (l UInt8List) Equal(other UInt8List) bool {
+	n := l.Len()
+	if other.Len() != n {
+		return false
+	}
+	for i := 0; i < n; i++ {
+		if l.At(i) != other.At(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// Contains reports whether some element of l is equal to v.
+func (l UInt8List) Contains(v uint8) bool {
+	for i, n := 0, l.Len(); i < n; i++ {
+		if l.At(i) == v {
+			return true
+		}
+	}
+	return false
+}
+
+// NewFloat32ListFromSlice creates a new list of float32 holding a copy
+// of vs, preferring placement in s.
+func NewFloat32ListFromSlice(s *Segment, vs []float32) (Float32List, error) {
+	if len(vs) >= 1<<29 {
+		return Float32List{}, errorf("new list: length out of range")
+	}
+	l, err := newPrimitiveList(s, 4, int32(len(vs)))
+	if err != nil {
+		return Float32List{}, err
+	}
+	data := l.seg.slice(l.off, Size(4*len(vs)))
+	for i, v := range vs {
+		b := data[i*4:]
+		binary.LittleEndian.PutUint32(b, math.Float32bits(v))
+	}
+	return Float32List(l), nil
+}
+
+// ToSlice returns a newly allocated slice holding the elements of l.
+func (l Float32List) ToSlice() []float32 {
+	if data, ok := List(l).primitiveData(4); ok {
+		vs := make([]float32, l.Len())
+		for i := range vs {
+			b := data[i*4:]
+			vs[i] = math.Float32frombits(binary.LittleEndian.Uint32(b))
+		}
+		return vs
+	}
+	// Empty, invalid, or not stored as consecutive float32 values.
+	vs := make([]float32, l.Len())
+	for i := range vs {
+		vs[i] = l.At(i)
+	}
+	return vs
+}
+
+// Equal reports whether l and other have the same length and equal
+// elements, compared with ==.  A null list is equal to an empty list.
+func (l Float32List) Equal(other Float32List) bool {
+	n := l.Len()
+	if other.Len() != n {
+		return false
+	}
+	for i := 0; i < n; i++ {
+		if l.At(i) != other.At(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// Contains reports whether some element of l is equal to v.
+func (l Float32List) Contains(v float32) bool {
+	for i, n := 0, l.Len(); i < n; i++ {
+		if l.At(i) == v {
+			return true
+		}
+	}
+	return false
+}
+
+// NewFloat64ListFromSlice creates a new list of float64 holding a copy
+// of vs, preferring placement in s.
+func NewFloat64ListFromSlice(s *Segment, vs []float64) (Float64List, error) {
+	if len(vs) >= 1<<29 {
+		return Float64List{}, errorf("new list: length out of range")
+	}
+	l, err := newPrimitiveList(s, 8, int32(len(vs)))
+	if err != nil {
+		return Float64List{}, err
+	}
+	data := l.seg.slice(l.off, Size(8*len(vs)))
+	for i, v := range vs {
+		b := data[i*8:]
+		binary.LittleEndian.PutUint64(b, math.Float64bits(v))
+	}
+	return Float64List(l), nil
+}
+
+// ToSlice returns a newly allocated slice holding the elements of l.
+func (l Float64List) ToSlice() []float64 {
+	if data, ok := List(l).primitiveData(8); ok {
+		vs := make([]float64, l.Len())
+		for i := range vs {
+			b := data[i*8:]
+			vs[i] = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		}
+		return vs
+	}
+	// Empty, invalid, or not stored as consecutive float64 values.
+	vs := make([]float64, l.Len())
+	for i := range vs {
+		vs[i] = l.At(i)
+	}
+	return vs
+}
+
+// Equal reports whether l and other have the same length and equal
+// elements, compared with ==.  A null list is equal to an empty list.
+func (l Float64List) Equal(other Float64List) bool {
+	n := l.Len()
+	if other.Len() != n {
+		return false
+	}
+	for i := 0; i < n; i++ {
+		if l.At(i) != other.At(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// Contains reports whether some element of l is equal to v.
+func (l Float64List) Contains(v float64) bool {
+	for i, n := 0, l.Len(); i < n; i++ {
+		if l.At(i) == v {
+			return true
+		}
+	}
+	return false
+}
+
+// NewInt16ListFromSlice creates a new list of int16 holding a copy
+// of vs, preferring placement in s.
+func NewInt16ListFromSlice(s *Segment, vs []int16) (Int16List, error) {
+	if len(vs) >= 1<<29 {
+		return Int16List{}, errorf("new list: length out of range")
+	}
+	l, err := newPrimitiveList(s, 2, int32(len(vs)))
+	if err != nil {
+		return Int16List{}, err
+	}
+	data := l.seg.slice(l.off, Size(2*len(vs)))
+	for i, v := range vs {
+		b := data[i*2:]
+		binary.LittleEndian.PutUint16(b, uint16(v))
+	}
+	return Int16List(l), nil
+}
+
+// ToSlice returns a newly allocated slice holding the elements of l.
+func (l Int16List) ToSlice() []int16 {
+	if data, ok := List(l).primitiveData(2); ok {
+		vs := make([]int16, l.Len())
+		for i := range vs {
+			b := data[i*2:]
+			vs[i] = int16(binary.LittleEndian.Uint16(b))
+		}
+		return vs
+	}
+	// Empty, invalid, or not stored as consecutive int16 values.
+	vs := make([]int16, l.Len())
+	for i := range vs {
+		vs[i] = l.At(i)
+	}
+	return vs
+}
+
+// Equal reports whether l and other have the same length and equal
+// elements, compared with ==.  A null list is equal to an empty list.
+func (l Int16List) Equal(other Int16List) bool {
+	n := l.Len()
+	if other.Len() != n {
+		return false
+	}
+	for i := 0; i < n; i++ {
+		if l.At(i) != other.At(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// Contains reports whether some element of l is equal to v.
+func (l Int16List) Contains(v int16) bool {
+	for i, n := 0, l.Len(); i < n; i++ {
+		if l.At(i) == v {
+			return true
+		}
+	}
+	return false
+}
+
+// NewUInt16ListFromSlice creates a new list of uint16 holding a copy
+// of vs, preferring placement in s.
+func NewUInt16ListFromSlice(s *Segment, vs []uint16) (UInt16List, error) {
+	if len(vs) >= 1<<29 {
+		return UInt16List{}, errorf("new list: length out of range")
+	}
+	l, err := newPrimitiveList(s, 2, int32(len(vs)))
+	if err != nil {
+		return UInt16List{}, err
+	}
+	data := l.seg.slice(l.off, Size(2*len(vs)))
+	for i, v := range vs {
+		b := data[i*2:]
+		binary.LittleEndian.PutUint16(b, v)
+	}
+	return UInt16List(l), nil
+}
+
+// ToSlice returns a newly allocated slice holding the elements of l.
+func (l UInt16List) ToSlice() []uint16 {
+	if data, ok := List(l).primitiveData(2); ok {
+		vs := make([]uint16, l.Len())
+		for i := range vs {
+			b := data[i*2:]
+			vs[i] = binary.LittleEndian.Uint16(b)
+		}
+		return vs
+	}
+	// Empty, invalid, or not stored as consecutive uint16 values.
+	vs := make([]uint16, l.Len())
+	for i := range vs {
+		vs[i] = l.At(i)
+	}
+	return vs
+}
+
+// Equal reports whether l and other have the same length and equal
+// elements, compared with ==.  A null list is equal to an empty list.
+func (l UInt16List) Equal(other UInt16List) bool {
+	n := l.Len()
+	if other.Len() != n {
+		return false
+	}
+	for i := 0; i < n; i++ {
+		if l.At(i) != other.At(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// Contains reports whether some element of l is equal to v.
+func (l UInt16List) Contains(v uint16) bool {
+	for i, n := 0, l.Len(); i < n; i++ {
+		if l.At(i) == v {
+			return true
+		}
+	}
+	return false
+}
+
+// NewInt32ListFromSlice creates a new list of int32 holding a copy
+// of vs, preferring placement in s.
+func NewInt32ListFromSlice(s *Segment, vs []int32) (Int32List, error) {
+	if len(vs) >= 1<<29 {
+		return Int32List{}, errorf("new list: length out of range")
+	}
+	l, err := newPrimitiveList(s, 4, int32(len(vs)))
+	if err != nil {
+		return Int32List{}, err
+	}
+	data := l.seg.slice(l.off, Size(4*len(vs)))
+	for i, v := range vs {
+		b := data[i*4:]
+		binary.LittleEndian.PutUint32(b, uint32(v))
+	}
+	return Int32List(l), nil
+}
+
+// ToSlice returns a newly allocated slice holding the elements of l.
+func (l Int32List) ToSlice() []int32 {
+	if data, ok := List(l).primitiveData(4); ok {
+		vs := make([]int32, l.Len())
+		for i := range vs {
+			b := data[i*4:]
+			vs[i] = int32(binary.LittleEndian.Uint32(b))
+		}
+		return vs
+	}
+	// Empty, invalid, or not stored as consecutive int32 values.
+	vs := make([]int32, l.Len())
+	for i := range vs {
+		vs[i] = l.At(i)
+	}
+	return vs
+}
+
+// Equal reports whether l and other have the same length and equal
+// elements, compared with ==.  A null list is equal to an empty list.
+func (l Int32List) Equal(other Int32List) bool {
+	n := l.Len()
+	if other.Len() != n {
+		return false
+	}
+	for i := 0; i < n; i++ {
+		if l.At(i) != other.At(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// Contains reports whether some element of l is equal to v.
+func (l Int32List) Contains(v int32) bool {
+	for i, n := 0, l.Len(); i < n; i++ {
+		if l.At(i) == v {
+			return true
+		}
+	}
+	return false
+}
+
+// NewUInt32ListFromSlice creates a new list of uint32 holding a copy
+// of vs, preferring placement in s.
+func NewUInt32ListFromSlice(s *Segment, vs []uint32) (UInt32List, error) {
+	if len(vs) >= 1<<29 {
+		return UInt32List{}, errorf("new list: length out of range")
+	}
+	l, err := newPrimitiveList(s, 4, int32(len(vs)))
+	if err != nil {
+		return UInt32List{}, err
+	}
+	data := l.seg.slice(l.off, Size(4*len(vs)))
+	for i, v := range vs {
+		b := data[i*4:]
+		binary.LittleEndian.PutUint32(b, v)
+	}
+	return UInt32List(l), nil
+}
+
+// ToSlice returns a newly allocated slice holding the elements of l.
+func (l UInt32List) ToSlice() []uint32 {
+	if data, ok := List(l).primitiveData(4); ok {
+		vs := make([]uint32, l.Len())
+		for i := range vs {
+			b := data[i*4:]
+			vs[i] = binary.LittleEndian.Uint32(b)
+		}
+		return vs
+	}
+	// Empty, invalid, or not stored as consecutive uint32 values.
+	vs := make([]uint32, l.Len())
+	for i := range vs {
+		vs[i] = l.At(i)
+	}
+	return vs
+}
+
+// Equal reports whether l and other have the same length and equal
+// elements, compared with ==.  A null list is equal to an empty list.
+func (l UInt32List) Equal(other UInt32List) bool {
+	n := l.Len()
+	if other.Len() != n {
+		return false
+	}
+	for i := 0; i < n; i++ {
+		if l.At(i) != other.At(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// Contains reports whether some element of l is equal to v.
+func (l UInt32List) Contains(v uint32) bool {
+	for i, n := 0, l.Len(); i < n; i++ {
+		if l.At(i) == v {
+			return true
+		}
+	}
+	return false
+}
+
+// NewInt64ListFromSlice creates a new list of int64 holding a copy
+// of vs, preferring placement in s.
+func NewInt64ListFromSlice(s *Segment, vs []int64) (Int64List, error) {
+	if len(vs) >= 1<<29 {
+		return Int64List{}, errorf("new list: length out of range")
+	}
+	l, err := newPrimitiveList(s, 8, int32(len(vs)))
+	if err != nil {
+		return Int64List{}, err
+	}
+	data := l.seg.slice(l.off, Size(8*len(vs)))
+	for i, v := range vs {
+		b := data[i*8:]
+		binary.LittleEndian.PutUint64(b, uint64(v))
+	}
+	return Int64List(l), nil
+}
+
+// ToSlice returns a newly allocated slice holding the elements of l.
+func (l Int64List) ToSlice() []int64 {
+	if data, ok := List(l).primitiveData(8); ok {
+		vs := make([]int64, l.Len())
+		for i := range vs {
+			b := data[i*8:]
+			vs[i] = int64(binary.LittleEndian.Uint64(b))
+		}
+		return vs
+	}
+	// Empty, invalid, or not stored as consecutive int64 values.
+	vs := make([]int64, l.Len())
+	for i := range vs {
+		vs[i] = l.At(i)
+	}
+	return vs
+}
+
+// Equal reports whether l and other have the same length and equal
+// elements, compared with ==.  A null list is equal to an empty list.
+func (l Int64List) Equal(other Int64List) bool {
+	n := l.Len()
+	if other.Len() != n {
+		return false
+	}
+	for i := 0; i < n; i++ {
+		if l.At(i) != other.At(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// Contains reports whether some element of l is equal to v.
+func (l Int64List) Contains(v int64) bool {
+	for i, n := 0, l.Len(); i < n; i++ {
+		if l.At(i) == v {
+			return true
+		}
+	}
+	return false
+}
+
+// NewUInt64ListFromSlice creates a new list of uint64 holding a copy
+// of vs, preferring placement in s.
+func NewUInt64ListFromSlice(s *Segment, vs []uint64) (UInt64List, error) {
+	if len(vs) >= 1<<29 {
+		return UInt64List{}, errorf("new list: length out of range")
+	}
+	l, err := newPrimitiveList(s, 8, int32(len(vs)))
+	if err != nil {
+		return UInt64List{}, err
+	}
+	data := l.seg.slice(l.off, Size(8*len(vs)))
+	for i, v := range vs {
+		b := data[i*8:]
+		binary.LittleEndian.PutUint64(b, v)
+	}
+	return UInt64List(l), nil
+}
+
+// ToSlice returns a newly allocated slice holding the elements of l.
+func (l UInt64List) ToSlice() []uint64 {
+	if data, ok := List(l).primitiveData(8); ok {
+		vs := make([]uint64, l.Len())
+		for i := range vs {
+			b := data[i*8:]
+			vs[i] = binary.LittleEndian.Uint64(b)
+		}
+		return vs
+	}
+	// Empty, invalid, or not stored as consecutive uint64 values.
+	vs := make([]uint64, l.Len())
+	for i := range vs {
+		vs[i] = l.At(i)
+	}
+	return vs
+}
+
+// Equal reports whether l and other have the same length and equal
+// elements, compared with ==.  A null list is equal to an empty list.
+func (l UInt64List) Equal(other UInt64List) bool {
+	n := l.Len()
+	if other.Len() != n {
+		return false
+	}
+	for i := 0; i < n; i++ {
+		if l.At(i) != other.At(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// Contains reports whether some element of l is equal to v.
+func (l UInt64List) Contains(v uint64) bool {
+	for i, n := 0, l.Len(); i < n; i++ {
+		if l.At(i) == v {
+			return true
+		}
+	}
+	return false
+}
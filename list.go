@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math"
 	"strconv"
+	"sync/atomic"
 
 	"capnproto.org/go/capnp/v3/internal/strquote"
 )
@@ -24,6 +25,31 @@ type ListKind = struct {
 	flags      listFlags
 }
 
+// listSizeLimit is the limit set by SetListSizeLimit, accessed atomically.
+var listSizeLimit uint32
+
+// SetListSizeLimit sets the largest number of bytes that a single new
+// list may occupy, including a composite list's tag word.  Functions
+// that create a list, such as NewUInt8List or NewCompositeList, return
+// an error rather than allocate a larger list.  This guards against
+// huge allocations when building a message from untrusted or faulty
+// lengths; see Message.TraverseLimit for the reading side.
+//
+// The default is zero, which disables the limit.  SetListSizeLimit is
+// safe to call concurrently with creating lists.
+func SetListSizeLimit(max Size) {
+	atomic.StoreUint32(&listSizeLimit, uint32(max))
+}
+
+// checkListSize returns an error if a new list of total bytes would
+// exceed the limit set by SetListSizeLimit.
+func checkListSize(total Size) error {
+	if max := Size(atomic.LoadUint32(&listSizeLimit)); max != 0 && total > max {
+		return errorf("list of %d bytes exceeds size limit of %d bytes", total, max)
+	}
+	return nil
+}
+
 // newPrimitiveList allocates a new list of primitive values, preferring placement in s.
 func newPrimitiveList(s *Segment, sz Size, n int32) (List, error) {
 	if n < 0 || n >= 1<<29 {
@@ -32,6 +58,9 @@ func newPrimitiveList(s *Segment, sz Size, n int32) (List, error) {
 	// sz is [0, 8] and n is [0, 1<<29).
 	// Range is [0, maxSegmentSize], thus there will never be overflow.
 	total := sz.timesUnchecked(n)
+	if err := checkListSize(total); err != nil {
+		return List{}, annotatef(err, "new list")
+	}
 	s, addr, err := alloc(s, total)
 	if err != nil {
 		return List{}, annotatef(err, "new list")
@@ -41,7 +70,7 @@ func newPrimitiveList(s *Segment, sz Size, n int32) (List, error) {
 		off:        addr,
 		length:     n,
 		size:       ObjectSize{DataSize: sz},
-		depthLimit: maxDepth,
+		depthLimit: s.depthLimit(),
 	}, nil
 }
 
@@ -59,6 +88,9 @@ func NewCompositeList(s *Segment, sz ObjectSize, n int32) (List, error) {
 	if !ok || total > maxSegmentSize-wordSize {
 		return List{}, errorf("new composite list: size overflow")
 	}
+	if err := checkListSize(wordSize + total); err != nil {
+		return List{}, annotatef(err, "new composite list")
+	}
 	s, addr, err := alloc(s, wordSize+total)
 	if err != nil {
 		return List{}, annotatef(err, "new composite list")
@@ -71,7 +103,7 @@ func NewCompositeList(s *Segment, sz ObjectSize, n int32) (List, error) {
 		length:     n,
 		size:       sz,
 		flags:      isCompositeList,
-		depthLimit: maxDepth,
+		depthLimit: s.depthLimit(),
 	}, nil
 }
 
@@ -198,6 +230,17 @@ func (p List) primitiveElem(i int, expectedSize ObjectSize) (address, error) {
 	return addr, nil
 }
 
+// primitiveData returns the elements of a list of consecutive
+// sz-byte values.  It returns false if p is invalid, empty, or has a
+// different layout.
+func (p List) primitiveData(sz Size) ([]byte, bool) {
+	if p.seg == nil || p.length == 0 || p.flags&(isBitList|isCompositeList) != 0 || p.size != (ObjectSize{DataSize: sz}) {
+		return nil, false
+	}
+	// List bounds were validated when the list was read or allocated.
+	return p.seg.slice(p.off, sz.timesUnchecked(p.length)), true
+}
+
 // Struct returns the i'th element as a struct.
 func (p List) Struct(i int) Struct {
 	if p.seg == nil || i < 0 || i >= int(p.length) {
@@ -250,6 +293,9 @@ func NewBitList(s *Segment, n int32) (BitList, error) {
 	if n < 0 || n >= 1<<29 {
 		return BitList{}, errorf("new bit list: length out of range")
 	}
+	if err := checkListSize(bitListSize(n)); err != nil {
+		return BitList{}, annotatef(err, "new %d-element bit list", n)
+	}
 	s, addr, err := alloc(s, bitListSize(n))
 	if err != nil {
 		return BitList{}, annotatef(err, "new %d-element bit list", n)
@@ -259,10 +305,62 @@ func NewBitList(s *Segment, n int32) (BitList, error) {
 		off:        addr,
 		length:     n,
 		flags:      isBitList,
-		depthLimit: maxDepth,
+		depthLimit: s.depthLimit(),
 	}, nil
 }
 
+// NewBitListFromSlice creates a new bit list holding a copy of vs,
+// preferring placement in s.
+func NewBitListFromSlice(s *Segment, vs []bool) (BitList, error) {
+	if len(vs) >= 1<<29 {
+		return BitList{}, errorf("new bit list: length out of range")
+	}
+	l, err := NewBitList(s, int32(len(vs)))
+	if err != nil {
+		return BitList{}, err
+	}
+	for i, v := range vs {
+		if v {
+			l.Set(i, true)
+		}
+	}
+	return l, nil
+}
+
+// ToSlice returns a newly allocated slice holding the elements of p.
+func (p BitList) ToSlice() []bool {
+	vs := make([]bool, p.Len())
+	for i := range vs {
+		vs[i] = p.At(i)
+	}
+	return vs
+}
+
+// Equal reports whether p and other have the same length and equal
+// elements.  A null list is equal to an empty list.
+func (p BitList) Equal(other BitList) bool {
+	n := p.Len()
+	if other.Len() != n {
+		return false
+	}
+	for i := 0; i < n; i++ {
+		if p.At(i) != other.At(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// Contains reports whether some element of p is equal to v.
+func (p BitList) Contains(v bool) bool {
+	for i, n := 0, p.Len(); i < n; i++ {
+		if p.At(i) == v {
+			return true
+		}
+	}
+	return false
+}
+
 // bitListSize returns the number of bytes needed for a bit list with n
 // elements.  It is only defined for n in [0, 1<<29).
 func bitListSize(n int32) Size {
@@ -293,6 +391,10 @@ func (p BitList) Set(i int, v bool) {
 		// Again, programmer error.  Should have used NewBitList.
 		panic("BitList.Set called on a non-bit list")
 	}
+	if p.seg.readOnly() {
+		// Programmer error, like an out of bounds index.
+		panic(ErrReadOnly)
+	}
 	bit := BitOffset(i)
 	addr := p.off.addOffset(bit.offset())
 	b := p.seg.slice(addr, 1)
@@ -332,6 +434,9 @@ func NewPointerList(s *Segment, n int32) (PointerList, error) {
 	if !ok {
 		return PointerList{}, errorf("new pointer list: size overflow")
 	}
+	if err := checkListSize(total); err != nil {
+		return PointerList{}, annotatef(err, "new %d-element pointer list", n)
+	}
 	s, addr, err := alloc(s, total)
 	if err != nil {
 		return PointerList{}, annotatef(err, "new %d-element pointer list", n)
@@ -341,7 +446,7 @@ func NewPointerList(s *Segment, n int32) (PointerList, error) {
 		off:        addr,
 		length:     n,
 		size:       ObjectSize{PointerCount: 1},
-		depthLimit: maxDepth,
+		depthLimit: s.depthLimit(),
 	}, nil
 }
 
@@ -515,7 +620,7 @@ func NewVoidList(s *Segment, n int32) VoidList {
 	return VoidList{
 		seg:        s,
 		length:     n,
-		depthLimit: maxDepth,
+		depthLimit: s.depthLimit(),
 	}
 }
 
@@ -547,6 +652,17 @@ func NewUInt8List(s *Segment, n int32) (UInt8List, error) {
 	return UInt8List(l), nil
 }
 
+// NewUInt8ListLimit is like NewUInt8List, but returns an error instead
+// of allocating a list of more than max bytes.  The limit set by
+// SetListSizeLimit also applies.  There is no per-call variant for
+// other list types; use SetListSizeLimit to bound those.
+func NewUInt8ListLimit(s *Segment, n int32, max Size) (UInt8List, error) {
+	if n > 0 && Size(n) > max {
+		return UInt8List{}, errorf("new list: list of %d bytes exceeds size limit of %d bytes", n, max)
+	}
+	return NewUInt8List(s, n)
+}
+
 // NewText creates a new list of UInt8 from a string.
 func NewText(s *Segment, v string) (UInt8List, error) {
 	// TODO(light): error if v is too long
@@ -1071,6 +1187,314 @@ func (s StructList[T]) Set(i int, v T) error {
 	return List(s).SetStruct(i, Struct(v))
 }
 
+// CopyFrom deep-copies the elements of src, which may be in a different
+// message, into s.  s and src must have the same length, so to copy a
+// list into a new message, first allocate s with NewCompositeList using
+// src's length and element size.  A null list is treated as empty.
+//
+// Elements are copied field by field, so the elements of s may be larger
+// than those of src, e.g. if s was allocated with a newer version of the
+// schema.  CopyFrom returns an error if they are smaller, since fields
+// would be dropped, or if src is a list of bits, which cannot hold
+// structs.  Capabilities referenced by the elements are added to the
+// message of s.
+func (s StructList[T]) CopyFrom(src StructList[T]) error {
+	dst, from := List(s), List(src)
+	if dst.Len() != from.Len() {
+		return errorf("copy struct list: length mismatch (%d into %d)", from.Len(), dst.Len())
+	}
+	if from.Len() == 0 {
+		return nil
+	}
+	if from.flags&isBitList != 0 || dst.flags&isBitList != 0 {
+		return errorf("copy struct list: list of bits cannot hold structs")
+	}
+	if dst.size.DataSize < from.size.DataSize || dst.size.PointerCount < from.size.PointerCount {
+		return errorf("copy struct list: element size %v too small for %v", dst.size, from.size)
+	}
+	for i := 0; i < from.Len(); i++ {
+		if err := copyStruct(dst.Struct(i), from.Struct(i)); err != nil {
+			return annotatef(err, "copy struct list: element %d", i)
+		}
+	}
+	return nil
+}
+
+// Truncate shortens s to its first n elements and returns the shorter
+// list.  The elements past n are zeroed.  Since the length of a list
+// of structs is usually stored in the list itself, s and any pointer to
+// it also see the shorter length.
+//
+// If s is the last object allocated in its segment, the space of the
+// dropped elements is reclaimed and later allocations reuse it.  In
+// that case, a pointer to s that was stored before calling Truncate,
+// such as by a generated NewX method, still covers the old size, so the
+// returned list must be stored again with SetPtr or the generated
+// setter.  Otherwise the space stays in the message.
+func (s StructList[T]) Truncate(n int) (StructList[T], error) {
+	l := List(s)
+	if n < 0 || n > l.Len() {
+		return StructList[T]{}, errorf("truncate struct list: length %d out of range [0, %d]", n, l.Len())
+	}
+	if l.seg == nil || n == l.Len() {
+		return s, nil
+	}
+	if l.seg.readOnly() {
+		return StructList[T]{}, ErrReadOnly
+	}
+	if l.flags&isBitList != 0 {
+		return StructList[T]{}, errorf("truncate struct list: list of bits cannot hold structs")
+	}
+
+	// List bounds were validated when the list was read or allocated.
+	elemSize := l.size.totalSize()
+	newEnd := l.off.addSizeUnchecked(elemSize.timesUnchecked(int32(n)))
+	end := l.off.addSizeUnchecked(elemSize.timesUnchecked(l.length))
+	dropped := l.seg.slice(newEnd, Size(end-newEnd))
+	for i := range dropped {
+		dropped[i] = 0
+	}
+	l.length = int32(n)
+	if l.flags&isCompositeList == 0 {
+		// The elements are stored as a list of primitives or pointers,
+		// whose length is only in the pointer to the list.
+		return StructList[T](l), nil
+	}
+	if int(end) == len(l.seg.data) {
+		// Composite elements are whole words, so newEnd is aligned.
+		l.seg.data = l.seg.data[:newEnd]
+	}
+	l.seg.writeRawPointer(l.off-address(wordSize), rawStructPointer(pointerOffset(l.length), l.size))
+	return StructList[T](l), nil
+}
+
+// A StructListBuilder builds a StructList whose length is not known in
+// advance.  The zero value is not usable; create one with
+// NewStructListBuilder.
+type StructListBuilder[T ~StructKind] struct {
+	seg  *Segment
+	size ObjectSize
+	list List // allocated elements; list.length is the capacity
+	n    int32
+}
+
+// NewStructListBuilder returns a builder for a list of structs of size
+// sz in s's message.  No space is allocated until the first call to
+// Append.
+func NewStructListBuilder[T ~StructKind](s *Segment, sz ObjectSize) *StructListBuilder[T] {
+	return &StructListBuilder[T]{seg: s, size: sz}
+}
+
+// Len returns the number of elements appended so far.
+func (b *StructListBuilder[T]) Len() int {
+	return int(b.n)
+}
+
+// Append adds a zeroed element to the end of the list and returns it.
+//
+// When the allocated space is full, Append allocates a list with twice
+// as many elements and moves the existing elements into it, so appending
+// costs amortized constant time.  Moving an element copies its data
+// section and rewrites its pointers, but not the objects they point to.
+// The space used by the old list is not reclaimed until the message is
+// reset, and any Struct previously returned by Append refers to the old
+// copy afterward, so writes through it are lost.
+func (b *StructListBuilder[T]) Append() (T, error) {
+	if b.seg == nil {
+		return T{}, errorf("struct list builder: not created with NewStructListBuilder")
+	}
+	if b.n == b.list.length {
+		if err := b.grow(); err != nil {
+			return T{}, annotatef(err, "struct list builder: append")
+		}
+	}
+	b.n++
+	return T(b.list.Struct(int(b.n - 1))), nil
+}
+
+// grow moves the elements into a list with twice the capacity.
+func (b *StructListBuilder[T]) grow() error {
+	newCap := 2 * b.list.length
+	if newCap < 4 {
+		newCap = 4
+	}
+	l, err := NewCompositeList(b.seg, b.size, newCap)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < int(b.n); i++ {
+		if err := moveStruct(l.Struct(i), b.list.Struct(i)); err != nil {
+			return err
+		}
+	}
+	b.seg, b.list = l.seg, l
+	return nil
+}
+
+// moveStruct copies src's data section and pointers to dst, a struct of
+// the same size in the same message, without copying the objects that
+// the pointers refer to.
+func moveStruct(dst, src Struct) error {
+	if dst.seg.readOnly() {
+		return ErrReadOnly
+	}
+	copy(dst.seg.slice(dst.off, dst.size.DataSize), src.seg.slice(src.off, src.size.DataSize))
+	for i := uint16(0); i < src.size.PointerCount; i++ {
+		p, err := src.seg.readPtr(src.pointerAddress(i), src.depthLimit)
+		if err != nil {
+			return annotatef(err, "move struct pointer %d", i)
+		}
+		if err := dst.seg.writePtr(dst.pointerAddress(i), p, false); err != nil {
+			return annotatef(err, "move struct pointer %d", i)
+		}
+	}
+	return nil
+}
+
+// Finish returns the list of appended elements.  The builder must not
+// be used afterward.
+func (b *StructListBuilder[T]) Finish() (StructList[T], error) {
+	if b.seg == nil {
+		return StructList[T]{}, errorf("struct list builder: not created with NewStructListBuilder")
+	}
+	if b.list.seg == nil {
+		l, err := NewCompositeList(b.seg, b.size, 0)
+		if err != nil {
+			return StructList[T]{}, annotatef(err, "struct list builder: finish")
+		}
+		return StructList[T](l), nil
+	}
+	// Shrink the list to its length by rewriting the tag word.  The
+	// unused elements are left in the segment.
+	l := b.list
+	l.length = b.n
+	l.seg.writeRawPointer(l.off-address(wordSize), rawStructPointer(pointerOffset(l.length), l.size))
+	return StructList[T](l), nil
+}
+
+// A GrowableList wraps a list of any element type so that it grows
+// when an element past its end is about to be set.  The zero value is
+// not usable; create one with NewGrowableList.
+type GrowableList[L ~ListKind] struct {
+	list List // allocated elements; list.length is the capacity
+	n    int32
+}
+
+// NewGrowableList returns a growable list that starts with l's
+// elements.  l must have been allocated, even if it is empty, so that
+// its segment and element size are known.
+func NewGrowableList[L ~ListKind](l L) *GrowableList[L] {
+	return &GrowableList[L]{list: List(l), n: List(l).length}
+}
+
+// Len returns the length of the list.
+func (g *GrowableList[L]) Len() int {
+	return int(g.n)
+}
+
+// List returns the list with its current length.  The list must be
+// stored with SetPtr (or the generated setter) after the last call to
+// Grow, since growing may move it.
+func (g *GrowableList[L]) List() L {
+	return L(g.view())
+}
+
+// Grow extends the list so that i is in range and returns it.  To set
+// element i past the end of the list, call Grow(i) and then the
+// returned list's Set method.  Elements added between the old end and
+// i read as zero, or the default value for pointers.
+//
+// When the allocated space is full, Grow allocates a list with at least
+// twice as many elements and moves the existing elements into it, so
+// setting ascending indices costs amortized constant time.  Moving an
+// element copies its data and rewrites its pointers, but not the
+// objects they point to.  The space used by the old list is not
+// reclaimed until the message is reset, and any list or element
+// previously obtained from g refers to the old copy afterward, so
+// writes through it are lost.
+func (g *GrowableList[L]) Grow(i int) (L, error) {
+	if g.list.seg == nil {
+		return L{}, errorf("growable list: not created from an allocated list")
+	}
+	if i < 0 || i >= 1<<29-1 {
+		return L{}, errorf("growable list: index %d out of range", i)
+	}
+	if n := int32(i) + 1; n > g.n {
+		if n > g.list.length {
+			if err := g.grow(n); err != nil {
+				return L{}, annotatef(err, "growable list: set element %d", i)
+			}
+		}
+		g.n = n
+	}
+	return L(g.view()), nil
+}
+
+// grow moves the elements into a list with room for at least n.
+func (g *GrowableList[L]) grow(n int32) error {
+	newCap := 2 * g.list.length
+	if newCap < 4 {
+		newCap = 4
+	}
+	if newCap < n {
+		newCap = n
+	}
+	if newCap >= 1<<29 {
+		newCap = 1<<29 - 1
+	}
+	old := g.view()
+	var l List
+	var err error
+	switch {
+	case old.flags&isCompositeList != 0:
+		l, err = NewCompositeList(old.seg, old.size, newCap)
+	case old.flags&isBitList != 0:
+		var bl BitList
+		bl, err = NewBitList(old.seg, newCap)
+		l = List(bl)
+	case old.size.PointerCount == 1:
+		var pl PointerList
+		pl, err = NewPointerList(old.seg, newCap)
+		l = List(pl)
+	default:
+		l, err = newPrimitiveList(old.seg, old.size.DataSize, newCap)
+	}
+	if err != nil {
+		return err
+	}
+	switch {
+	case old.flags&isBitList != 0:
+		sz := bitListSize(old.length)
+		copy(l.seg.slice(l.off, sz), old.seg.slice(old.off, sz))
+	case old.size.PointerCount == 0:
+		// List bounds were validated when the list was allocated.
+		sz := old.size.DataSize.timesUnchecked(old.length)
+		copy(l.seg.slice(l.off, sz), old.seg.slice(old.off, sz))
+	default:
+		for i := 0; i < old.Len(); i++ {
+			if err := moveStruct(l.Struct(i), old.Struct(i)); err != nil {
+				return err
+			}
+		}
+	}
+	g.list = l
+	return nil
+}
+
+// view returns the allocated list cut down to the current length.  For
+// composite lists, it rewrites the tag word to match.
+func (g *GrowableList[L]) view() List {
+	l := g.list
+	if l.seg == nil {
+		return l
+	}
+	l.length = g.n
+	if l.flags&isCompositeList != 0 {
+		l.seg.writeRawPointer(l.off-address(wordSize), rawStructPointer(pointerOffset(l.length), l.size))
+	}
+	return l
+}
+
 // String returns the list in Cap'n Proto schema format (e.g. "[(x = 1), (x = 2)]").
 func (s StructList[T]) String() string {
 	buf := &bytes.Buffer{}
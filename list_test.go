@@ -2,6 +2,8 @@ package capnp
 
 import (
 	"bytes"
+	"fmt"
+	"runtime"
 	"testing"
 )
 
@@ -128,3 +130,699 @@ func TestListRaw(t *testing.T) {
 		}
 	}
 }
+
+func TestStructListCopyFrom(t *testing.T) {
+	elemSize := ObjectSize{DataSize: 8, PointerCount: 2}
+	innerSize := ObjectSize{DataSize: 8, PointerCount: 1}
+
+	srcMsg, srcSeg, err := NewMessage(SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcList, err := NewCompositeList(srcSeg, elemSize, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := StructList[Struct](srcList)
+	hook := new(dummyHook)
+	c := NewClient(hook)
+	defer c.Release()
+	for i := 0; i < src.Len(); i++ {
+		e := src.At(i)
+		e.SetUint64(0, uint64(100+i))
+		inner, err := NewStruct(srcSeg, innerSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inner.SetUint64(0, uint64(200+i))
+		txt, err := NewText(srcSeg, "hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := inner.SetPtr(0, txt.ToPtr()); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.SetPtr(0, inner.ToPtr()); err != nil {
+			t.Fatal(err)
+		}
+		capID := srcMsg.AddCap(c.AddRef())
+		if err := e.SetPtr(1, NewInterface(srcSeg, capID).ToPtr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Small segments force the copy to span several segments.
+	dstMsg := &Message{Arena: MultiSegment([][]byte{make([]byte, 0, 16), make([]byte, 0, 32)})}
+	dstSeg, err := dstMsg.Segment(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstList, err := NewCompositeList(dstSeg, elemSize, int32(src.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := StructList[Struct](dstList)
+	if err := dst.CopyFrom(src); err != nil {
+		t.Fatal("CopyFrom:", err)
+	}
+	if n := dstMsg.NumSegments(); n < 2 {
+		t.Errorf("destination message has %d segments; want several", n)
+	}
+
+	for i := 0; i < src.Len(); i++ {
+		d, s := dst.At(i), src.At(i)
+		if got, want := d.Uint64(0), s.Uint64(0); got != want {
+			t.Errorf("dst[%d] data = %d; want %d", i, got, want)
+		}
+		dp, err := d.Ptr(0)
+		if err != nil {
+			t.Fatalf("dst[%d].Ptr(0): %v", i, err)
+		}
+		sp, _ := s.Ptr(0)
+		if !deepPointerEqual(dp, sp) {
+			t.Errorf("dst[%d].Ptr(0) not equal to source", i)
+		}
+		if dp.Segment().Message() != dstMsg {
+			t.Errorf("dst[%d].Ptr(0) is not in destination message", i)
+		}
+		ip, err := d.Ptr(1)
+		if err != nil {
+			t.Fatalf("dst[%d].Ptr(1): %v", i, err)
+		}
+		if !ip.Interface().Client().IsSame(c) {
+			t.Errorf("dst[%d] capability does not refer to source capability", i)
+		}
+	}
+
+	// Larger elements are copied field by field.
+	l, err := NewCompositeList(dstSeg, ObjectSize{DataSize: 16, PointerCount: 3}, int32(src.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	larger := StructList[Struct](l)
+	if err := larger.CopyFrom(src); err != nil {
+		t.Fatal("CopyFrom into larger elements:", err)
+	}
+	if got := larger.At(2).Uint64(0); got != 102 {
+		t.Errorf("CopyFrom into larger elements: dst[2] data = %d; want 102", got)
+	}
+	if p, err := larger.At(2).Ptr(0); err != nil || !p.IsValid() {
+		t.Errorf("CopyFrom into larger elements: dst[2].Ptr(0) = %v, %v; want copy of source", p, err)
+	}
+
+	// Lists that cannot hold every field of src are rejected.
+	for _, layout := range []struct {
+		name string
+		sz   ObjectSize
+		n    int32
+	}{
+		{"smaller elements", ObjectSize{DataSize: 8}, int32(src.Len())},
+		{"shorter list", elemSize, 1},
+	} {
+		l, err := NewCompositeList(dstSeg, layout.sz, layout.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := StructList[Struct](l).CopyFrom(src); err == nil {
+			t.Errorf("CopyFrom into %s succeeded; want error", layout.name)
+		}
+	}
+
+	var null StructList[Struct]
+	if err := null.CopyFrom(src); err == nil {
+		t.Error("CopyFrom into null list succeeded; want error")
+	}
+	if err := null.CopyFrom(StructList[Struct]{}); err != nil {
+		t.Error("CopyFrom null list into null list:", err)
+	}
+	if err := dst.CopyFrom(StructList[Struct]{}); err == nil {
+		t.Error("CopyFrom null list into non-empty list succeeded; want error")
+	}
+
+	// The copies hold their own references to the capability.
+	srcMsg.Reset(nil)
+	c.Release()
+	if hook.shutdowns != 0 {
+		t.Error("capability shut down while destination message references it")
+	}
+	dstMsg.Reset(nil)
+	if hook.shutdowns != 1 {
+		t.Errorf("capability shut down %d times after releasing all references; want 1", hook.shutdowns)
+	}
+}
+
+// A sliceList is a primitive list type with FromSlice and ToSlice.
+type sliceList[T any] interface {
+	Len() int
+	At(int) T
+	ToSlice() []T
+	Segment() *Segment
+}
+
+func testListFromSlice[T comparable, L sliceList[T]](t *testing.T, newList func(*Segment, []T) (L, error), gen func(i int) T) {
+	t.Helper()
+	for _, n := range []int{0, 1, 7, 20000} {
+		vs := make([]T, n)
+		for i := range vs {
+			vs[i] = gen(i)
+		}
+		// The first segment is too small for the large list.
+		msg := &Message{Arena: MultiSegment([][]byte{make([]byte, 0, 64)})}
+		seg, err := msg.Segment(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := newList(seg, vs)
+		if err != nil {
+			t.Errorf("%T from %d-element slice: %v", l, n, err)
+			continue
+		}
+		if l.Len() != n {
+			t.Errorf("%T from %d-element slice: Len() = %d", l, n, l.Len())
+			continue
+		}
+		if n == 20000 && l.Segment().ID() == 0 {
+			t.Errorf("%T from %d-element slice: allocated in first segment", l, n)
+		}
+		for i, v := range vs {
+			if got := l.At(i); got != v {
+				t.Errorf("%T from %d-element slice: At(%d) = %v; want %v", l, n, i, got, v)
+				break
+			}
+		}
+		out := l.ToSlice()
+		if len(out) != n {
+			t.Errorf("%T from %d-element slice: len(ToSlice()) = %d", l, n, len(out))
+			continue
+		}
+		for i, v := range vs {
+			if out[i] != v {
+				t.Errorf("%T from %d-element slice: ToSlice()[%d] = %v; want %v", l, n, i, out[i], v)
+				break
+			}
+		}
+		if n > 0 {
+			out[0] = gen(1)
+			if l.At(0) != vs[0] {
+				t.Errorf("%T: ToSlice result aliases list", l)
+			}
+		}
+	}
+}
+
+func TestStructListTruncate(t *testing.T) {
+	t.Parallel()
+
+	sz := ObjectSize{DataSize: 8}
+	newList := func(t *testing.T) (*Message, Struct, StructList[Struct]) {
+		msg, seg, err := NewMessage(SingleSegment(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, err := NewRootStruct(seg, ObjectSize{PointerCount: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := NewCompositeList(seg, sz, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			l.Struct(i).SetUint64(0, uint64(i+1))
+		}
+		if err := root.SetPtr(0, l.ToPtr()); err != nil {
+			t.Fatal(err)
+		}
+		return msg, root, StructList[Struct](l)
+	}
+	// readBack marshals msg and returns the list in its root's field.
+	readBack := func(t *testing.T, msg *Message) StructList[Struct] {
+		data, err := msg.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err = Unmarshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, err := msg.Root()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := root.Struct().Ptr(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return StructList[Struct](p.List())
+	}
+	checkElems := func(t *testing.T, l StructList[Struct]) {
+		if l.Len() != 3 {
+			t.Fatalf("Len() = %d; want 3", l.Len())
+		}
+		for i := 0; i < 3; i++ {
+			if got := l.At(i).Uint64(0); got != uint64(i+1) {
+				t.Errorf("element %d = %d; want %d", i, got, i+1)
+			}
+		}
+	}
+
+	t.Run("Last", func(t *testing.T) {
+		msg, root, l := newList(t)
+		before, _ := msg.TotalSize()
+		l, err := l.Truncate(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkElems(t, l)
+		after, _ := msg.TotalSize()
+		if want := before - 7*uint64(sz.totalSize()); after != want {
+			t.Errorf("message size after Truncate = %d; want %d", after, want)
+		}
+		if err := root.SetPtr(0, l.ToPtr()); err != nil {
+			t.Fatal(err)
+		}
+		checkElems(t, readBack(t, msg))
+	})
+
+	t.Run("NotLast", func(t *testing.T) {
+		msg, root, l := newList(t)
+		if _, err := NewText(root.Segment(), "after"); err != nil {
+			t.Fatal(err)
+		}
+		before, _ := msg.TotalSize()
+		l, err := l.Truncate(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkElems(t, l)
+		if after, _ := msg.TotalSize(); after != before {
+			t.Errorf("message size changed from %d to %d; want no reclaim", before, after)
+		}
+		// The stored pointer still reads back, without being set again.
+		checkElems(t, readBack(t, msg))
+	})
+
+	t.Run("OutOfRange", func(t *testing.T) {
+		_, _, l := newList(t)
+		if _, err := l.Truncate(11); err == nil {
+			t.Error("Truncate(11) on 10-element list succeeded")
+		}
+		if _, err := l.Truncate(-1); err == nil {
+			t.Error("Truncate(-1) succeeded")
+		}
+	})
+}
+
+func TestStructListBuilder(t *testing.T) {
+	sz := ObjectSize{DataSize: 8, PointerCount: 1}
+	for _, n := range []int{0, 1, 3, 4, 5, 17, 100} {
+		msg, seg, err := NewMessage(SingleSegment(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := NewStructListBuilder[Struct](seg, sz)
+		for i := 0; i < n; i++ {
+			e, err := b.Append()
+			if err != nil {
+				t.Fatalf("n=%d: Append #%d: %v", n, i, err)
+			}
+			e.SetUint64(0, uint64(i))
+			if err := e.SetNewText(0, fmt.Sprintf("elem %d", i)); err != nil {
+				t.Fatalf("n=%d: SetNewText #%d: %v", n, i, err)
+			}
+		}
+		if b.Len() != n {
+			t.Errorf("n=%d: Len() = %d", n, b.Len())
+		}
+		l, err := b.Finish()
+		if err != nil {
+			t.Fatalf("n=%d: Finish: %v", n, err)
+		}
+		if err := msg.SetRoot(l.ToPtr()); err != nil {
+			t.Fatalf("n=%d: SetRoot: %v", n, err)
+		}
+
+		// Read back through a fresh message to check the encoding.
+		data, err := msg.Marshal()
+		if err != nil {
+			t.Fatalf("n=%d: Marshal: %v", n, err)
+		}
+		msg2, err := Unmarshal(data)
+		if err != nil {
+			t.Fatalf("n=%d: Unmarshal: %v", n, err)
+		}
+		root, err := msg2.Root()
+		if err != nil {
+			t.Fatalf("n=%d: Root: %v", n, err)
+		}
+		got := StructList[Struct](root.List())
+		if got.Len() != n {
+			t.Fatalf("n=%d: decoded list has %d elements", n, got.Len())
+		}
+		for i := 0; i < n; i++ {
+			e := got.At(i)
+			if v := e.Uint64(0); v != uint64(i) {
+				t.Errorf("n=%d: [%d] data = %d; want %d", n, i, v, i)
+			}
+			p, err := e.Ptr(0)
+			if err != nil {
+				t.Fatalf("n=%d: [%d].Ptr(0): %v", n, i, err)
+			}
+			if txt, want := p.Text(), fmt.Sprintf("elem %d", i); txt != want {
+				t.Errorf("n=%d: [%d] text = %q; want %q", n, i, txt, want)
+			}
+		}
+	}
+}
+
+func TestListFromSlice(t *testing.T) {
+	t.Parallel()
+
+	testListFromSlice(t, NewBitListFromSlice, func(i int) bool { return i%3 == 0 })
+	testListFromSlice(t, NewInt8ListFromSlice, func(i int) int8 { return int8(i) - 100 })
+	testListFromSlice(t, NewUInt8ListFromSlice, func(i int) uint8 { return uint8(i * 7) })
+	testListFromSlice(t, NewInt16ListFromSlice, func(i int) int16 { return int16(-i * 3) })
+	testListFromSlice(t, NewUInt16ListFromSlice, func(i int) uint16 { return uint16(i * 0x101) })
+	testListFromSlice(t, NewInt32ListFromSlice, func(i int) int32 { return int32(-i * 100003) })
+	testListFromSlice(t, NewUInt32ListFromSlice, func(i int) uint32 { return uint32(i) * 0x01010101 })
+	testListFromSlice(t, NewInt64ListFromSlice, func(i int) int64 { return int64(-i) << 40 })
+	testListFromSlice(t, NewUInt64ListFromSlice, func(i int) uint64 { return uint64(i) * 0x0101010101010101 })
+	testListFromSlice(t, NewFloat32ListFromSlice, func(i int) float32 { return float32(i) / 4 })
+	testListFromSlice(t, NewFloat64ListFromSlice, func(i int) float64 { return -float64(i) / 3 })
+}
+
+func TestListToSlice_Invalid(t *testing.T) {
+	t.Parallel()
+
+	if s := (UInt32List{}).ToSlice(); len(s) != 0 {
+		t.Errorf("UInt32List{}.ToSlice() = %v; want empty", s)
+	}
+	if s := (BitList{}).ToSlice(); len(s) != 0 {
+		t.Errorf("BitList{}.ToSlice() = %v; want empty", s)
+	}
+}
+
+func TestListToSlice_Composite(t *testing.T) {
+	t.Parallel()
+
+	_, seg, err := NewMessage(SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewCompositeList(seg, ObjectSize{DataSize: 8, PointerCount: 1}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Struct(0).SetUint32(0, 12)
+	l.Struct(1).SetUint32(0, 34)
+	if s := UInt32List(l).ToSlice(); len(s) != 2 || s[0] != 12 || s[1] != 34 {
+		t.Errorf("UInt32List(composite list).ToSlice() = %v; want [12 34]", s)
+	}
+}
+
+func TestListEqual(t *testing.T) {
+	t.Parallel()
+
+	_, seg, err := NewMessage(SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newList := func(vs ...uint64) UInt64List {
+		l, err := NewUInt64ListFromSlice(seg, vs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	a := newList(1, 2, 3)
+	tests := []struct {
+		name string
+		l, m UInt64List
+		want bool
+	}{
+		{"same elements", a, newList(1, 2, 3), true},
+		{"same list", a, a, true},
+		{"different element", a, newList(1, 2, 4), false},
+		{"shorter", a, newList(1, 2), false},
+		{"longer", a, newList(1, 2, 3, 4), false},
+		{"null and empty", UInt64List{}, newList(), true},
+		{"null and non-empty", UInt64List{}, a, false},
+		{"both null", UInt64List{}, UInt64List{}, true},
+	}
+	for _, test := range tests {
+		if got := test.l.Equal(test.m); got != test.want {
+			t.Errorf("%s: l.Equal(m) = %t; want %t", test.name, got, test.want)
+		}
+		if got := test.m.Equal(test.l); got != test.want {
+			t.Errorf("%s: m.Equal(l) = %t; want %t", test.name, got, test.want)
+		}
+	}
+
+	b1, _ := NewBitListFromSlice(seg, []bool{true, false, true})
+	b2, _ := NewBitListFromSlice(seg, []bool{true, false, true})
+	b3, _ := NewBitListFromSlice(seg, []bool{true, true, true})
+	if !b1.Equal(b2) {
+		t.Error("equal bit lists reported unequal")
+	}
+	if b1.Equal(b3) {
+		t.Error("different bit lists reported equal")
+	}
+}
+
+func TestListContains(t *testing.T) {
+	t.Parallel()
+
+	_, seg, err := NewMessage(SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewUInt64ListFromSlice(seg, []uint64{5, 10, 15})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Contains(10) {
+		t.Error("Contains(10) = false; want true")
+	}
+	if l.Contains(11) {
+		t.Error("Contains(11) = true; want false")
+	}
+	if (UInt64List{}).Contains(0) {
+		t.Error("UInt64List{}.Contains(0) = true; want false")
+	}
+	f, err := NewFloat32ListFromSlice(seg, []float32{0.5, -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Contains(-1) || f.Contains(1) {
+		t.Errorf("Float32List %v: Contains(-1) = %t, Contains(1) = %t; want true, false", f.ToSlice(), f.Contains(-1), f.Contains(1))
+	}
+	b, err := NewBitListFromSlice(seg, []bool{false, false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Contains(true) || !b.Contains(false) {
+		t.Error("BitList [false false]: Contains(true) or not Contains(false)")
+	}
+}
+
+func TestGrowableList(t *testing.T) {
+	// Indices chosen to force several reallocations, sometimes past
+	// double the capacity.
+	indices := []int{2, 3, 10, 11, 40, 300}
+
+	t.Run("UInt32", func(t *testing.T) {
+		_, seg, err := NewMessage(SingleSegment(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := NewUInt32List(seg, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := NewGrowableList(l)
+		for _, i := range indices {
+			l, err := g.Grow(i)
+			if err != nil {
+				t.Fatalf("Grow(%d): %v", i, err)
+			}
+			l.Set(i, uint32(i)+1)
+		}
+		l = g.List()
+		if l.Len() != 301 {
+			t.Fatalf("Len() = %d; want 301", l.Len())
+		}
+		set := make(map[int]bool)
+		for _, i := range indices {
+			set[i] = true
+		}
+		for i := 0; i < l.Len(); i++ {
+			want := uint32(0)
+			if set[i] {
+				want = uint32(i) + 1
+			}
+			if got := l.At(i); got != want {
+				t.Errorf("[%d] = %d; want %d", i, got, want)
+			}
+		}
+	})
+
+	t.Run("Bit", func(t *testing.T) {
+		_, seg, err := NewMessage(SingleSegment(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := NewBitList(seg, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Set(0, true)
+		g := NewGrowableList(l)
+		for _, i := range indices {
+			l, err := g.Grow(i)
+			if err != nil {
+				t.Fatalf("Grow(%d): %v", i, err)
+			}
+			l.Set(i, true)
+		}
+		l = g.List()
+		var got []int
+		for i := 0; i < l.Len(); i++ {
+			if l.At(i) {
+				got = append(got, i)
+			}
+		}
+		if want := append([]int{0}, indices...); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("set bits = %v; want %v", got, want)
+		}
+	})
+
+	t.Run("Struct", func(t *testing.T) {
+		msg, seg, err := NewMessage(SingleSegment(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := NewCompositeList(seg, ObjectSize{DataSize: 8, PointerCount: 1}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := NewGrowableList(StructList[Struct](l))
+		for _, i := range indices {
+			l, err := g.Grow(i)
+			if err != nil {
+				t.Fatalf("Grow(%d): %v", i, err)
+			}
+			e := l.At(i)
+			e.SetUint64(0, uint64(i))
+			if err := e.SetNewText(0, fmt.Sprintf("elem %d", i)); err != nil {
+				t.Fatalf("SetNewText(%d): %v", i, err)
+			}
+		}
+		if err := msg.SetRoot(g.List().ToPtr()); err != nil {
+			t.Fatal("SetRoot:", err)
+		}
+
+		// Read back through a fresh message to check the encoding.
+		data, err := msg.Marshal()
+		if err != nil {
+			t.Fatal("Marshal:", err)
+		}
+		msg2, err := Unmarshal(data)
+		if err != nil {
+			t.Fatal("Unmarshal:", err)
+		}
+		root, err := msg2.Root()
+		if err != nil {
+			t.Fatal("Root:", err)
+		}
+		got := StructList[Struct](root.List())
+		if got.Len() != 301 {
+			t.Fatalf("decoded list has %d elements; want 301", got.Len())
+		}
+		next := 0
+		for i := 0; i < got.Len(); i++ {
+			e := got.At(i)
+			p, err := e.Ptr(0)
+			if err != nil {
+				t.Fatalf("[%d].Ptr(0): %v", i, err)
+			}
+			if next < len(indices) && i == indices[next] {
+				next++
+				if v := e.Uint64(0); v != uint64(i) {
+					t.Errorf("[%d] data = %d; want %d", i, v, i)
+				}
+				if txt, want := p.Text(), fmt.Sprintf("elem %d", i); txt != want {
+					t.Errorf("[%d] text = %q; want %q", i, txt, want)
+				}
+				continue
+			}
+			if v := e.Uint64(0); v != 0 || p.IsValid() {
+				t.Errorf("[%d] = (%d, %v); want zero", i, v, p)
+			}
+		}
+	})
+}
+
+func TestGrowableList_Unallocated(t *testing.T) {
+	g := NewGrowableList(UInt32List{})
+	if _, err := g.Grow(0); err == nil {
+		t.Error("Grow on unallocated list did not return an error")
+	}
+}
+
+func TestSetListSizeLimit(t *testing.T) {
+	SetListSizeLimit(1024)
+	defer SetListSizeLimit(0)
+
+	_, seg, err := NewMessage(SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := len(seg.Data())
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := NewUInt8List(seg, 1<<28); err == nil {
+		t.Error("NewUInt8List(seg, 1<<28) did not return an error")
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Errorf("rejected NewUInt8List allocated %d bytes", n)
+	}
+	if len(seg.Data()) != size {
+		t.Errorf("rejected NewUInt8List grew segment from %d to %d bytes", size, len(seg.Data()))
+	}
+
+	if _, err := NewPointerList(seg, 200); err == nil {
+		t.Error("NewPointerList(seg, 200) did not return an error")
+	}
+	if _, err := NewBitList(seg, 1<<14); err == nil {
+		t.Error("NewBitList(seg, 1<<14) did not return an error")
+	}
+	// 32 elements of 32 bytes plus the tag word is just over the limit.
+	if _, err := NewCompositeList(seg, ObjectSize{DataSize: 16, PointerCount: 2}, 32); err == nil {
+		t.Error("NewCompositeList of 1032 bytes did not return an error")
+	}
+	if _, err := NewUInt8List(seg, 1024); err != nil {
+		t.Errorf("NewUInt8List(seg, 1024): %v", err)
+	}
+}
+
+func TestNewUInt8ListLimit(t *testing.T) {
+	_, seg, err := NewMessage(SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := len(seg.Data())
+	if _, err := NewUInt8ListLimit(seg, 1<<28, 64); err == nil {
+		t.Error("NewUInt8ListLimit(seg, 1<<28, 64) did not return an error")
+	}
+	if len(seg.Data()) != size {
+		t.Errorf("rejected NewUInt8ListLimit grew segment from %d to %d bytes", size, len(seg.Data()))
+	}
+	l, err := NewUInt8ListLimit(seg, 64, 64)
+	if err != nil {
+		t.Fatalf("NewUInt8ListLimit(seg, 64, 64): %v", err)
+	}
+	if l.Len() != 64 {
+		t.Errorf("NewUInt8ListLimit(seg, 64, 64).Len() = %d; want 64", l.Len())
+	}
+}
@@ -0,0 +1,280 @@
+package capnp
+
+import (
+	"context"
+	"sync"
+)
+
+// NewLocalPromise returns a client for a capability that is not known
+// yet, along with a function that resolves it.  Calls made on the
+// client before it is resolved, including calls pipelined on their
+// results, are queued and delivered in the order they were made once
+// resolve is called.
+//
+// resolve takes ownership of c.  If err is not nil, c is ignored and
+// the queued and future calls fail with err.  resolve must be called at
+// most once.  Until it is called, the queued calls wait: if the
+// client's last reference is released first, they are rejected.
+//
+// Unlike NewPromisedClient, NewLocalPromise does not need a ClientHook:
+// it is meant for application code that hands out a capability before
+// it is able to create it.
+func NewLocalPromise() (Client, func(c Client, err error)) {
+	h := new(localPromiseHook)
+	c, cp := NewPromisedClient(h)
+	var once sync.Once
+	resolve := func(target Client, err error) {
+		first := false
+		once.Do(func() {
+			first = true
+			if err != nil {
+				target.Release()
+				target = ErrorClient(err)
+			}
+			h.resolve(target)
+			cp.Fulfill(target)
+		})
+		target.Release()
+		if !first {
+			panic("local promise resolved more than once")
+		}
+	}
+	return c, resolve
+}
+
+// localPromiseHook queues calls until its target is known.
+type localPromiseHook struct {
+	mu       sync.Mutex
+	target   Client // set once queue has been delivered
+	resolved bool
+	shutdown bool
+	queue    []*queuedCall
+}
+
+func (h *localPromiseHook) Send(ctx context.Context, s Send) (*Answer, ReleaseFunc) {
+	h.mu.Lock()
+	if h.resolved {
+		t := h.target
+		h.mu.Unlock()
+		return t.SendCall(ctx, s)
+	}
+	q, err := newQueuedCall(ctx, s, nil)
+	if err != nil {
+		h.mu.Unlock()
+		return ErrorAnswer(s.Method, err), func() {}
+	}
+	h.queue = append(h.queue, q)
+	h.mu.Unlock()
+	return q.p.Answer(), q.release
+}
+
+func (h *localPromiseHook) Recv(ctx context.Context, r Recv) PipelineCaller {
+	h.mu.Lock()
+	if h.resolved {
+		t := h.target
+		h.mu.Unlock()
+		return t.RecvCall(ctx, r)
+	}
+	h.mu.Unlock()
+	return recvAsSend(ctx, r, h.Send)
+}
+
+// resolve delivers the queued calls to c, then sends any later calls to
+// it directly.  Calls made while the queue is being delivered are
+// queued behind it, so that they cannot overtake earlier ones.
+func (h *localPromiseHook) resolve(c Client) {
+	for {
+		h.mu.Lock()
+		if h.shutdown {
+			h.mu.Unlock()
+			return
+		}
+		if len(h.queue) == 0 {
+			h.target = c
+			h.resolved = true
+			h.mu.Unlock()
+			return
+		}
+		queue := h.queue
+		h.queue = nil
+		h.mu.Unlock()
+		for _, q := range queue {
+			q.deliver(c.SendCall)
+		}
+	}
+}
+
+func (h *localPromiseHook) Brand() Brand {
+	return Brand{}
+}
+
+func (h *localPromiseHook) Shutdown() {
+	h.mu.Lock()
+	h.shutdown = true
+	queue := h.queue
+	h.queue = nil
+	h.mu.Unlock()
+	for _, q := range queue {
+		q.deliver(rejectSend(errorf("local promise released before resolution")))
+	}
+}
+
+// A queuedCall is a call that waits for its target to be known.  The
+// target is either a client or the result of another queued call.
+type queuedCall struct {
+	ctx       context.Context
+	send      Send     // arguments are copied from args
+	args      *Message // owns the copied arguments
+	transform []PipelineOp
+	p         *Promise
+
+	mu        sync.Mutex
+	ans       *Answer // set once the pipelined calls have been delivered
+	rel       ReleaseFunc
+	pipelined []*queuedCall
+}
+
+// newQueuedCall copies the arguments of s, since s.PlaceArgs must not
+// be called after the hook's Send returns.
+func newQueuedCall(ctx context.Context, s Send, transform []PipelineOp) (*queuedCall, error) {
+	args, seg, err := NewMessage(MultiSegment(nil))
+	if err != nil {
+		return nil, err
+	}
+	st, err := NewRootStruct(seg, s.ArgsSize)
+	if err != nil {
+		args.Reset(nil)
+		return nil, err
+	}
+	if s.PlaceArgs != nil {
+		if err := s.PlaceArgs(st); err != nil {
+			// Reset also releases any capabilities that PlaceArgs
+			// added before failing.
+			args.Reset(nil)
+			return nil, annotatef(err, "place args")
+		}
+	}
+	q := &queuedCall{
+		ctx:       ctx,
+		args:      args,
+		transform: transform,
+	}
+	q.send = s
+	q.send.ArgsSize = st.Size()
+	q.send.PlaceArgs = func(dst Struct) error {
+		return dst.CopyFrom(st)
+	}
+	q.p = NewPromise(s.Method, q)
+	return q, nil
+}
+
+// deliver makes the call with send, then delivers the calls pipelined
+// on it in order.
+func (q *queuedCall) deliver(send func(context.Context, Send) (*Answer, ReleaseFunc)) {
+	ans, rel := send(q.ctx, q.send)
+	q.args.ReleaseCaps()
+	for {
+		q.mu.Lock()
+		if len(q.pipelined) == 0 {
+			q.ans = ans
+			q.rel = rel
+			q.mu.Unlock()
+			break
+		}
+		pipelined := q.pipelined
+		q.pipelined = nil
+		q.mu.Unlock()
+		for _, pq := range pipelined {
+			transform := pq.transform
+			pq.deliver(func(ctx context.Context, s Send) (*Answer, ReleaseFunc) {
+				return ans.PipelineSend(ctx, transform, s)
+			})
+		}
+	}
+	go func() {
+		res, err := ans.Struct()
+		q.p.Resolve(res.ToPtr(), err)
+	}()
+}
+
+// release is the ReleaseFunc of the queued call's answer.  It does not
+// wait for the call to be delivered.
+func (q *queuedCall) release() {
+	finish := func() {
+		q.p.ReleaseClients()
+		q.mu.Lock()
+		rel := q.rel
+		q.mu.Unlock()
+		if rel != nil {
+			rel()
+		}
+	}
+	select {
+	case <-q.p.Answer().Done():
+		finish()
+	default:
+		go func() {
+			<-q.p.Answer().Done()
+			finish()
+		}()
+	}
+}
+
+func (q *queuedCall) PipelineSend(ctx context.Context, transform []PipelineOp, s Send) (*Answer, ReleaseFunc) {
+	q.mu.Lock()
+	if q.ans != nil {
+		ans := q.ans
+		q.mu.Unlock()
+		return ans.PipelineSend(ctx, transform, s)
+	}
+	pq, err := newQueuedCall(ctx, s, transform)
+	if err != nil {
+		q.mu.Unlock()
+		return ErrorAnswer(s.Method, err), func() {}
+	}
+	q.pipelined = append(q.pipelined, pq)
+	q.mu.Unlock()
+	return pq.p.Answer(), pq.release
+}
+
+func (q *queuedCall) PipelineRecv(ctx context.Context, transform []PipelineOp, r Recv) PipelineCaller {
+	return recvAsSend(ctx, r, func(ctx context.Context, s Send) (*Answer, ReleaseFunc) {
+		return q.PipelineSend(ctx, transform, s)
+	})
+}
+
+// recvAsSend makes the call r with send and copies the results to
+// r.Returner once they are ready.
+func recvAsSend(ctx context.Context, r Recv, send func(context.Context, Send) (*Answer, ReleaseFunc)) PipelineCaller {
+	ans, rel := send(ctx, Send{
+		Method:   r.Method,
+		ArgsSize: r.Args.Size(),
+		PlaceArgs: func(s Struct) error {
+			return s.CopyFrom(r.Args)
+		},
+		Metadata:         r.Metadata,
+		ResponseMetadata: r.ResponseMetadata,
+	})
+	r.ReleaseArgs()
+	go func() {
+		defer rel()
+		res, err := ans.Struct()
+		if err != nil {
+			r.Returner.Return(err)
+			return
+		}
+		results, err := r.Returner.AllocResults(res.Size())
+		if err == nil {
+			err = results.CopyFrom(res)
+		}
+		r.Returner.Return(err)
+	}()
+	return ans
+}
+
+// rejectSend returns a send function that fails every call with err.
+func rejectSend(err error) func(context.Context, Send) (*Answer, ReleaseFunc) {
+	return func(_ context.Context, s Send) (*Answer, ReleaseFunc) {
+		return ErrorAnswer(s.Method, err), func() {}
+	}
+}
@@ -0,0 +1,189 @@
+package capnp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// orderHook records the first argument word of each call it receives.
+// If callee is not null, each call returns it in pointer 0 of the
+// results.
+type orderHook struct {
+	mu     sync.Mutex
+	args   []uint64
+	callee Client
+}
+
+func (oh *orderHook) Send(_ context.Context, s Send) (*Answer, ReleaseFunc) {
+	_, seg, err := NewMessage(SingleSegment(nil))
+	if err != nil {
+		return ErrorAnswer(s.Method, err), func() {}
+	}
+	args, err := NewStruct(seg, s.ArgsSize)
+	if err != nil {
+		return ErrorAnswer(s.Method, err), func() {}
+	}
+	if err := s.PlaceArgs(args); err != nil {
+		return ErrorAnswer(s.Method, err), func() {}
+	}
+	oh.mu.Lock()
+	oh.args = append(oh.args, args.Uint64(0))
+	oh.mu.Unlock()
+
+	results, err := NewRootStruct(seg, ObjectSize{PointerCount: 1})
+	if err != nil {
+		return ErrorAnswer(s.Method, err), func() {}
+	}
+	if (oh.callee != Client{}) {
+		id := seg.Message().AddCap(oh.callee.AddRef())
+		if err := results.SetPtr(0, NewInterface(seg, id).ToPtr()); err != nil {
+			return ErrorAnswer(s.Method, err), func() {}
+		}
+	}
+	return ImmediateAnswer(s.Method, results), func() {}
+}
+
+func (oh *orderHook) Recv(ctx context.Context, r Recv) PipelineCaller {
+	panic("not implemented")
+}
+
+func (oh *orderHook) Brand() Brand {
+	return Brand{}
+}
+
+func (oh *orderHook) Shutdown() {
+	oh.callee.Release()
+}
+
+func (oh *orderHook) received() []uint64 {
+	oh.mu.Lock()
+	defer oh.mu.Unlock()
+	return append([]uint64(nil), oh.args...)
+}
+
+// sendUint64 calls c with a single uint64 argument.
+func sendUint64(c Client, v uint64) (*Answer, ReleaseFunc) {
+	return c.SendCall(context.Background(), Send{
+		Method:   Method{InterfaceID: 0xa7317bd7216570aa, MethodID: 9},
+		ArgsSize: ObjectSize{DataSize: 8},
+		PlaceArgs: func(s Struct) error {
+			s.SetUint64(0, v)
+			return nil
+		},
+	})
+}
+
+func TestLocalPromise(t *testing.T) {
+	t.Parallel()
+
+	callee := new(orderHook)
+	target := &orderHook{callee: NewClient(callee)}
+	c, resolve := NewLocalPromise()
+	defer c.Release()
+
+	var rels []ReleaseFunc
+	var answers []*Answer
+	for i := uint64(1); i <= 3; i++ {
+		ans, rel := sendUint64(c, i)
+		answers = append(answers, ans)
+		rels = append(rels, rel)
+	}
+	pc := answers[0].Future().Field(0, nil).Client()
+	pans, prel := sendUint64(pc, 100)
+	rels = append(rels, prel)
+	select {
+	case <-answers[0].Done():
+		t.Fatal("call answered before promise resolved")
+	default:
+	}
+
+	resolve(NewClient(target), nil)
+	ans, rel := sendUint64(c, 4)
+	answers = append(answers, ans, pans)
+	rels = append(rels, rel)
+	for i, ans := range answers {
+		if _, err := ans.Struct(); err != nil {
+			t.Errorf("call #%d: %v", i, err)
+		}
+	}
+	for _, rel := range rels {
+		rel()
+	}
+	pc.Release()
+
+	got := target.received()
+	if len(got) != 4 || got[0] != 1 || got[1] != 2 || got[2] != 3 || got[3] != 4 {
+		t.Errorf("target received %v; want [1 2 3 4]", got)
+	}
+	if got := callee.received(); len(got) != 1 || got[0] != 100 {
+		t.Errorf("callee received %v; want [100]", got)
+	}
+}
+
+func TestLocalPromise_Error(t *testing.T) {
+	t.Parallel()
+
+	c, resolve := NewLocalPromise()
+	defer c.Release()
+	ans, rel := sendUint64(c, 1)
+	defer rel()
+
+	errFail := errors.New("no capability")
+	resolve(Client{}, errFail)
+	if _, err := ans.Struct(); !errors.Is(err, errFail) {
+		t.Errorf("queued call returned %v; want %v", err, errFail)
+	}
+	ans2, rel2 := sendUint64(c, 2)
+	defer rel2()
+	if _, err := ans2.Struct(); !errors.Is(err, errFail) {
+		t.Errorf("call after resolve returned %v; want %v", err, errFail)
+	}
+}
+
+func TestLocalPromise_PlaceArgsError(t *testing.T) {
+	t.Parallel()
+
+	c, resolve := NewLocalPromise()
+	defer c.Release()
+	arg := new(dummyHook)
+	errFail := errors.New("bad args")
+	ans, rel := c.SendCall(context.Background(), Send{
+		Method:   Method{InterfaceID: 0xa7317bd7216570aa, MethodID: 9},
+		ArgsSize: ObjectSize{PointerCount: 1},
+		PlaceArgs: func(s Struct) error {
+			id := s.Message().AddCap(NewClient(arg))
+			if err := s.SetPtr(0, NewInterface(s.Segment(), id).ToPtr()); err != nil {
+				return err
+			}
+			return errFail
+		},
+	})
+	defer rel()
+	if _, err := ans.Struct(); !errors.Is(err, errFail) {
+		t.Errorf("call returned %v; want %v", err, errFail)
+	}
+	if arg.shutdowns != 1 {
+		t.Errorf("capability in failed arguments shut down %d times; want 1", arg.shutdowns)
+	}
+	resolve(NewClient(new(orderHook)), nil)
+}
+
+func TestLocalPromise_Released(t *testing.T) {
+	t.Parallel()
+
+	c, resolve := NewLocalPromise()
+	ans, rel := sendUint64(c, 1)
+	defer rel()
+	c.Release()
+	if _, err := ans.Struct(); err == nil {
+		t.Error("queued call succeeded after promise was released")
+	}
+
+	target := new(orderHook)
+	resolve(NewClient(target), nil)
+	if got := target.received(); len(got) != 0 {
+		t.Errorf("target received %v after promise was released; want none", got)
+	}
+}
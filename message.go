@@ -3,8 +3,11 @@ package capnp
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"reflect"
 	"sync"
 	"sync/atomic"
 
@@ -55,9 +58,17 @@ type Message struct {
 	TraverseLimit uint64
 
 	// DepthLimit limits how deeply-nested a message structure can be.
+	// It bounds the recursion of operations that traverse a message,
+	// such as copying a struct, Equal, Walk and Canonicalize, which
+	// report ErrDepthLimit when a pointer chain is nested more deeply.
+	// The depth is counted from the object that the traversal starts
+	// at, whether it was read from the message or created in it.
 	// If not set, this defaults to 64.
 	DepthLimit uint
 
+	// readOnly makes writes fail; see SetReadOnly.
+	readOnly bool
+
 	// mu protects the following fields:
 	mu       sync.Mutex
 	segs     map[SegmentID]*Segment
@@ -122,22 +133,43 @@ func NewMultiSegmentMessage(b [][]byte) (msg *Message, first *Segment) {
 // Reset resets a message to use a different arena, allowing a single
 // Message to be reused for reading multiple messages.  This invalidates
 // any existing pointers in the Message, so use with caution.  All
-// clients in the message's capability table will be released.
+// clients in the message's capability table will be released, and if
+// the message was using a ReleasableArena other than arena, such as a
+// ZeroingArena, it is released too.  Other arenas are left untouched.
 func (m *Message) Reset(arena Arena) {
+	if ra, ok := m.Arena.(ReleasableArena); ok && !sameArena(m.Arena, arena) {
+		ra.Release()
+	}
 	m.mu.Lock()
 	m.segs = nil
 	m.firstSeg = Segment{}
 	m.mu.Unlock()
 
 	m.Arena = arena
-	for _, c := range m.CapTable {
-		c.Release()
-	}
-	m.CapTable = nil
+	m.readOnly = false
+	m.ReleaseCaps()
 	m.rlimitInit.Do(func() {})
 	m.initReadLimit()
 }
 
+// SetReadOnly sets whether m's data may be modified.  While m is
+// read-only, allocating an object or setting a pointer in it returns
+// ErrReadOnly, and setters that do not return an error, such as
+// Struct.SetUint32 or BitList.Set, panic with ErrReadOnly.  Use it for
+// messages whose segments alias memory that must not be written, such
+// as a shared buffer or a memory-mapped file.  Reset makes the message
+// writable again.
+//
+// SetReadOnly must not be called concurrently with other writes to m.
+func (m *Message) SetReadOnly(readOnly bool) {
+	m.readOnly = readOnly
+}
+
+// ReadOnly reports whether m's data may not be modified.
+func (m *Message) ReadOnly() bool {
+	return m.readOnly
+}
+
 func (m *Message) initReadLimit() {
 	if m.TraverseLimit == 0 {
 		atomic.StoreUint64(&m.rlimit, defaultTraverseLimit)
@@ -176,7 +208,10 @@ func (m *Message) Unread(sz Size) {
 	atomic.AddUint64(&m.rlimit, uint64(sz))
 }
 
-// Root returns the pointer to the message's root object.
+// Root returns the pointer to the message's root object.  The root is
+// usually a struct, but it may be any kind of pointer: use the methods
+// of Ptr to read it.  Root returns a null Ptr if the root has not been
+// set.
 func (m *Message) Root() (Ptr, error) {
 	s, err := m.Segment(0)
 	if err != nil {
@@ -189,7 +224,9 @@ func (m *Message) Root() (Ptr, error) {
 	return p, nil
 }
 
-// SetRoot sets the message's root object to p.
+// SetRoot sets the message's root object to p, which may be a struct,
+// list, or interface pointer, or null to clear the root.  If p is in a
+// different message, its object is copied into m.
 func (m *Message) SetRoot(p Ptr) error {
 	s, err := m.Segment(0)
 	if err != nil {
@@ -210,6 +247,38 @@ func (m *Message) AddCap(c Client) CapabilityID {
 	return n
 }
 
+// ReleaseCaps releases every client in the message's capability table
+// and clears the table.  Call it when discarding a received message
+// without having taken every capability out of it.  Capability
+// pointers in the message refer to null clients afterward.
+func (m *Message) ReleaseCaps() {
+	for i, c := range m.CapTable {
+		c.Release()
+		m.CapTable[i] = Client{}
+	}
+	m.CapTable = nil
+}
+
+// CopyCapTable replaces dst's capability table with a copy of src's,
+// adding a reference to each client, and releases the clients that
+// were in dst's table.  Use it after copying a message's data by other
+// means than Struct.CopyFrom or Struct.SetPtr, e.g. by unmarshaling the
+// bytes of src, so that dst's capability pointers keep their indices.
+// Releasing src's clients afterward does not affect dst.
+func CopyCapTable(dst, src *Message) {
+	if dst == src {
+		return
+	}
+	old := dst.CapTable
+	dst.CapTable = make([]Client, len(src.CapTable))
+	for i, c := range src.CapTable {
+		dst.CapTable[i] = c.AddRef()
+	}
+	for _, c := range old {
+		c.Release()
+	}
+}
+
 // Compute the total size of the message in bytes, when serialized as
 // a stream. This is the same as the length of the slice returned by
 // m.Marshal()
@@ -238,6 +307,86 @@ func (m *Message) NumSegments() int64 {
 	return int64(m.Arena.NumSegments())
 }
 
+// SegmentData returns the raw bytes of the segment with the given ID.
+// The returned slice aliases the message's backing store: writes to it
+// modify the message, and it may no longer reflect the segment once
+// more objects are allocated in it.
+func (m *Message) SegmentData(id SegmentID) ([]byte, error) {
+	s, err := m.Segment(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.Data(), nil
+}
+
+// ForEachSegment calls f with the ID and raw bytes of each of the
+// message's segments in order, stopping at the first error returned by
+// f, which ForEachSegment then returns.  As with SegmentData, the slices
+// passed to f alias the message's backing store.
+func (m *Message) ForEachSegment(f func(id SegmentID, data []byte) error) error {
+	for id := SegmentID(0); int64(id) < m.NumSegments(); id++ {
+		data, err := m.SegmentData(id)
+		if err != nil {
+			return err
+		}
+		if err := f(id, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ArenaStats describes how much of a message's arena is in use.  All
+// sizes are in bytes.
+type ArenaStats struct {
+	// Segments is the number of segments in the arena.
+	Segments int
+
+	// Allocated is the total capacity of the segments, and Used is
+	// how much of it holds message data.
+	Allocated uint64
+	Used      uint64
+
+	// LargestFree is the largest amount of unused capacity at the end
+	// of a single segment, which bounds the largest object that can be
+	// allocated without adding a segment.
+	LargestFree uint64
+}
+
+// Utilization returns the fraction of the allocated bytes that are
+// used, or zero if nothing is allocated.
+func (st ArenaStats) Utilization() float64 {
+	if st.Allocated == 0 {
+		return 0
+	}
+	return float64(st.Used) / float64(st.Allocated)
+}
+
+// ArenaStats reports the capacity and use of the message's segments.
+// The capacity of a segment is that of the slice that the arena holds
+// it in, so it includes space reserved by the arena's growth policy.
+// Objects that are no longer referenced still count as used.  Segments
+// that cannot be loaded are not counted.
+func (m *Message) ArenaStats() ArenaStats {
+	var st ArenaStats
+	n := m.NumSegments()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id := SegmentID(0); int64(id) < n; id++ {
+		s, err := m.segment(id)
+		if err != nil {
+			continue
+		}
+		st.Segments++
+		st.Allocated += uint64(cap(s.data))
+		st.Used += uint64(len(s.data))
+		if free := uint64(cap(s.data) - len(s.data)); free > st.LargestFree {
+			st.LargestFree = free
+		}
+	}
+	return st
+}
+
 // Segment returns the segment with the given ID.
 func (m *Message) Segment(id SegmentID) (*Segment, error) {
 	if int64(id) >= m.Arena.NumSegments() {
@@ -318,7 +467,7 @@ func (m *Message) allocSegment(sz Size) (*Segment, error) {
 	id, data, err := m.Arena.Allocate(sz, m.segs)
 	if err != nil {
 		m.mu.Unlock()
-		return nil, errorf("allocation: %v", err)
+		return nil, annotatef(err, "allocation")
 	}
 	seg := m.setSegment(id, data)
 	m.mu.Unlock()
@@ -332,6 +481,9 @@ func alloc(s *Segment, sz Size) (*Segment, address, error) {
 	if sz > maxAllocSize() {
 		return nil, 0, errorf("allocation: too large")
 	}
+	if s.readOnly() {
+		return nil, 0, ErrReadOnly
+	}
 	sz = sz.padToWord()
 
 	if !hasCapacity(s.data, sz) {
@@ -401,6 +553,27 @@ type Arena interface {
 	Allocate(minsz Size, segs map[SegmentID]*Segment) (SegmentID, []byte, error)
 }
 
+// A ReleasableArena is an Arena that holds resources to free once a
+// message is done with it.  Message.Reset calls Release when it
+// switches a message from the arena to a different one.  The arena's
+// type should be comparable, usually a pointer: otherwise Reset cannot
+// tell it apart from the arena it switches to, and always releases it.
+type ReleasableArena interface {
+	Arena
+	Release()
+}
+
+// sameArena reports whether a and b are the same arena.  Comparing
+// interfaces panics if their dynamic type is not comparable, such as a
+// slice, so such arenas are never the same.
+func sameArena(a, b Arena) bool {
+	t := reflect.TypeOf(a)
+	if t == nil || t != reflect.TypeOf(b) || !t.Comparable() {
+		return false
+	}
+	return a == b
+}
+
 // SingleSegmentArena is an Arena implementation that stores message data
 // in a continguous slice.  Allocation is performed by first allocating a
 // new slice and copying existing data. SingleSegment arena does not fail
@@ -450,6 +623,125 @@ func (ssa SingleSegmentArena) String() string {
 	return fmt.Sprintf("single-segment arena [len=%d cap=%d]", len(ssa), cap(ssa))
 }
 
+// ErrTooManySegments is returned, possibly wrapped, when a serialized
+// message's header declares more segments than the decoder allows.
+var ErrTooManySegments = errors.New("too many segments")
+
+// ErrReadOnly is returned, possibly wrapped, when writing to a
+// read-only message.  See Message.SetReadOnly.
+var ErrReadOnly = errors.New("message is read-only")
+
+// ErrDepthLimit is returned, possibly wrapped, when following a pointer
+// would nest objects more deeply than the message's DepthLimit.
+var ErrDepthLimit = errors.New("depth limit reached")
+
+// ErrShortRead is returned, possibly wrapped, by Decode on a resumable
+// Decoder when its stream ends partway through a message.  The bytes
+// read so far are kept, and the next call to Decode continues the
+// message once more data is available.
+var ErrShortRead = errors.New("short read")
+
+// checkSegmentCount returns an error if a message whose last segment
+// is maxSeg has more than max segments, or 512 if max is zero.
+func checkSegmentCount(maxSeg SegmentID, max int) error {
+	if max <= 0 {
+		max = maxStreamSegments
+	}
+	if uint64(maxSeg) >= uint64(max) {
+		return annotatef(ErrTooManySegments, "%d segments, limit is %d", uint64(maxSeg)+1, max)
+	}
+	return nil
+}
+
+// ErrArenaFull is returned, possibly wrapped, when an allocation does
+// not fit in an arena created by NewFixedArena.
+var ErrArenaFull = errors.New("arena full")
+
+// FixedArena is an Arena that serves every allocation from a single
+// buffer provided by the caller, whose capacity is never grown.  Once
+// the buffer is exhausted, allocations fail with ErrArenaFull, so
+// building a message in a FixedArena never allocates message data on
+// the heap.  Use TotalSize on a similar message to choose the buffer
+// size.
+type FixedArena struct {
+	buf []byte
+}
+
+// NewFixedArena returns an arena that allocates from buf[:cap(buf)],
+// overwriting its contents.  Each message created with the arena starts
+// over at the beginning of buf, so the arena may be reused once the
+// previous message is no longer needed.
+func NewFixedArena(buf []byte) *FixedArena {
+	return &FixedArena{buf: buf[:0]}
+}
+
+func (fa *FixedArena) NumSegments() int64 {
+	return 1
+}
+
+func (fa *FixedArena) Data(id SegmentID) ([]byte, error) {
+	if id != 0 {
+		return nil, errorf("segment %d requested in fixed arena", id)
+	}
+	return fa.buf, nil
+}
+
+func (fa *FixedArena) Allocate(sz Size, segs map[SegmentID]*Segment) (SegmentID, []byte, error) {
+	data := fa.buf
+	if segs[0] != nil {
+		data = segs[0].data
+	}
+	if !hasCapacity(data, sz) {
+		return 0, nil, annotatef(ErrArenaFull, "alloc %v with %d bytes free", sz, cap(data)-len(data))
+	}
+	return 0, data, nil
+}
+
+func (fa *FixedArena) String() string {
+	return fmt.Sprintf("fixed arena [cap=%d]", cap(fa.buf))
+}
+
+// NewMessageOnStack creates a message whose first segment is scratch,
+// like the scratch space of the C++ MallocMessageBuilder, and returns
+// it along with its first segment.  The message's data is only
+// allocated on the heap once it overflows scratch, at which point it is
+// continued in additional segments as with MultiSegment; its contents
+// are never copied out of scratch.  The contents of scratch[:cap(scratch)]
+// are overwritten.  Creating the message allocates only the Message
+// itself, so a small message can be built with a single allocation by
+// reusing scratch once the previous message is no longer needed.
+func NewMessageOnStack(scratch []byte) (msg *Message, first *Segment, err error) {
+	sm := new(scratchMessage)
+	sm.arena = sm.first[:0]
+	if cap(scratch) >= int(wordSize) {
+		sm.first[0] = scratch[:0]
+		sm.arena = sm.first[:]
+	}
+	sm.Message.Arena = &sm.arena
+	msg = &sm.Message
+	if len(sm.arena) == 0 {
+		first, err = msg.allocSegment(wordSize)
+	} else {
+		first, err = msg.Segment(0)
+	}
+	if err != nil {
+		return nil, nil, annotatef(err, "new message")
+	}
+	if _, _, err := alloc(first, wordSize); err != nil { // allocate root
+		return nil, nil, annotatef(err, "new message")
+	}
+	return msg, first, nil
+}
+
+// scratchMessage is a Message allocated together with its arena, for
+// NewMessageOnStack.  The arena's segment list starts out in first, so
+// that it is not allocated separately.
+type scratchMessage struct {
+	Message
+	arena MultiSegmentArena
+	first [1][]byte
+}
+
 type roSingleSegment []byte
 
 func (ss roSingleSegment) NumSegments() int64 {
@@ -542,6 +834,99 @@ func (msa *MultiSegmentArena) String() string {
 	return fmt.Sprintf("multi-segment arena [%d segments]", len(*msa))
 }
 
+// A ZeroingArena is a multi-segment Arena that overwrites its segments
+// with zeros when it is released, so that secrets such as keys do not
+// linger in memory after the message is done with.  It is a
+// ReleasableArena, so Message.Reset releases it when it switches to a
+// different arena; call Release directly to discard a message without
+// resetting it.
+//
+// Releasing an arena writes to every byte of its segments' capacity,
+// so it costs time proportional to the memory the message used, on
+// top of the cost of building the message.  The zeroing does not cover
+// copies of the data made elsewhere, e.g. by Message.Marshal or by a
+// transport's buffers.
+type ZeroingArena struct {
+	segs  [][]byte
+	alloc func(n int) []byte
+	free  func(b []byte)
+}
+
+// NewZeroingArena returns an empty ZeroingArena.  alloc returns a
+// buffer with a capacity of at least n bytes for a new segment, and
+// free is called with each segment's buffer after Release zeroes it,
+// e.g. to return the buffer to a pool.  If alloc is nil, buffers are
+// allocated with make; free may be nil.
+func NewZeroingArena(alloc func(n int) []byte, free func(b []byte)) *ZeroingArena {
+	return &ZeroingArena{alloc: alloc, free: free}
+}
+
+func (za *ZeroingArena) NumSegments() int64 {
+	return int64(len(za.segs))
+}
+
+func (za *ZeroingArena) Data(id SegmentID) ([]byte, error) {
+	if int64(id) >= int64(len(za.segs)) {
+		return nil, errorf("segment %d requested (arena only has %d segments)", id, len(za.segs))
+	}
+	return za.segs[id], nil
+}
+
+func (za *ZeroingArena) Allocate(sz Size, segs map[SegmentID]*Segment) (SegmentID, []byte, error) {
+	var total int64
+	for i, data := range za.segs {
+		id := SegmentID(i)
+		if s := segs[id]; s != nil {
+			data = s.data
+		}
+		if hasCapacity(data, sz) {
+			return id, data, nil
+		}
+		total += int64(cap(data))
+		if total < 0 {
+			// Overflow.
+			return 0, nil, errorf("alloc %d bytes: message too large", sz)
+		}
+	}
+	n, err := nextAlloc(total, 1<<63-1, sz)
+	if err != nil {
+		return 0, nil, err
+	}
+	var buf []byte
+	if za.alloc != nil {
+		buf = za.alloc(n)[:0]
+		if cap(buf) < n {
+			return 0, nil, errorf("alloc %d bytes: allocator returned %d bytes", n, cap(buf))
+		}
+	} else {
+		buf = make([]byte, 0, n)
+	}
+	id := SegmentID(len(za.segs))
+	za.segs = append(za.segs, buf)
+	return id, buf, nil
+}
+
+// Release overwrites the arena's segments with zeros, passes them to
+// the free function, and empties the arena.  Any message using the
+// arena must not be used afterward, except to call Reset.
+func (za *ZeroingArena) Release() {
+	for i, buf := range za.segs {
+		buf = buf[:cap(buf)]
+		for j := range buf {
+			buf[j] = 0
+		}
+		if za.free != nil {
+			za.free(buf[:0])
+		}
+		za.segs[i] = nil
+	}
+	za.segs = nil
+}
+
+func (za *ZeroingArena) String() string {
+	return fmt.Sprintf("zeroing arena [%d segments]", len(za.segs))
+}
+
 // nextAlloc computes how much more space to allocate given the number
 // of bytes allocated in the entire message and the requested number of
 // bytes.  It will always return a multiple of wordSize.  max must be a
@@ -588,7 +973,16 @@ func nextAlloc(curr, max int64, req Size) (int, error) {
 // A Decoder represents a framer that deserializes a particular Cap'n
 // Proto input stream.
 type Decoder struct {
-	r io.Reader
+	r  io.Reader
+	pr *packed.Reader // reader of r if the next message is packed
+
+	// br is the buffered stream under pr, if any, and bpr is its
+	// packed reader.  SetAutoPacking peeks at br to choose r and pr
+	// for each message.
+	br           *bufio.Reader
+	bpr          *packed.Reader
+	auto         bool
+	packedStream bool // created by NewPackedDecoder
 
 	wordbuf [wordSize]byte
 	hdrbuf  []byte
@@ -598,9 +992,25 @@ type Decoder struct {
 	msg   Message
 	arena roSingleSegment
 
+	nread int64
+
+	resumable bool
+	partial   []byte // the current message's bytes, if resumable
+
+	// The next message's header, if peeked is true.
+	peeked bool
+	hdr    streamHeader
+	total  uint64
+
 	// Maximum number of bytes that can be read per call to Decode.
 	// If not set, a reasonable default is used.
 	MaxMessageSize uint64
+
+	// Maximum number of segments in a message.  Decode returns an
+	// error wrapping ErrTooManySegments for a message whose header
+	// declares more, before reading the rest of the header.  If not
+	// set, the limit is 512.
+	MaxSegments int
 }
 
 // NewDecoder creates a new Cap'n Proto framer that reads from r.
@@ -612,31 +1022,211 @@ func NewDecoder(r io.Reader) *Decoder {
 
 // NewPackedDecoder creates a new Cap'n Proto framer that reads from a
 // packed stream r.  The returned decoder may read more data than
-// necessary from r.
+// necessary from r, unless r is a *bufio.Reader: the decoder then reads
+// only the packed words of each message, so several decoders can take
+// turns reading from a shared *bufio.Reader, as long as each message was
+// packed separately, as by an Encoder from NewPackedEncoder.
+// MaxMessageSize limits the unpacked size of each message, so a small
+// packed message cannot expand past it before the decoder checks the
+// message's header.
 func NewPackedDecoder(r io.Reader) *Decoder {
-	return NewDecoder(packed.NewReader(bufio.NewReader(r)))
+	br := bufio.NewReader(r)
+	pr := packed.NewReader(br)
+	d := NewDecoder(pr)
+	d.pr = pr
+	d.br = br
+	d.bpr = pr
+	d.packedStream = true
+	return d
+}
+
+// SetAutoPacking sets whether the decoder detects the encoding of each
+// message, so that a single stream may mix packed and unpacked
+// messages.  When auto is true, Decode peeks at the first bytes of each
+// message and decodes it as packed if packed.IsLikelyPacked reports so.
+// When auto is false, messages are decoded in the encoding chosen by
+// the constructor, as they are by default.
+//
+// Detection is a heuristic: an unpacked message's first word holds a
+// small segment count, whereas a packed message begins with a tag byte.
+// An unpacked message with more than 512 segments, which Decode rejects
+// unless MaxSegments is raised, or a packed message whose header does
+// not look like a stream header can be misdetected, and the message
+// then fails to decode.  Use it only when the encoding cannot be agreed
+// on out of band.
+//
+// Auto detection requires buffering the stream, so the decoder may read
+// more data than necessary from its stream unless it is a
+// *bufio.Reader.
+func (d *Decoder) SetAutoPacking(auto bool) {
+	if auto && d.br == nil {
+		br, ok := d.r.(*bufio.Reader)
+		if !ok {
+			br = bufio.NewReader(d.r)
+		}
+		d.br = br
+		d.r = br
+	}
+	d.auto = auto
+	if !auto && d.br != nil {
+		if d.packedStream {
+			d.r, d.pr = d.bpr, d.bpr
+		} else {
+			d.r, d.pr = d.br, nil
+		}
+	}
+}
+
+// sniff chooses the reader for the next message by peeking at its
+// first bytes.  Errors are left for the read of the header to report.
+func (d *Decoder) sniff() {
+	prefix, _ := d.br.Peek(int(wordSize) + 1)
+	if !packed.IsLikelyPacked(prefix) {
+		d.r, d.pr = d.br, nil
+		return
+	}
+	if d.bpr == nil {
+		d.bpr = packed.NewReader(d.br)
+	}
+	d.r, d.pr = d.bpr, d.bpr
 }
 
 // Decode reads a message from the decoder stream.  The error is io.EOF
 // only if no bytes were read.
 func (d *Decoder) Decode() (*Message, error) {
+	arena, err := d.decodeArena(d.reuse)
+	if err != nil {
+		return nil, err
+	}
+	if !d.reuse {
+		return &Message{Arena: arena}, nil
+	}
+	d.msg.Reset(arena)
+	return &d.msg, nil
+}
+
+// DecodeInto reads a message from the decoder stream into m, which is
+// reset as if by m.Reset.  The message's data is read into the
+// decoder's reused buffer, as with ReuseBuffer, so decoding a stream
+// into a single Message allocates little or nothing per message; the
+// data of the previously decoded message is invalidated, whether it was
+// decoded into m or returned by Decode.  Like the messages decoded with
+// ReuseBuffer, m cannot handle allocations.  If DecodeInto returns an
+// error, the contents of m are undefined.  The error is io.EOF only if
+// no bytes were read.
+func (d *Decoder) DecodeInto(m *Message) error {
+	arena, err := d.decodeArena(true)
+	if err != nil {
+		return err
+	}
+	m.Reset(arena)
+	return nil
+}
+
+// decodeArena reads a message from the decoder stream and returns an
+// arena with its segments.  If reuse is true, the arena's data is read
+// into d.buf.
+func (d *Decoder) decodeArena(reuse bool) (Arena, error) {
+	maxSize, err := d.maxSize()
+	if err != nil {
+		return nil, err
+	}
+	hdr, total, err := d.header(maxSize)
+	if err != nil {
+		return nil, err
+	}
+	d.peeked = false
+	if d.resumable && d.pr == nil {
+		return d.decodeResumable(reuse, hdr, total)
+	}
+
+	// Read segments.
+	if !reuse {
+		buf := make([]byte, int(total))
+		if _, err := d.readFull(buf); err != nil {
+			return nil, errorf("decode: read segments: %v", err)
+		}
+		arena, err := demuxArena(hdr, buf)
+		if err != nil {
+			return nil, annotatef(err, "decode")
+		}
+		return arena, nil
+	}
+	d.buf = resizeSlice(d.buf, int(total))
+	if _, err := d.readFull(d.buf); err != nil {
+		return nil, errorf("decode: read segments: %v", err)
+	}
+	var arena Arena
+	if hdr.maxSegment() == 0 {
+		d.arena = d.buf[:len(d.buf):len(d.buf)]
+		arena = &d.arena
+	} else {
+		var err error
+		arena, err = demuxArena(hdr, d.buf)
+		if err != nil {
+			return nil, annotatef(err, "decode")
+		}
+	}
+	return arena, nil
+}
+
+// maxSize returns the limit on the size of a message.
+func (d *Decoder) maxSize() (uint64, error) {
 	maxSize := d.MaxMessageSize
 	if maxSize == 0 {
-		maxSize = defaultDecodeLimit
-	} else if maxSize < uint64(len(d.wordbuf)) {
-		return nil, errorf("decode: max message size is smaller than header size")
+		return defaultDecodeLimit, nil
+	}
+	if maxSize < uint64(len(d.wordbuf)) {
+		return 0, errorf("decode: max message size is smaller than header size")
+	}
+	return maxSize, nil
+}
+
+// header returns the header of the next message in the stream and the
+// total size of its segments.  If PeekHeader has already read the
+// header, header returns it again, and otherwise reads it.
+func (d *Decoder) header(maxSize uint64) (streamHeader, uint64, error) {
+	if d.peeked {
+		return d.hdr, d.total, nil
+	}
+	if d.auto && len(d.partial) == 0 {
+		d.sniff()
+	}
+	var hdr streamHeader
+	var total uint64
+	var err error
+	if d.resumable && d.pr == nil {
+		hdr, total, err = d.resumableHeader(maxSize)
+	} else {
+		hdr, total, err = d.readHeader(maxSize)
+	}
+	if err != nil {
+		return streamHeader{}, 0, err
+	}
+	d.hdr, d.total, d.peeked = hdr, total, true
+	return hdr, total, nil
+}
+
+// readHeader reads the header of the next message from the stream.
+func (d *Decoder) readHeader(maxSize uint64) (streamHeader, uint64, error) {
+	if d.pr != nil {
+		if maxSize > math.MaxInt64 {
+			d.pr.SetReadLimit(-1)
+		} else {
+			d.pr.SetReadLimit(int64(maxSize))
+		}
 	}
 
 	// Read first word (number of segments and first segment size).
 	// For single-segment messages, this will be sufficient.
-	if _, err := io.ReadFull(d.r, d.wordbuf[:]); err == io.EOF {
-		return nil, io.EOF
+	if _, err := d.readFull(d.wordbuf[:]); err == io.EOF {
+		return streamHeader{}, 0, io.EOF
 	} else if err != nil {
-		return nil, errorf("decode: read header: %v", err)
+		return streamHeader{}, 0, errorf("decode: read header: %v", err)
 	}
 	maxSeg := SegmentID(binary.LittleEndian.Uint32(d.wordbuf[:]))
-	if maxSeg > maxStreamSegments {
-		return nil, errorf("decode: too many segments to decode")
+	if err := checkSegmentCount(maxSeg, d.MaxSegments); err != nil {
+		return streamHeader{}, 0, annotatef(err, "decode")
 	}
 
 	// Read the rest of the header if more than one segment.
@@ -646,54 +1236,96 @@ func (d *Decoder) Decode() (*Message, error) {
 	} else {
 		hdrSize := streamHeaderSize(maxSeg)
 		if hdrSize > maxSize || hdrSize > uint64(maxInt) {
-			return nil, errorf("decode: message too large")
+			return streamHeader{}, 0, errorf("decode: message too large")
 		}
 		d.hdrbuf = resizeSlice(d.hdrbuf, int(hdrSize))
 		copy(d.hdrbuf, d.wordbuf[:])
-		if _, err := io.ReadFull(d.r, d.hdrbuf[len(d.wordbuf):]); err != nil {
-			return nil, errorf("decode: read header: %v", err)
+		if _, err := d.readFull(d.hdrbuf[len(d.wordbuf):]); err != nil {
+			return streamHeader{}, 0, errorf("decode: read header: %v", err)
 		}
 		hdr = streamHeader{d.hdrbuf}
 	}
 	total, err := hdr.totalSize()
 	if err != nil {
-		return nil, annotatef(err, "decode")
+		return streamHeader{}, 0, annotatef(err, "decode")
 	}
 	// TODO(someday): if total size is greater than can fit in one buffer,
 	// attempt to allocate buffer per segment.
 	if total > maxSize-uint64(len(hdr.b)) || total > uint64(maxInt) {
-		return nil, errorf("decode: message too large")
+		return streamHeader{}, 0, errorf("decode: message too large")
 	}
+	if d.pr != nil {
+		// Stop at the end of the message, leaving the rest of the
+		// stream for the next reader.
+		d.pr.SetReadLimit(int64(total))
+	}
+	return hdr, total, nil
+}
 
-	// Read segments.
-	if !d.reuse {
-		buf := make([]byte, int(total))
-		if _, err := io.ReadFull(d.r, buf); err != nil {
-			return nil, errorf("decode: read segments: %v", err)
-		}
-		arena, err := demuxArena(hdr, buf)
-		if err != nil {
-			return nil, annotatef(err, "decode")
-		}
-		return &Message{Arena: arena}, nil
+// PeekHeader reads the segment table of the next message in the
+// stream, but not its segments, and returns the number of segments and
+// their total size in words.  The next call to Decode, DecodeInto or
+// Skip reads that message; until then, calling PeekHeader again returns
+// the same header.  The decoder's settings, such as SetResumable, must
+// not be changed in between.  The error is io.EOF only if no bytes were
+// read.
+func (d *Decoder) PeekHeader() (segmentCount int, totalWords uint64, err error) {
+	maxSize, err := d.maxSize()
+	if err != nil {
+		return 0, 0, err
 	}
-	d.buf = resizeSlice(d.buf, int(total))
-	if _, err := io.ReadFull(d.r, d.buf); err != nil {
-		return nil, errorf("decode: read segments: %v", err)
+	hdr, total, err := d.header(maxSize)
+	if err != nil {
+		return 0, 0, err
 	}
-	var arena Arena
-	if maxSeg == 0 {
-		d.arena = d.buf[:len(d.buf):len(d.buf)]
-		arena = &d.arena
-	} else {
-		var err error
-		arena, err = demuxArena(hdr, d.buf)
-		if err != nil {
-			return nil, annotatef(err, "decode")
+	return int(hdr.maxSegment()) + 1, total / uint64(wordSize), nil
+}
+
+// Skip reads past the next message in the stream without decoding it.
+// Its segments are discarded as they are read, rather than kept in a
+// buffer.  Like Decode with ReuseBuffer, Skip invalidates the data of
+// the previous message if the decoder reuses its buffer.  The error is
+// io.EOF only if no bytes were read.
+func (d *Decoder) Skip() error {
+	maxSize, err := d.maxSize()
+	if err != nil {
+		return err
+	}
+	hdr, total, err := d.header(maxSize)
+	if err != nil {
+		return err
+	}
+	d.peeked = false
+	if d.resumable && d.pr == nil {
+		if err := d.fill(uint64(len(hdr.b)) + total); err != nil {
+			return errorf("skip: read segments: %w", err)
 		}
+		d.partial = d.partial[:0]
+		return nil
 	}
-	d.msg.Reset(arena)
-	return &d.msg, nil
+	n, err := io.CopyN(io.Discard, d.r, int64(total))
+	d.nread += n
+	if err != nil {
+		return errorf("skip: read segments: %v", err)
+	}
+	return nil
+}
+
+// readFull reads exactly len(b) bytes into b, counting them toward
+// BytesRead.
+func (d *Decoder) readFull(b []byte) (int, error) {
+	n, err := io.ReadFull(d.r, b)
+	d.nread += int64(n)
+	return n, err
+}
+
+// BytesRead returns the total number of bytes that the decoder has
+// consumed from its stream, including the segment tables and any
+// header padding.  After a successful Decode, this is the offset of the
+// next message in the stream.  For a decoder created by
+// NewPackedDecoder, BytesRead counts unpacked bytes.
+func (d *Decoder) BytesRead() int64 {
+	return d.nread
 }
 
 func resizeSlice(b []byte, size int) []byte {
@@ -709,9 +1341,108 @@ func (d *Decoder) ReuseBuffer() {
 	d.reuse = true
 }
 
+// SetResumable sets whether the decoder keeps a partially read message
+// when its stream runs out of data, as a non-blocking source does when
+// it returns io.EOF or io.ErrUnexpectedEOF before more data arrives.
+// When resumable is true, Decode then returns an error wrapping
+// ErrShortRead, and the next call to Decode continues reading the
+// message where the previous one stopped.  Decode still returns io.EOF
+// if the stream ends between messages.
+//
+// SetResumable has no effect on a decoder that reads packed messages.
+func (d *Decoder) SetResumable(resumable bool) {
+	d.resumable = resumable
+	if !resumable {
+		d.partial = d.partial[:0]
+	}
+}
+
+// fill reads from the stream until d.partial holds n bytes.  It keeps
+// the bytes that it reads even if it returns an error.
+func (d *Decoder) fill(n uint64) error {
+	have := len(d.partial)
+	if uint64(have) >= n {
+		return nil
+	}
+	if uint64(cap(d.partial)) < n {
+		buf := make([]byte, have, n)
+		copy(buf, d.partial)
+		d.partial = buf
+	}
+	d.partial = d.partial[:n]
+	k, err := d.readFull(d.partial[have:])
+	d.partial = d.partial[:have+k]
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return annotatef(ErrShortRead, "%d of %d bytes", have+k, n)
+	}
+	return err
+}
+
+// resumableHeader is readHeader for a resumable decoder.  The header is
+// kept at the start of d.partial.
+func (d *Decoder) resumableHeader(maxSize uint64) (streamHeader, uint64, error) {
+	if err := d.fill(uint64(wordSize)); err != nil {
+		if len(d.partial) == 0 && errors.Is(err, ErrShortRead) {
+			return streamHeader{}, 0, io.EOF
+		}
+		return streamHeader{}, 0, errorf("decode: read header: %w", err)
+	}
+	maxSeg := SegmentID(binary.LittleEndian.Uint32(d.partial))
+	if err := checkSegmentCount(maxSeg, d.MaxSegments); err != nil {
+		d.partial = d.partial[:0]
+		return streamHeader{}, 0, annotatef(err, "decode")
+	}
+	hdrSize := streamHeaderSize(maxSeg)
+	if hdrSize > maxSize {
+		d.partial = d.partial[:0]
+		return streamHeader{}, 0, errorf("decode: message too large")
+	}
+	if err := d.fill(hdrSize); err != nil {
+		return streamHeader{}, 0, errorf("decode: read header: %w", err)
+	}
+	hdr := streamHeader{d.partial[:hdrSize]}
+	total, err := hdr.totalSize()
+	if err != nil {
+		d.partial = d.partial[:0]
+		return streamHeader{}, 0, annotatef(err, "decode")
+	}
+	if total > maxSize-hdrSize || total > uint64(maxInt)-hdrSize {
+		d.partial = d.partial[:0]
+		return streamHeader{}, 0, errorf("decode: message too large")
+	}
+	return hdr, total, nil
+}
+
+// decodeResumable is decodeArena for a resumable decoder.
+func (d *Decoder) decodeResumable(reuse bool, hdr streamHeader, total uint64) (Arena, error) {
+	hdrSize := uint64(len(hdr.b))
+	if err := d.fill(hdrSize + total); err != nil {
+		return nil, errorf("decode: read segments: %w", err)
+	}
+	hdr = streamHeader{d.partial[:hdrSize]}
+	data := d.partial[hdrSize : hdrSize+total : hdrSize+total]
+	if reuse {
+		d.partial = d.partial[:0]
+	} else {
+		// The message keeps the buffer.
+		d.partial = nil
+	}
+	if reuse && hdr.maxSegment() == 0 {
+		d.arena = roSingleSegment(data)
+		return &d.arena, nil
+	}
+	arena, err := demuxArena(hdr, data)
+	if err != nil {
+		return nil, annotatef(err, "decode")
+	}
+	return arena, nil
+}
+
 // Unmarshal reads an unpacked serialized stream into a message.  No
 // copying is performed, so the objects in the returned message read
-// directly from data.
+// directly from data.  Like Decode, Unmarshal returns an error wrapping
+// ErrTooManySegments if the message has more than 512 segments; use a
+// Decoder with MaxSegments set to read larger ones.
 func Unmarshal(data []byte) (*Message, error) {
 	if len(data) == 0 {
 		return nil, io.EOF
@@ -720,6 +1451,9 @@ func Unmarshal(data []byte) (*Message, error) {
 		return nil, errorf("unmarshal: short header section")
 	}
 	maxSeg := SegmentID(binary.LittleEndian.Uint32(data))
+	if err := checkSegmentCount(maxSeg, 0); err != nil {
+		return nil, annotatef(err, "unmarshal")
+	}
 	hdrSize := streamHeaderSize(maxSeg)
 	if uint64(len(data)) < hdrSize {
 		return nil, errorf("unmarshal: short header section")
@@ -738,6 +1472,135 @@ func Unmarshal(data []byte) (*Message, error) {
 	return &Message{Arena: arena}, nil
 }
 
+// UnmarshalFlat reads a single-segment message in the flat array format
+// produced by the C++ capnp::messageToFlatArray: an 8-byte header
+// followed by the segment.  It returns an error if the header declares
+// more than one segment.  The returned message's segment aliases data,
+// but growing the message will not write past the end of the segment.
+func UnmarshalFlat(data []byte) (*Message, error) {
+	if len(data) == 0 {
+		return nil, io.EOF
+	}
+	if len(data) < int(wordSize) {
+		return nil, errorf("unmarshal flat: short header section")
+	}
+	hdr := streamHeader{data[:wordSize]}
+	if n := hdr.maxSegment(); n != 0 {
+		return nil, errorf("unmarshal flat: message has %d segments; want 1", uint64(n)+1)
+	}
+	sz, err := hdr.segmentSize(0)
+	if err != nil {
+		return nil, annotatef(err, "unmarshal flat")
+	}
+	data = data[wordSize:]
+	if uint64(sz) > uint64(len(data)) {
+		return nil, errorf("unmarshal flat: short data section")
+	}
+	return &Message{Arena: SingleSegment(data[:sz:sz])}, nil
+}
+
+// UnmarshalFromReaderAt reads an unpacked serialized message of size
+// bytes from r.  Only the segment table is read up front: each segment
+// is read from r the first time the message accesses it, and then kept
+// in memory, so reading part of a large message only reads the segments
+// it touches.  The returned message is read-only, and r must remain
+// readable for as long as the message is used.  As with Unmarshal, the
+// message may have at most 512 segments.
+func UnmarshalFromReaderAt(r io.ReaderAt, size int64) (*Message, error) {
+	if size == 0 {
+		return nil, io.EOF
+	}
+	if size < int64(wordSize) {
+		return nil, errorf("unmarshal: short header section")
+	}
+	var first [wordSize]byte
+	if err := readFullAt(r, first[:], 0); err != nil {
+		return nil, annotatef(err, "unmarshal: read header")
+	}
+	maxSeg := SegmentID(binary.LittleEndian.Uint32(first[:]))
+	if err := checkSegmentCount(maxSeg, 0); err != nil {
+		return nil, annotatef(err, "unmarshal")
+	}
+	hdrSize := streamHeaderSize(maxSeg)
+	if uint64(size) < hdrSize {
+		return nil, errorf("unmarshal: short header section")
+	}
+	hdr := streamHeader{make([]byte, hdrSize)}
+	if err := readFullAt(r, hdr.b, 0); err != nil {
+		return nil, annotatef(err, "unmarshal: read header")
+	}
+	if total, err := hdr.totalSize(); err != nil {
+		return nil, annotatef(err, "unmarshal")
+	} else if total > uint64(size)-hdrSize {
+		return nil, errorf("unmarshal: short data section")
+	}
+	arena := &readerAtArena{
+		r:    r,
+		hdr:  hdr,
+		offs: make([]int64, int(maxSeg)+1),
+		segs: make([][]byte, int(maxSeg)+1),
+	}
+	off := int64(hdrSize)
+	for i := range arena.offs {
+		arena.offs[i] = off
+		sz, _ := hdr.segmentSize(SegmentID(i)) // checked by totalSize
+		off += int64(sz)
+	}
+	return &Message{Arena: arena, readOnly: true}, nil
+}
+
+// readerAtArena is the read-only Arena for UnmarshalFromReaderAt.
+type readerAtArena struct {
+	r    io.ReaderAt
+	hdr  streamHeader
+	offs []int64  // offset of each segment in r
+	segs [][]byte // nil until loaded
+}
+
+func (ra *readerAtArena) NumSegments() int64 {
+	return int64(len(ra.segs))
+}
+
+func (ra *readerAtArena) Data(id SegmentID) ([]byte, error) {
+	if int64(id) >= int64(len(ra.segs)) {
+		return nil, errorf("segment %d requested (arena only has %d segments)", id, len(ra.segs))
+	}
+	if ra.segs[id] != nil {
+		return ra.segs[id], nil
+	}
+	sz, err := ra.hdr.segmentSize(id)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, sz)
+	if err := readFullAt(ra.r, buf, ra.offs[id]); err != nil {
+		return nil, annotatef(err, "read segment %d", id)
+	}
+	ra.segs[id] = buf
+	return buf, nil
+}
+
+func (ra *readerAtArena) Allocate(sz Size, segs map[SegmentID]*Segment) (SegmentID, []byte, error) {
+	return 0, nil, errorf("arena is read-only")
+}
+
+func (ra *readerAtArena) String() string {
+	return fmt.Sprintf("read-only reader arena [segments=%d]", len(ra.segs))
+}
+
+// readFullAt reads len(b) bytes from r at off.  Unlike ReadAt, it
+// reports io.ErrUnexpectedEOF if fewer bytes are available.
+func readFullAt(r io.ReaderAt, b []byte, off int64) error {
+	n, err := r.ReadAt(b, off)
+	if n == len(b) {
+		return nil
+	}
+	if err == io.EOF || err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
 // UnmarshalPacked reads a packed serialized stream into a message.
 func UnmarshalPacked(data []byte) (*Message, error) {
 	if len(data) == 0 {
@@ -766,10 +1629,20 @@ func MustUnmarshalRoot(data []byte) Ptr {
 
 // An Encoder represents a framer for serializing a particular Cap'n
 // Proto stream.
+//
+// An Encoder retains its scratch buffers across calls to Encode, so
+// that encoding a stream of similarly sized messages does not allocate.
+// As a consequence, an Encoder is not safe for concurrent use.
 type Encoder struct {
 	w      io.Writer
 	hdrbuf []byte
 	bufs   [][]byte
+	nbufs  [][]byte // consumed by write, so kept apart from bufs
+
+	packed  bool
+	packbuf []byte
+
+	bufLimit int
 }
 
 // NewEncoder creates a new Cap'n Proto framer that writes to w.
@@ -780,7 +1653,28 @@ func NewEncoder(w io.Writer) *Encoder {
 // NewPackedEncoder creates a new Cap'n Proto framer that writes to a
 // packed stream w.
 func NewPackedEncoder(w io.Writer) *Encoder {
-	return NewEncoder(&packed.Writer{Writer: w})
+	return &Encoder{w: w, packed: true}
+}
+
+// SetPacked sets whether the messages that e writes from then on are
+// packed.  A single encoder may switch between packed and unpacked
+// messages; the packing buffer is kept between messages either way.
+func (e *Encoder) SetPacked(packed bool) {
+	e.packed = packed
+}
+
+// Packed reports whether e writes packed messages.
+func (e *Encoder) Packed() bool {
+	return e.packed
+}
+
+// SetBufferLimit sets the largest scratch buffer, in bytes, that the
+// encoder will retain between calls to Encode.  Encoding a message that
+// needs a larger buffer still succeeds, but the buffer is discarded
+// afterward instead of being kept for reuse.  A limit <= 0, the
+// default, retains buffers of any size.
+func (e *Encoder) SetBufferLimit(n int) {
+	e.bufLimit = n
 }
 
 // Encode writes a message to the encoder stream.
@@ -814,13 +1708,39 @@ func (e *Encoder) Encode(m *Message) error {
 	}
 	e.bufs[0] = e.hdrbuf
 
-	if err := e.write(e.bufs); err != nil {
+	err := e.flush()
+	// Don't keep the message's segments alive until the next Encode.
+	for i := range e.bufs {
+		e.bufs[i] = nil
+	}
+	if e.bufLimit > 0 {
+		if cap(e.packbuf) > e.bufLimit {
+			e.packbuf = nil
+		}
+		if cap(e.hdrbuf) > e.bufLimit {
+			e.hdrbuf = nil
+		}
+	}
+	if err != nil {
 		return errorf("encode: %v", err)
 	}
-
 	return nil
 }
 
+// flush writes e.bufs to the underlying writer, packing them first if
+// the encoder is packed.
+func (e *Encoder) flush() error {
+	if !e.packed {
+		return e.write(e.bufs)
+	}
+	e.packbuf = e.packbuf[:0]
+	for _, b := range e.bufs {
+		e.packbuf = packed.Pack(e.packbuf, b)
+	}
+	_, err := e.w.Write(e.packbuf)
+	return err
+}
+
 // Marshal concatenates the segments in the message into a single byte
 // slice including framing.
 func (m *Message) Marshal() ([]byte, error) {
@@ -882,6 +1802,47 @@ func (m *Message) Marshal() ([]byte, error) {
 	return buf, nil
 }
 
+// MarshalFlat marshals a single-segment message in the flat array
+// format read by UnmarshalFlat.  It returns an error if the message has
+// more than one segment.
+func (m *Message) MarshalFlat() ([]byte, error) {
+	if n := m.NumSegments(); n != 1 {
+		return nil, errorf("marshal flat: message has %d segments; want 1", n)
+	}
+	return m.Marshal()
+}
+
+// MarshalDeterministic marshals the message in the same stream format
+// as Marshal, but with a layout that depends only on the objects
+// reachable from the root, so that building the same message twice
+// produces the same bytes.  Marshal writes segments as the arena
+// allocated them, which varies with the arena's buffers and may include
+// objects that are no longer referenced.
+//
+// The output always has a single segment.  It holds the root pointer
+// followed by each object in depth-first order, with the fields of a
+// struct or the elements of a list visited in index order, and uses
+// no far pointers.  Unlike Canonicalize, structs keep their sizes and
+// capability pointers keep their indices into m.CapTable.
+func (m *Message) MarshalDeterministic() ([]byte, error) {
+	root, err := m.Root()
+	if err != nil {
+		return nil, annotatef(err, "marshal deterministic")
+	}
+	msg, seg, err := NewMessage(SingleSegment(nil))
+	if err != nil {
+		return nil, annotatef(err, "marshal deterministic")
+	}
+	p, err := canonicalPtr(seg, root, false)
+	if err != nil {
+		return nil, annotatef(err, "marshal deterministic")
+	}
+	if err := msg.SetRoot(p); err != nil {
+		return nil, annotatef(err, "marshal deterministic")
+	}
+	return msg.Marshal()
+}
+
 // MarshalPacked marshals the message in packed form.
 func (m *Message) MarshalPacked() ([]byte, error) {
 	data, err := m.Marshal()
@@ -893,6 +1854,62 @@ func (m *Message) MarshalPacked() ([]byte, error) {
 	return buf, nil
 }
 
+// EncodeStreamHeader appends the segment table that precedes a message
+// with segments of the given sizes in the stream format, as written by
+// Marshal and Encoder, to dst and returns the extended slice.  The table
+// is padded to a whole number of words, so its length is a multiple of
+// 8.  Each size must be a multiple of 8 bytes and no larger than a
+// segment can be; EncodeStreamHeader panics if a size is invalid or if
+// segmentSizes is empty.
+func EncodeStreamHeader(dst []byte, segmentSizes []Size) []byte {
+	if len(segmentSizes) == 0 {
+		panic("EncodeStreamHeader: no segments")
+	}
+	if uint64(len(segmentSizes)) > 1<<32 {
+		panic("EncodeStreamHeader: too many segments")
+	}
+	dst = appendUint32(dst, uint32(len(segmentSizes)-1))
+	for i, sz := range segmentSizes {
+		if sz%wordSize != 0 || sz > maxSegmentSize {
+			panic(fmt.Sprintf("EncodeStreamHeader: invalid size %d for segment %d", sz, i))
+		}
+		dst = appendUint32(dst, uint32(sz/wordSize))
+	}
+	if len(segmentSizes)%2 == 0 {
+		dst = appendUint32(dst, 0)
+	}
+	return dst
+}
+
+// DecodeStreamHeader reads the segment table at the start of src, which
+// holds a message in the stream format, and returns the size of each
+// segment in bytes and the length of the table, after which the
+// segments follow in order.  src need not contain the segments.  Like
+// Unmarshal, DecodeStreamHeader returns an error wrapping
+// ErrTooManySegments if the table declares more than 512 segments.
+func DecodeStreamHeader(src []byte) (sizes []Size, headerLen int, err error) {
+	if len(src) < int(wordSize) {
+		return nil, 0, errorf("decode stream header: short header section")
+	}
+	maxSeg := SegmentID(binary.LittleEndian.Uint32(src))
+	if err := checkSegmentCount(maxSeg, 0); err != nil {
+		return nil, 0, annotatef(err, "decode stream header")
+	}
+	hdrSize := streamHeaderSize(maxSeg)
+	if uint64(len(src)) < hdrSize {
+		return nil, 0, errorf("decode stream header: short header section")
+	}
+	hdr := streamHeader{src[:hdrSize]}
+	sizes = make([]Size, int(maxSeg)+1)
+	for i := range sizes {
+		sizes[i], err = hdr.segmentSize(SegmentID(i))
+		if err != nil {
+			return nil, 0, annotatef(err, "decode stream header")
+		}
+	}
+	return sizes, int(hdrSize), nil
+}
+
 // streamHeaderSize returns the size of the header, given the lower 32
 // bits of the first word of the header (the number of segments minus
 // one).
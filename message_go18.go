@@ -6,6 +6,10 @@ package capnp
 import "net"
 
 func (e *Encoder) write(bufs [][]byte) error {
-	_, err := (*net.Buffers)(&bufs).WriteTo(e.w)
+	// WriteTo consumes its receiver, so copy the slice header into a
+	// field of e rather than taking the address of bufs, which would
+	// allocate on every call.
+	e.nbufs = bufs
+	_, err := (*net.Buffers)(&e.nbufs).WriteTo(e.w)
 	return err
 }
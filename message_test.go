@@ -1,11 +1,16 @@
 package capnp
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"math"
+	"runtime"
+	"strings"
 	"testing"
 	"testing/quick"
 
@@ -55,6 +60,55 @@ func TestNewMessage(t *testing.T) {
 	}
 }
 
+func TestArenaStats(t *testing.T) {
+	t.Parallel()
+
+	msg, seg, err := NewMessage(SingleSegment(make([]byte, 0, 1024)))
+	require.NoError(t, err)
+	_, err = NewRootStruct(seg, ObjectSize{DataSize: 16})
+	require.NoError(t, err)
+	st := msg.ArenaStats()
+	assert.Equal(t, ArenaStats{
+		Segments:    1,
+		Allocated:   1024,
+		Used:        24,
+		LargestFree: 1000,
+	}, st)
+	assert.InDelta(t, 24.0/1024.0, st.Utilization(), 1e-9)
+
+	// A first segment too small for the root struct leaves a gap that
+	// objects allocated next to the root do not fill.
+	msg, seg, err = NewMessage(MultiSegment([][]byte{make([]byte, 0, 24)}))
+	require.NoError(t, err)
+	root, err := NewRootStruct(seg, ObjectSize{DataSize: 32, PointerCount: 2})
+	require.NoError(t, err)
+	require.NoError(t, root.SetNewText(0, "hi"))
+	require.NoError(t, root.SetNewText(1, "a longer string that needs its own space"))
+	require.Equal(t, int64(2), msg.NumSegments())
+
+	st = msg.ArenaStats()
+	var want ArenaStats
+	for id := SegmentID(0); id < 2; id++ {
+		s, err := msg.Segment(id)
+		require.NoError(t, err)
+		want.Segments++
+		want.Allocated += uint64(cap(s.data))
+		want.Used += uint64(len(s.data))
+		if free := uint64(cap(s.data) - len(s.data)); free > want.LargestFree {
+			want.LargestFree = free
+		}
+	}
+	assert.Equal(t, want, st)
+	s0, err := msg.Segment(0)
+	require.NoError(t, err)
+	assert.Equal(t, 24, cap(s0.data), "first segment capacity")
+	assert.Equal(t, 8, len(s0.data), "first segment should hold only the root pointer")
+	assert.Less(t, st.Used, st.Allocated)
+	assert.InDelta(t, float64(st.Used)/float64(st.Allocated), st.Utilization(), 1e-9)
+
+	assert.Equal(t, 0.0, ArenaStats{}.Utilization())
+}
+
 func TestAlloc(t *testing.T) {
 	t.Parallel()
 
@@ -589,6 +643,424 @@ func TestUnmarshal(t *testing.T) {
 	}
 }
 
+// flatVector is a message with a root struct {int64 = 42, text = "hi"}
+// in the layout written by capnp::messageToFlatArray.  It is built by
+// hand; TestFlatInterop checks the format against the C++ tool.
+var flatVector = []byte{
+	0x00, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, // 1 segment, 4 words
+	0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, // root: struct, 1 data word, 1 pointer
+	0x2a, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 42
+	0x01, 0x00, 0x00, 0x00, 0x1a, 0x00, 0x00, 0x00, // list of 3 bytes
+	'h', 'i', 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+func TestMarshalFlat(t *testing.T) {
+	t.Parallel()
+
+	msg, seg, err := NewMessage(SingleSegment(nil))
+	require.NoError(t, err)
+	root, err := NewRootStruct(seg, ObjectSize{DataSize: 8, PointerCount: 1})
+	require.NoError(t, err)
+	root.SetUint64(0, 42)
+	txt, err := NewText(seg, "hi")
+	require.NoError(t, err)
+	require.NoError(t, root.SetPtr(0, txt.ToPtr()))
+
+	out, err := msg.MarshalFlat()
+	require.NoError(t, err)
+	assert.Equal(t, flatVector, out)
+
+	msg2, err := UnmarshalFlat(out)
+	require.NoError(t, err)
+	p, err := msg2.Root()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(42), p.Struct().Uint64(0))
+	tp, err := p.Struct().Ptr(0)
+	require.NoError(t, err)
+	assert.Equal(t, "hi", tp.Text())
+
+	out2, err := msg2.MarshalFlat()
+	require.NoError(t, err)
+	assert.Equal(t, out, out2, "round trip changed encoding")
+}
+
+func TestMarshalFlat_MultiSegment(t *testing.T) {
+	t.Parallel()
+
+	msg := &Message{Arena: MultiSegment([][]byte{
+		make([]byte, 8),
+		make([]byte, 8),
+	})}
+	_, err := msg.MarshalFlat()
+	assert.Error(t, err)
+}
+
+func TestMarshalDeterministic(t *testing.T) {
+	t.Parallel()
+
+	// build constructs the same logical message in arena, optionally
+	// leaving an unreferenced object behind.
+	build := func(arena Arena, orphan bool) *Message {
+		msg, seg, err := NewMessage(arena)
+		require.NoError(t, err)
+		root, err := NewRootStruct(seg, ObjectSize{DataSize: 16, PointerCount: 3})
+		require.NoError(t, err)
+		if orphan {
+			_, err := NewText(seg, "garbage")
+			require.NoError(t, err)
+		}
+		root.SetUint64(0, 42)
+		require.NoError(t, root.SetNewText(0, "hello"))
+		l, err := NewCompositeList(seg, ObjectSize{DataSize: 8, PointerCount: 1}, 3)
+		require.NoError(t, err)
+		for i := 0; i < l.Len(); i++ {
+			e := l.Struct(i)
+			e.SetUint64(0, uint64(i))
+			require.NoError(t, e.SetData(0, []byte{byte(i), 0xff}))
+		}
+		require.NoError(t, root.SetPtr(1, l.ToPtr()))
+		require.NoError(t, root.SetPtr(2, NewInterface(seg, 7).ToPtr()))
+		return msg
+	}
+
+	want, err := build(SingleSegment(nil), false).MarshalDeterministic()
+	require.NoError(t, err)
+	again, err := build(SingleSegment(nil), false).MarshalDeterministic()
+	require.NoError(t, err)
+	assert.Equal(t, want, again, "same build sequence")
+
+	// The root struct does not fit in the first segment, but later
+	// small objects do, so the message uses far pointers.
+	multi := build(MultiSegment([][]byte{make([]byte, 0, 16)}), true)
+	plain, err := multi.Marshal()
+	require.NoError(t, err)
+	assert.NotEqual(t, want, plain, "Marshal of multi-segment message (test is not exercising layout differences)")
+	got, err := multi.MarshalDeterministic()
+	require.NoError(t, err)
+	assert.Equal(t, want, got, "multi-segment arena with orphaned object")
+
+	// The output is a single segment holding the same message.
+	msg, err := Unmarshal(got)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), msg.NumSegments())
+	p, err := msg.Root()
+	require.NoError(t, err)
+	root := p.Struct()
+	assert.Equal(t, ObjectSize{DataSize: 16, PointerCount: 3}, root.Size())
+	assert.Equal(t, uint64(42), root.Uint64(0))
+	tp, err := root.Ptr(0)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", tp.Text())
+	lp, err := root.Ptr(1)
+	require.NoError(t, err)
+	l := lp.List()
+	require.Equal(t, 3, l.Len())
+	for i := 0; i < l.Len(); i++ {
+		assert.Equal(t, uint64(i), l.Struct(i).Uint64(0))
+		dp, err := l.Struct(i).Ptr(0)
+		require.NoError(t, err)
+		assert.Equal(t, []byte{byte(i), 0xff}, dp.Data())
+	}
+	ip, err := root.Ptr(2)
+	require.NoError(t, err)
+	assert.Equal(t, CapabilityID(7), ip.Interface().Capability())
+}
+
+func TestMarshalDeterministic_NoRoot(t *testing.T) {
+	t.Parallel()
+
+	msg, _, err := NewMessage(SingleSegment(nil))
+	require.NoError(t, err)
+	out, err := msg.MarshalDeterministic()
+	require.NoError(t, err)
+	plain, err := msg.Marshal()
+	require.NoError(t, err)
+	assert.Equal(t, plain, out)
+}
+
+func TestSegmentData(t *testing.T) {
+	t.Parallel()
+
+	msg, seg, err := NewMessage(MultiSegment(nil))
+	require.NoError(t, err)
+	root, err := NewRootStruct(seg, ObjectSize{DataSize: 8})
+	require.NoError(t, err)
+	root.SetUint64(0, 0xdeadbeef)
+	s, err := NewStruct(seg, ObjectSize{DataSize: 2048})
+	require.NoError(t, err)
+	require.Equal(t, SegmentID(1), s.Segment().ID(), "second struct should not fit in segment 0")
+
+	assert.Equal(t, int64(2), msg.NumSegments())
+	var sizes []int
+	err = msg.ForEachSegment(func(id SegmentID, data []byte) error {
+		data2, err := msg.SegmentData(id)
+		require.NoError(t, err)
+		assert.Equal(t, data2, data, "segment %d", id)
+		sizes = append(sizes, len(data))
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []int{16, 2048}, sizes, "segment sizes")
+
+	data, err := msg.SegmentData(0)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0xdeadbeef), binary.LittleEndian.Uint64(data[8:]), "should alias root struct data")
+
+	_, err = msg.SegmentData(2)
+	assert.Error(t, err, "out of bounds segment")
+
+	stop := errors.New("stop")
+	calls := 0
+	err = msg.ForEachSegment(func(SegmentID, []byte) error {
+		calls++
+		return stop
+	})
+	assert.Equal(t, stop, err, "should return f's error")
+	assert.Equal(t, 1, calls, "should stop at f's error")
+}
+
+func TestFixedArena(t *testing.T) {
+	arena := NewFixedArena(make([]byte, 64))
+	text := make([]byte, 40)
+	build := func(textLen int) (*Message, error) {
+		msg, seg, err := NewMessage(arena)
+		if err != nil {
+			return nil, err
+		}
+		root, err := NewRootStruct(seg, ObjectSize{DataSize: 8, PointerCount: 1})
+		if err != nil {
+			return nil, err
+		}
+		root.SetUint64(0, 42)
+		txt, err := NewTextFromBytes(seg, text[:textLen])
+		if err != nil {
+			return nil, err
+		}
+		return msg, root.SetPtr(0, txt.ToPtr())
+	}
+
+	// 8 (root pointer) + 16 (struct) + 40 (text) = 64 bytes.
+	msg, err := build(39)
+	require.NoError(t, err, "message that fits")
+	data, err := msg.Marshal()
+	require.NoError(t, err)
+	msg, err = Unmarshal(data)
+	require.NoError(t, err)
+	root, err := msg.Root()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(42), root.Struct().Uint64(0))
+
+	_, err = build(40)
+	assert.ErrorIs(t, err, ErrArenaFull, "message that overflows")
+
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := build(39); err != nil {
+			t.Fatal(err)
+		}
+	})
+	assert.Equal(t, 1.0, allocs, "should only allocate the Message")
+}
+
+func TestNewMessageOnStack(t *testing.T) {
+	scratch := make([]byte, 64)
+	text := make([]byte, 200)
+	build := func(textLen int) (*Message, error) {
+		msg, seg, err := NewMessageOnStack(scratch[:0])
+		if err != nil {
+			return nil, err
+		}
+		root, err := NewRootStruct(seg, ObjectSize{DataSize: 8, PointerCount: 1})
+		if err != nil {
+			return nil, err
+		}
+		root.SetUint64(0, 42)
+		txt, err := NewTextFromBytes(seg, text[:textLen])
+		if err != nil {
+			return nil, err
+		}
+		return msg, root.SetPtr(0, txt.ToPtr())
+	}
+	check := func(msg *Message) {
+		t.Helper()
+		data, err := msg.Marshal()
+		require.NoError(t, err)
+		msg, err = Unmarshal(data)
+		require.NoError(t, err)
+		root, err := msg.Root()
+		require.NoError(t, err)
+		assert.Equal(t, uint64(42), root.Struct().Uint64(0))
+	}
+
+	// 8 (root pointer) + 16 (struct) + 40 (text) = 64 bytes.
+	msg, err := build(39)
+	require.NoError(t, err, "message that fits")
+	assert.Equal(t, int64(1), msg.NumSegments())
+	seg0, err := msg.SegmentData(0)
+	require.NoError(t, err)
+	assert.Same(t, &scratch[0], &seg0[0], "first segment should be scratch")
+	check(msg)
+
+	msg, err = build(199)
+	require.NoError(t, err, "message that overflows")
+	assert.Greater(t, msg.NumSegments(), int64(1), "should continue in a new segment")
+	seg0, err = msg.SegmentData(0)
+	require.NoError(t, err)
+	assert.Same(t, &scratch[0], &seg0[0], "first segment should still be scratch")
+	check(msg)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := build(39); err != nil {
+			t.Fatal(err)
+		}
+	})
+	assert.Equal(t, 1.0, allocs, "should only allocate the Message")
+
+	// Scratch space too small for the root pointer is not used.
+	msg, seg, err := NewMessageOnStack(nil)
+	require.NoError(t, err, "nil scratch")
+	_, err = NewRootStruct(seg, ObjectSize{DataSize: 8})
+	require.NoError(t, err)
+	root, err := msg.Root()
+	require.NoError(t, err)
+	assert.True(t, root.IsValid())
+}
+
+func TestUnmarshalFlat(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Empty", func(t *testing.T) {
+		t.Parallel()
+		_, err := UnmarshalFlat(nil)
+		assert.Equal(t, io.EOF, err)
+	})
+	t.Run("ShortHeader", func(t *testing.T) {
+		t.Parallel()
+		_, err := UnmarshalFlat(flatVector[:4])
+		assert.Error(t, err)
+	})
+	t.Run("ShortData", func(t *testing.T) {
+		t.Parallel()
+		_, err := UnmarshalFlat(flatVector[:len(flatVector)-8])
+		assert.Error(t, err)
+	})
+	t.Run("MultiSegment", func(t *testing.T) {
+		t.Parallel()
+		_, err := UnmarshalFlat([]byte{
+			0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+			0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		})
+		assert.Error(t, err)
+	})
+	t.Run("DoesNotGrowIntoTrailingData", func(t *testing.T) {
+		t.Parallel()
+		data := append(append([]byte(nil), flatVector...), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+		msg, err := UnmarshalFlat(data)
+		require.NoError(t, err)
+		seg, err := msg.Segment(0)
+		require.NoError(t, err)
+		_, err = NewStruct(seg, ObjectSize{DataSize: 8})
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, data[len(flatVector):])
+	})
+}
+
+// countingReaderAt records the ranges read from it.
+type countingReaderAt struct {
+	r     io.ReaderAt
+	reads [][2]int64 // offset and length
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.reads = append(c.reads, [2]int64{off, int64(len(p))})
+	return c.r.ReadAt(p, off)
+}
+
+func TestUnmarshalFromReaderAt(t *testing.T) {
+	t.Parallel()
+
+	// Place each text in its own segment, leaving room in the first
+	// segment for the landing pads of far pointers.
+	msg, seg, err := NewMessage(MultiSegment([][]byte{make([]byte, 0, 1024)}))
+	require.NoError(t, err)
+	root, err := NewRootStruct(seg, ObjectSize{PointerCount: 3})
+	require.NoError(t, err)
+	texts := []string{
+		strings.Repeat("a", 2000),
+		strings.Repeat("b", 5000),
+		strings.Repeat("c", 20000),
+	}
+	for i, txt := range texts {
+		require.NoError(t, root.SetNewText(uint16(i), txt))
+	}
+	require.Equal(t, int64(4), msg.NumSegments(), "test message should have one segment per text plus the root's")
+	data, err := msg.Marshal()
+	require.NoError(t, err)
+
+	hdrSize := streamHeaderSize(3)
+	segOffs := []int64{int64(hdrSize)}
+	for i := 0; i < 3; i++ {
+		d, err := msg.SegmentData(SegmentID(i))
+		require.NoError(t, err)
+		segOffs = append(segOffs, segOffs[i]+int64(len(d)))
+	}
+	readSegs := func(c *countingReaderAt) map[int]int {
+		m := make(map[int]int)
+		for _, r := range c.reads {
+			for i, off := range segOffs {
+				if r[0] == off {
+					m[i]++
+				}
+			}
+		}
+		return m
+	}
+
+	r := &countingReaderAt{r: bytes.NewReader(data)}
+	msg2, err := UnmarshalFromReaderAt(r, int64(len(data)))
+	require.NoError(t, err)
+	assert.Empty(t, readSegs(r), "no segments should be read before they are accessed")
+
+	p, err := msg2.Root()
+	require.NoError(t, err)
+	p, err = p.Struct().Ptr(1)
+	require.NoError(t, err)
+	assert.Equal(t, texts[1], p.Text())
+	p, err = msg2.Root()
+	require.NoError(t, err)
+	p, err = p.Struct().Ptr(1)
+	require.NoError(t, err)
+	assert.Equal(t, texts[1], p.Text())
+	assert.Equal(t, map[int]int{0: 1, 2: 1}, readSegs(r), "only the root's and text 1's segments should be read, once each")
+
+	var read int64
+	for _, rd := range r.reads {
+		read += rd[1]
+	}
+	assert.Less(t, read, int64(len(data))/2, "reading one text should not read the whole message")
+
+	seg2, err := msg2.Segment(0)
+	require.NoError(t, err)
+	_, err = NewStruct(seg2, ObjectSize{DataSize: 8})
+	assert.Error(t, err, "message should be read-only")
+}
+
+func TestUnmarshalFromReaderAt_Errors(t *testing.T) {
+	t.Parallel()
+
+	_, err := UnmarshalFromReaderAt(bytes.NewReader(nil), 0)
+	assert.Equal(t, io.EOF, err)
+	_, err = UnmarshalFromReaderAt(bytes.NewReader(flatVector[:4]), 4)
+	assert.Error(t, err, "short header")
+	_, err = UnmarshalFromReaderAt(bytes.NewReader(flatVector), int64(len(flatVector)-8))
+	assert.Error(t, err, "short data")
+	msg, err := UnmarshalFromReaderAt(bytes.NewReader(flatVector[:len(flatVector)-8]), int64(len(flatVector)))
+	require.NoError(t, err, "header fits, data is read lazily")
+	_, err = msg.Segment(0)
+	assert.Error(t, err, "truncated segment")
+}
+
 func TestWriteTo(t *testing.T) {
 	t.Parallel()
 
@@ -641,6 +1113,105 @@ func TestEncoder(t *testing.T) {
 	}
 }
 
+func TestEncoder_Allocs(t *testing.T) {
+	msg, seg, err := NewMessage(SingleSegment(nil))
+	require.NoError(t, err)
+	root, err := NewRootStruct(seg, ObjectSize{DataSize: 64, PointerCount: 1})
+	require.NoError(t, err)
+	root.SetUint64(0, 0xdeadbeef)
+	require.NoError(t, root.SetNewText(0, "hello, world"))
+
+	for _, packed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("packed=%t", packed), func(t *testing.T) {
+			enc := NewEncoder(io.Discard)
+			if packed {
+				enc = NewPackedEncoder(io.Discard)
+			}
+			// Warm up the scratch buffers.
+			require.NoError(t, enc.Encode(msg))
+			allocs := testing.AllocsPerRun(100, func() {
+				if err := enc.Encode(msg); err != nil {
+					t.Fatal(err)
+				}
+			})
+			assert.Zero(t, allocs, "Encode should not allocate after warm-up")
+		})
+	}
+}
+
+func TestEncoder_SetPacked(t *testing.T) {
+	msg, seg, err := NewMessage(SingleSegment(nil))
+	require.NoError(t, err)
+	root, err := NewRootStruct(seg, ObjectSize{DataSize: 64, PointerCount: 1})
+	require.NoError(t, err)
+	root.SetUint64(0, 0xdeadbeef)
+	require.NoError(t, root.SetNewText(0, "hello, world"))
+	unpacked, err := msg.Marshal()
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	assert.False(t, enc.Packed())
+	enc.SetPacked(true)
+	assert.True(t, enc.Packed())
+	require.NoError(t, enc.Encode(msg))
+	packedLen := buf.Len()
+	assert.Less(t, packedLen, len(unpacked), "packed message is not smaller")
+	enc.SetPacked(false)
+	require.NoError(t, enc.Encode(msg))
+	assert.Equal(t, unpacked, buf.Bytes()[packedLen:], "unpacked message after packed one")
+
+	m, err := NewPackedDecoder(bytes.NewReader(buf.Bytes()[:packedLen])).Decode()
+	require.NoError(t, err)
+	p, err := m.Root()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0xdeadbeef), p.Struct().Uint64(0))
+
+	// Once the buffers are warm, switching modes does not allocate.
+	enc = NewEncoder(io.Discard)
+	for _, packed := range []bool{true, false} {
+		enc.SetPacked(packed)
+		require.NoError(t, enc.Encode(msg))
+	}
+	packed := false
+	allocs := testing.AllocsPerRun(100, func() {
+		packed = !packed
+		enc.SetPacked(packed)
+		if err := enc.Encode(msg); err != nil {
+			t.Fatal(err)
+		}
+	})
+	assert.Zero(t, allocs, "Encode should not allocate after warm-up")
+}
+
+func TestEncoder_BufferLimit(t *testing.T) {
+	t.Parallel()
+
+	_, seg, err := NewMessage(SingleSegment(nil))
+	require.NoError(t, err)
+	root, err := NewRootStruct(seg, ObjectSize{DataSize: 4096})
+	require.NoError(t, err)
+	for off := DataOffset(0); off < 4096; off += 8 {
+		root.SetUint64(off, 0x0101010101010101) // incompressible
+	}
+
+	var buf bytes.Buffer
+	enc := NewPackedEncoder(&buf)
+	require.NoError(t, enc.Encode(seg.Message()))
+	assert.NotNil(t, enc.packbuf, "buffer retained without a limit")
+
+	enc.SetBufferLimit(16)
+	buf.Reset()
+	require.NoError(t, enc.Encode(seg.Message()))
+	assert.Nil(t, enc.packbuf, "buffer over limit should be discarded")
+
+	msg, err := NewPackedDecoder(&buf).Decode()
+	require.NoError(t, err, "output should still decode")
+	p, err := msg.Root()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0x0101010101010101), p.Struct().Uint64(4088))
+}
+
 func TestDecoder(t *testing.T) {
 	t.Parallel()
 
@@ -679,6 +1250,95 @@ func TestDecoder(t *testing.T) {
 	}
 }
 
+func TestDecoder_BytesRead(t *testing.T) {
+	t.Parallel()
+
+	// Two segments, so the header is padded.
+	msg1 := &Message{Arena: MultiSegment([][]byte{
+		{0, 0, 0, 0, 0, 0, 0, 0},
+		{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+	})}
+	b1, err := msg1.Marshal()
+	require.NoError(t, err)
+	msg2 := &Message{Arena: SingleSegment([]byte{0, 0, 0, 0, 0, 0, 0, 0})}
+	b2, err := msg2.Marshal()
+	require.NoError(t, err)
+
+	for _, reuse := range []bool{false, true} {
+		d := NewDecoder(bytes.NewReader(append(append([]byte(nil), b1...), b2...)))
+		if reuse {
+			d.ReuseBuffer()
+		}
+		assert.Zero(t, d.BytesRead(), "reuse=%t: before Decode", reuse)
+		_, err = d.Decode()
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(b1)), d.BytesRead(), "reuse=%t: after first Decode", reuse)
+		_, err = d.Decode()
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(b1)+len(b2)), d.BytesRead(), "reuse=%t: after second Decode", reuse)
+		_, err = d.Decode()
+		assert.Equal(t, io.EOF, err)
+		assert.Equal(t, int64(len(b1)+len(b2)), d.BytesRead(), "reuse=%t: at EOF", reuse)
+	}
+}
+
+func TestDecoder_DecodeInto(t *testing.T) {
+	const n = 150
+	var stream bytes.Buffer
+	enc := NewEncoder(&stream)
+	for i := 0; i < n; i++ {
+		msg, seg, err := NewMessage(SingleSegment(nil))
+		require.NoError(t, err)
+		root, err := NewRootStruct(seg, ObjectSize{DataSize: 8, PointerCount: 1})
+		require.NoError(t, err)
+		root.SetUint64(0, uint64(i))
+		require.NoError(t, root.SetText(0, fmt.Sprintf("message %d", i)))
+		require.NoError(t, enc.Encode(msg))
+	}
+
+	want := make([]string, n)
+	for i := range want {
+		want[i] = fmt.Sprintf("message %d", i)
+	}
+
+	d := NewDecoder(bytes.NewReader(stream.Bytes()))
+	msg := new(Message)
+	i := 0
+	check := func() {
+		// Formatting is deferred to failures to keep allocations out of
+		// the measured loop.
+		if err := d.DecodeInto(msg); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		p, err := msg.Root()
+		if err != nil {
+			t.Fatalf("message %d: root: %v", i, err)
+		}
+		root := p.Struct()
+		if root.Uint64(0) != uint64(i) {
+			t.Fatalf("message %d: field = %d", i, root.Uint64(0))
+		}
+		txt, err := root.Ptr(0)
+		if err != nil {
+			t.Fatalf("message %d: text: %v", i, err)
+		}
+		if txt.Text() != want[i] {
+			t.Fatalf("message %d: text = %q; want %q", i, txt.Text(), want[i])
+		}
+		i++
+	}
+	// Warm up the decoder's buffer.
+	for i < 10 {
+		check()
+	}
+	allocs := testing.AllocsPerRun(n-20, check)
+	assert.Zero(t, allocs, "decoding into a reused message")
+	for i < n {
+		check()
+	}
+	assert.Equal(t, io.EOF, d.DecodeInto(msg))
+}
+
 func TestDecoder_MaxMessageSize(t *testing.T) {
 	t.Parallel()
 
@@ -758,6 +1418,66 @@ func TestDecoder_MaxMessageSize(t *testing.T) {
 	}
 }
 
+func TestPackedDecoder_MaxMessageSize(t *testing.T) {
+	t.Parallel()
+
+	// Two messages at the limit: the limit applies to each message.
+	msg, seg, err := NewMessage(SingleSegment(nil))
+	require.NoError(t, err)
+	_, err = NewRootStruct(seg, ObjectSize{DataSize: 1024})
+	require.NoError(t, err)
+	b, err := msg.Marshal()
+	require.NoError(t, err)
+	maxSize := uint64(len(b))
+	var buf bytes.Buffer
+	enc := NewPackedEncoder(&buf)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, enc.Encode(msg))
+	}
+	data := buf.Bytes()
+	d := NewPackedDecoder(bytes.NewReader(data))
+	d.MaxMessageSize = maxSize
+	for i := 0; i < 2; i++ {
+		_, err := d.Decode()
+		assert.NoError(t, err, "message #%d", i)
+	}
+
+	d = NewPackedDecoder(bytes.NewReader(data))
+	d.MaxMessageSize = maxSize - 8
+	_, err = d.Decode()
+	assert.Error(t, err, "should reject message over limit")
+	assert.NotErrorIs(t, err, io.EOF)
+}
+
+func TestPackedDecoder_SharedReader(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	enc := NewPackedEncoder(&buf)
+	for i := 0; i < 2; i++ {
+		msg, seg, err := NewMessage(SingleSegment(nil))
+		require.NoError(t, err)
+		root, err := NewRootStruct(seg, ObjectSize{DataSize: 16, PointerCount: 1})
+		require.NoError(t, err)
+		root.SetUint64(0, uint64(i+1))
+		require.NoError(t, root.SetNewText(0, "message"))
+		require.NoError(t, enc.Encode(msg))
+	}
+	buf.WriteString("trailer")
+
+	br := bufio.NewReader(&buf)
+	for i := 0; i < 2; i++ {
+		msg, err := NewPackedDecoder(br).Decode()
+		require.NoError(t, err, "message #%d", i)
+		root, err := msg.Root()
+		require.NoError(t, err, "message #%d", i)
+		assert.Equal(t, uint64(i+1), root.Struct().Uint64(0), "message #%d", i)
+	}
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "trailer", string(rest), "decoders should leave the rest of the stream")
+}
+
 // TestStreamHeaderPadding is a regression test for
 // stream header padding.
 //
@@ -765,6 +1485,278 @@ func TestDecoder_MaxMessageSize(t *testing.T) {
 // this test ensures that the padding is explicitly
 // zeroed. This was not done in previous versions and
 // resulted in the padding being garbage.
+func TestDecoder_MaxSegments(t *testing.T) {
+	// Not parallel, so that other tests' allocations don't count.
+	t.Run("HugeCount", func(t *testing.T) {
+		// A header claiming four million segments, with nothing after it.
+		hdr := []byte{0x00, 0x09, 0x3d, 0x00, 0x01, 0x00, 0x00, 0x00}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := NewDecoder(bytes.NewReader(hdr)).Decode()
+		runtime.ReadMemStats(&after)
+		assert.ErrorIs(t, err, ErrTooManySegments)
+		assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20),
+			"decoder should not allocate a segment table before checking the count")
+
+		_, err = Unmarshal(hdr)
+		assert.ErrorIs(t, err, ErrTooManySegments)
+		_, err = UnmarshalFromReaderAt(bytes.NewReader(hdr), int64(len(hdr)))
+		assert.ErrorIs(t, err, ErrTooManySegments)
+	})
+	t.Run("Configured", func(t *testing.T) {
+		// Three empty segments.
+		msg := []byte{
+			0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		}
+		d := NewDecoder(bytes.NewReader(msg))
+		d.MaxSegments = 2
+		_, err := d.Decode()
+		assert.ErrorIs(t, err, ErrTooManySegments)
+
+		d = NewDecoder(bytes.NewReader(msg))
+		d.MaxSegments = 3
+		m, err := d.Decode()
+		require.NoError(t, err)
+		assert.Equal(t, int64(3), m.NumSegments())
+	})
+}
+
+// trickleReader returns at most one byte from each Read, and io.EOF
+// when it has no more bytes, like a non-blocking source that more data
+// can arrive on later.
+type trickleReader struct {
+	avail []byte
+}
+
+func (r *trickleReader) Read(p []byte) (int, error) {
+	if len(r.avail) == 0 {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	p[0] = r.avail[0]
+	r.avail = r.avail[1:]
+	return 1, nil
+}
+
+func TestDecoder_PeekHeaderAndSkip(t *testing.T) {
+	t.Parallel()
+
+	// Messages with 1, 2, 1 and 3 segments, each holding a text.
+	var msgs [][]byte
+	var words []uint64
+	for i, segs := range []int{1, 2, 1, 3} {
+		msg, seg, err := NewMessage(MultiSegment(nil))
+		require.NoError(t, err)
+		root, err := NewRootStruct(seg, ObjectSize{PointerCount: 3})
+		require.NoError(t, err)
+		for j := 1; j < segs; j++ {
+			// Too big for the current segment, so it goes in a new one.
+			big := strings.Repeat("x", 4096<<j)
+			require.NoError(t, root.SetText(uint16(j), big))
+		}
+		require.NoError(t, root.SetText(0, fmt.Sprintf("message %d", i)))
+		require.EqualValues(t, segs, msg.NumSegments())
+		data, err := msg.Marshal()
+		require.NoError(t, err)
+		msgs = append(msgs, data)
+		hdrSize := streamHeaderSize(SegmentID(segs - 1))
+		words = append(words, uint64(len(data)-int(hdrSize))/8)
+	}
+
+	check := func(t *testing.T, dec *Decoder) {
+		peek := func(i int) {
+			n, total, err := dec.PeekHeader()
+			require.NoError(t, err, "PeekHeader of message %d", i)
+			assert.Equal(t, int(msgs[i][0])+1, n, "segment count of message %d", i)
+			assert.Equal(t, words[i], total, "size of message %d", i)
+		}
+		decode := func(i int) {
+			msg, err := dec.Decode()
+			require.NoError(t, err, "Decode of message %d", i)
+			root, err := msg.Root()
+			require.NoError(t, err)
+			txt, err := root.Struct().Ptr(0)
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("message %d", i), txt.Text())
+		}
+
+		peek(0)
+		peek(0)
+		decode(0)
+		require.NoError(t, dec.Skip(), "Skip of message 1")
+		peek(2)
+		require.NoError(t, dec.Skip(), "Skip of message 2 after PeekHeader")
+		peek(3)
+		decode(3)
+		_, _, err := dec.PeekHeader()
+		assert.Equal(t, io.EOF, err, "PeekHeader at end of stream")
+		assert.Equal(t, io.EOF, dec.Skip(), "Skip at end of stream")
+	}
+
+	stream := bytes.Join(msgs, nil)
+	t.Run("Unpacked", func(t *testing.T) {
+		dec := NewDecoder(bytes.NewReader(stream))
+		check(t, dec)
+		assert.Equal(t, int64(len(stream)), dec.BytesRead())
+	})
+	t.Run("Packed", func(t *testing.T) {
+		var buf bytes.Buffer
+		enc := NewPackedEncoder(&buf)
+		for _, data := range msgs {
+			msg, err := Unmarshal(data)
+			require.NoError(t, err)
+			require.NoError(t, enc.Encode(msg))
+		}
+		check(t, NewPackedDecoder(&buf))
+	})
+	t.Run("Resumable", func(t *testing.T) {
+		dec := NewDecoder(bytes.NewReader(stream))
+		dec.SetResumable(true)
+		check(t, dec)
+	})
+}
+
+func TestDecoder_Resumable(t *testing.T) {
+	t.Parallel()
+
+	var tests []serializeTest
+	var stream []byte
+	for _, test := range serializeTests {
+		if !test.decodeFails && !test.encodeFails {
+			tests = append(tests, test)
+			stream = append(stream, test.out...)
+		}
+	}
+
+	for _, reuse := range []bool{false, true} {
+		r := new(trickleReader)
+		d := NewDecoder(r)
+		d.SetResumable(true)
+		if reuse {
+			d.ReuseBuffer()
+		}
+		rest := stream
+		for i, test := range tests {
+			// Feed the message one byte at a time.
+			var msg *Message
+			for j := range test.out {
+				r.avail = append(r.avail, rest[0])
+				rest = rest[1:]
+				var err error
+				msg, err = d.Decode()
+				if j < len(test.out)-1 {
+					require.ErrorIs(t, err, ErrShortRead, "reuse=%t, message %d after %d bytes", reuse, i, j+1)
+					continue
+				}
+				require.NoError(t, err, "reuse=%t, message %d", reuse, i)
+			}
+			assert.Equal(t, int64(len(stream)-len(rest)), d.BytesRead())
+			n := msg.NumSegments()
+			assert.Equal(t, int64(len(test.segs)), n, "reuse=%t, message %d", reuse, i)
+			for id := int64(0); id < n; id++ {
+				data, err := msg.SegmentData(SegmentID(id))
+				require.NoError(t, err)
+				assert.Equal(t, test.segs[id], data, "reuse=%t, message %d segment %d", reuse, i, id)
+			}
+		}
+		_, err := d.Decode()
+		assert.Equal(t, io.EOF, err, "reuse=%t: end of stream", reuse)
+	}
+}
+
+func TestDecoder_AutoPacking(t *testing.T) {
+	t.Parallel()
+
+	// Encode each message both ways, alternating the encodings.
+	var msgs []*Message
+	for i := 0; i < 3; i++ {
+		msg, seg, err := NewMessage(SingleSegment(nil))
+		require.NoError(t, err)
+		root, err := NewRootStruct(seg, ObjectSize{DataSize: 64, PointerCount: 1})
+		require.NoError(t, err)
+		root.SetUint64(0, uint64(i+1))
+		require.NoError(t, root.SetNewText(0, fmt.Sprintf("message %d", i)))
+		msgs = append(msgs, msg)
+	}
+	// The first segment only has room for the root pointer.
+	multi, seg, err := NewMessage(MultiSegment([][]byte{make([]byte, 0, 8)}))
+	require.NoError(t, err)
+	root, err := NewRootStruct(seg, ObjectSize{DataSize: 8})
+	require.NoError(t, err)
+	root.SetUint64(0, 99)
+	require.Equal(t, int64(2), multi.NumSegments())
+	msgs = append(msgs, multi)
+
+	var buf bytes.Buffer
+	enc, penc := NewEncoder(&buf), NewPackedEncoder(&buf)
+	var wantPacked []bool
+	for i, msg := range msgs {
+		for _, packed := range []bool{i%2 == 0, i%2 != 0} {
+			if packed {
+				require.NoError(t, penc.Encode(msg))
+			} else {
+				require.NoError(t, enc.Encode(msg))
+			}
+			wantPacked = append(wantPacked, packed)
+		}
+	}
+	data := buf.Bytes()
+
+	for _, mk := range []struct {
+		name string
+		new  func(io.Reader) *Decoder
+	}{
+		{"NewDecoder", NewDecoder},
+		{"NewPackedDecoder", NewPackedDecoder},
+	} {
+		d := mk.new(bytes.NewReader(data))
+		d.SetAutoPacking(true)
+		for i, packed := range wantPacked {
+			m, err := d.Decode()
+			require.NoError(t, err, "%s: message #%d (packed = %t)", mk.name, i, packed)
+			got, err := m.Marshal()
+			require.NoError(t, err)
+			want, err := msgs[i/2].Marshal()
+			require.NoError(t, err)
+			assert.Equal(t, want, got, "%s: message #%d (packed = %t)", mk.name, i, packed)
+		}
+		_, err := d.Decode()
+		assert.ErrorIs(t, err, io.EOF, mk.name)
+	}
+}
+
+func TestDecoder_AutoPackingOff(t *testing.T) {
+	t.Parallel()
+
+	msg, seg, err := NewMessage(SingleSegment(nil))
+	require.NoError(t, err)
+	root, err := NewRootStruct(seg, ObjectSize{DataSize: 8})
+	require.NoError(t, err)
+	root.SetUint64(0, 42)
+	var buf bytes.Buffer
+	require.NoError(t, NewPackedEncoder(&buf).Encode(msg))
+	require.NoError(t, NewEncoder(&buf).Encode(msg))
+
+	// Turning detection off returns to the constructor's encoding,
+	// without losing data that detection buffered.
+	d := NewDecoder(&buf)
+	d.SetAutoPacking(true)
+	m, err := d.Decode()
+	require.NoError(t, err)
+	p, err := m.Root()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(42), p.Struct().Uint64(0))
+	d.SetAutoPacking(false)
+	m, err = d.Decode()
+	require.NoError(t, err)
+	p, err = m.Root()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(42), p.Struct().Uint64(0))
+}
+
 func TestStreamHeaderPadding(t *testing.T) {
 	t.Parallel()
 
@@ -879,6 +1871,388 @@ func TestAddCap(t *testing.T) {
 	}
 }
 
+func TestMessage_SetRoot(t *testing.T) {
+	t.Parallel()
+
+	t.Run("List", func(t *testing.T) {
+		t.Parallel()
+
+		msg, seg, err := NewMessage(SingleSegment(nil))
+		require.NoError(t, err)
+		l, err := NewInt32ListFromSlice(seg, []int32{1, 2, 3})
+		require.NoError(t, err)
+		require.NoError(t, msg.SetRoot(l.ToPtr()))
+
+		data, err := msg.Marshal()
+		require.NoError(t, err)
+		msg, err = Unmarshal(data)
+		require.NoError(t, err)
+		p, err := msg.Root()
+		require.NoError(t, err)
+		got, err := p.AsList()
+		require.NoError(t, err)
+		assert.Equal(t, []int32{1, 2, 3}, Int32List(got).ToSlice())
+	})
+
+	t.Run("Interface", func(t *testing.T) {
+		t.Parallel()
+
+		msg, seg, err := NewMessage(SingleSegment(nil))
+		require.NoError(t, err)
+		require.NoError(t, msg.SetRoot(NewInterface(seg, 3).ToPtr()))
+		p, err := msg.Root()
+		require.NoError(t, err)
+		iface, err := p.AsInterface()
+		require.NoError(t, err)
+		assert.Equal(t, CapabilityID(3), iface.Capability())
+	})
+
+	t.Run("Null", func(t *testing.T) {
+		t.Parallel()
+
+		msg, seg, err := NewMessage(SingleSegment(nil))
+		require.NoError(t, err)
+		p, err := msg.Root()
+		require.NoError(t, err)
+		assert.False(t, p.IsValid(), "root of new message is not null")
+
+		_, err = NewRootStruct(seg, ObjectSize{DataSize: 8})
+		require.NoError(t, err)
+		require.NoError(t, msg.SetRoot(Ptr{}))
+		p, err = msg.Root()
+		require.NoError(t, err)
+		assert.False(t, p.IsValid(), "root is not null after SetRoot(Ptr{})")
+	})
+
+	t.Run("OtherMessage", func(t *testing.T) {
+		t.Parallel()
+
+		_, seg1, err := NewMessage(SingleSegment(nil))
+		require.NoError(t, err)
+		txt, err := NewText(seg1, "hello")
+		require.NoError(t, err)
+		msg2, _, err := NewMessage(SingleSegment(nil))
+		require.NoError(t, err)
+		require.NoError(t, msg2.SetRoot(txt.ToPtr()))
+		p, err := msg2.Root()
+		require.NoError(t, err)
+		assert.Same(t, msg2, p.Message(), "root is not in the message")
+		got, err := p.AsText()
+		require.NoError(t, err)
+		assert.Equal(t, "hello", got)
+	})
+}
+
+func TestMessage_SetReadOnly(t *testing.T) {
+	t.Parallel()
+
+	msg, seg, err := NewMessage(SingleSegment(nil))
+	require.NoError(t, err)
+	root, err := NewRootStruct(seg, ObjectSize{DataSize: 8, PointerCount: 1})
+	require.NoError(t, err)
+	root.SetUint64(0, 42)
+	require.NoError(t, root.SetText(0, "hello"))
+	data, err := msg.Marshal()
+	require.NoError(t, err)
+	want := append([]byte(nil), data...)
+
+	msg, err = Unmarshal(data)
+	require.NoError(t, err)
+	msg.SetReadOnly(true)
+	assert.True(t, msg.ReadOnly())
+	p, err := msg.Root()
+	require.NoError(t, err)
+	root = p.Struct()
+	seg = root.Segment()
+
+	assert.PanicsWithValue(t, ErrReadOnly, func() { root.SetUint64(0, 7) })
+	assert.ErrorIs(t, root.SetText(0, "bye"), ErrReadOnly)
+	assert.ErrorIs(t, root.SetPtr(0, Ptr{}), ErrReadOnly)
+	_, err = NewStruct(seg, ObjectSize{DataSize: 8})
+	assert.ErrorIs(t, err, ErrReadOnly)
+	assert.ErrorIs(t, msg.SetRoot(Ptr{}), ErrReadOnly)
+	assert.Equal(t, want, data, "read-only message's buffer was modified")
+	assert.Equal(t, uint64(42), root.Uint64(0))
+	txt, err := root.Ptr(0)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", txt.Text())
+
+	msg.SetReadOnly(false)
+	root.SetUint64(0, 7)
+	assert.Equal(t, uint64(7), root.Uint64(0))
+
+	msg, seg, err = NewMessage(SingleSegment(nil))
+	require.NoError(t, err)
+	bits, err := NewBitList(seg, 8)
+	require.NoError(t, err)
+	require.NoError(t, msg.SetRoot(bits.ToPtr()))
+	msg.SetReadOnly(true)
+	assert.PanicsWithValue(t, ErrReadOnly, func() { bits.Set(0, true) })
+	assert.False(t, bits.At(0))
+
+	msg, err = UnmarshalFromReaderAt(bytes.NewReader(want), int64(len(want)))
+	require.NoError(t, err)
+	assert.True(t, msg.ReadOnly(), "message from UnmarshalFromReaderAt is writable")
+
+	// Trim must not shrink a read-only struct in place.
+	msg, seg, err = NewMessage(SingleSegment(nil))
+	require.NoError(t, err)
+	root, err = NewRootStruct(seg, ObjectSize{DataSize: 16, PointerCount: 1})
+	require.NoError(t, err)
+	root.SetUint64(0, 42)
+	data, err = msg.Marshal()
+	require.NoError(t, err)
+	want = append([]byte(nil), data...)
+	msg, err = Unmarshal(data)
+	require.NoError(t, err)
+	msg.SetReadOnly(true)
+	p, err = msg.Root()
+	require.NoError(t, err)
+	_, err = p.Struct().Trim()
+	assert.ErrorIs(t, err, ErrReadOnly)
+	assert.Equal(t, want, data, "Trim modified a read-only message's buffer")
+	p, err = msg.Root()
+	require.NoError(t, err, "Root after Trim")
+	assert.Equal(t, uint64(42), p.Struct().Uint64(0))
+}
+
+func TestZeroingArena(t *testing.T) {
+	t.Parallel()
+
+	buf := make([]byte, 0, 1024)
+	var freed [][]byte
+	arena := NewZeroingArena(func(n int) []byte {
+		require.LessOrEqual(t, n, cap(buf), "allocation larger than test buffer")
+		return buf
+	}, func(b []byte) {
+		freed = append(freed, b)
+	})
+	msg, seg, err := NewMessage(arena)
+	require.NoError(t, err)
+	root, err := NewRootStruct(seg, ObjectSize{PointerCount: 1})
+	require.NoError(t, err)
+	require.NoError(t, root.SetText(0, "s3cret"))
+	require.True(t, bytes.Contains(buf[:cap(buf)], []byte("s3cret")))
+
+	msg.Reset(SingleSegment(nil))
+	assert.Equal(t, make([]byte, cap(buf)), buf[:cap(buf)], "segment not zeroed")
+	require.Len(t, freed, 1)
+	assert.Equal(t, cap(buf), cap(freed[0]))
+	assert.Zero(t, arena.NumSegments())
+}
+
+// releasingArena counts calls to Release.  Its type is not
+// comparable, because of the slice.
+type releasingArena struct {
+	segs     [][]byte
+	releases *int
+}
+
+func (ra releasingArena) Release() {
+	*ra.releases++
+}
+
+func (ra releasingArena) NumSegments() int64 {
+	return MultiSegment(ra.segs).NumSegments()
+}
+
+func (ra releasingArena) Data(id SegmentID) ([]byte, error) {
+	return MultiSegment(ra.segs).Data(id)
+}
+
+func (ra releasingArena) Allocate(sz Size, segs map[SegmentID]*Segment) (SegmentID, []byte, error) {
+	return MultiSegment(ra.segs).Allocate(sz, segs)
+}
+
+func TestMessage_ResetReleasesArena(t *testing.T) {
+	t.Parallel()
+
+	t.Run("ZeroingArena", func(t *testing.T) {
+		t.Parallel()
+
+		frees := 0
+		arena := NewZeroingArena(nil, func([]byte) { frees++ })
+		msg, _, err := NewMessage(arena)
+		require.NoError(t, err)
+		msg.Reset(arena)
+		assert.Zero(t, frees, "Reset to the same arena released it")
+		_, err = msg.Segment(0)
+		require.NoError(t, err)
+		msg.Reset(NewZeroingArena(nil, nil))
+		assert.Equal(t, 1, frees, "Reset to a different arena")
+	})
+	t.Run("Uncomparable", func(t *testing.T) {
+		t.Parallel()
+
+		releases := 0
+		msg, _, err := NewMessage(releasingArena{[][]byte{make([]byte, 0, 64)}, &releases})
+		require.NoError(t, err)
+		assert.NotPanics(t, func() {
+			msg.Reset(releasingArena{[][]byte{make([]byte, 0, 64)}, &releases})
+		})
+		assert.Equal(t, 1, releases, "Reset to a different arena")
+		msg.Reset(SingleSegment(nil))
+		assert.Equal(t, 2, releases, "Reset to a different arena type")
+	})
+}
+
+func TestStreamHeader(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		sizes  []Size
+		hdrLen int
+	}{
+		{[]Size{8}, 8},
+		{[]Size{16, 8}, 16},
+		{[]Size{8, 0, 24}, 16},
+	}
+	for _, test := range tests {
+		hdr := EncodeStreamHeader([]byte{0xff}, test.sizes)
+		require.Equal(t, byte(0xff), hdr[0], "EncodeStreamHeader(%v) overwrote dst", test.sizes)
+		hdr = hdr[1:]
+		assert.Len(t, hdr, test.hdrLen, "EncodeStreamHeader(%v)", test.sizes)
+		if len(test.sizes)%2 == 0 {
+			assert.Equal(t, []byte{0, 0, 0, 0}, hdr[len(hdr)-4:], "padding of EncodeStreamHeader(%v)", test.sizes)
+		}
+
+		sizes, n, err := DecodeStreamHeader(hdr)
+		require.NoError(t, err, "DecodeStreamHeader(%v)", test.sizes)
+		assert.Equal(t, test.sizes, sizes)
+		assert.Equal(t, test.hdrLen, n)
+
+		// The header frames segments for Unmarshal.
+		var total Size
+		for _, sz := range test.sizes {
+			total += sz
+		}
+		_, err = Unmarshal(append(hdr, make([]byte, total)...))
+		assert.NoError(t, err, "Unmarshal of framed %v", test.sizes)
+	}
+
+	_, _, err := DecodeStreamHeader([]byte{1, 0, 0, 0, 1, 0, 0, 0})
+	assert.Error(t, err, "DecodeStreamHeader of truncated two-segment table")
+	assert.Panics(t, func() { EncodeStreamHeader(nil, []Size{7}) })
+}
+
+func TestCopyCapTable(t *testing.T) {
+	t.Parallel()
+
+	hook1 := new(dummyHook)
+	hook2 := new(dummyHook)
+	src, seg, err := NewMessage(SingleSegment(nil))
+	require.NoError(t, err)
+	root, err := NewRootStruct(seg, ObjectSize{PointerCount: 2})
+	require.NoError(t, err)
+	for i, h := range []*dummyHook{hook1, hook2} {
+		id := src.AddCap(NewClient(h))
+		require.NoError(t, root.SetPtr(uint16(i), NewInterface(seg, id).ToPtr()))
+	}
+
+	// Copy by CopyFrom, which builds its own table.
+	_, seg1, err := NewMessage(SingleSegment(nil))
+	require.NoError(t, err)
+	copied, err := NewRootStruct(seg1, root.Size())
+	require.NoError(t, err)
+	require.NoError(t, copied.CopyFrom(root))
+
+	// Copy the bytes, then the table.
+	data, err := src.Marshal()
+	require.NoError(t, err)
+	unmarshaled, err := Unmarshal(data)
+	require.NoError(t, err)
+	CopyCapTable(unmarshaled, src)
+	p, err := unmarshaled.Root()
+	require.NoError(t, err)
+
+	src.ReleaseCaps()
+	assert.Zero(t, hook1.shutdowns, "hook1 shut down after releasing source")
+	assert.Zero(t, hook2.shutdowns, "hook2 shut down after releasing source")
+
+	for _, s := range []Struct{copied, p.Struct()} {
+		for i := uint16(0); i < 2; i++ {
+			ptr, err := s.Ptr(i)
+			require.NoError(t, err)
+			ans, release := ptr.Interface().Client().SendCall(context.Background(), Send{})
+			_, err = ans.Struct()
+			release()
+			assert.NoError(t, err, "call through copied capability %d", i)
+		}
+	}
+	assert.Equal(t, 2, hook1.calls)
+	assert.Equal(t, 2, hook2.calls)
+
+	seg1.Message().ReleaseCaps()
+	unmarshaled.ReleaseCaps()
+	assert.Equal(t, 1, hook1.shutdowns)
+	assert.Equal(t, 1, hook2.shutdowns)
+}
+
+func TestReleaseCaps(t *testing.T) {
+	t.Parallel()
+
+	hooks := []*dummyHook{new(dummyHook), new(dummyHook), new(dummyHook)}
+	msg, seg, err := NewMessage(SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := NewRootStruct(seg, ObjectSize{PointerCount: uint16(len(hooks))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, h := range hooks {
+		iface := NewInterface(seg, msg.AddCap(NewClient(h)))
+		if err := root.SetPtr(uint16(i), iface.ToPtr()); err != nil {
+			t.Fatalf("SetPtr(%d): %v", i, err)
+		}
+	}
+
+	// Decode the message and hand it the capability table, as a
+	// transport would.
+	data, err := msg.Marshal()
+	if err != nil {
+		t.Fatal("Marshal:", err)
+	}
+	msg2, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal("Unmarshal:", err)
+	}
+	msg2.CapTable = msg.CapTable
+	msg.CapTable = nil
+	root2, err := msg2.Root()
+	if err != nil {
+		t.Fatal("Root:", err)
+	}
+	p, err := root2.Struct().Ptr(1)
+	if err != nil {
+		t.Fatal("Ptr(1):", err)
+	}
+	if c := p.Interface().Client(); !c.IsValid() {
+		t.Error("decoded capability pointer is null before ReleaseCaps")
+	}
+
+	msg2.ReleaseCaps()
+	for i, h := range hooks {
+		if h.shutdowns != 1 {
+			t.Errorf("hook %d shut down %d times; want 1", i, h.shutdowns)
+		}
+	}
+	if len(msg2.CapTable) != 0 {
+		t.Errorf("len(CapTable) = %d after ReleaseCaps; want 0", len(msg2.CapTable))
+	}
+	if c := p.Interface().Client(); c.IsValid() {
+		t.Error("capability pointer refers to a client after ReleaseCaps")
+	}
+
+	// Releasing again is a no-op.
+	msg2.ReleaseCaps()
+	for i, h := range hooks {
+		if h.shutdowns != 1 {
+			t.Errorf("hook %d shut down %d times after second ReleaseCaps; want 1", i, h.shutdowns)
+		}
+	}
+}
+
 func TestFirstSegmentMessage_SingleSegment(t *testing.T) {
 	t.Parallel()
 
@@ -0,0 +1,72 @@
+package packed
+
+import (
+	"bufio"
+	"context"
+	"io"
+)
+
+// contextCheckBytes is how much input PackContext and UnpackContext
+// process between checks of their context.
+const contextCheckBytes = 64 * 1024
+
+// PackContext is like Pack, but checks ctx periodically while packing a
+// large src.  If ctx is done before src is fully packed, PackContext
+// returns the partially packed output along with ctx.Err().  len(src)
+// must be a multiple of 8 or PackContext panics.
+func PackContext(ctx context.Context, dst, src []byte) ([]byte, error) {
+	if len(src)%wordSize != 0 {
+		panic("packed.PackContext len(src) must be a multiple of 8")
+	}
+	for len(src) > 0 {
+		if err := ctx.Err(); err != nil {
+			return dst, err
+		}
+		dst, src = pack(dst, src, contextCheckBytes)
+	}
+	return dst, nil
+}
+
+// UnpackContext is like Unpack, but checks ctx periodically while
+// unpacking a large src.  If ctx is done before src is fully unpacked,
+// UnpackContext returns the partially unpacked output along with
+// ctx.Err().
+func UnpackContext(ctx context.Context, dst, src []byte) ([]byte, error) {
+	for len(src) > 0 {
+		if err := ctx.Err(); err != nil {
+			return dst, err
+		}
+		var err error
+		dst, src, err = unpack(dst, src, contextCheckBytes)
+		if err != nil {
+			return dst, err
+		}
+	}
+	return dst, nil
+}
+
+// NewReaderContext returns a reader that decompresses a packed stream
+// from r, like NewReader, but stops reading once ctx is done: Read and
+// ReadWord then return ctx.Err().
+//
+// The context is checked before each read from r, so cancelling it does
+// not interrupt a read from r that is already blocked; Read returns
+// once that read does.  To unblock a stalled network connection, also
+// set a deadline on the connection or close it.
+func NewReaderContext(ctx context.Context, r io.Reader) *Reader {
+	return NewReader(bufio.NewReader(contextReader{ctx, r}))
+}
+
+// contextReader is an io.Reader that fails with its context's error
+// once the context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
@@ -0,0 +1,93 @@
+package packed
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// defaultMaxFrameSize is the largest frame that a FrameReader will
+// read if FrameReader.MaxFrameSize is not set.
+const defaultMaxFrameSize = 64 << 20
+
+// A FrameWriter writes a sequence of independently packed messages to
+// a stream.  Each message is packed and prefixed with the length of its
+// packed form as a uvarint, so that a FrameReader can read the messages
+// back one at a time.  This differs from Writer, whose output is a
+// single packed stream with no boundaries between writes.
+type FrameWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewFrameWriter returns a FrameWriter that writes frames to w.
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{w: w}
+}
+
+// Write packs b as a single frame and writes it to the underlying
+// writer.  len(b) must be a multiple of 8 or Write panics.  On success,
+// Write returns len(b).
+func (fw *FrameWriter) Write(b []byte) (int, error) {
+	if len(b)%wordSize != 0 {
+		panic("packed.FrameWriter.Write len(b) must be a multiple of 8")
+	}
+	// Reserve space for the largest possible length prefix, then move
+	// the actual prefix to sit right before the packed data.
+	fw.buf = append(fw.buf[:0], make([]byte, binary.MaxVarintLen64)...)
+	fw.buf = Pack(fw.buf, b)
+	n := len(fw.buf) - binary.MaxVarintLen64
+	var hdr [binary.MaxVarintLen64]byte
+	hn := binary.PutUvarint(hdr[:], uint64(n))
+	start := binary.MaxVarintLen64 - hn
+	copy(fw.buf[start:], hdr[:hn])
+	if _, err := fw.w.Write(fw.buf[start:]); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// A FrameReader reads a sequence of packed messages written by a
+// FrameWriter.
+type FrameReader struct {
+	rd *bufio.Reader
+
+	// MaxFrameSize is the largest packed frame, in bytes, that Next
+	// will read.  If not set, a reasonable default is used.
+	MaxFrameSize uint64
+}
+
+// NewFrameReader returns a FrameReader that reads frames from r.
+func NewFrameReader(r *bufio.Reader) *FrameReader {
+	return &FrameReader{rd: r}
+}
+
+// Next reads the next frame and returns its packed bytes, which may be
+// passed to Unpack.  Next returns io.EOF if the stream ends cleanly
+// between frames and ErrTruncated if it ends in the middle of a frame.
+func (fr *FrameReader) Next() ([]byte, error) {
+	n, err := binary.ReadUvarint(fr.rd)
+	if err == io.EOF {
+		return nil, io.EOF
+	} else if errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, ErrTruncated
+	} else if err != nil {
+		return nil, fmt.Errorf("packed: read frame length: %w", err)
+	}
+	max := fr.MaxFrameSize
+	if max == 0 {
+		max = defaultMaxFrameSize
+	}
+	if n > max {
+		return nil, fmt.Errorf("%w: frame of %d bytes exceeds limit of %d bytes", ErrTooLarge, n, max)
+	}
+	buf := make([]byte, int(n))
+	if _, err := io.ReadFull(fr.rd, buf); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, ErrTruncated
+	} else if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,85 @@
+package packed
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// maxExpansion is the most that a byte of packed input can unpack to:
+// a zero tag and a run count of 255 take two bytes and unpack to 256
+// words.
+const maxExpansion = 256 * wordSize / 2
+
+// addFuzzSeeds adds the packed test vectors and the go-fuzz corpus to f.
+func addFuzzSeeds(f *testing.F) {
+	for _, test := range compressionTests {
+		f.Add(test.compressed)
+	}
+	for _, test := range decompressionTests {
+		f.Add(test.compressed)
+	}
+	for _, test := range badDecompressionTests {
+		f.Add(test.input)
+	}
+	files, err := filepath.Glob(filepath.Join("testdata", "corpus", "*"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+}
+
+func FuzzUnpack(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		unpacked, err := Unpack(nil, data)
+		if max := maxExpansion*len(data) + wordSize; len(unpacked) > max {
+			t.Fatalf("Unpack of %d bytes produced %d bytes; want at most %d", len(data), len(unpacked), max)
+		}
+
+		r := NewReader(bufio.NewReader(bytes.NewReader(data)))
+		read, rerr := io.ReadAll(r)
+		if (err == nil) != (rerr == nil) {
+			t.Fatalf("Unpack error = %v; Reader error = %v", err, rerr)
+		}
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(unpacked, read) {
+			t.Fatalf("Unpack = %x; Reader = %x", unpacked, read)
+		}
+		unpacked2, err := Unpack(nil, Pack(nil, unpacked))
+		if err != nil {
+			t.Fatal("repacked data does not unpack:", err)
+		}
+		if !bytes.Equal(unpacked, unpacked2) {
+			t.Fatalf("unpack, pack, unpack = %x; want %x", unpacked2, unpacked)
+		}
+	})
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	for _, test := range compressionTests {
+		f.Add(test.original)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		data = data[:len(data)&^(wordSize-1)]
+		packed := Pack(nil, data)
+		unpacked, err := Unpack(nil, packed)
+		if err != nil {
+			t.Fatalf("Unpack(Pack(%x)): %v", data, err)
+		}
+		if !bytes.Equal(unpacked, data) {
+			t.Fatalf("Unpack(Pack(%x)) = %x", data, unpacked)
+		}
+	})
+}
@@ -4,12 +4,33 @@ package packed
 
 import (
 	"bufio"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"math/bits"
 )
 
 const wordSize = 8
 
+// Errors returned while decoding packed data.  They may be wrapped, so
+// compare with errors.Is.
+//
+// There is no error for an invalid tag: every tag byte has a meaning in
+// the packed encoding, so a corrupt tag is only detected if it makes the
+// stream end early, which is reported as ErrTruncated.  Otherwise it
+// yields unpacked data that may then fail to decode as a message.
+var (
+	// ErrTruncated is returned by Unpack and Reader when the packed
+	// stream ends in the middle of a word or run.  It wraps
+	// io.ErrUnexpectedEOF.
+	ErrTruncated = fmt.Errorf("packed: truncated stream: %w", io.ErrUnexpectedEOF)
+
+	// ErrTooLarge is returned when packed data exceeds a configured size
+	// limit, such as FrameReader.MaxFrameSize or a Reader's read limit.
+	ErrTooLarge = errors.New("packed: data too large")
+)
+
 // Special case tags.
 const (
 	zeroTag     byte = 0x00
@@ -17,24 +38,41 @@ const (
 )
 
 // Pack appends the packed version of src to dst and returns the
-// resulting slice.  len(src) must be a multiple of 8 or Pack panics.
+// resulting slice.  Like the built-in append, Pack leaves the first
+// len(dst) bytes intact and only reallocates if dst lacks capacity, so
+// callers may reserve room for a header before the packed data.
+// len(src) must be a multiple of 8 or Pack panics.
 func Pack(dst, src []byte) []byte {
 	if len(src)%wordSize != 0 {
 		panic("packed.Pack len(src) must be a multiple of 8")
 	}
+	dst, _ = pack(dst, src, len(src))
+	return dst
+}
+
+// pack appends the packed version of a prefix of src to dst, stopping
+// after the first token that reaches limit or more bytes into src.  It
+// returns the resulting slice and the rest of src, which may be packed
+// by a later call to pack with the same result as packing src at once.
+func pack(dst, src []byte, limit int) ([]byte, []byte) {
 	var buf [wordSize]byte
-	for len(src) > 0 {
-		var hdr byte
-		n := 0
-		for i := uint(0); i < wordSize; i++ {
-			if src[i] != 0 {
-				hdr |= 1 << i
-				buf[n] = src[i]
-				n++
+	for stop := len(src) - limit; len(src) > 0 && len(src) > stop; {
+		hdr := ZeroByteMask(binary.LittleEndian.Uint64(src))
+		dst = append(dst, hdr)
+		switch hdr {
+		case zeroTag:
+		case unpackedTag:
+			dst = append(dst, src[:wordSize]...)
+		default:
+			n := 0
+			for i := uint(0); i < wordSize; i++ {
+				if hdr&(1<<i) != 0 {
+					buf[n] = src[i]
+					n++
+				}
 			}
+			dst = append(dst, buf[:n]...)
 		}
-		dst = append(dst, hdr)
-		dst = append(dst, buf[:n]...)
 		src = src[wordSize:]
 
 		switch hdr {
@@ -43,19 +81,13 @@ func Pack(dst, src []byte) []byte {
 			dst = append(dst, byte(z))
 			src = src[z*wordSize:]
 		case unpackedTag:
+			// Extend the literal run over the following words with at
+			// most one zero byte, which would not pack any smaller.
+			// Checking a word at a time keeps incompressible data, like
+			// an embedded image, cheap to scan.
 			i := 0
 			end := min(len(src), 0xff*wordSize)
-			for i < end {
-				zeros := 0
-				for _, b := range src[i : i+wordSize] {
-					if b == 0 {
-						zeros++
-					}
-				}
-
-				if zeros > 1 {
-					break
-				}
+			for i < end && PopcountTag(ZeroByteMask(binary.LittleEndian.Uint64(src[i:]))) >= wordSize-1 {
 				i += wordSize
 			}
 
@@ -65,7 +97,30 @@ func Pack(dst, src []byte) []byte {
 			src = src[i:]
 		}
 	}
-	return dst
+	return dst, src
+}
+
+// ZeroByteMask returns the packed tag byte for a word read in little-
+// endian order: bit i is set if byte i of the word is not zero.  The
+// word's nonzero bytes follow the tag in the packed encoding, so a tag
+// of 0x00 or 0xff begins a run of zero or literal words.
+func ZeroByteMask(word uint64) byte {
+	const low7 = 0x7f7f7f7f7f7f7f7f
+	// Adding low7 to the low seven bits of a byte sets its high bit
+	// unless they are all zero, and never carries into the next byte.
+	// Or-ing in the byte itself then sets the high bit of each nonzero
+	// byte.
+	nonzero := (word&low7 + low7 | word) &^ low7
+	// Move the high bit of byte i to bit 56+i, where no other product
+	// of the multiplication lands, and take the top byte.
+	return byte((nonzero >> 7) * 0x0102040810204080 >> 56)
+}
+
+// PopcountTag returns the number of bits set in a packed tag byte,
+// which is the number of nonzero bytes in its word and thus the number
+// of bytes that follow the tag.
+func PopcountTag(tag byte) int {
+	return bits.OnesCount8(tag)
 }
 
 // numZeroWords returns the number of leading zero words in b.
@@ -79,11 +134,112 @@ func numZeroWords(b []byte) int {
 }
 
 // Unpack appends the unpacked version of src to dst and returns the
-// resulting slice.
+// resulting slice.  If src ends in the middle of a token, Unpack returns
+// the words decoded so far and ErrTruncated.
 func Unpack(dst, src []byte) ([]byte, error) {
+	dst, _, err := unpack(dst, src, len(src))
+	return dst, err
+}
+
+// UnpackedSize returns the number of bytes that Unpack would append
+// when unpacking src, without unpacking it, so that the destination can
+// be allocated once.  For malformed src, it returns the same error as
+// Unpack, along with the length of the partial output that Unpack
+// would return.  If the size does not fit in an int, UnpackedSize
+// returns ErrTooLarge.
+func UnpackedSize(src []byte) (int, error) {
+	const maxInt = int(^uint(0) >> 1)
+	size := 0
+	for len(src) > 0 {
+		tag := src[0]
+		src = src[1:]
+		if size > maxInt-wordSize {
+			return 0, ErrTooLarge
+		}
+		size += wordSize // the tag's word, which Unpack appends first
+		n := bits.OnesCount8(tag)
+		if len(src) < n {
+			return size, ErrTruncated
+		}
+		src = src[n:]
+		if tag != zeroTag && tag != unpackedTag {
+			continue
+		}
+		if len(src) == 0 {
+			return size, ErrTruncated
+		}
+		run := int(src[0])
+		src = src[1:]
+		if size > maxInt-run*wordSize {
+			return 0, ErrTooLarge
+		}
+		if tag == unpackedTag && len(src) < run*wordSize {
+			// Unpack keeps the whole words of a short literal run.
+			return size + len(src)&^(wordSize-1), ErrTruncated
+		}
+		size += run * wordSize
+		if tag == unpackedTag {
+			src = src[run*wordSize:]
+		}
+	}
+	return size, nil
+}
+
+// ScanPacked calls fn for each token in the packed stream src, in
+// order, without unpacking it.  tag is the token's tag byte and literal
+// holds the bytes that follow it for the tag's own word: its nonzero
+// bytes, in order, or all eight bytes for a tag of 0xff.  For a tag of
+// 0x00, zeroRun is the number of zero words that follow the tag's word;
+// for a tag of 0xff, copyRun is the number of words copied verbatim
+// after it.  Both are zero for other tags.  literal aliases src and must
+// not be retained after fn returns.
+//
+// If fn returns an error, ScanPacked stops and returns it.  If src ends
+// in the middle of a token, ScanPacked returns ErrTruncated without
+// calling fn for that token.
+func ScanPacked(src []byte, fn func(tag byte, literal []byte, zeroRun, copyRun int) error) error {
 	for len(src) > 0 {
 		tag := src[0]
 		src = src[1:]
+		n := bits.OnesCount8(tag)
+		if len(src) < n {
+			return ErrTruncated
+		}
+		literal := src[:n:n]
+		src = src[n:]
+		var zeroRun, copyRun int
+		switch tag {
+		case zeroTag:
+			if len(src) == 0 {
+				return ErrTruncated
+			}
+			zeroRun = int(src[0])
+			src = src[1:]
+		case unpackedTag:
+			if len(src) == 0 {
+				return ErrTruncated
+			}
+			copyRun = int(src[0])
+			src = src[1:]
+			if len(src) < copyRun*wordSize {
+				return ErrTruncated
+			}
+			src = src[copyRun*wordSize:]
+		}
+		if err := fn(tag, literal, zeroRun, copyRun); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unpack appends the unpacked version of a prefix of src to dst,
+// stopping after the first token that reaches limit or more bytes into src.
+// It returns the resulting slice and the rest of src.
+func unpack(dst, src []byte, limit int) ([]byte, []byte, error) {
+	for stop := len(src) - limit; len(src) > 0 && len(src) > stop; {
+		tag := src[0]
+		src = src[1:]
 
 		pstart := len(dst)
 		dst = allocWords(dst, 1)
@@ -121,7 +277,7 @@ func Unpack(dst, src []byte) ([]byte, error) {
 					continue
 				}
 				if len(src) == 0 {
-					return dst, io.ErrUnexpectedEOF
+					return dst, src, ErrTruncated
 				}
 				p[i] = src[0]
 				src = src[1:]
@@ -130,22 +286,76 @@ func Unpack(dst, src []byte) ([]byte, error) {
 		switch tag {
 		case zeroTag:
 			if len(src) == 0 {
-				return dst, io.ErrUnexpectedEOF
+				return dst, src, ErrTruncated
 			}
-			dst = allocWords(dst, int(src[0]))
+			dst = append(dst, zeroWords[:int(src[0])*wordSize]...)
 			src = src[1:]
 		case unpackedTag:
 			if len(src) == 0 {
-				return dst, io.ErrUnexpectedEOF
+				return dst, src, ErrTruncated
 			}
 			start := len(dst)
 			dst = allocWords(dst, int(src[0]))
 			src = src[1:]
 			n := copy(dst[start:], src)
 			src = src[n:]
+			if start+n < len(dst) {
+				// Literal run is shorter than its count.
+				return dst[:start+(n&^(wordSize-1))], src, ErrTruncated
+			}
 		}
 	}
-	return dst, nil
+	return dst, src, nil
+}
+
+// maxStreamSegments is the largest segment count (minus one) that the
+// capnp package accepts in a stream header by default.
+const maxStreamSegments = 511
+
+// IsLikelyPacked reports whether prefix, the first bytes of a
+// serialized Cap'n Proto message, looks like the packed encoding
+// rather than the standard (unpacked) stream encoding.  At least the
+// first 9 bytes should be given for an accurate answer.
+//
+// The heuristic interprets prefix both ways and checks whether the
+// first word is a plausible stream header: a small segment count
+// followed by a non-zero first segment size.  An unpacked header's low
+// bytes are usually zero, which as a packed tag would denote an empty
+// message, whereas a packed header starts with a tag byte that, read as
+// a segment count, is usually implausibly large.  This is a best-effort
+// guess: it can be fooled by unusual messages (e.g. ones with hundreds
+// of segments), and it returns false when prefix is ambiguous or
+// matches neither encoding.
+func IsLikelyPacked(prefix []byte) bool {
+	unpackedOK := len(prefix) >= wordSize && isPlausibleHeader(prefix[:wordSize])
+	if unpackedOK || len(prefix) == 0 {
+		return false
+	}
+	var word [wordSize]byte
+	tag := prefix[0]
+	src := prefix[1:]
+	for i := uint(0); i < wordSize; i++ {
+		if tag&(1<<i) == 0 {
+			continue
+		}
+		if len(src) == 0 {
+			// Not enough data to tell, but a partial header that is
+			// not unpacked can only be useful as packed.
+			return len(prefix) < wordSize
+		}
+		word[i] = src[0]
+		src = src[1:]
+	}
+	return isPlausibleHeader(word[:])
+}
+
+// isPlausibleHeader reports whether w, the first word of an unpacked
+// stream, could be a valid stream header.
+func isPlausibleHeader(w []byte) bool {
+	maxSeg := binary.LittleEndian.Uint32(w)
+	firstSize := binary.LittleEndian.Uint32(w[4:])
+	// The first segment must hold at least the root pointer.
+	return maxSeg <= maxStreamSegments && firstSize > 0
 }
 
 func allocWords(p []byte, n int) []byte {
@@ -186,11 +396,63 @@ type Reader struct {
 	// Read state
 	word    [wordSize]byte
 	wordIdx int
+
+	decoded int64 // bytes in words fully decoded so far
+	limit   int64 // value of decoded at which to stop, or -1 for none
+
+	wordAligned bool
+}
+
+// ReaderOptions configures a Reader created by NewReaderWithOptions.
+type ReaderOptions struct {
+	// WordAligned makes every Read end on a word boundary of the
+	// decompressed stream.  When p holds at least a word, Read fills
+	// only as much of p as holds whole words, so the count it returns
+	// is a multiple of 8.  A shorter p is filled from a word that the
+	// Reader decodes into an internal buffer, and subsequent calls to
+	// Read return the rest of that word, and nothing more, before
+	// moving on to the next one.
+	WordAligned bool
 }
 
 // NewReader returns a reader that decompresses a packed stream from r.
 func NewReader(r *bufio.Reader) *Reader {
-	return &Reader{rd: r, wordIdx: wordSize}
+	return &Reader{rd: r, wordIdx: wordSize, limit: -1}
+}
+
+// NewReaderWithOptions is like NewReader, but configured by opts.
+func NewReaderWithOptions(r *bufio.Reader, opts ReaderOptions) *Reader {
+	rd := NewReader(r)
+	rd.wordAligned = opts.WordAligned
+	return rd
+}
+
+// SetReadLimit limits the reader to decompressing n more bytes, after
+// which Read and ReadWord return ErrTooLarge.  The limit is counted in
+// whole words, so it is effectively rounded down to a multiple of 8.
+// Bytes of a word that was already decompressed by an earlier call to
+// Read do not count against it.  A negative n removes the limit.
+func (r *Reader) SetReadLimit(n int64) {
+	if n < 0 {
+		r.limit = -1
+		return
+	}
+	r.limit = r.decoded + n
+	if r.limit < 0 {
+		// Overflow: the limit is unreachable.
+		r.limit = -1
+	}
+}
+
+// zeroWords is the longest run of zero words that a single zero tag
+// can encode.
+var zeroWords [255 * wordSize]byte
+
+func min64(a, b int64) int64 {
+	if b < a {
+		return b
+	}
+	return a
 }
 
 func min(a, b int) int {
@@ -200,18 +462,36 @@ func min(a, b int) int {
 	return a
 }
 
+// BytesDecoded returns the number of bytes in the words that have been
+// fully decompressed from the underlying stream so far.  It is always a
+// multiple of 8.  After a decoding error, such as ErrTruncated, it
+// reports how much of the stream was recovered before the error.
+func (r *Reader) BytesDecoded() int64 {
+	return r.decoded
+}
+
 // ReadWord decompresses the next word from the underlying stream.
 func (r *Reader) ReadWord(p []byte) error {
 	if len(p) < wordSize {
 		return errors.New("packed: read word buffer too small")
 	}
 	r.wordIdx = wordSize // if the caller tries to call ReadWord and Read, don't give them partial words.
+	if r.limit >= 0 && r.limit-r.decoded < wordSize {
+		return ErrTooLarge
+	}
 	if r.err != nil {
 		err := r.err
 		r.err = nil
 		return err
 	}
-	p = p[:wordSize]
+	err := r.readWord(p[:wordSize])
+	if err == nil {
+		r.decoded += wordSize
+	}
+	return err
+}
+
+func (r *Reader) readWord(p []byte) error {
 	switch {
 	case r.zeroes > 0:
 		r.zeroes--
@@ -222,6 +502,9 @@ func (r *Reader) ReadWord(p []byte) error {
 	case r.literal > 0:
 		r.literal--
 		_, err := io.ReadFull(r.rd, p)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrTruncated
+		}
 		return err
 	}
 
@@ -240,7 +523,7 @@ func (r *Reader) ReadWord(p []byte) error {
 				p[i], err = r.rd.ReadByte()
 				if err != nil {
 					if err == io.EOF {
-						err = io.ErrUnexpectedEOF
+						err = ErrTruncated
 					}
 					return err
 				}
@@ -282,7 +565,7 @@ func (r *Reader) ReadWord(p []byte) error {
 	case zeroTag:
 		z, err := r.rd.ReadByte()
 		if err == io.EOF {
-			r.err = io.ErrUnexpectedEOF
+			r.err = ErrTruncated
 			return nil
 		} else if err != nil {
 			r.err = err
@@ -292,7 +575,7 @@ func (r *Reader) ReadWord(p []byte) error {
 	case unpackedTag:
 		l, err := r.rd.ReadByte()
 		if err == io.EOF {
-			r.err = io.ErrUnexpectedEOF
+			r.err = ErrTruncated
 			return nil
 		} else if err != nil {
 			r.err = err
@@ -307,11 +590,35 @@ func (r *Reader) ReadWord(p []byte) error {
 // words at a time, so mixing calls to Read and ReadWord may lead to
 // bytes missing.
 func (r *Reader) Read(p []byte) (n int, err error) {
+	if r.wordAligned {
+		if r.wordIdx < wordSize {
+			// Finish the buffered word and stop at its end.
+			n = copy(p, r.word[r.wordIdx:])
+			r.wordIdx += n
+			return n, nil
+		}
+		if len(p) >= wordSize {
+			p = p[:len(p)&^(wordSize-1)]
+		}
+	}
 	if r.wordIdx < wordSize {
 		n = copy(p, r.word[r.wordIdx:])
 		r.wordIdx += n
 	}
 	for n < len(p) {
+		if r.zeroes > 0 && len(p)-n >= wordSize {
+			// Expand as much of the zero run as fits in one copy.
+			k := min(r.zeroes, (len(p)-n)/wordSize)
+			if r.limit >= 0 {
+				k = int(min64(int64(k), (r.limit-r.decoded)/wordSize))
+			}
+			if k > 0 {
+				n += copy(p[n:n+k*wordSize], zeroWords[:])
+				r.zeroes -= k
+				r.decoded += int64(k) * wordSize
+				continue
+			}
+		}
 		if r.rd.Buffered() < wordSize+1 && n > 0 {
 			return n, nil
 		}
@@ -336,9 +643,51 @@ func (r *Reader) Read(p []byte) (n int, err error) {
 type Writer struct {
 	io.Writer
 	buf []byte
+	src []byte // ReadFrom's read buffer
 }
 
 func (w *Writer) Write(b []byte) (int, error) {
 	w.buf = Pack(w.buf[:0], b)
-	return w.Writer.Write(w.buf)
+	if _, err := w.Writer.Write(w.buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// readFromChunk is the size of the buffer that ReadFrom reads into.
+const readFromChunk = 32 * 1024
+
+// ReadFrom reads from r until EOF, packing and writing the data in
+// word-aligned chunks, so that io.Copy to a Writer does not need to
+// preserve word boundaries.  A partial word at the end of one read is
+// held until the next read completes it.  ReadFrom returns the number
+// of bytes read from r, and returns an error if that is not a multiple
+// of 8.
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	if w.src == nil {
+		w.src = make([]byte, readFromChunk)
+	}
+	var n int64
+	pending := 0 // bytes at the start of w.src not yet packed
+	for {
+		nr, rerr := r.Read(w.src[pending:])
+		n += int64(nr)
+		pending += nr
+		if whole := pending &^ (wordSize - 1); whole > 0 {
+			w.buf = Pack(w.buf[:0], w.src[:whole])
+			if _, err := w.Writer.Write(w.buf); err != nil {
+				return n, err
+			}
+			pending = copy(w.src, w.src[whole:pending])
+		}
+		if rerr == io.EOF {
+			if pending != 0 {
+				return n, fmt.Errorf("packed: read %d bytes, not a multiple of %d", n, wordSize)
+			}
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
 }
@@ -4,14 +4,22 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"testing/iotest"
+	"time"
 
+	"capnproto.org/go/capnp/v3/internal/capnptool"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -227,13 +235,17 @@ var decompressionTests = []testCase{
 var badDecompressionTests = []struct {
 	name  string
 	input []byte
+	err   error
 }{
 	{
+		// Every tag byte is valid, so wrong tags are only detected when
+		// they claim more bytes than the stream has.
 		"wrong tag",
 		[]byte{
 			0xa7, 8, 100, 6, 1, 1, 2,
 			0xa7, 8, 100, 6, 1, 1, 2,
 		},
+		ErrTruncated,
 	},
 	{
 		"badly written decompression benchmark",
@@ -247,6 +259,16 @@ var badDecompressionTests = []struct {
 			'o', 'r', 'l', 'd', '!', ' ', ' ', 'P',
 			'a', 'd', ' ', 't', 'e', 'x', 't', '.',
 		}, 128),
+		ErrTruncated,
+	},
+	{
+		// Found by FuzzUnpack: Unpack used to zero-fill the missing words.
+		"truncated literal run",
+		[]byte{
+			0xff, 1, 2, 3, 4, 5, 6, 7, 8,
+			2, 'a', 'b', 'c',
+		},
+		ErrTruncated,
 	},
 }
 
@@ -269,6 +291,414 @@ func TestPack(t *testing.T) {
 	}
 }
 
+func TestReferenceVectors(t *testing.T) {
+	t.Parallel()
+
+	files, err := filepath.Glob(filepath.Join("testdata", "reference", "*.txt"))
+	require.NoError(t, err)
+	require.NotEmpty(t, files, "no reference vectors found")
+	for _, name := range files {
+		name := name
+		t.Run(filepath.Base(name), func(t *testing.T) {
+			t.Parallel()
+
+			unpacked, packed := readReferenceVector(t, name)
+			assert.Equal(t, packed, Pack(nil, unpacked), "Pack")
+			got, err := Unpack(nil, packed)
+			require.NoError(t, err, "Unpack")
+			assert.Equal(t, unpacked, got, "Unpack")
+			got, err = ioutil.ReadAll(NewReader(bufio.NewReader(bytes.NewReader(packed))))
+			require.NoError(t, err, "Reader")
+			assert.Equal(t, unpacked, got, "Reader")
+		})
+	}
+}
+
+// TestReferenceVectorsTool checks the reference vectors against the
+// C++ encoder, by having the capnp tool encode each unpacked input as
+// the payload of a Zdata message:
+//
+//	capnp encode --packed internal/aircraftlib/aircraft.capnp Zdata <<< '(data = 0x"<unpacked>")'
+//
+// Each word that precedes the payload has both zero and nonzero bytes,
+// so no run crosses into the payload and the packed message ends with
+// the packed payload.  On a mismatch, the test logs the packed section
+// that the tool produced, in the format of the vector files.
+func TestReferenceVectorsTool(t *testing.T) {
+	t.Parallel()
+
+	tool, err := capnptool.Find()
+	if err != nil {
+		t.Skip("capnp tool not found:", err)
+	}
+	typ := capnptool.Type{SchemaPath: filepath.Join("..", "internal", "aircraftlib", "aircraft.capnp"), Name: "Zdata"}
+	files, err := filepath.Glob(filepath.Join("testdata", "reference", "*.txt"))
+	require.NoError(t, err)
+	for _, name := range files {
+		unpacked, packed := readReferenceVector(t, name)
+		text := fmt.Sprintf("(data = 0x\"%x\")", unpacked)
+		msg, err := tool.Encode(typ, text)
+		require.NoError(t, err, name)
+		require.True(t, bytes.HasSuffix(msg, unpacked), "%s: capnp encode did not end with the payload", name)
+		prefix := Pack(nil, msg[:len(msg)-len(unpacked)])
+		out, err := tool.Run(strings.NewReader(text), "encode", "--packed", typ.SchemaPath, typ.Name)
+		require.NoError(t, err, name)
+		if !bytes.HasPrefix(out, prefix) || !bytes.Equal(out[len(prefix):], packed) {
+			t.Errorf("%s: packed section differs from capnp encode --packed, which gives:\npacked:\n%s",
+				name, formatReferenceWords(out[len(prefix):]))
+		}
+	}
+}
+
+// formatReferenceWords formats b as a section of a reference vector.
+func formatReferenceWords(b []byte) string {
+	var sb strings.Builder
+	for i := 0; i < len(b); i += 8 {
+		end := i + 8
+		if end > len(b) {
+			end = len(b)
+		}
+		fmt.Fprintf(&sb, "%x", b[i:end])
+		if (i/8)%4 == 3 || end == len(b) {
+			sb.WriteByte('\n')
+		} else {
+			sb.WriteByte(' ')
+		}
+	}
+	return sb.String()
+}
+
+func TestUnpackedSize(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range compressionTests {
+		t.Run(test.name, func(t *testing.T) {
+			want, err := Unpack(nil, test.compressed)
+			require.NoError(t, err)
+			size, err := UnpackedSize(test.compressed)
+			assert.NoError(t, err)
+			assert.Equal(t, len(want), size)
+
+			// A destination of that size is not reallocated.
+			dst := make([]byte, 0, size)
+			got, err := Unpack(dst, test.compressed)
+			assert.NoError(t, err)
+			if size > 0 {
+				assert.Same(t, &dst[:1][0], &got[0], "Unpack reallocated dst")
+			}
+
+			// Truncations fail the same way as Unpack.
+			for n := 0; n < len(test.compressed); n++ {
+				partial, wantErr := Unpack(nil, test.compressed[:n])
+				size, err := UnpackedSize(test.compressed[:n])
+				assert.Equal(t, wantErr, err, "truncated to %d bytes", n)
+				assert.Equal(t, len(partial), size, "truncated to %d bytes", n)
+			}
+		})
+	}
+	for _, test := range badDecompressionTests {
+		t.Run(test.name, func(t *testing.T) {
+			partial, _ := Unpack(nil, test.input)
+			size, err := UnpackedSize(test.input)
+			assert.ErrorIs(t, err, test.err)
+			assert.Equal(t, len(partial), size)
+		})
+	}
+}
+
+// TestZeroRuns checks that expanding zero runs in bulk gives the same
+// output as the rest of the decoder, for reads of every size and with
+// runs that end in the middle of a read.
+func TestZeroRuns(t *testing.T) {
+	t.Parallel()
+
+	inputs := map[string][]byte{
+		// 255 zero words, then 3 more, then data.
+		"long run": {0x00, 0xfe, 0x00, 0x02, 0x01, 0x2a},
+	}
+	for _, test := range compressionTests {
+		inputs[test.name] = test.compressed
+	}
+	files, err := filepath.Glob(filepath.Join("testdata", "reference", "*.txt"))
+	require.NoError(t, err)
+	for _, name := range files {
+		_, packed := readReferenceVector(t, name)
+		inputs[filepath.Base(name)] = packed
+	}
+
+	for name, packed := range inputs {
+		want, err := Unpack(nil, packed)
+		require.NoError(t, err, name)
+		for _, size := range []int{1, 7, 8, 13, 64, 4096} {
+			r := NewReader(bufio.NewReader(bytes.NewReader(packed)))
+			var got []byte
+			buf := make([]byte, size)
+			for {
+				n, err := r.Read(buf)
+				got = append(got, buf[:n]...)
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err, "%s: Read([%d]byte)", name, size)
+			}
+			assert.Equal(t, want, got, "%s: reading %d bytes at a time", name, size)
+			assert.Equal(t, int64(len(want)), r.BytesDecoded(), "%s: BytesDecoded", name)
+		}
+	}
+}
+
+// readReferenceVector parses a file from testdata/reference.  See the
+// README there for the format.
+func readReferenceVector(t *testing.T, name string) (unpacked, packed []byte) {
+	data, err := os.ReadFile(name)
+	require.NoError(t, err)
+	var section *[]byte
+	for _, line := range strings.Split(string(data), "\n") {
+		switch line = strings.TrimSpace(line); {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case line == "unpacked:":
+			section = &unpacked
+		case line == "packed:":
+			section = &packed
+		default:
+			require.NotNil(t, section, "data before section header")
+			b, err := hex.DecodeString(strings.Join(strings.Fields(line), ""))
+			require.NoError(t, err)
+			*section = append(*section, b...)
+		}
+	}
+	require.NotNil(t, unpacked, "missing unpacked section")
+	require.NotNil(t, packed, "missing packed section")
+	return unpacked, packed
+}
+
+func TestPackParallel(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range compressionTests {
+		t.Run(test.name, func(t *testing.T) {
+			if testing.Short() && test.long {
+				t.Skip("skipping long test due to -short")
+			}
+
+			assert.Equal(t, test.compressed, PackParallel([]byte{}, test.original, 4), "small input")
+
+			// Repeat the input so that it is large enough to be split.
+			n := 4*minParallelChunk/(len(test.original)+1) + 1
+			large := bytes.Repeat(test.original, n)
+			for _, workers := range []int{2, 3, 4, 8} {
+				assert.Equal(t, Pack(nil, large), PackParallel(nil, large, workers), "workers=%d", workers)
+			}
+		})
+	}
+}
+
+func TestPackParallel_dst(t *testing.T) {
+	t.Parallel()
+
+	src := bytes.Repeat([]byte{1, 2, 0, 0, 0, 0, 0, 0}, minParallelChunk)
+	prefix := []byte("prefix")
+	got := PackParallel(append([]byte{}, prefix...), src, 4)
+	assert.Equal(t, Pack(append([]byte{}, prefix...), src), got)
+	assert.Len(t, splitForPack(src, 4), 4, "should split into one chunk per worker")
+}
+
+func TestPackParallel_wordsize(t *testing.T) {
+	t.Parallel()
+
+	assert.Panics(t, func() {
+		PackParallel([]byte{}, make([]byte, 1), 4)
+	}, "should panic if len(src) is not a multiple of 8")
+}
+
+func TestPack_dst(t *testing.T) {
+	t.Parallel()
+
+	prefix := []byte("prefix")
+	for _, test := range compressionTests {
+		t.Run(test.name, func(t *testing.T) {
+			if testing.Short() && test.long {
+				t.Skip("skipping long test due to -short")
+			}
+
+			want := append(append([]byte{}, prefix...), test.compressed...)
+			dst := append([]byte{}, prefix...)
+			assert.Equal(t, want, Pack(dst, test.original), "full dst")
+
+			dst = make([]byte, len(prefix), len(prefix)+len(test.compressed))
+			copy(dst, prefix)
+			got := Pack(dst, test.original)
+			assert.Equal(t, want, got, "dst with spare capacity")
+			if len(got) > 0 {
+				assert.Same(t, &dst[0], &got[0], "should reuse dst's capacity")
+			}
+		})
+	}
+}
+
+func TestPack_LongLiteralRun(t *testing.T) {
+	t.Parallel()
+
+	const words = 300
+	rng := rand.New(rand.NewSource(580))
+	src := make([]byte, words*wordSize)
+	for i := range src {
+		src[i] = byte(rng.Intn(255) + 1)
+	}
+
+	packed := Pack(nil, src)
+	// The first word's tag is followed by a run of at most 255 words, so
+	// the rest must start a second literal run.
+	second := 1 + wordSize + 1 + 255*wordSize
+	require.Len(t, packed, second+1+wordSize+1+(words-257)*wordSize)
+	assert.Equal(t, []byte{0xff}, packed[:1], "first tag")
+	assert.Equal(t, byte(255), packed[1+wordSize], "first run length")
+	assert.Equal(t, []byte{0xff}, packed[second:second+1], "second tag")
+	assert.Equal(t, byte(words-257), packed[second+1+wordSize], "second run length")
+
+	unpacked, err := Unpack(nil, packed)
+	require.NoError(t, err)
+	assert.Equal(t, src, unpacked, "round trip")
+}
+
+// packBytewise is Pack as it was before literal runs were scanned a
+// word at a time, kept as a reference for the optimized version.
+func packBytewise(dst, src []byte) []byte {
+	for len(src) > 0 {
+		var hdr byte
+		var buf []byte
+		for i := uint(0); i < wordSize; i++ {
+			if src[i] != 0 {
+				hdr |= 1 << i
+				buf = append(buf, src[i])
+			}
+		}
+		dst = append(dst, hdr)
+		dst = append(dst, buf...)
+		src = src[wordSize:]
+
+		switch hdr {
+		case zeroTag:
+			z := min(numZeroWords(src), 0xff)
+			dst = append(dst, byte(z))
+			src = src[z*wordSize:]
+		case unpackedTag:
+			i := 0
+			end := min(len(src), 0xff*wordSize)
+			for i < end {
+				zeros := 0
+				for _, b := range src[i : i+wordSize] {
+					if b == 0 {
+						zeros++
+					}
+				}
+				if zeros > 1 {
+					break
+				}
+				i += wordSize
+			}
+			dst = append(dst, byte(i/wordSize))
+			dst = append(dst, src[:i]...)
+			src = src[i:]
+		}
+	}
+	return dst
+}
+
+func TestPack_MatchesBytewise(t *testing.T) {
+	t.Parallel()
+
+	inputs := make(map[string][]byte)
+	for _, test := range compressionTests {
+		inputs[test.name] = test.original
+	}
+	files, err := filepath.Glob(filepath.Join("testdata", "reference", "*.txt"))
+	require.NoError(t, err)
+	for _, name := range files {
+		unpacked, _ := readReferenceVector(t, name)
+		inputs[filepath.Base(name)] = unpacked
+	}
+	// Random words with a chosen chance of each byte being zero, so
+	// that literal runs end on words with exactly one and two zeros.
+	rng := rand.New(rand.NewSource(607))
+	for _, zeroPct := range []int{0, 2, 10, 25, 50} {
+		src := make([]byte, 4096*wordSize)
+		for i := range src {
+			if rng.Intn(100) >= zeroPct {
+				src[i] = byte(rng.Intn(255) + 1)
+			}
+		}
+		inputs[fmt.Sprintf("random %d%% zeros", zeroPct)] = src
+	}
+	for _, b := range [...]uint64{
+		0x0102030405060708, 0x0002030405060708, 0x0102030405060700,
+		0x0100030405060708, 0x0001030405060708, 0x0000000000000001,
+		0x8000000000000080, 0x7f7f7f7f7f7f7f7f, 0xff00ff00ff00ff00,
+	} {
+		word := make([]byte, wordSize)
+		for i := range word {
+			word[i] = byte(b >> (8 * i))
+		}
+		// A literal run, then the word under test, then another run.
+		src := append(bytes.Repeat([]byte{1}, 2*wordSize), word...)
+		src = append(src, bytes.Repeat([]byte{2}, wordSize)...)
+		inputs[fmt.Sprintf("word %#016x", b)] = src
+	}
+
+	for name, src := range inputs {
+		assert.Equal(t, packBytewise(nil, src), Pack(nil, src), name)
+	}
+}
+
+func TestZeroByteMask(t *testing.T) {
+	t.Parallel()
+
+	// Every tag, with the nonzero bytes taking values around the bit
+	// boundaries that the mask arithmetic depends on.
+	fills := []byte{0x01, 0x55, 0x79, 0x80, 0xf8}
+	for tag := 0; tag < 256; tag++ {
+		for _, fill := range fills {
+			var word uint64
+			for i := 0; i < wordSize; i++ {
+				if tag&(1<<i) != 0 {
+					word |= uint64(fill+byte(i)) << (8 * i)
+				}
+			}
+			assert.Equal(t, byte(tag), ZeroByteMask(word), "ZeroByteMask(%#016x)", word)
+		}
+	}
+	for _, test := range []struct {
+		word uint64
+		tag  byte
+	}{
+		{0, 0x00},
+		{0xffffffffffffffff, 0xff},
+		{0x0101010101010101, 0xff},
+		{0x8080808080808080, 0xff},
+		{0x7f7f7f7f7f7f7f7f, 0xff},
+		{0x0000000000000001, 0x01},
+		{0x8000000000000000, 0x80},
+		{0x00ff00ff00ff00ff, 0x55},
+		{0x0100000000000001, 0x81},
+	} {
+		assert.Equal(t, test.tag, ZeroByteMask(test.word), "ZeroByteMask(%#016x)", test.word)
+	}
+}
+
+func TestPopcountTag(t *testing.T) {
+	t.Parallel()
+
+	for tag := 0; tag < 256; tag++ {
+		want := 0
+		for i := 0; i < 8; i++ {
+			if tag&(1<<i) != 0 {
+				want++
+			}
+		}
+		assert.Equal(t, want, PopcountTag(byte(tag)), "PopcountTag(%#02x)", tag)
+	}
+}
+
 func TestPack_wordsize(t *testing.T) {
 	t.Parallel()
 
@@ -310,7 +740,7 @@ func TestUnpack_Fail(t *testing.T) {
 			compressed := make([]byte, len(test.input))
 			copy(compressed, test.input)
 			_, err := Unpack([]byte{}, compressed)
-			assert.Error(t, err, "should return error")
+			assert.ErrorIs(t, err, test.err)
 		})
 	}
 }
@@ -382,11 +812,368 @@ func TestReader_Fail(t *testing.T) {
 		t.Run(test.name, func(t *testing.T) {
 			d := NewReader(bufio.NewReader(bytes.NewReader(test.input)))
 			_, err := ioutil.ReadAll(d)
-			assert.Error(t, err, "should return error")
+			assert.ErrorIs(t, err, test.err)
 		})
 	}
 }
 
+func TestReader_Truncated(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range compressionTests {
+		if len(test.compressed) == 0 {
+			continue
+		}
+		t.Run(test.name, func(t *testing.T) {
+			for n := 0; n < len(test.compressed); n++ {
+				words, clean := completeWords(test.compressed[:n])
+				d := NewReader(bufio.NewReader(bytes.NewReader(test.compressed[:n])))
+				_, err := ioutil.ReadAll(d)
+				if clean {
+					assert.NoError(t, err, "truncated at token boundary (%d bytes)", n)
+				} else {
+					assert.ErrorIs(t, err, ErrTruncated, "truncated to %d bytes", n)
+					assert.ErrorIs(t, err, io.ErrUnexpectedEOF, "truncated to %d bytes", n)
+				}
+				assert.Equal(t, int64(words)*8, d.BytesDecoded(), "truncated to %d bytes", n)
+			}
+		})
+	}
+}
+
+func TestReader_SetReadLimit(t *testing.T) {
+	t.Parallel()
+
+	// 1 MiB of zeroes packs to a few kilobytes.
+	const limit = 64 * 1024
+	src := Pack(nil, make([]byte, 1<<20))
+	require.Less(t, len(src), limit/8)
+
+	r := NewReader(bufio.NewReader(bytes.NewReader(src)))
+	r.SetReadLimit(limit)
+	n, err := io.Copy(ioutil.Discard, r)
+	assert.ErrorIs(t, err, ErrTooLarge)
+	assert.Equal(t, int64(limit), n, "should read up to limit")
+	assert.Equal(t, int64(limit), r.BytesDecoded())
+
+	// The limit counts from the call to SetReadLimit.
+	r.SetReadLimit(8)
+	var word [8]byte
+	assert.NoError(t, r.ReadWord(word[:]))
+	assert.ErrorIs(t, r.ReadWord(word[:]), ErrTooLarge)
+
+	r.SetReadLimit(-1)
+	n, err = io.Copy(ioutil.Discard, r)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1<<20-limit-8), n, "should read rest of stream without limit")
+}
+
+// completeWords returns the number of complete words that can be
+// decoded from a prefix of a packed stream and whether the prefix ends
+// on a token boundary.
+func completeWords(src []byte) (words int, clean bool) {
+	for len(src) > 0 {
+		tag := src[0]
+		src = src[1:]
+		n := 0
+		for i := uint(0); i < 8; i++ {
+			if tag&(1<<i) != 0 {
+				n++
+			}
+		}
+		if len(src) < n {
+			return words, false
+		}
+		src = src[n:]
+		words++
+		switch tag {
+		case 0x00:
+			if len(src) == 0 {
+				return words, false
+			}
+			words += int(src[0])
+			src = src[1:]
+		case 0xff:
+			if len(src) == 0 {
+				return words, false
+			}
+			run := int(src[0])
+			src = src[1:]
+			if len(src) < run*8 {
+				return words + len(src)/8, false
+			}
+			words += run
+			src = src[run*8:]
+		}
+	}
+	return words, true
+}
+
+func TestFrame(t *testing.T) {
+	t.Parallel()
+
+	msgs := [][]byte{
+		{0, 0, 12, 0, 0, 34, 0, 0},
+		{},
+		bytes.Repeat([]byte{0x8a, 0, 0, 0, 0, 0, 0, 0x8a}, 300),
+	}
+	buf := new(bytes.Buffer)
+	fw := NewFrameWriter(buf)
+	for _, m := range msgs {
+		n, err := fw.Write(m)
+		require.NoError(t, err, "should write frame")
+		assert.Equal(t, len(m), n, "should report unpacked length")
+	}
+
+	fr := NewFrameReader(bufio.NewReader(bytes.NewReader(buf.Bytes())))
+	for i, m := range msgs {
+		frame, err := fr.Next()
+		require.NoError(t, err, "should read frame %d", i)
+		assert.Equal(t, Pack([]byte{}, m), frame, "frame %d should be the packed message", i)
+		unpacked, err := Unpack(nil, frame)
+		require.NoError(t, err, "frame %d should unpack", i)
+		assert.Equal(t, len(m), len(unpacked), "frame %d should unpack to original length", i)
+	}
+	_, err := fr.Next()
+	assert.Equal(t, io.EOF, err, "should return io.EOF after last frame")
+
+	truncated := buf.Bytes()[:buf.Len()-1]
+	fr = NewFrameReader(bufio.NewReader(bytes.NewReader(truncated)))
+	for i := 0; i < len(msgs)-1; i++ {
+		_, err := fr.Next()
+		require.NoError(t, err, "should read frame %d", i)
+	}
+	_, err = fr.Next()
+	assert.ErrorIs(t, err, ErrTruncated, "should report truncated last frame")
+
+	fr = NewFrameReader(bufio.NewReader(bytes.NewReader(buf.Bytes())))
+	fr.MaxFrameSize = 1
+	_, err = fr.Next()
+	assert.ErrorIs(t, err, ErrTooLarge, "should reject frame larger than MaxFrameSize")
+}
+
+func TestWriter_ReadFrom(t *testing.T) {
+	t.Parallel()
+
+	src := make([]byte, 0, 3*readFromChunk+8)
+	for len(src) < cap(src) {
+		src = append(src, 0, 0, byte(len(src)), 0, 0, 0, 1, 0)
+	}
+	readers := []struct {
+		name string
+		r    func([]byte) io.Reader
+	}{
+		{"Whole", func(b []byte) io.Reader { return bytes.NewReader(b) }},
+		{"OneByte", func(b []byte) io.Reader { return iotest.OneByteReader(bytes.NewReader(b)) }},
+		{"Half", func(b []byte) io.Reader { return iotest.HalfReader(bytes.NewReader(b)) }},
+		{"DataErr", func(b []byte) io.Reader { return iotest.DataErrReader(bytes.NewReader(b)) }},
+	}
+	for _, rd := range readers {
+		rd := rd
+		t.Run(rd.name, func(t *testing.T) {
+			t.Parallel()
+
+			buf := new(bytes.Buffer)
+			n, err := io.Copy(&Writer{Writer: buf}, rd.r(src))
+			require.NoError(t, err, "should copy")
+			assert.Equal(t, int64(len(src)), n, "should report source bytes consumed")
+			unpacked, err := Unpack(nil, buf.Bytes())
+			require.NoError(t, err, "output should unpack")
+			assert.Equal(t, src, unpacked, "output should unpack to source")
+		})
+	}
+
+	t.Run("PartialWord", func(t *testing.T) {
+		t.Parallel()
+
+		buf := new(bytes.Buffer)
+		n, err := (&Writer{Writer: buf}).ReadFrom(bytes.NewReader(src[:20]))
+		assert.Error(t, err, "should reject trailing partial word")
+		assert.Equal(t, int64(20), n, "should report source bytes consumed")
+		assert.Equal(t, Pack(nil, src[:16]), buf.Bytes(), "should write complete words")
+	})
+}
+
+func TestIsLikelyPacked(t *testing.T) {
+	t.Parallel()
+
+	messages := []struct {
+		name string
+		data []byte
+	}{
+		{
+			name: "single segment",
+			data: []byte{
+				0x00, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, // 1 segment, 2 words
+				0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, // root struct pointer
+				0x2a, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // data
+			},
+		},
+		{
+			name: "single segment without zero bytes",
+			data: []byte{
+				0x00, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, // 1 segment, 2 words
+				0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, // root struct pointer
+				0x8a, 0x8a, 0x8a, 0x8a, 0x8a, 0x8a, 0x8a, 0x8a, // data
+			},
+		},
+		{
+			name: "large single segment",
+			data: append([]byte{
+				0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x00, 0x00, // 1 segment, 513 words
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, // root struct pointer
+			}, make([]byte, 512*8)...),
+		},
+		{
+			name: "two segments",
+			data: []byte{
+				0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, // 2 segments, first is 1 word
+				0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // second is 1 word, padding
+				0x02, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, // far pointer
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // empty struct
+			},
+		},
+	}
+	for _, test := range messages {
+		t.Run(test.name, func(t *testing.T) {
+			assert.False(t, IsLikelyPacked(test.data), "unpacked message")
+			assert.True(t, IsLikelyPacked(Pack(nil, test.data)), "packed message")
+		})
+	}
+
+	assert.False(t, IsLikelyPacked(nil), "empty prefix")
+	assert.False(t, IsLikelyPacked([]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}), "all zero header")
+}
+
+func TestPackContext(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range compressionTests {
+		t.Run(test.name, func(t *testing.T) {
+			if testing.Short() && test.long {
+				t.Skip("skipping long test due to -short")
+			}
+
+			// Repeat the input so that it spans several checks.
+			n := 4*contextCheckBytes/(len(test.original)+1) + 1
+			large := bytes.Repeat(test.original, n)
+			packed, err := PackContext(context.Background(), []byte("prefix"), large)
+			require.NoError(t, err, "PackContext")
+			assert.Equal(t, Pack([]byte("prefix"), large), packed, "PackContext")
+
+			unpacked, err := UnpackContext(context.Background(), []byte("prefix"), Pack(nil, large))
+			require.NoError(t, err, "UnpackContext")
+			assert.Equal(t, append([]byte("prefix"), large...), unpacked, "UnpackContext")
+		})
+	}
+}
+
+func TestPackContext_Cancel(t *testing.T) {
+	t.Parallel()
+
+	src := bytes.Repeat([]byte{1, 2, 0, 0, 0, 0, 0, 3}, 16*contextCheckBytes/wordSize)
+	packed := Pack(nil, src)
+
+	t.Run("Pack", func(t *testing.T) {
+		ctx := &cancelAfterContext{Context: context.Background(), n: 2}
+		out, err := PackContext(ctx, nil, src)
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Less(t, len(out), len(packed), "should stop before packing all of src")
+		assert.Equal(t, packed[:len(out)], out, "partial output should be a prefix of Pack output")
+	})
+	t.Run("Unpack", func(t *testing.T) {
+		ctx := &cancelAfterContext{Context: context.Background(), n: 2}
+		out, err := UnpackContext(ctx, nil, packed)
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Less(t, len(out), len(src), "should stop before unpacking all of src")
+		assert.Equal(t, src[:len(out)], out, "partial output should be a prefix of src")
+	})
+	t.Run("Error", func(t *testing.T) {
+		_, err := UnpackContext(context.Background(), nil, packed[:len(packed)-1])
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+}
+
+func TestNewReaderContext(t *testing.T) {
+	t.Parallel()
+
+	// The stream holds one whole word and then stalls halfway through
+	// the second.
+	sr := &stalledReader{
+		data:    []byte{0x01, 0x2a, 0x03, 0x01},
+		reading: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := NewReaderContext(ctx, sr)
+
+	word := make([]byte, wordSize)
+	require.NoError(t, r.ReadWord(word))
+	assert.Equal(t, []byte{0x2a, 0, 0, 0, 0, 0, 0, 0}, word)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.Read(word)
+		done <- err
+	}()
+	<-sr.reading
+	cancel()
+	select {
+	case err := <-done:
+		t.Fatalf("Read returned %v while the underlying read was blocked", err)
+	default:
+	}
+	// Once the blocked read returns, Read stops instead of reading again.
+	close(sr.release)
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read did not return after the context was cancelled")
+	}
+	_, err := r.Read(word)
+	assert.ErrorIs(t, err, context.Canceled, "Read after cancel")
+}
+
+// stalledReader returns data and then blocks each read until release
+// is closed, after which reads return no data.
+type stalledReader struct {
+	data    []byte
+	reading chan struct{} // receives a value when a read blocks
+	release chan struct{}
+}
+
+func (sr *stalledReader) Read(p []byte) (int, error) {
+	if len(sr.data) > 0 {
+		n := copy(p, sr.data)
+		sr.data = sr.data[n:]
+		return n, nil
+	}
+	select {
+	case sr.reading <- struct{}{}:
+	default:
+	}
+	<-sr.release
+	return 0, nil
+}
+
+// cancelAfterContext is a context that reports that it has been
+// canceled once Err has been called n times, so that a test can cancel
+// an operation partway through.
+type cancelAfterContext struct {
+	context.Context
+	n int
+}
+
+func (ctx *cancelAfterContext) Err() error {
+	if ctx.n == 0 {
+		return context.Canceled
+	}
+	ctx.n--
+	return nil
+}
+
 var result []byte
 
 func BenchmarkPack(b *testing.B) {
@@ -412,6 +1199,53 @@ func BenchmarkPack(b *testing.B) {
 	result = dst
 }
 
+// Scanning literal runs a word at a time instead of a byte at a time
+// changed this as follows (median of 3 runs on one CPU):
+//
+//	BenchmarkPack_Incompressible  1274458 ns/op -> 407273 ns/op
+func BenchmarkPack_Incompressible(b *testing.B) {
+	src := make([]byte, 1<<20)
+	rng := rand.New(rand.NewSource(607))
+	for i := range src {
+		src[i] = byte(rng.Intn(255) + 1)
+	}
+	dst := make([]byte, 0, len(src)+len(src)/(255*wordSize)*2+16)
+	b.SetBytes(int64(len(src)))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dst = Pack(dst[:0], src)
+	}
+	result = dst
+}
+
+func BenchmarkPackParallel(b *testing.B) {
+	src := bytes.Repeat([]byte{
+		8, 0, 100, 6, 0, 1, 1, 2,
+		8, 0, 100, 6, 0, 1, 1, 2,
+		0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0,
+		0, 1, 0, 2, 0, 3, 0, 0,
+		'H', 'e', 'l', 'l', 'o', ',', ' ', 'W',
+		'o', 'r', 'l', 'd', '!', ' ', ' ', 'P',
+		'a', 'd', ' ', 't', 'e', 'x', 't', '.',
+	}, 128*1024)
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			dst := make([]byte, 0, len(src))
+			b.SetBytes(int64(len(src)))
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				dst = PackParallel(dst[:0], src, workers)
+			}
+			result = dst
+		})
+	}
+}
+
 func benchUnpack(b *testing.B, src []byte) {
 	var unpackedSize int
 	{
@@ -435,6 +1269,60 @@ func benchUnpack(b *testing.B, src []byte) {
 	result = dst
 }
 
+func benchmarkWriterSource() []byte {
+	return bytes.Repeat([]byte{
+		8, 0, 100, 6, 0, 1, 1, 2,
+		0, 0, 0, 0, 0, 0, 0, 0,
+		0, 1, 0, 2, 0, 3, 0, 0,
+		'H', 'e', 'l', 'l', 'o', ',', ' ', 'W',
+	}, 4096)
+}
+
+func BenchmarkWriter_ReadFrom(b *testing.B) {
+	src := benchmarkWriterSource()
+	w := &Writer{Writer: ioutil.Discard}
+	r := bytes.NewReader(src)
+	b.SetBytes(int64(len(src)))
+	b.ReportAllocs()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(src)
+		if _, err := w.ReadFrom(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkWriter_WriteLoop packs the same data as
+// BenchmarkWriter_ReadFrom, but with the caller managing the buffer.
+func BenchmarkWriter_WriteLoop(b *testing.B) {
+	src := benchmarkWriterSource()
+	w := &Writer{Writer: ioutil.Discard}
+	r := bytes.NewReader(src)
+	b.SetBytes(int64(len(src)))
+	b.ReportAllocs()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(src)
+		buf := make([]byte, 4096)
+		for {
+			n, err := io.ReadFull(r, buf)
+			if n > 0 {
+				if _, err := w.Write(buf[:n]); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
 func BenchmarkUnpack(b *testing.B) {
 	benchUnpack(b, bytes.Repeat([]byte{
 		0xb7, 8, 100, 6, 1, 1, 2,
@@ -448,6 +1336,13 @@ func BenchmarkUnpack(b *testing.B) {
 	}, 128))
 }
 
+// BenchmarkUnpack_Large and BenchmarkReader_Large are dominated by
+// zero runs.  Expanding each run with a single copy, rather than a
+// word at a time in Reader, changed them as follows (-benchtime 5000x,
+// median of 5 runs on one CPU):
+//
+//	BenchmarkUnpack_Large   2335 ns/op -> 2148 ns/op
+//	BenchmarkReader_Large  76408 ns/op -> 2959 ns/op
 func BenchmarkUnpack_Large(b *testing.B) {
 	benchUnpack(b, []byte("\x00\xff\x00\xf6\x00\xff\x00\xf6\x00\xff\x00\xf6\x00\xff@\xf6\x00\xff\x00\xf6"+
 		"\x00\xff\x00\xf6\x00\xff\x00\xf6\x00\xff\x00\xf6\x00\xff\x00\xf6\x00\xff\x00\xf6"+
@@ -527,3 +1422,114 @@ func mustGunzip(s string) []byte {
 	}
 	return data
 }
+
+func TestReader_WordAligned(t *testing.T) {
+	t.Parallel()
+
+	var tests []testCase
+	tests = append(tests, compressionTests...)
+	tests = append(tests, decompressionTests...)
+
+	for _, test := range tests {
+		if test.long && testing.Short() {
+			continue
+		}
+		for _, readSize := range []int{8, 13, 16, 23, 100} {
+			r := NewReaderWithOptions(bufio.NewReader(bytes.NewReader(test.compressed)), ReaderOptions{WordAligned: true})
+			buf := make([]byte, readSize)
+			var got []byte
+			for {
+				n, err := r.Read(buf)
+				if n%8 != 0 {
+					t.Errorf("%s: Read(%d bytes) = %d; want a multiple of 8", test.name, readSize, n)
+				}
+				got = append(got, buf[:n]...)
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err, "%s: Read(%d bytes)", test.name, readSize)
+			}
+			if !bytes.Equal(got, test.original) {
+				t.Errorf("%s: read %d bytes with size %d reads; want %d bytes", test.name, len(got), readSize, len(test.original))
+			}
+		}
+	}
+
+	// Reads shorter than a word are served from the buffered word
+	// without running past its end.
+	r := NewReaderWithOptions(bufio.NewReader(bytes.NewReader([]byte{0x01, 0x02, 0x00, 0x00})), ReaderOptions{WordAligned: true})
+	var got []byte
+	for _, size := range []int{3, 3, 16} {
+		buf := make([]byte, size)
+		n, err := r.Read(buf)
+		require.NoError(t, err, "Read(%d bytes)", size)
+		got = append(got, buf[:n]...)
+	}
+	assert.Equal(t, []byte{0x02, 0, 0, 0, 0, 0, 0, 0}, got, "first word")
+	buf := make([]byte, 16)
+	n, err := r.Read(buf)
+	if err != nil && err != io.EOF {
+		t.Fatal("Read:", err)
+	}
+	assert.Equal(t, make([]byte, 8), buf[:n], "second word")
+}
+
+func TestScanPacked(t *testing.T) {
+	t.Parallel()
+
+	type token struct {
+		tag              byte
+		literal          []byte
+		zeroRun, copyRun int
+	}
+	scan := func(src []byte) ([]token, error) {
+		var toks []token
+		err := ScanPacked(src, func(tag byte, literal []byte, zeroRun, copyRun int) error {
+			toks = append(toks, token{tag, append([]byte{}, literal...), zeroRun, copyRun})
+			return nil
+		})
+		return toks, err
+	}
+
+	var bench testCase
+	for _, test := range compressionTests {
+		if test.name == "shortened benchmark data" {
+			bench = test
+		}
+	}
+	require.NotNil(t, bench.compressed, "test vector not found")
+	toks, err := scan(bench.compressed)
+	require.NoError(t, err)
+	assert.Equal(t, []token{
+		{tag: 0xb7, literal: []byte{8, 100, 6, 1, 1, 2}},
+		{tag: 0xb7, literal: []byte{8, 100, 6, 1, 1, 2}},
+		{tag: 0x00, literal: []byte{}, zeroRun: 3},
+		{tag: 0x2a, literal: []byte{1, 2, 3}},
+		{tag: 0xff, literal: []byte("Hello, W"), copyRun: 2},
+	}, toks)
+
+	// The tokens account for every word of the unpacked data.
+	for _, test := range compressionTests {
+		toks, err := scan(test.compressed)
+		require.NoError(t, err, test.name)
+		words := 0
+		for _, tok := range toks {
+			words += 1 + tok.zeroRun + tok.copyRun
+		}
+		assert.Equal(t, len(test.original)/8, words, test.name)
+	}
+
+	for _, test := range badDecompressionTests {
+		_, err := scan(test.input)
+		assert.ErrorIs(t, err, test.err, test.name)
+	}
+
+	errStop := errors.New("stop")
+	calls := 0
+	err = ScanPacked(bench.compressed, func(byte, []byte, int, int) error {
+		calls++
+		return errStop
+	})
+	assert.ErrorIs(t, err, errStop)
+	assert.Equal(t, 1, calls, "should stop at the first error")
+}
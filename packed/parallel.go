@@ -0,0 +1,85 @@
+package packed
+
+import "sync"
+
+// minParallelChunk is the smallest amount of input, in bytes, that
+// PackParallel will hand to a single worker.
+const minParallelChunk = 64 * 1024
+
+// PackParallel appends the packed version of src to dst and returns
+// the resulting slice, packing chunks of src concurrently on up to
+// workers goroutines.  The output is identical to Pack(dst, src).
+// len(src) must be a multiple of 8 or PackParallel panics.
+//
+// Zero runs and literal runs can span many words, so src is only split
+// right after a word that Pack always encodes as a token of its own: a
+// word that is neither all zero nor has fewer than two zero bytes.  If
+// src has few such words, fewer workers are used.  Small inputs or a
+// workers value less than 2 fall back to Pack.
+func PackParallel(dst, src []byte, workers int) []byte {
+	if len(src)%wordSize != 0 {
+		panic("packed.PackParallel len(src) must be a multiple of 8")
+	}
+	if max := len(src) / minParallelChunk; workers > max {
+		workers = max
+	}
+	if workers < 2 {
+		return Pack(dst, src)
+	}
+
+	chunks := splitForPack(src, workers)
+	if len(chunks) < 2 {
+		return Pack(dst, src)
+	}
+	bufs := make([][]byte, len(chunks))
+	var wg sync.WaitGroup
+	// The first chunk is packed directly onto dst.
+	for i := 1; i < len(chunks); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bufs[i] = Pack(make([]byte, 0, len(chunks[i])), chunks[i])
+		}(i)
+	}
+	dst = Pack(dst, chunks[0])
+	wg.Wait()
+	for _, b := range bufs[1:] {
+		dst = append(dst, b...)
+	}
+	return dst
+}
+
+// splitForPack splits src into at most n word-aligned chunks that Pack
+// encodes independently of each other.
+func splitForPack(src []byte, n int) [][]byte {
+	target := (len(src) / n) &^ (wordSize - 1)
+	chunks := make([][]byte, 0, n)
+	for len(chunks) < n-1 && len(src) > target {
+		i := target
+		for ; i < len(src); i += wordSize {
+			if isStandaloneWord(src[i : i+wordSize]) {
+				break
+			}
+		}
+		if i >= len(src)-wordSize {
+			break
+		}
+		i += wordSize // split after the standalone word
+		chunks = append(chunks, src[:i])
+		src = src[i:]
+	}
+	return append(chunks, src)
+}
+
+// isStandaloneWord reports whether Pack always encodes w as a token by
+// itself: it is not part of a zero run (w is not zero) and it ends any
+// literal run (w has at least two zero bytes).
+func isStandaloneWord(w []byte) bool {
+	zeros := 0
+	for _, b := range w {
+		if b == 0 {
+			zeros++
+		}
+	}
+	return zeros >= 2 && zeros < wordSize
+}
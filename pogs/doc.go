@@ -56,14 +56,24 @@ follows:
 	List                          -> slice
 	enum                          -> uint16
 	struct                        -> a struct or pointer to struct
-	interface                     -> a *capnp.Client or struct with
-	                                 exactly one field, named
-	                                 "Client", of type *capnp.Client
+	interface                     -> a capnp.Client or a generated
+	                                 client type (e.g. myschema.Foo)
 
 Note that the unsized int and uint type can't be used: int and float
 types must match in size.  For Data and Text fields using []byte, the
 filled-in byte slice will point to original segment.
 
+Capabilities
+
+Interface fields are mapped to capnp.Client values (or any generated
+client type, which is convertible to capnp.Client).  A null capability
+pointer maps to the zero Client.  Insert adds a new reference to the
+client to the message's capability table, so the Go struct keeps its
+own reference and the caller is still responsible for releasing it.
+Likewise, Extract gives the Go struct a new reference to each client,
+which the caller must release once it is done with it and which
+remains valid after the message is reset.
+
 Renaming and Omitting Fields
 
 By default, the Go field name is the same as the Cap'n Proto schema
@@ -139,6 +149,17 @@ which field in the union is set.
 		// ...
 	}
 
+Defaults
+
+By default, Insert writes every mapped field, even if its value is the
+default declared in the schema.  InsertWithOptions with OmitDefaults set
+leaves such fields unset instead, which keeps pointer fields null and
+messages smaller; Extract still reads them back as their defaults.
+Within a union, the discriminant is always written, so a union set to
+its first variant is preserved.  ExtractWithOptions with
+MaterializeDefaults set fills in unset pointer fields with empty values
+rather than nil.
+
 Embedding
 
 Anonymous struct fields are usually extracted or inserted as if their
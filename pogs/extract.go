@@ -13,7 +13,31 @@ import (
 
 // Extract copies s into val, a pointer to a Go struct.
 func Extract(val interface{}, typeID uint64, s capnp.Struct) error {
+	return ExtractWithOptions(val, typeID, s, nil)
+}
+
+// ExtractOptions specifies optional behavior for ExtractWithOptions.
+// The zero value is the same behavior as Extract.
+type ExtractOptions struct {
+	// MaterializeDefaults fills in unset pointer fields that have no
+	// schema default with an empty value instead of leaving them nil:
+	// struct pointers are set to a new struct populated with its own
+	// field defaults, and lists, Data, and []byte Text fields are set to
+	// empty, non-nil slices.  Struct pointers inside a materialized
+	// struct are left nil, so recursive types terminate.  This is useful
+	// when reading messages written with InsertOptions.OmitDefaults.
+	// Unset union variants are not materialized: only the variant
+	// selected by the discriminant is extracted.
+	MaterializeDefaults bool
+}
+
+// ExtractWithOptions copies s into val, a pointer to a Go struct, using
+// the given options.  A nil opts is the same as Extract.
+func ExtractWithOptions(val interface{}, typeID uint64, s capnp.Struct, opts *ExtractOptions) error {
 	e := new(extracter)
+	if opts != nil {
+		e.opts = *opts
+	}
 	err := e.extractStruct(reflect.ValueOf(val), typeID, s)
 	if err != nil {
 		return fmt.Errorf("pogs: extract @%#x: %v", typeID, err)
@@ -23,6 +47,7 @@ func Extract(val interface{}, typeID uint64, s capnp.Struct) error {
 
 type extracter struct {
 	nodes nodemap.Map
+	opts  ExtractOptions
 }
 
 var (
@@ -186,6 +211,9 @@ func (e *extracter) extractField(val reflect.Value, s capnp.Struct, f schema.Fie
 		} else {
 			b, _ = dv.TextBytes()
 		}
+		if b == nil && e.opts.MaterializeDefaults {
+			b = []byte{}
+		}
 		if val.Kind() == reflect.String {
 			val.SetString(string(b))
 		} else {
@@ -203,6 +231,9 @@ func (e *extracter) extractField(val reflect.Value, s capnp.Struct, f schema.Fie
 		} else {
 			b, _ = dv.Data()
 		}
+		if b == nil && e.opts.MaterializeDefaults {
+			b = []byte{}
+		}
 		val.SetBytes(b)
 	case schema.Type_Which_structType:
 		p, err := s.Ptr(uint16(f.Slot().Offset()))
@@ -214,6 +245,14 @@ func (e *extracter) extractField(val reflect.Value, s capnp.Struct, f schema.Fie
 			p, _ = dv.StructValue()
 			ss = p.Struct()
 		}
+		if !ss.IsValid() && s.IsValid() && e.opts.MaterializeDefaults && val.Kind() == reflect.Ptr {
+			// Only materialize one level deep so that recursive types
+			// don't recurse forever.
+			if val.IsNil() {
+				val.Set(reflect.New(val.Type().Elem()))
+			}
+			val = val.Elem()
+		}
 		return e.extractStruct(val, typ.StructType().TypeId(), ss)
 	case schema.Type_Which_list:
 		p, err := s.Ptr(uint16(f.Slot().Offset()))
@@ -231,7 +270,7 @@ func (e *extracter) extractField(val reflect.Value, s capnp.Struct, f schema.Fie
 		if err != nil {
 			return err
 		}
-		client := p.Interface().Client()
+		client := p.Interface().Client().AddRef()
 		val.Set(reflect.ValueOf(client).Convert(val.Type()))
 	case schema.Type_Which_anyPointer:
 		p, err := s.Ptr(uint16(f.Slot().Offset()))
@@ -252,7 +291,7 @@ func (e *extracter) extractField(val reflect.Value, s capnp.Struct, f schema.Fie
 		case listType:
 			val.Set(reflect.ValueOf(p.List()))
 		case clientType:
-			val.Set(reflect.ValueOf(p.Interface().Client()))
+			val.Set(reflect.ValueOf(p.Interface().Client().AddRef()))
 		default:
 			panic("unreachable")
 		}
@@ -273,7 +312,11 @@ func (e *extracter) extractList(val reflect.Value, typ schema.Type, l capnp.List
 		return fmt.Errorf("can't extract %v list into a Go %v", elem.Which(), vt)
 	}
 	if !l.IsValid() {
-		val.Set(reflect.Zero(vt))
+		if e.opts.MaterializeDefaults {
+			val.Set(reflect.MakeSlice(vt, 0, 0))
+		} else {
+			val.Set(reflect.Zero(vt))
+		}
 		return nil
 	}
 	n := l.Len()
@@ -390,7 +433,7 @@ func (e *extracter) extractList(val reflect.Value, typ schema.Type, l capnp.List
 				return err
 			}
 			val.Index(i).Set(
-				reflect.ValueOf(p.Interface().Client()).Convert(elemType),
+				reflect.ValueOf(p.Interface().Client().AddRef()).Convert(elemType),
 			)
 		}
 	case schema.Type_Which_anyPointer:
@@ -1,6 +1,7 @@
 package pogs
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"math"
@@ -13,7 +14,35 @@ import (
 
 // Insert copies val, a pointer to a Go struct, into s.
 func Insert(typeID uint64, s capnp.Struct, val interface{}) error {
+	return InsertWithOptions(typeID, s, val, nil)
+}
+
+// InsertOptions specifies optional behavior for InsertWithOptions.
+// The zero value is the same behavior as Insert.
+type InsertOptions struct {
+	// OmitDefaults skips writing any field whose Go value is equal to
+	// the default declared in the schema.  Since reading an unset field
+	// yields its default, the extracted value is unchanged, but pointer
+	// fields equal to their default are left null instead of being
+	// allocated.  A non-pointer Go struct field is always written, since
+	// the nested struct's field defaults need not be zero.
+	//
+	// The union discriminant is always written, even if it selects the
+	// union's first (default) variant.  The selected variant's field is
+	// then omitted like any other field if it is equal to its default.
+	//
+	// OmitDefaults assumes s has just been allocated: any data already
+	// present in an omitted field is left in place.
+	OmitDefaults bool
+}
+
+// InsertWithOptions copies val, a pointer to a Go struct, into s,
+// using the given options.  A nil opts is the same as Insert.
+func InsertWithOptions(typeID uint64, s capnp.Struct, val interface{}, opts *InsertOptions) error {
 	ins := new(inserter)
+	if opts != nil {
+		ins.opts = *opts
+	}
 	err := ins.insertStruct(typeID, s, reflect.ValueOf(val))
 	if err != nil {
 		return fmt.Errorf("pogs: insert @%#x: %v", typeID, err)
@@ -23,6 +52,7 @@ func Insert(typeID uint64, s capnp.Struct, val interface{}) error {
 
 type inserter struct {
 	nodes nodemap.Map
+	opts  InsertOptions
 }
 
 func (ins *inserter) insertStruct(typeID uint64, s capnp.Struct, val reflect.Value) error {
@@ -111,6 +141,9 @@ func (ins *inserter) insertField(s capnp.Struct, f schema.Field, val reflect.Val
 		name, _ := f.NameBytes()
 		return fmt.Errorf("can't insert field %s: allocated struct is too small", name)
 	}
+	if ins.opts.OmitDefaults && isDefault(val, typ, dv) {
+		return nil
+	}
 	switch typ.Which() {
 	case schema.Type_Which_bool:
 		v := val.Bool()
@@ -239,7 +272,7 @@ func (ins *inserter) insertField(s capnp.Struct, f schema.Field, val reflect.Val
 			if !c.IsValid() {
 				return s.SetPtr(off, capnp.Ptr{})
 			}
-			id := s.Message().AddCap(c)
+			id := s.Message().AddCap(c.AddRef())
 			return s.SetPtr(off, capnp.NewInterface(s.Segment(), id).ToPtr())
 		default:
 			panic("unreachable")
@@ -250,12 +283,15 @@ func (ins *inserter) insertField(s capnp.Struct, f schema.Field, val reflect.Val
 	return nil
 }
 
+// capPtr adds a new reference to the client in val to seg's message
+// and returns an interface pointer to it.  The caller's reference in
+// val is left untouched.
 func capPtr(seg *capnp.Segment, val reflect.Value) capnp.Ptr {
 	client := val.Convert(clientType).Interface().(capnp.Client)
 	if !client.IsValid() {
 		return capnp.Ptr{}
 	}
-	cap := seg.Message().AddCap(client)
+	cap := seg.Message().AddCap(client.AddRef())
 	iface := capnp.NewInterface(seg, cap)
 	return iface.ToPtr()
 }
@@ -485,6 +521,62 @@ func isFieldInBounds(sz capnp.ObjectSize, off uint32, t schema.Type) bool {
 	}
 }
 
+// isDefault reports whether val is equal to the default value dv of a
+// field of type typ, meaning that the field can be left unset.
+func isDefault(val reflect.Value, typ schema.Type, dv schema.Value) bool {
+	switch typ.Which() {
+	case schema.Type_Which_void:
+		return true
+	case schema.Type_Which_bool:
+		return val.Bool() == dv.Bool()
+	case schema.Type_Which_int8:
+		return int8(val.Int()) == dv.Int8()
+	case schema.Type_Which_int16:
+		return int16(val.Int()) == dv.Int16()
+	case schema.Type_Which_int32:
+		return int32(val.Int()) == dv.Int32()
+	case schema.Type_Which_int64:
+		return val.Int() == dv.Int64()
+	case schema.Type_Which_uint8:
+		return uint8(val.Uint()) == dv.Uint8()
+	case schema.Type_Which_uint16:
+		return uint16(val.Uint()) == dv.Uint16()
+	case schema.Type_Which_enum:
+		return uint16(val.Uint()) == dv.Enum()
+	case schema.Type_Which_uint32:
+		return uint32(val.Uint()) == dv.Uint32()
+	case schema.Type_Which_uint64:
+		return val.Uint() == dv.Uint64()
+	case schema.Type_Which_float32:
+		// Compare bits so that -0 and NaN payloads are preserved.
+		return math.Float32bits(float32(val.Float())) == math.Float32bits(dv.Float32())
+	case schema.Type_Which_float64:
+		return math.Float64bits(val.Float()) == math.Float64bits(dv.Float64())
+	case schema.Type_Which_text:
+		b, _ := dv.TextBytes()
+		if val.Kind() == reflect.String {
+			return bytesStrEqual(b, val.String())
+		}
+		return bytes.Equal(b, val.Bytes())
+	case schema.Type_Which_data:
+		b, _ := dv.Data()
+		return bytes.Equal(b, val.Bytes())
+	case schema.Type_Which_list:
+		// Only empty lists are compared; non-empty lists are always written.
+		p, _ := dv.List()
+		return val.Len() == 0 && p.List().Len() == 0
+	case schema.Type_Which_structType:
+		// A nil pointer is written as null regardless.  A non-pointer
+		// struct is always written: reading a null struct yields the
+		// nested fields' defaults, which need not be zero.
+		return val.Kind() == reflect.Ptr && val.IsNil()
+	case schema.Type_Which_interface:
+		return !val.Convert(clientType).Interface().(capnp.Client).IsValid()
+	default:
+		return false
+	}
+}
+
 func isEmptyValue(v schema.Value) bool {
 	if !v.IsValid() {
 		return false
@@ -2,6 +2,7 @@ package pogs
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"strings"
@@ -9,6 +10,7 @@ import (
 
 	"capnproto.org/go/capnp/v3"
 	air "capnproto.org/go/capnp/v3/internal/aircraftlib"
+	rpccp "capnproto.org/go/capnp/v3/std/capnp/rpc"
 	"github.com/kylelemons/godebug/pretty"
 )
 
@@ -977,6 +979,220 @@ func TestExtraFields(t *testing.T) {
 	}
 }
 
+type Defaults struct {
+	Text  string
+	Data  []byte
+	Float float32
+	Int   int32
+	Uint  uint32
+}
+
+func TestInsert_OmitDefaults(t *testing.T) {
+	in := &Defaults{
+		Text:  "foo",
+		Data:  []byte("bar"),
+		Float: 3.14,
+		Int:   -123,
+		Uint:  7,
+	}
+	insert := func(opts *InsertOptions) []byte {
+		t.Helper()
+		msg, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+		if err != nil {
+			t.Fatalf("NewMessage: %v", err)
+		}
+		d, err := air.NewRootDefaults(seg)
+		if err != nil {
+			t.Fatalf("NewRootDefaults: %v", err)
+		}
+		if err := InsertWithOptions(air.Defaults_TypeID, capnp.Struct(d), in, opts); err != nil {
+			t.Fatalf("InsertWithOptions(%s, %+v): %v", zpretty.Sprint(in), opts, err)
+		}
+		data, err := msg.Marshal()
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		return data
+	}
+	full := insert(nil)
+	omitted := insert(&InsertOptions{OmitDefaults: true})
+	if len(omitted) >= len(full) {
+		t.Errorf("len(OmitDefaults message) = %d; want < %d", len(omitted), len(full))
+	}
+
+	msg, err := capnp.Unmarshal(omitted)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	d, err := air.ReadRootDefaults(msg)
+	if err != nil {
+		t.Fatalf("ReadRootDefaults: %v", err)
+	}
+	if d.HasText() || d.HasData() {
+		t.Errorf("OmitDefaults wrote default pointer fields: HasText() = %t, HasData() = %t", d.HasText(), d.HasData())
+	}
+	out := new(Defaults)
+	if err := Extract(out, air.Defaults_TypeID, capnp.Struct(d)); err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+	if !bytes.Equal(out.Data, in.Data) || out.Text != in.Text || out.Float != in.Float || out.Int != in.Int || out.Uint != in.Uint {
+		t.Errorf("Extract(OmitDefaults message) = %s; want %s", zpretty.Sprint(out), zpretty.Sprint(in))
+	}
+}
+
+type rpcFinish struct {
+	QuestionId        uint32
+	ReleaseResultCaps bool
+}
+
+type rpcMessage struct {
+	Which  rpccp.Message_Which
+	Finish rpcFinish
+}
+
+func TestInsert_OmitDefaultsNestedStruct(t *testing.T) {
+	// Finish.releaseResultCaps defaults to true, so a zero Finish
+	// must be written out rather than left null.
+	in := &rpcMessage{Which: rpccp.Message_Which_finish}
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatalf("NewMessage: %v", err)
+	}
+	m, err := rpccp.NewRootMessage(seg)
+	if err != nil {
+		t.Fatalf("NewRootMessage: %v", err)
+	}
+	if err := InsertWithOptions(rpccp.Message_TypeID, capnp.Struct(m), in, &InsertOptions{OmitDefaults: true}); err != nil {
+		t.Fatalf("InsertWithOptions(%s): %v", zpretty.Sprint(in), err)
+	}
+	out := new(rpcMessage)
+	if err := Extract(out, rpccp.Message_TypeID, capnp.Struct(m)); err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+	if *out != *in {
+		t.Errorf("Extract(OmitDefaults message) = %s; want %s", zpretty.Sprint(out), zpretty.Sprint(in))
+	}
+}
+
+func TestExtract_MaterializeDefaults(t *testing.T) {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatalf("NewMessage: %v", err)
+	}
+	z, err := air.NewRootZ(seg)
+	if err != nil {
+		t.Fatalf("NewRootZ: %v", err)
+	}
+	if err := zfill(z, &Z{Which: air.Z_Which_planebase}); err != nil {
+		t.Fatalf("zfill: %v", err)
+	}
+
+	out := new(Z)
+	if err := Extract(out, air.Z_TypeID, capnp.Struct(z)); err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+	if out.Planebase != nil {
+		t.Errorf("Extract(null planebase).Planebase = %s; want nil", zpretty.Sprint(out.Planebase))
+	}
+
+	out = new(Z)
+	err = ExtractWithOptions(out, air.Z_TypeID, capnp.Struct(z), &ExtractOptions{MaterializeDefaults: true})
+	if err != nil {
+		t.Fatalf("ExtractWithOptions: %v", err)
+	}
+	if out.Planebase == nil {
+		t.Fatal("ExtractWithOptions(null planebase, MaterializeDefaults).Planebase = nil; want non-nil")
+	}
+	if out.Planebase.Homes == nil || len(out.Planebase.Homes) != 0 {
+		t.Errorf("ExtractWithOptions(null planebase, MaterializeDefaults).Planebase.Homes = %v; want empty, non-nil", out.Planebase.Homes)
+	}
+}
+
+type EchoBase struct {
+	Echo air.Echo
+}
+
+type echoServer struct{}
+
+func (echoServer) Echo(ctx context.Context, call air.Echo_echo) error {
+	in, err := call.Args().In()
+	if err != nil {
+		return err
+	}
+	res, err := call.AllocResults()
+	if err != nil {
+		return err
+	}
+	return res.SetOut(in)
+}
+
+func TestInsertExtract_Capability(t *testing.T) {
+	msg, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatalf("NewMessage: %v", err)
+	}
+	base, err := air.NewRootEchoBase(seg)
+	if err != nil {
+		t.Fatalf("NewRootEchoBase: %v", err)
+	}
+	in := &EchoBase{Echo: air.Echo_ServerToClient(echoServer{})}
+	err = Insert(air.EchoBase_TypeID, capnp.Struct(base), in)
+	if err != nil {
+		t.Fatalf("Insert(%s): %v", zpretty.Sprint(in), err)
+	}
+	// The message holds its own reference.
+	in.Echo.Release()
+
+	out := new(EchoBase)
+	if err := Extract(out, air.EchoBase_TypeID, capnp.Struct(base)); err != nil {
+		t.Fatalf("Extract(%v): %v", base, err)
+	}
+	// The extracted client must outlive the message's reference.
+	msg.Reset(nil)
+	defer out.Echo.Release()
+	if !out.Echo.IsValid() {
+		t.Fatal("extracted Echo is not valid")
+	}
+
+	ans, release := out.Echo.Echo(context.Background(), func(p air.Echo_echo_Params) error {
+		return p.SetIn("hello")
+	})
+	defer release()
+	res, err := ans.Struct()
+	if err != nil {
+		t.Fatalf("Echo: %v", err)
+	}
+	if s, _ := res.Out(); s != "hello" {
+		t.Errorf("Echo(\"hello\") = %q; want \"hello\"", s)
+	}
+}
+
+func TestInsertExtract_NullCapability(t *testing.T) {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatalf("NewMessage: %v", err)
+	}
+	base, err := air.NewRootEchoBase(seg)
+	if err != nil {
+		t.Fatalf("NewRootEchoBase: %v", err)
+	}
+	if err := Insert(air.EchoBase_TypeID, capnp.Struct(base), new(EchoBase)); err != nil {
+		t.Fatalf("Insert(null capability): %v", err)
+	}
+	if base.HasEcho() {
+		t.Error("Insert(null capability) set echo pointer")
+	}
+	out := &EchoBase{Echo: air.Echo_ServerToClient(echoServer{})}
+	old := out.Echo
+	defer old.Release()
+	if err := Extract(out, air.EchoBase_TypeID, capnp.Struct(base)); err != nil {
+		t.Fatalf("Extract(%v): %v", base, err)
+	}
+	if out.Echo != (air.Echo{}) {
+		t.Errorf("Extract(null capability) = %v; want zero client", out.Echo)
+	}
+}
+
 func zequal(g *Z, c air.Z) (bool, error) {
 	if g.Which != c.Which() {
 		return false, nil
@@ -148,7 +148,8 @@ func (p Ptr) text() (b []byte, ok bool) {
 }
 
 // Data attempts to convert p into Data, returning nil if p is not a
-// valid 1-byte list pointer.
+// valid 1-byte list pointer.  It returns a slice directly into the
+// segment: see Struct.DataField.
 func (p Ptr) Data() []byte {
 	return p.DataDefault(nil)
 }
@@ -167,6 +168,78 @@ func (p Ptr) DataDefault(def []byte) []byte {
 	return b
 }
 
+// AsStruct converts p to a Struct, returning a *PtrTypeError if p
+// holds a list or interface pointer.  A null pointer converts to the
+// zero Struct.
+func (p Ptr) AsStruct() (Struct, error) {
+	if p.IsValid() && p.flags.ptrType() != structPtrType {
+		return Struct{}, &PtrTypeError{Want: "struct", Got: p.kind()}
+	}
+	return p.Struct(), nil
+}
+
+// AsList converts p to a List, returning a *PtrTypeError if p holds a
+// struct or interface pointer.  A null pointer converts to the zero
+// List.
+func (p Ptr) AsList() (List, error) {
+	if p.IsValid() && p.flags.ptrType() != listPtrType {
+		return List{}, &PtrTypeError{Want: "list", Got: p.kind()}
+	}
+	return p.List(), nil
+}
+
+// AsInterface converts p to an Interface, returning a *PtrTypeError if
+// p holds a struct or list pointer.  A null pointer converts to the
+// zero Interface.
+func (p Ptr) AsInterface() (Interface, error) {
+	if p.IsValid() && p.flags.ptrType() != interfacePtrType {
+		return Interface{}, &PtrTypeError{Want: "interface", Got: p.kind()}
+	}
+	return p.Interface(), nil
+}
+
+// AsText converts p to Text, returning a *PtrTypeError if p holds
+// anything other than a 1-byte list pointer, or an error if the list
+// is not null-terminated.  A null pointer converts to the empty string.
+func (p Ptr) AsText() (string, error) {
+	if !p.IsValid() {
+		return "", nil
+	}
+	if !isOneByteList(p) {
+		return "", &PtrTypeError{Want: "text", Got: p.kind()}
+	}
+	b, ok := p.text()
+	if !ok {
+		return "", errorf("text is not null-terminated")
+	}
+	return string(b), nil
+}
+
+// kind returns the name of the kind of object that p points to.
+func (p Ptr) kind() string {
+	switch {
+	case !p.IsValid():
+		return "null"
+	case p.flags.ptrType() == structPtrType:
+		return "struct"
+	case p.flags.ptrType() == interfacePtrType:
+		return "interface"
+	default:
+		return "list"
+	}
+}
+
+// A PtrTypeError is returned by Ptr's As methods when the pointer
+// holds a different kind of object than the one requested.
+type PtrTypeError struct {
+	Want string // "struct", "list", "interface", or "text"
+	Got  string // "struct", "list", or "interface"
+}
+
+func (e *PtrTypeError) Error() string {
+	return "capnp: want " + e.Want + " pointer, got " + e.Got
+}
+
 // IsValid reports whether p is valid.
 func (p Ptr) IsValid() bool {
 	return p.seg != nil
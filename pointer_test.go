@@ -163,3 +163,102 @@ func TestEqual(t *testing.T) {
 		})
 	}
 }
+
+func TestPtrAs(t *testing.T) {
+	_, seg, err := NewMessage(SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each value is stored in the any-pointer field of holder and read
+	// back before being converted.
+	holder, err := NewStruct(seg, ObjectSize{PointerCount: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip := func(p Ptr) Ptr {
+		t.Helper()
+		if err := holder.SetPtr(0, p); err != nil {
+			t.Fatal(err)
+		}
+		p, err := holder.Ptr(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	st, err := NewStruct(seg, ObjectSize{DataSize: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.SetUint64(0, 42)
+	list, err := NewInt32List(seg, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := NewText(seg, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	structPtr := roundTrip(st.ToPtr())
+	if s, err := structPtr.AsStruct(); err != nil {
+		t.Error("AsStruct on struct:", err)
+	} else if s.Uint64(0) != 42 {
+		t.Errorf("AsStruct on struct: field = %d; want 42", s.Uint64(0))
+	}
+	listPtr := roundTrip(list.ToPtr())
+	if l, err := listPtr.AsList(); err != nil {
+		t.Error("AsList on list:", err)
+	} else if l.Len() != 3 {
+		t.Errorf("AsList on list: len = %d; want 3", l.Len())
+	}
+	textPtr := roundTrip(text.ToPtr())
+	if s, err := textPtr.AsText(); err != nil {
+		t.Error("AsText on text:", err)
+	} else if s != "hello" {
+		t.Errorf("AsText on text = %q; want \"hello\"", s)
+	}
+	ifacePtr := roundTrip(NewInterface(seg, 7).ToPtr())
+	if i, err := ifacePtr.AsInterface(); err != nil {
+		t.Error("AsInterface on interface:", err)
+	} else if i.Capability() != 7 {
+		t.Errorf("AsInterface on interface: capability = %d; want 7", i.Capability())
+	}
+
+	mismatches := []struct {
+		name string
+		f    func() error
+		want PtrTypeError
+	}{
+		{"AsStruct on list", func() error { _, err := listPtr.AsStruct(); return err }, PtrTypeError{"struct", "list"}},
+		{"AsStruct on interface", func() error { _, err := ifacePtr.AsStruct(); return err }, PtrTypeError{"struct", "interface"}},
+		{"AsList on struct", func() error { _, err := structPtr.AsList(); return err }, PtrTypeError{"list", "struct"}},
+		{"AsInterface on text", func() error { _, err := textPtr.AsInterface(); return err }, PtrTypeError{"interface", "list"}},
+		{"AsText on struct", func() error { _, err := structPtr.AsText(); return err }, PtrTypeError{"text", "struct"}},
+		{"AsText on Int32 list", func() error { _, err := listPtr.AsText(); return err }, PtrTypeError{"text", "list"}},
+	}
+	for _, test := range mismatches {
+		err := test.f()
+		var pte *PtrTypeError
+		if !errors.As(err, &pte) {
+			t.Errorf("%s: error = %v; want *PtrTypeError", test.name, err)
+		} else if *pte != test.want {
+			t.Errorf("%s: error = %+v; want %+v", test.name, *pte, test.want)
+		}
+	}
+
+	// A null pointer converts to any kind.
+	var null Ptr
+	if _, err := null.AsStruct(); err != nil {
+		t.Error("AsStruct on null:", err)
+	}
+	if _, err := null.AsList(); err != nil {
+		t.Error("AsList on null:", err)
+	}
+	if _, err := null.AsInterface(); err != nil {
+		t.Error("AsInterface on null:", err)
+	}
+	if s, err := null.AsText(); err != nil || s != "" {
+		t.Errorf("AsText on null = %q, %v; want \"\", <nil>", s, err)
+	}
+}
@@ -0,0 +1,113 @@
+//go:build capnpdebug
+// +build capnpdebug
+
+package capnp
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"unsafe"
+)
+
+// refDebug records where each open reference to a clientHook was
+// created.  It is only compiled in with the capnpdebug build tag; see
+// Client.RefCount.
+type refDebug struct {
+	// sites is keyed by the address of each reference's client, so that
+	// it does not keep an unreleased client from being reported by
+	// SetClientLeakFunc.
+	sites map[uintptr]string
+
+	// released holds references that were released before their records
+	// were moved here from a resolved promise.
+	released map[uintptr]struct{}
+}
+
+// add records the caller skip frames above add as the creator of c.
+// The caller must be holding the clientHook's mutex or be its only user.
+func (d *refDebug) add(c *client, skip int) {
+	site := "<unknown>"
+	if _, file, line, ok := runtime.Caller(skip + 1); ok {
+		site = fmt.Sprintf("%s:%d", file, line)
+	}
+	if d.sites == nil {
+		d.sites = make(map[uintptr]string)
+	}
+	d.sites[clientKey(c)] = site
+}
+
+// remove forgets c.  The caller must be holding the clientHook's mutex.
+func (d *refDebug) remove(c *client) {
+	k := clientKey(c)
+	if _, ok := d.sites[k]; ok {
+		delete(d.sites, k)
+		return
+	}
+	if d.released == nil {
+		d.released = make(map[uintptr]struct{})
+	}
+	d.released[k] = struct{}{}
+}
+
+// moveTo transfers the records to dst when a promise resolves.  The
+// caller must be holding dst's mutex, and no other goroutine may use d.
+func (d *refDebug) moveTo(dst *refDebug) {
+	for k, site := range d.sites {
+		if _, ok := dst.released[k]; ok {
+			delete(dst.released, k)
+			continue
+		}
+		if dst.sites == nil {
+			dst.sites = make(map[uintptr]string)
+		}
+		dst.sites[k] = site
+	}
+	d.sites = nil
+}
+
+func clientKey(c *client) uintptr {
+	return uintptr(unsafe.Pointer(c))
+}
+
+// RefCount returns the number of open references to the capability that
+// c refers to, including c itself, or 0 if c is null or released.  It is
+// only available with the capnpdebug build tag, and is intended for
+// tests that check that references are balanced.
+func (c Client) RefCount() int {
+	h := c.lockHook()
+	if h == nil {
+		return 0
+	}
+	defer h.mu.Unlock()
+	return h.refs
+}
+
+// RefSites returns the call sites, as "file:line", of NewClient,
+// NewPromisedClient, or AddRef calls that created the open references
+// to the capability that c refers to.  It is only available with the
+// capnpdebug build tag.
+func (c Client) RefSites() []string {
+	h := c.lockHook()
+	if h == nil {
+		return nil
+	}
+	sites := make([]string, 0, len(h.debug.sites))
+	for _, site := range h.debug.sites {
+		sites = append(sites, site)
+	}
+	h.mu.Unlock()
+	sort.Strings(sites)
+	return sites
+}
+
+// lockHook returns c's resolved hook with its mutex held, or nil if c is
+// null or released.
+func (c Client) lockHook() *clientHook {
+	h, _, _ := c.peek()
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	return resolveHook(h)
+}
@@ -0,0 +1,12 @@
+//go:build !capnpdebug
+// +build !capnpdebug
+
+package capnp
+
+// refDebug is empty without the capnpdebug build tag, so that recording
+// reference call sites costs nothing.
+type refDebug struct{}
+
+func (*refDebug) add(*client, int)     {}
+func (*refDebug) remove(*client)       {}
+func (*refDebug) moveTo(dst *refDebug) {}
@@ -0,0 +1,73 @@
+//go:build capnpdebug
+// +build capnpdebug
+
+package capnp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestClientRefCount(t *testing.T) {
+	c := NewClient(new(dummyHook))
+	if n := c.RefCount(); n != 1 {
+		t.Fatalf("new client RefCount() = %d; want 1", n)
+	}
+	var refs []Client
+	for i := 0; i < 3; i++ {
+		refs = append(refs, c.AddRef())
+	}
+	if n := c.RefCount(); n != 4 {
+		t.Errorf("after 3 AddRefs, RefCount() = %d; want 4", n)
+	}
+	for _, r := range refs {
+		r.Release()
+	}
+	if n := c.RefCount(); n != 1 {
+		t.Errorf("after releasing refs, RefCount() = %d; want 1", n)
+	}
+
+	// An intentional leak is caught, along with where it was made.
+	leak := c.AddRef()
+	if n := c.RefCount(); n != 2 {
+		t.Errorf("with leaked ref, RefCount() = %d; want 2", n)
+	}
+	sites := c.RefSites()
+	if len(sites) != 2 {
+		t.Fatalf("RefSites() = %q; want 2 sites", sites)
+	}
+	for _, site := range sites {
+		if !strings.Contains(site, "refdebug_test.go:") {
+			t.Errorf("site %q is not in refdebug_test.go", site)
+		}
+	}
+	leak.Release()
+	c.Release()
+	if n := c.RefCount(); n != 0 {
+		t.Errorf("released client RefCount() = %d; want 0", n)
+	}
+}
+
+func TestClientRefCount_Promise(t *testing.T) {
+	p, cp := NewPromisedClient(new(dummyHook))
+	ref := p.AddRef()
+	c := NewClient(new(dummyHook))
+	cp.Fulfill(c)
+
+	// The promise's references move to the client that it resolved to.
+	if n := c.RefCount(); n != 3 {
+		t.Errorf("resolved promise RefCount() = %d; want 3", n)
+	}
+	if sites := c.RefSites(); len(sites) != 3 {
+		t.Errorf("resolved promise RefSites() = %q; want 3 sites", sites)
+	}
+	p.Release()
+	c.Release()
+	if n := ref.RefCount(); n != 1 {
+		t.Errorf("RefCount() of last ref = %d; want 1", n)
+	}
+	if sites := ref.RefSites(); len(sites) != 1 {
+		t.Errorf("RefSites() of last ref = %q; want 1 site", sites)
+	}
+	ref.Release()
+}
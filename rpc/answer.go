@@ -5,9 +5,9 @@ import (
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"capnproto.org/go/capnp/v3"
-	"capnproto.org/go/capnp/v3/exc"
 	"capnproto.org/go/capnp/v3/internal/syncutil"
 	rpccp "capnproto.org/go/capnp/v3/std/capnp/rpc"
 )
@@ -74,6 +74,10 @@ type answer struct {
 	// the Return message.  Can only be read after resultsReady is set in
 	// flags.
 	err error
+
+	// ttl evicts the answer if it does not receive a finish in time
+	// after its return is sent.  It is nil if Options.AnswerTTL is zero.
+	ttl *time.Timer
 }
 
 type answerFlags uint8
@@ -97,7 +101,7 @@ func errorAnswer(c *Conn, id answerID, err error) *answer {
 
 // newReturn creates a new Return message.
 func (c *Conn) newReturn(ctx context.Context) (rpccp.Return, func(), capnp.ReleaseFunc, error) {
-	msg, send, releaseMsg, err := c.transport.NewMessage(ctx)
+	msg, send, releaseMsg, err := c.newMessage(ctx)
 	if err != nil {
 		return rpccp.Return{}, nil, nil, rpcerr.Failedf("create return: %w", err)
 	}
@@ -266,6 +270,7 @@ func (ans *answer) sendReturn() (releaseList, error) {
 	}
 	ans.flags |= returnSent
 	if ans.flags&finishReceived == 0 {
+		ans.startTTL()
 		return nil, nil
 	}
 	rl, err := ans.destroy()
@@ -299,7 +304,7 @@ func (ans *answer) sendException(ex error) releaseList {
 		if e, err := ans.ret.NewException(); err != nil {
 			ans.c.er.ReportError(fmt.Errorf("send exception: %w", err))
 		} else {
-			e.SetType(rpccp.Exception_Type(exc.TypeOf(ex)))
+			e.SetType(rpccp.Exception_Type(exceptionType(ex)))
 			if err := e.SetReason(ex.Error()); err != nil {
 				ans.c.er.ReportError(fmt.Errorf("send exception: %w", err))
 			} else {
@@ -316,6 +321,7 @@ func (ans *answer) sendException(ex error) releaseList {
 	}
 	ans.flags |= returnSent
 	if ans.flags&finishReceived == 0 {
+		ans.startTTL()
 		return nil
 	}
 	// destroy will never return an error because sendException does
@@ -333,6 +339,9 @@ func (ans *answer) sendException(ex error) releaseList {
 //
 // shutdown has its own strategy for cleaning up an answer.
 func (ans *answer) destroy() (releaseList, error) {
+	if ans.ttl != nil {
+		ans.ttl.Stop()
+	}
 	delete(ans.c.answers, ans.id)
 	rl := releaseList(ans.resultCapTable)
 	if ans.flags&releaseResultCapsFlag == 0 || len(ans.exportRefs) == 0 {
@@ -341,3 +350,53 @@ func (ans *answer) destroy() (releaseList, error) {
 	exportReleases, err := ans.c.releaseExportRefs(ans.exportRefs)
 	return append(rl, exportReleases...), err
 }
+
+// startTTL arranges for the answer to be evicted if it has not received
+// a finish after the Conn's AnswerTTL.  The caller must be holding onto
+// ans.c.mu.
+func (ans *answer) startTTL() {
+	if ans.c.answerTTL <= 0 {
+		return
+	}
+	ans.ttl = time.AfterFunc(ans.c.answerTTL, ans.evict)
+}
+
+// evict releases the results of an answer that returned but never
+// received a finish.  The answer is replaced by a placeholder, so that
+// pipelined calls on it fail and a late finish is still accepted, until
+// another AnswerTTL has passed.  The caller MUST NOT hold ans.c.mu.
+func (ans *answer) evict() {
+	c := ans.c
+	c.mu.Lock()
+	if c.answers[ans.id] != ans || ans.flags&finishReceived != 0 {
+		// Finished or shut down in the meantime.
+		c.mu.Unlock()
+		return
+	}
+	err := rpcerr.Failedf("answer ID %d evicted: no finish received within %v", ans.id, c.answerTTL)
+	tomb := errorAnswer(c, ans.id, err)
+	tomb.releaseMsg = func() {}
+	tomb.exportRefs = ans.exportRefs // released by a late finish
+	tomb.ttl = time.AfterFunc(c.answerTTL, tomb.forget)
+	c.answers[ans.id] = tomb
+	rl := releaseList(ans.resultCapTable)
+	ans.resultCapTable = nil
+	c.mu.Unlock()
+
+	c.er.warn("answer evicted", err, "id", uint32(ans.id))
+	ans.releaseMsg()
+	rl.release()
+}
+
+// forget removes the placeholder left by evict from the answer table,
+// freeing its ID.  The exports referred to by the results are kept
+// until the remote vat releases them, since a finish can no longer do
+// so.  The caller MUST NOT hold ans.c.mu.
+func (ans *answer) forget() {
+	c := ans.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.answers[ans.id] == ans && ans.flags&finishReceived == 0 {
+		delete(c.answers, ans.id)
+	}
+}
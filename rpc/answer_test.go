@@ -0,0 +1,205 @@
+package rpc_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"capnproto.org/go/capnp/v3"
+	"capnproto.org/go/capnp/v3/pogs"
+	"capnproto.org/go/capnp/v3/rpc"
+	testcp "capnproto.org/go/capnp/v3/rpc/internal/testcapnp"
+	"capnproto.org/go/capnp/v3/rpc/transport"
+	rpccp "capnproto.org/go/capnp/v3/std/capnp/rpc"
+)
+
+// errorChan is an ErrorReporter that sends errors on a channel, dropping
+// them if the channel is full.
+type errorChan chan error
+
+func (ec errorChan) ReportError(err error) {
+	select {
+	case ec <- err:
+	default:
+	}
+}
+
+// TestAnswerTTL returns the bootstrap interface to a peer that never
+// finishes the answer, and checks that once the TTL elapses, calls
+// pipelined on the answer fail without ending the connection.
+func TestAnswerTTL(t *testing.T) {
+	t.Parallel()
+
+	errs := make(errorChan, 10)
+	left, right := transport.NewPipe(1)
+	p1, p2 := rpc.NewTransport(left), rpc.NewTransport(right)
+	conn := rpc.NewConn(p1, &rpc.Options{
+		BootstrapClient: capnp.Client(testcp.PingPong_ServerToClient(pingPongServer{})),
+		ErrorReporter:   errs,
+		AnswerTTL:       50 * time.Millisecond,
+	})
+	defer finishTest(t, conn, p2)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const bootstrapQID = 1
+	err := sendMessage(ctx, p2, &rpcMessage{
+		Which:     rpccp.Message_Which_bootstrap,
+		Bootstrap: &rpcBootstrap{QuestionID: bootstrapQID},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := recvBootstrapReturn(ctx, p2, bootstrapQID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Don't send finish, and wait for the answer to be evicted.
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "evicted") {
+			t.Fatal("unexpected error:", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("answer not evicted")
+	}
+
+	// A call pipelined on the evicted answer fails.
+	const callQID = 2
+	{
+		msg, send, release, err := p2.NewMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		params, err := capnp.NewStruct(msg.Segment(), capnp.ObjectSize{DataSize: 8})
+		if err != nil {
+			t.Fatal(err)
+		}
+		params.SetUint64(0, 42)
+		err = pogs.Insert(rpccp.Message_TypeID, capnp.Struct(msg), &rpcMessage{
+			Which: rpccp.Message_Which_call,
+			Call: &rpcCall{
+				QuestionID: callQID,
+				Target: rpcMessageTarget{
+					Which:          rpccp.MessageTarget_Which_promisedAnswer,
+					PromisedAnswer: &rpcPromisedAnswer{QuestionID: bootstrapQID},
+				},
+				InterfaceID: testcp.PingPong_TypeID,
+				MethodID:    0,
+				Params:      rpcPayload{Content: params.ToPtr()},
+			},
+		})
+		if err != nil {
+			release()
+			t.Fatal(err)
+		}
+		err = send()
+		release()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	rmsg, release, err := recvMessage(ctx, p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if rmsg.Which != rpccp.Message_Which_return || rmsg.Return.AnswerID != callQID {
+		t.Fatalf("received %v; want return for question %d", rmsg.Which, callQID)
+	}
+	if rmsg.Return.Which != rpccp.Return_Which_exception {
+		t.Fatalf("return is %v; want exception", rmsg.Return.Which)
+	}
+	if !strings.Contains(rmsg.Return.Exception.Reason, "evicted") {
+		t.Errorf("exception reason = %q; want it to mention eviction", rmsg.Return.Exception.Reason)
+	}
+
+	// Late finishes are still accepted.
+	for _, qid := range []uint32{bootstrapQID, callQID} {
+		err := sendMessage(ctx, p2, &rpcMessage{
+			Which:  rpccp.Message_Which_finish,
+			Finish: &rpcFinish{QuestionID: qid, ReleaseResultCaps: true},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	timeout := time.After(20 * time.Millisecond)
+	for {
+		select {
+		case <-conn.Done():
+			t.Fatal("conn shut down after late finish")
+		case err := <-errs:
+			// The call's own answer may be evicted before its finish
+			// arrives.  Finishing an answer twice, or one that the conn
+			// does not know, would be reported though.
+			if !strings.Contains(err.Error(), "evicted") {
+				t.Fatal("error after late finish:", err)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// TestAnswerTTL_Forget checks that an evicted answer's ID is freed
+// after the second TTL, so that the table does not keep a placeholder
+// for every answer that a peer never finishes.
+func TestAnswerTTL_Forget(t *testing.T) {
+	t.Parallel()
+
+	const ttl = 10 * time.Millisecond
+	errs := make(errorChan, 10)
+	left, right := transport.NewPipe(1)
+	p1, p2 := rpc.NewTransport(left), rpc.NewTransport(right)
+	conn := rpc.NewConn(p1, &rpc.Options{
+		BootstrapClient: capnp.Client(testcp.PingPong_ServerToClient(pingPongServer{})),
+		ErrorReporter:   errs,
+		AnswerTTL:       ttl,
+	})
+	defer finishTest(t, conn, p2)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const qid = 1
+	bootstrap := func() {
+		t.Helper()
+		err := sendMessage(ctx, p2, &rpcMessage{
+			Which:     rpccp.Message_Which_bootstrap,
+			Bootstrap: &rpcBootstrap{QuestionID: qid},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := recvBootstrapReturn(ctx, p2, qid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bootstrap()
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "evicted") {
+			t.Fatal("unexpected error:", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("answer not evicted")
+	}
+
+	// Once the placeholder is gone, the ID can be used again.  Had it
+	// stayed, reusing the ID would end the connection.
+	time.Sleep(3 * ttl)
+	bootstrap()
+	err := sendMessage(ctx, p2, &rpcMessage{
+		Which:  rpccp.Message_Which_finish,
+		Finish: &rpcFinish{QuestionID: qid},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-conn.Done():
+		t.Fatal("conn shut down after reusing a forgotten answer ID")
+	case <-time.After(2 * ttl):
+	}
+}
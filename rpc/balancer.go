@@ -0,0 +1,165 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+
+	"capnproto.org/go/capnp/v3"
+)
+
+// A Strategy selects the backend that a client created by NewBalancer
+// sends each call to.
+type Strategy int
+
+const (
+	// RoundRobin sends calls to each backend in turn.
+	RoundRobin Strategy = iota
+
+	// LeastInFlight sends each call to the backend with the fewest calls
+	// that have not yet returned, breaking ties in round-robin order.
+	LeastInFlight
+)
+
+// NewBalancer returns a client that spreads the calls made on it
+// across backends according to strategy.  It takes ownership of the
+// backends, releasing them when the returned client is released.
+//
+// A backend is skipped for all later calls once a call made on it fails
+// with a disconnected exception.  The failed call is not retried; see
+// NewReconnectingClient for that.  Once every backend has been skipped,
+// calls fail with a disconnected exception.
+func NewBalancer(backends []capnp.Client, strategy Strategy) capnp.Client {
+	h := &balancerHook{strategy: strategy}
+	for _, c := range backends {
+		h.backends = append(h.backends, &backend{client: c})
+	}
+	return capnp.NewClient(h)
+}
+
+// balancerHook is the ClientHook for NewBalancer.
+type balancerHook struct {
+	strategy Strategy
+
+	mu       sync.Mutex
+	backends []*backend
+	next     int // index of the backend to consider first
+}
+
+// A backend is one of a balancerHook's clients.  Its fields other than
+// client are protected by balancerHook.mu.
+type backend struct {
+	client   capnp.Client
+	inFlight int
+	failed   bool
+}
+
+// pick chooses the backend for a call and counts the call as in
+// flight, or returns nil if every backend has failed.
+func (h *balancerHook) pick() *backend {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var best *backend
+	bestIdx := 0
+	for i := range h.backends {
+		idx := (h.next + i) % len(h.backends)
+		b := h.backends[idx]
+		if b.failed {
+			continue
+		}
+		if best == nil || h.strategy == LeastInFlight && b.inFlight < best.inFlight {
+			best, bestIdx = b, idx
+		}
+		if h.strategy == RoundRobin {
+			break
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	h.next = bestIdx + 1
+	best.inFlight++
+	return best
+}
+
+// done records that a call on b has returned with err.
+func (h *balancerHook) done(b *backend, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	b.inFlight--
+	if capnp.IsDisconnected(err) {
+		b.failed = true
+	}
+}
+
+func (h *balancerHook) Send(ctx context.Context, s capnp.Send) (*capnp.Answer, capnp.ReleaseFunc) {
+	b := h.pick()
+	if b == nil {
+		return capnp.ErrorAnswer(s.Method, rpcerr.Disconnectedf("balancer: no backends available")), func() {}
+	}
+	// Releasing the call before it returns cancels ctx, which is how
+	// the backend learns that the call is no longer wanted.
+	ctx, cancel := context.WithCancel(ctx)
+	ans, release := b.client.SendCall(ctx, s)
+
+	// Resolve a promise only after the call has been counted as done, so
+	// that a caller that waits for the answer sees the updated counts.
+	p := capnp.NewPromise(s.Method, ans)
+	go func() {
+		defer cancel()
+		res, err := ans.Struct()
+		h.done(b, err)
+		p.Resolve(res.ToPtr(), err)
+	}()
+	return p.Answer(), func() {
+		cancel()
+		finish := func() {
+			p.ReleaseClients()
+			release()
+		}
+		select {
+		case <-p.Answer().Done():
+			finish()
+		default:
+			go func() {
+				<-p.Answer().Done()
+				finish()
+			}()
+		}
+	}
+}
+
+func (h *balancerHook) Recv(ctx context.Context, r capnp.Recv) capnp.PipelineCaller {
+	b := h.pick()
+	if b == nil {
+		r.Reject(rpcerr.Disconnectedf("balancer: no backends available"))
+		return nil
+	}
+	r.Returner = balancerReturner{r.Returner, h, b}
+	return b.client.RecvCall(ctx, r)
+}
+
+func (h *balancerHook) Brand() capnp.Brand {
+	return capnp.Brand{}
+}
+
+func (h *balancerHook) Shutdown() {
+	h.mu.Lock()
+	backends := h.backends
+	h.backends = nil
+	h.mu.Unlock()
+	for _, b := range backends {
+		b.client.Release()
+	}
+}
+
+// balancerReturner counts a received call as done when it returns.
+type balancerReturner struct {
+	capnp.Returner
+	h *balancerHook
+	b *backend
+}
+
+func (r balancerReturner) Return(e error) {
+	r.h.done(r.b, e)
+	r.Returner.Return(e)
+}
@@ -0,0 +1,180 @@
+package rpc_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"capnproto.org/go/capnp/v3"
+	"capnproto.org/go/capnp/v3/rpc"
+	"capnproto.org/go/capnp/v3/rpc/internal/testcapnp"
+)
+
+// countingPingServer counts the calls it receives and, if block is not
+// nil, holds each call until block is closed.
+type countingPingServer struct {
+	mu    *sync.Mutex
+	calls *int
+	block <-chan struct{}
+}
+
+func newCountingPingServer(block <-chan struct{}) (testcapnp.PingPong, func() int) {
+	s := countingPingServer{mu: new(sync.Mutex), calls: new(int), block: block}
+	return testcapnp.PingPong_ServerToClient(s), func() int {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return *s.calls
+	}
+}
+
+func (s countingPingServer) EchoNum(ctx context.Context, p testcapnp.PingPong_echoNum) error {
+	s.mu.Lock()
+	*s.calls++
+	s.mu.Unlock()
+	if s.block != nil {
+		p.Ack()
+		select {
+		case <-s.block:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	results, err := p.AllocResults()
+	if err != nil {
+		return err
+	}
+	results.SetN(p.Args().N())
+	return nil
+}
+
+func TestBalancer_RoundRobin(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	var backends []capnp.Client
+	var counts []func() int
+	for i := 0; i < 3; i++ {
+		c, count := newCountingPingServer(nil)
+		backends = append(backends, capnp.Client(c))
+		counts = append(counts, count)
+	}
+	pp := testcapnp.PingPong(rpc.NewBalancer(backends, rpc.RoundRobin))
+	defer pp.Release()
+
+	for i := int64(0); i < 6; i++ {
+		if n, err := echoNum(ctx, pp, i); err != nil || n != i {
+			t.Fatalf("EchoNum(%d) = %d, %v", i, n, err)
+		}
+	}
+	for i, count := range counts {
+		if got := count(); got != 2 {
+			t.Errorf("backend %d got %d calls; want 2", i, got)
+		}
+	}
+}
+
+func TestBalancer_LeastInFlight(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	block := make(chan struct{})
+	slow, slowCount := newCountingPingServer(block)
+	fast1, fast1Count := newCountingPingServer(nil)
+	fast2, fast2Count := newCountingPingServer(nil)
+	pp := testcapnp.PingPong(rpc.NewBalancer([]capnp.Client{
+		capnp.Client(slow),
+		capnp.Client(fast1),
+		capnp.Client(fast2),
+	}, rpc.LeastInFlight))
+	defer pp.Release()
+
+	// The first call goes to the first backend and stays in flight.
+	pending, release := pp.EchoNum(ctx, func(p testcapnp.PingPong_echoNum_Params) error {
+		p.SetN(42)
+		return nil
+	})
+	defer release()
+	for i := int64(0); i < 4; i++ {
+		if n, err := echoNum(ctx, pp, i); err != nil || n != i {
+			t.Fatalf("EchoNum(%d) = %d, %v", i, n, err)
+		}
+	}
+	if got := slowCount(); got != 1 {
+		t.Errorf("busy backend got %d calls; want 1", got)
+	}
+	if got := fast1Count() + fast2Count(); got != 4 {
+		t.Errorf("idle backends got %d calls; want 4", got)
+	}
+
+	close(block)
+	if res, err := pending.Struct(); err != nil || res.N() != 42 {
+		t.Errorf("blocked EchoNum = %d, %v; want 42, <nil>", res.N(), err)
+	}
+}
+
+func TestBalancer_ReleasePending(t *testing.T) {
+	t.Parallel()
+
+	block := make(chan struct{})
+	defer close(block)
+	srv, count := newCountingPingServer(block)
+	pp := testcapnp.PingPong(rpc.NewBalancer([]capnp.Client{capnp.Client(srv)}, rpc.RoundRobin))
+	defer pp.Release()
+
+	future, release := pp.EchoNum(context.Background(), func(p testcapnp.PingPong_echoNum_Params) error {
+		p.SetN(1)
+		return nil
+	})
+	for count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	releaseWithin(t, release)
+	if _, err := future.Struct(); err == nil {
+		t.Error("released call succeeded; want it canceled")
+	}
+}
+
+func TestBalancer_SkipsDisconnected(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	good1, count1 := newCountingPingServer(nil)
+	good2, count2 := newCountingPingServer(nil)
+	pp := testcapnp.PingPong(rpc.NewBalancer([]capnp.Client{
+		capnp.Client(good1),
+		capnp.ErrorClient(capnp.Disconnected("backend gone")),
+		capnp.Client(good2),
+	}, rpc.RoundRobin))
+	defer pp.Release()
+
+	failures := 0
+	for i := int64(0); i < 7; i++ {
+		if _, err := echoNum(ctx, pp, i); capnp.IsDisconnected(err) {
+			failures++
+		} else if err != nil {
+			t.Fatalf("EchoNum(%d): %v", i, err)
+		}
+	}
+	if failures != 1 {
+		t.Errorf("%d calls failed; want 1 before the backend is skipped", failures)
+	}
+	if got := count1() + count2(); got != 6 {
+		t.Errorf("healthy backends got %d calls; want 6", got)
+	}
+}
+
+func TestBalancer_AllDisconnected(t *testing.T) {
+	t.Parallel()
+
+	pp := testcapnp.PingPong(rpc.NewBalancer([]capnp.Client{
+		capnp.ErrorClient(capnp.Disconnected("backend gone")),
+	}, rpc.RoundRobin))
+	defer pp.Release()
+
+	for i := 0; i < 2; i++ {
+		if _, err := echoNum(context.Background(), pp, 1); !capnp.IsDisconnected(err) {
+			t.Errorf("call %d: %v; want disconnected", i, err)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package rpc_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"capnproto.org/go/capnp/v3"
+	"capnproto.org/go/capnp/v3/pogs"
+	"capnproto.org/go/capnp/v3/rpc"
+	"capnproto.org/go/capnp/v3/rpc/transport"
+	rpccp "capnproto.org/go/capnp/v3/std/capnp/rpc"
+)
+
+// TestBootstrapCache calls Bootstrap twice and checks that both clients
+// share one import, which is released with the last reference.
+func TestBootstrapCache(t *testing.T) {
+	t.Parallel()
+
+	left, right := transport.NewPipe(1)
+	p1, p2 := rpc.NewTransport(left), rpc.NewTransport(right)
+	conn := rpc.NewConn(p1, &rpc.Options{
+		ErrorReporter: testErrorReporter{tb: t},
+	})
+	defer finishTest(t, conn, p2)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	a := conn.Bootstrap(ctx)
+	b := conn.Bootstrap(ctx)
+	qid := recvBootstrap(ctx, t, p2)
+	returnBootstrap(ctx, t, p2, qid)
+	if err := a.Resolve(ctx); err != nil {
+		t.Fatal("a.Resolve:", err)
+	}
+	if err := b.Resolve(ctx); err != nil {
+		t.Fatal("b.Resolve:", err)
+	}
+	if a.Identity() != b.Identity() {
+		t.Error("bootstrap clients refer to different imports")
+	}
+	rmsg, release, err := recvMessage(ctx, p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if rmsg.Which != rpccp.Message_Which_finish {
+		t.Fatalf("received %v; want finish", rmsg.Which)
+	}
+
+	// While b is held, Bootstrap returns another reference without
+	// asking the remote vat.
+	a.Release()
+	c := conn.Bootstrap(ctx)
+	if c.Identity() != b.Identity() {
+		t.Error("Bootstrap after releasing one reference returned a different import")
+	}
+	c.Release()
+	b.Release()
+
+	// The import is released once, when the last reference is.
+	rmsg, release, err = recvMessage(ctx, p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if rmsg.Which != rpccp.Message_Which_release {
+		t.Fatalf("received %v; want release", rmsg.Which)
+	}
+	if rmsg.Release.ID != bootstrapExportID || rmsg.Release.ReferenceCount != 1 {
+		t.Errorf("received release of %d references to %d; want 1 reference to %d",
+			rmsg.Release.ReferenceCount, rmsg.Release.ID, bootstrapExportID)
+	}
+}
+
+// TestBootstrapCacheError checks that a bootstrap that failed is not
+// handed out again while a reference to it is held.
+func TestBootstrapCacheError(t *testing.T) {
+	t.Parallel()
+
+	left, right := transport.NewPipe(1)
+	p1, p2 := rpc.NewTransport(left), rpc.NewTransport(right)
+	conn := rpc.NewConn(p1, &rpc.Options{
+		ErrorReporter: testErrorReporter{tb: t},
+	})
+	defer finishTest(t, conn, p2)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	a := conn.Bootstrap(ctx)
+	defer a.Release()
+	qa := recvBootstrap(ctx, t, p2)
+	err := sendMessage(ctx, p2, &rpcMessage{
+		Which: rpccp.Message_Which_return,
+		Return: &rpcReturn{
+			AnswerID: qa,
+			Which:    rpccp.Return_Which_exception,
+			Exception: &rpcException{
+				Type:   rpccp.Exception_Type_failed,
+				Reason: "no bootstrap yet",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Resolve(ctx); err != nil {
+		t.Fatal("a.Resolve:", err)
+	}
+	if a.Snapshot().IsErr() == nil {
+		t.Fatal("bootstrap resolved without error")
+	}
+	rmsg, release, err := recvMessage(ctx, p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if rmsg.Which != rpccp.Message_Which_finish {
+		t.Fatalf("received %v; want finish", rmsg.Which)
+	}
+
+	b := conn.Bootstrap(ctx)
+	defer b.Release()
+	qb := recvBootstrap(ctx, t, p2)
+	returnBootstrap(ctx, t, p2, qb)
+	if err := b.Resolve(ctx); err != nil {
+		t.Fatal("b.Resolve:", err)
+	}
+	if err := b.Snapshot().IsErr(); err != nil {
+		t.Errorf("second bootstrap resolved to %v; want the remote bootstrap", err)
+	}
+}
+
+func TestBootstrapCacheDisabled(t *testing.T) {
+	t.Parallel()
+
+	left, right := transport.NewPipe(1)
+	p1, p2 := rpc.NewTransport(left), rpc.NewTransport(right)
+	conn := rpc.NewConn(p1, &rpc.Options{
+		ErrorReporter:         testErrorReporter{tb: t},
+		DisableBootstrapCache: true,
+	})
+	defer finishTest(t, conn, p2)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	a := conn.Bootstrap(ctx)
+	defer a.Release()
+	qa := recvBootstrap(ctx, t, p2)
+	b := conn.Bootstrap(ctx)
+	defer b.Release()
+	qb := recvBootstrap(ctx, t, p2)
+	if qa == qb {
+		t.Errorf("both bootstraps used question %d", qa)
+	}
+}
+
+func recvBootstrap(ctx context.Context, t *testing.T, p rpc.Transport) uint32 {
+	t.Helper()
+	rmsg, release, err := recvMessage(ctx, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if rmsg.Which != rpccp.Message_Which_bootstrap {
+		t.Fatalf("received %v; want bootstrap", rmsg.Which)
+	}
+	return rmsg.Bootstrap.QuestionID
+}
+
+// returnBootstrap answers question qid with bootstrapExportID.
+func returnBootstrap(ctx context.Context, t *testing.T, p rpc.Transport, qid uint32) {
+	t.Helper()
+	msg, send, release, err := p.NewMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	iptr := capnp.NewInterface(msg.Segment(), 0)
+	err = pogs.Insert(rpccp.Message_TypeID, capnp.Struct(msg), &rpcMessage{
+		Which: rpccp.Message_Which_return,
+		Return: &rpcReturn{
+			AnswerID: qid,
+			Which:    rpccp.Return_Which_results,
+			Results: &rpcPayload{
+				Content: iptr.ToPtr(),
+				CapTable: []rpcCapDescriptor{{
+					Which:        rpccp.CapDescriptor_Which_senderHosted,
+					SenderHosted: bootstrapExportID,
+				}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := send(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,329 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"capnproto.org/go/capnp/v3"
+	"capnproto.org/go/capnp/v3/server"
+)
+
+// Methods of the ByteStream interface from Sandstorm's util.capnp:
+//
+//	interface ByteStream {
+//	  write @0 (data :Data);
+//	  done @1 ();
+//	  expectSize @2 (size :UInt64);
+//	}
+//
+// The interface is push-only: the holder of a ByteStream writes bytes
+// to it, and there is no method to read them back.
+const byteStreamID = 0xcd57387729cfe35f
+
+var (
+	byteStreamWrite = capnp.Method{
+		InterfaceID:   byteStreamID,
+		MethodID:      0,
+		InterfaceName: "util.capnp:ByteStream",
+		MethodName:    "write",
+	}
+	byteStreamDone = capnp.Method{
+		InterfaceID:   byteStreamID,
+		MethodID:      1,
+		InterfaceName: "util.capnp:ByteStream",
+		MethodName:    "done",
+	}
+	byteStreamExpectSize = capnp.Method{
+		InterfaceID:   byteStreamID,
+		MethodID:      2,
+		InterfaceName: "util.capnp:ByteStream",
+		MethodName:    "expectSize",
+	}
+)
+
+// byteStreamChunk is the largest number of bytes sent in one write call.
+const byteStreamChunk = 64 * 1024
+
+// byteStreamWindow is the most bytes that CopyToByteStream and
+// NewByteStreamAdapter's writer have in write calls that have not
+// returned.
+const byteStreamWindow = 4 * byteStreamChunk
+
+// NewByteStreamAdapter returns a writer that sends the bytes written to
+// it to client, which must implement the ByteStream interface from
+// Sandstorm's util.capnp.  It takes ownership of client.
+//
+// Write sends write calls of up to 64 KiB without waiting for them to
+// return, so that several can be in flight at once.  Once 256 KiB are
+// in calls that have not returned, Write waits for the oldest calls
+// before sending more; a flow limiter set on client with SetFlowLimiter
+// can bound this further.  An error from a write call is returned by a
+// later call to Write or by Close.  Close waits for the outstanding
+// calls, calls done, and releases client.
+//
+// ByteStream is push-only, so the returned writer cannot read.  To
+// receive a stream, export a client created by NewByteStreamServer.
+// The writer is not safe for concurrent use.
+func NewByteStreamAdapter(client capnp.Client) io.WriteCloser {
+	return &byteStreamWriter{client: client}
+}
+
+type byteStreamWriter struct {
+	client   capnp.Client
+	pending  []byteStreamCall // in call order
+	inFlight int              // bytes in pending
+	err      error
+	closed   bool
+}
+
+type byteStreamCall struct {
+	ans     *capnp.Answer
+	release capnp.ReleaseFunc
+	n       int // bytes sent
+}
+
+func (w *byteStreamWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("rpc: write to closed byte stream")
+	}
+	w.reap(false)
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > byteStreamChunk {
+			chunk = chunk[:byteStreamChunk]
+		}
+		for len(w.pending) > 0 && w.inFlight+len(chunk) > byteStreamWindow {
+			w.finishOldest()
+		}
+		if w.err != nil {
+			return n - len(p), w.err
+		}
+		p = p[len(chunk):]
+
+		// The arguments may be placed after Write returns, so they
+		// cannot refer to p.
+		data := append([]byte(nil), chunk...)
+		ans, release := w.client.SendCall(context.Background(), capnp.Send{
+			Method:   byteStreamWrite,
+			ArgsSize: capnp.ObjectSize{DataSize: 0, PointerCount: 1},
+			PlaceArgs: func(s capnp.Struct) error {
+				return s.SetData(0, data)
+			},
+		})
+		w.pending = append(w.pending, byteStreamCall{ans: ans, release: release, n: len(data)})
+		w.inFlight += len(data)
+	}
+	return n, nil
+}
+
+// reap releases the write calls that have returned, in order, and
+// records the first error.  If wait is true, reap waits for all of them.
+func (w *byteStreamWriter) reap(wait bool) {
+	for len(w.pending) > 0 {
+		if !wait {
+			select {
+			case <-w.pending[0].ans.Done():
+			default:
+				return
+			}
+		}
+		w.finishOldest()
+	}
+}
+
+// finishOldest waits for the oldest pending write call to return,
+// releases it, and records its error if it is the first.
+func (w *byteStreamWriter) finishOldest() {
+	call := w.pending[0]
+	if _, err := call.ans.Struct(); err != nil && w.err == nil {
+		w.err = rpcerr.Annotate(err, "byte stream write")
+	}
+	call.release()
+	w.pending[0] = byteStreamCall{}
+	w.pending = w.pending[1:]
+	w.inFlight -= call.n
+}
+
+func (w *byteStreamWriter) Close() error {
+	if w.closed {
+		return errors.New("rpc: byte stream already closed")
+	}
+	w.closed = true
+	defer w.client.Release()
+	w.reap(true)
+	if w.err != nil {
+		return w.err
+	}
+	ans, release := w.client.SendCall(context.Background(), capnp.Send{
+		Method: byteStreamDone,
+	})
+	defer release()
+	if _, err := ans.Struct(); err != nil {
+		return rpcerr.Annotate(err, "byte stream done")
+	}
+	return nil
+}
+
+// CopyToByteStream reads src until EOF and sends its bytes to client,
+// which must implement the ByteStream interface from Sandstorm's
+// util.capnp, then calls done.  It returns the number of bytes that
+// client accepted and the first error encountered.  It takes ownership
+// of client, releasing it before returning.
+//
+// Reads are coalesced into write calls of up to 64 KiB, and at most
+// 256 KiB are sent in calls that have not returned; a flow limiter set
+// on client with SetFlowLimiter can bound this further.  If reading src
+// fails, or ctx is canceled, the stream is aborted by releasing client
+// without calling done, which the receiver sees as an incomplete
+// stream.
+func CopyToByteStream(ctx context.Context, client capnp.Client, src io.Reader) (int64, error) {
+	defer client.Release()
+	var (
+		pending  []byteStreamCall // in call order
+		inFlight int
+		written  int64
+	)
+	defer func() {
+		for _, call := range pending {
+			call.release()
+		}
+	}()
+	// wait waits for the oldest pending call to return.
+	wait := func() error {
+		call := pending[0]
+		select {
+		case <-call.ans.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		_, err := call.ans.Struct()
+		call.release()
+		pending[0] = byteStreamCall{}
+		pending = pending[1:]
+		inFlight -= call.n
+		if err != nil {
+			return rpcerr.Annotate(err, "byte stream write")
+		}
+		written += int64(call.n)
+		return nil
+	}
+
+	for {
+		buf := make([]byte, byteStreamChunk)
+		n, rerr := io.ReadFull(src, buf)
+		if n > 0 {
+			for len(pending) > 0 && inFlight+n > byteStreamWindow {
+				if err := wait(); err != nil {
+					return written, err
+				}
+			}
+			data := buf[:n]
+			ans, release := client.SendCall(ctx, capnp.Send{
+				Method:   byteStreamWrite,
+				ArgsSize: capnp.ObjectSize{DataSize: 0, PointerCount: 1},
+				PlaceArgs: func(s capnp.Struct) error {
+					return s.SetData(0, data)
+				},
+			})
+			pending = append(pending, byteStreamCall{ans: ans, release: release, n: n})
+			inFlight += n
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return written, rpcerr.Annotate(rerr, "byte stream copy")
+		}
+	}
+	for len(pending) > 0 {
+		if err := wait(); err != nil {
+			return written, err
+		}
+	}
+	ans, release := client.SendCall(ctx, capnp.Send{
+		Method: byteStreamDone,
+	})
+	defer release()
+	if _, err := ans.Struct(); err != nil {
+		return written, rpcerr.Annotate(err, "byte stream done")
+	}
+	return written, nil
+}
+
+// NewByteStreamServer returns a client that implements the ByteStream
+// interface from Sandstorm's util.capnp by writing the data it receives
+// to w.  w is closed when done is called.  If the client is released
+// before done is called, the stream is incomplete: w is closed with an
+// error if it has a CloseWithError method, like *io.PipeWriter, and
+// closed normally otherwise.
+func NewByteStreamServer(w io.WriteCloser) capnp.Client {
+	s := &byteStreamServer{w: w}
+	return capnp.NewClient(server.New([]server.Method{
+		{Method: byteStreamWrite, Impl: s.write},
+		{Method: byteStreamDone, Impl: s.done},
+		{Method: byteStreamExpectSize, Impl: s.expectSize},
+	}, s, s))
+}
+
+type byteStreamServer struct {
+	w io.WriteCloser
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (s *byteStreamServer) write(ctx context.Context, call *server.Call) error {
+	p, err := call.Args().Ptr(0)
+	if err != nil {
+		return err
+	}
+	if s.isClosed() {
+		return errors.New("write after done")
+	}
+	_, err = s.w.Write(p.Data())
+	return err
+}
+
+func (s *byteStreamServer) done(ctx context.Context, call *server.Call) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errors.New("done called twice")
+	}
+	s.closed = true
+	s.mu.Unlock()
+	return s.w.Close()
+}
+
+func (s *byteStreamServer) expectSize(ctx context.Context, call *server.Call) error {
+	// The size is only a hint, and callers ignore errors from
+	// expectSize, so there is nothing to check.
+	return nil
+}
+
+func (s *byteStreamServer) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *byteStreamServer) Shutdown() {
+	s.mu.Lock()
+	closed := s.closed
+	s.closed = true
+	s.mu.Unlock()
+	if closed {
+		return
+	}
+	if cw, ok := s.w.(interface{ CloseWithError(error) error }); ok {
+		cw.CloseWithError(errors.New("rpc: byte stream released before done"))
+	} else {
+		s.w.Close()
+	}
+}
@@ -0,0 +1,238 @@
+package rpc_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"capnproto.org/go/capnp/v3/flowcontrol"
+	"capnproto.org/go/capnp/v3/rpc"
+	"capnproto.org/go/capnp/v3/rpc/transport"
+)
+
+func TestByteStreamAdapter(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	pr, pw := io.Pipe()
+	left, right := transport.NewPipe(1)
+	srv := rpc.NewConn(rpc.NewTransport(left), &rpc.Options{
+		BootstrapClient: rpc.NewByteStreamServer(pw),
+	})
+	defer srv.Close()
+	cli := rpc.NewConn(rpc.NewTransport(right), nil)
+	defer cli.Close()
+
+	// More than one write call's worth of data.
+	want := make([]byte, 150*1024+3)
+	rand.New(rand.NewSource(590)).Read(want)
+
+	stream := cli.Bootstrap(ctx)
+	stream.SetFlowLimiter(flowcontrol.NewFixedLimiter(128 * 1024))
+	w := rpc.NewByteStreamAdapter(stream)
+	copyErr := make(chan error, 1)
+	go func() {
+		if _, err := io.Copy(w, bytes.NewReader(want)); err != nil {
+			w.Close()
+			copyErr <- err
+			return
+		}
+		copyErr <- w.Close()
+	}()
+
+	// Read in small pieces that don't line up with the writes.
+	var got []byte
+	buf := make([]byte, 1000)
+	for {
+		n, err := pr.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal("Read:", err)
+		}
+	}
+	if err := <-copyErr; err != nil {
+		t.Error("copy:", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("received %d bytes; want the %d bytes written", len(got), len(want))
+	}
+}
+
+func TestByteStreamAdapter_Window(t *testing.T) {
+	t.Parallel()
+
+	// The server blocks every write call until unblock is closed.
+	unblock := make(chan struct{})
+	w := rpc.NewByteStreamAdapter(rpc.NewByteStreamServer(blockingWriter(unblock)))
+
+	// A full window is sent without waiting.
+	if _, err := w.Write(make([]byte, 256*1024)); err != nil {
+		t.Fatal("Write:", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.Write([]byte{1})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Write past a full window returned %v without waiting", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(unblock)
+	if err := <-done; err != nil {
+		t.Error("Write:", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Error("Close:", err)
+	}
+}
+
+// blockingWriter blocks each Write until the channel is closed, then
+// discards the bytes.
+type blockingWriter <-chan struct{}
+
+func (w blockingWriter) Write(p []byte) (int, error) {
+	<-w
+	return len(p), nil
+}
+
+func (w blockingWriter) Close() error {
+	return nil
+}
+
+func TestByteStreamServer_Release(t *testing.T) {
+	t.Parallel()
+
+	// Releasing the stream without calling done reports an error to the
+	// reader.
+	pr, pw := io.Pipe()
+	rpc.NewByteStreamServer(pw).Release()
+	if _, err := pr.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Errorf("Read after release = %v; want an error other than EOF", err)
+	}
+}
+
+// countingWriter records the bytes and write calls it receives.
+type countingWriter struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	writes int
+	closed bool
+	err    error // from CloseWithError
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes++
+	return w.buf.Write(p)
+}
+
+func (w *countingWriter) Close() error {
+	return w.CloseWithError(nil)
+}
+
+func (w *countingWriter) CloseWithError(err error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed, w.err = true, err
+	return nil
+}
+
+func (w *countingWriter) written() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Len()
+}
+
+// smallReader returns at most 1000 bytes from each Read and records
+// the largest number of bytes it has returned that w had not received.
+type smallReader struct {
+	r       io.Reader
+	w       *countingWriter
+	read    int
+	maxLead int
+}
+
+func (r *smallReader) Read(p []byte) (int, error) {
+	if len(p) > 1000 {
+		p = p[:1000]
+	}
+	n, err := r.r.Read(p)
+	r.read += n
+	if lead := r.read - r.w.written(); lead > r.maxLead {
+		r.maxLead = lead
+	}
+	return n, err
+}
+
+func TestCopyToByteStream(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dst := new(countingWriter)
+	left, right := transport.NewPipe(1)
+	srv := rpc.NewConn(rpc.NewTransport(left), &rpc.Options{
+		BootstrapClient: rpc.NewByteStreamServer(dst),
+	})
+	defer srv.Close()
+	cli := rpc.NewConn(rpc.NewTransport(right), nil)
+	defer cli.Close()
+
+	want := make([]byte, 4<<20+5)
+	rand.New(rand.NewSource(613)).Read(want)
+	src := &smallReader{r: bytes.NewReader(want), w: dst}
+
+	n, err := rpc.CopyToByteStream(ctx, cli.Bootstrap(ctx), src)
+	if err != nil {
+		t.Fatal("CopyToByteStream:", err)
+	}
+	if n != int64(len(want)) {
+		t.Errorf("CopyToByteStream = %d; want %d", n, len(want))
+	}
+
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+	if !bytes.Equal(dst.buf.Bytes(), want) {
+		t.Errorf("received %d bytes; want the %d bytes read", dst.buf.Len(), len(want))
+	}
+	if !dst.closed || dst.err != nil {
+		t.Errorf("stream closed = %t with error %v; want closed without error", dst.closed, dst.err)
+	}
+	// The 1000-byte reads are coalesced into 64 KiB writes.
+	if want := (len(want) + 64*1024 - 1) / (64 * 1024); dst.writes != want {
+		t.Errorf("got %d write calls; want %d", dst.writes, want)
+	}
+	// The window, plus the chunk being read while it is full.
+	if max := 5 * 64 * 1024; src.maxLead > max {
+		t.Errorf("read %d bytes ahead of the receiver; want at most %d", src.maxLead, max)
+	}
+}
+
+func TestCopyToByteStream_ReadError(t *testing.T) {
+	t.Parallel()
+
+	dst := new(countingWriter)
+	readErr := errors.New("source broke")
+	src := io.MultiReader(bytes.NewReader(make([]byte, 100*1024)), iotest.ErrReader(readErr))
+	_, err := rpc.CopyToByteStream(context.Background(), rpc.NewByteStreamServer(dst), src)
+	if !errors.Is(err, readErr) {
+		t.Errorf("CopyToByteStream error = %v; want %v", err, readErr)
+	}
+
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+	if !dst.closed || dst.err == nil {
+		t.Errorf("stream closed = %t with error %v; want closed with an error", dst.closed, dst.err)
+	}
+}
@@ -18,12 +18,46 @@ var (
 	ExcClosed = rpcerr.Disconnected(ErrConnClosed)
 )
 
+// errReporter passes a Conn's errors to its ErrorReporter and Logger.
 type errReporter struct {
 	ErrorReporter
+	log    Logger
+	connID uint64
 }
 
+// ReportError reports an error that ends the connection or that the
+// remote vat sent.
 func (er errReporter) ReportError(err error) {
-	if er.ErrorReporter != nil && err != nil {
+	if err == nil {
+		return
+	}
+	if er.ErrorReporter != nil {
+		er.ErrorReporter.ReportError(err)
+	}
+	er.log.Error("rpc: connection error", "conn", er.connID, "error", err)
+}
+
+// warn reports an error that the Conn recovered from.  args are extra
+// key-value pairs for the Logger.
+func (er errReporter) warn(msg string, err error, args ...any) {
+	if er.ErrorReporter != nil {
 		er.ErrorReporter.ReportError(err)
 	}
+	er.log.Warn("rpc: "+msg, append([]any{"conn", er.connID, "error", err}, args...)...)
+}
+
+// debug logs an event that is not reported as an error.
+func (er errReporter) debug(msg string, args ...any) {
+	er.log.Debug("rpc: "+msg, append([]any{"conn", er.connID}, args...)...)
+}
+
+// exceptionType returns the type of the first exception in err's chain,
+// so that an exception wrapped by a method, as by fmt.Errorf with %w,
+// keeps its type when sent to the caller.
+func exceptionType(err error) exc.Type {
+	var e *exc.Exception
+	if errors.As(err, &e) {
+		return e.Type
+	}
+	return exc.Failed
 }
@@ -0,0 +1,59 @@
+package rpc_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"capnproto.org/go/capnp/v3"
+	"capnproto.org/go/capnp/v3/exc"
+	"capnproto.org/go/capnp/v3/rpc"
+	"capnproto.org/go/capnp/v3/rpc/internal/testcapnp"
+	"capnproto.org/go/capnp/v3/rpc/transport"
+	"capnproto.org/go/capnp/v3/server"
+)
+
+// errorPingServer fails every call with err.
+type errorPingServer struct {
+	err error
+}
+
+func (s errorPingServer) EchoNum(context.Context, testcapnp.PingPong_echoNum) error {
+	return s.err
+}
+
+func TestExceptionType(t *testing.T) {
+	t.Parallel()
+
+	overloaded := server.NewException(exc.Overloaded, errors.New("too busy"))
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"NewException", overloaded},
+		{"Wrapped", fmt.Errorf("echo: %w", overloaded)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			left, right := transport.NewPipe(1)
+			srv := rpc.NewConn(rpc.NewTransport(left), &rpc.Options{
+				BootstrapClient: capnp.Client(testcapnp.PingPong_ServerToClient(errorPingServer{test.err})),
+			})
+			defer srv.Close()
+			cli := rpc.NewConn(rpc.NewTransport(right), nil)
+			defer cli.Close()
+
+			pp := testcapnp.PingPong(cli.Bootstrap(ctx))
+			defer pp.Release()
+			_, err := echoNum(ctx, pp, 1)
+			if err == nil {
+				t.Fatal("EchoNum succeeded; want error")
+			}
+			if !capnp.IsOverloaded(err) {
+				t.Errorf("EchoNum error = %v (type %v); want overloaded", err, exc.TypeOf(err))
+			}
+		})
+	}
+}
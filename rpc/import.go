@@ -45,6 +45,20 @@ type impent struct {
 	generation uint64
 }
 
+// OriginConn returns the connection that c was imported from, if c has
+// resolved to a capability hosted by the remote vat of some Conn.  It
+// returns false for local capabilities and for clients that have not
+// resolved yet, such as the pipelined result of a pending call.  A
+// proxy can use it to avoid sending a call back out the connection it
+// came from.
+func OriginConn(c capnp.Client) (*Conn, bool) {
+	ic, ok := c.State().Brand.Value.(*importClient)
+	if !ok {
+		return nil, false
+	}
+	return ic.c, true
+}
+
 // addImport returns a client that represents the given import,
 // incrementing the number of references to this import from this vat.
 // This is separate from the reference counting that capnp.Client does.
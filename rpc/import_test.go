@@ -0,0 +1,48 @@
+package rpc_test
+
+import (
+	"context"
+	"testing"
+
+	"capnproto.org/go/capnp/v3"
+	"capnproto.org/go/capnp/v3/rpc"
+	"capnproto.org/go/capnp/v3/rpc/internal/testcapnp"
+	"capnproto.org/go/capnp/v3/rpc/transport"
+)
+
+func TestOriginConn(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	local := capnp.Client(testcapnp.PingPong_ServerToClient(echoNumServer{}))
+	defer local.Release()
+	if !local.IsLocal() {
+		t.Error("local server client: IsLocal() = false; want true")
+	}
+	if c, ok := rpc.OriginConn(local); ok {
+		t.Errorf("local server client: OriginConn() = %p, true; want false", c)
+	}
+
+	left, right := transport.NewPipe(1)
+	srv := rpc.NewConn(rpc.NewTransport(left), &rpc.Options{
+		BootstrapClient: local.AddRef(),
+	})
+	defer srv.Close()
+	cli := rpc.NewConn(rpc.NewTransport(right), nil)
+	defer cli.Close()
+
+	imported := cli.Bootstrap(ctx)
+	defer imported.Release()
+	if err := imported.Resolve(ctx); err != nil {
+		t.Fatal("Resolve:", err)
+	}
+	if imported.IsLocal() {
+		t.Error("imported client: IsLocal() = true; want false")
+	}
+	if c, ok := rpc.OriginConn(imported); !ok || c != cli {
+		t.Errorf("imported client: OriginConn() = %p, %t; want %p, true", c, ok, cli)
+	}
+	if c, ok := rpc.OriginConn(capnp.Client{}); ok {
+		t.Errorf("nil client: OriginConn() = %p, true; want false", c)
+	}
+}
@@ -0,0 +1,70 @@
+package rpc
+
+import (
+	"time"
+
+	"capnproto.org/go/capnp/v3"
+	rpccp "capnproto.org/go/capnp/v3/std/capnp/rpc"
+)
+
+// keepAliveLoop checks that the remote vat is responding every
+// c.keepAlive until the connection shuts down.  It returns an error,
+// shutting down the connection, if a check times out.
+//
+// Any message from the remote vat shows that it is responding, so a
+// check only sends a ping if nothing has been received since the last
+// one.  A ping is an obsoleteDelete message, which no vat implements:
+// the remote vat echoes it back in an unimplemented message, which is
+// dropped on receipt.  Neither message refers to any question or
+// capability, so the check does not affect the order of calls.
+func (c *Conn) keepAliveLoop() error {
+	t := time.NewTicker(c.keepAlive)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-c.bgctx.Done():
+			return nil
+		}
+		select {
+		case <-c.keepAliveRecv:
+			continue
+		default:
+		}
+		if err := c.checkAlive(); err != nil {
+			return err
+		}
+	}
+}
+
+// checkAlive sends a ping and waits for the remote vat to send
+// anything back.
+func (c *Conn) checkAlive() error {
+	timeout := time.NewTimer(c.keepAliveTimeout)
+	defer timeout.Stop()
+	c.mu.Lock()
+	c.sendMessage(c.bgctx, func(m rpccp.Message) error {
+		return m.SetObsoleteDelete(capnp.Ptr{})
+	}, func(err error) {
+		if err != nil {
+			c.er.debug("keepalive: send ping", "error", err)
+		}
+	})
+	c.mu.Unlock()
+	select {
+	case <-c.keepAliveRecv:
+		return nil
+	case <-c.bgctx.Done():
+		return nil
+	case <-timeout.C:
+		return rpcerr.Disconnectedf("keepalive: no response from remote vat within %v", c.keepAliveTimeout)
+	}
+}
+
+// noteAlive records that a message was received from the remote vat.
+func (c *Conn) noteAlive() {
+	select {
+	case c.keepAliveRecv <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,132 @@
+package rpc_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"capnproto.org/go/capnp/v3"
+	"capnproto.org/go/capnp/v3/rpc"
+	"capnproto.org/go/capnp/v3/rpc/internal/testcapnp"
+	"capnproto.org/go/capnp/v3/rpc/transport"
+	rpccp "capnproto.org/go/capnp/v3/std/capnp/rpc"
+)
+
+func TestKeepAlive(t *testing.T) {
+	t.Parallel()
+
+	left, right := transport.NewPipe(1)
+	srv := rpc.NewConn(rpc.NewTransport(left), &rpc.Options{
+		BootstrapClient: capnp.Client(testcapnp.PingPong_ServerToClient(echoNumServer{})),
+	})
+	defer srv.Close()
+	cli := rpc.NewConn(rpc.NewTransport(right), &rpc.Options{
+		KeepAlive: 5 * time.Millisecond,
+	})
+	defer cli.Close()
+
+	// Calls keep working while checks are made in between them.
+	ctx := context.Background()
+	pp := testcapnp.PingPong(cli.Bootstrap(ctx))
+	defer pp.Release()
+	deadline := time.Now().Add(50 * time.Millisecond)
+	for i := int64(0); time.Now().Before(deadline); i++ {
+		if n, err := echoNum(ctx, pp, i); err != nil || n != i {
+			t.Fatalf("EchoNum(%d) = %d, %v", i, n, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-cli.Done():
+		t.Fatal("connection to responsive peer closed")
+	default:
+	}
+}
+
+func TestKeepAlive_Timeout(t *testing.T) {
+	t.Parallel()
+
+	// The other end of the pipe never reads or responds.
+	left, right := transport.NewPipe(1)
+	defer left.Close()
+	start := time.Now()
+	conn := rpc.NewConn(rpc.NewTransport(right), &rpc.Options{
+		KeepAlive:        10 * time.Millisecond,
+		KeepAliveTimeout: 20 * time.Millisecond,
+		AbortTimeout:     time.Millisecond,
+	})
+	defer conn.Close()
+
+	select {
+	case <-conn.Done():
+		if d := time.Since(start); d < 30*time.Millisecond {
+			t.Errorf("connection closed after %v; want at least the keepalive interval plus timeout", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection to unresponsive peer not closed")
+	}
+}
+
+func TestKeepAlive_NoBootstrap(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu      sync.Mutex
+		inbound []rpccp.Message_Which
+	)
+	left, right := transport.NewPipe(1)
+	srv := rpc.NewConn(rpc.NewTransport(left), &rpc.Options{
+		ErrorReporter: testErrorReporter{tb: t},
+		MessageObserver: func(dir rpc.Direction, msg rpc.Message) {
+			if dir == rpc.Inbound {
+				mu.Lock()
+				inbound = append(inbound, msg.Which())
+				mu.Unlock()
+			}
+		},
+	})
+	defer srv.Close()
+	cli := rpc.NewConn(rpc.NewTransport(right), &rpc.Options{
+		ErrorReporter: testErrorReporter{tb: t},
+		KeepAlive:     5 * time.Millisecond,
+	})
+	defer cli.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-cli.Done():
+		t.Fatal("connection to responsive peer closed")
+	default:
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(inbound) == 0 {
+		t.Fatal("no keepalive pings sent")
+	}
+	for _, w := range inbound {
+		if w != rpccp.Message_Which_obsoleteDelete {
+			t.Fatalf("peer received %v; want only keepalive pings", w)
+		}
+	}
+}
+
+func TestKeepAlive_ManualReceive(t *testing.T) {
+	t.Parallel()
+
+	// Nothing is received without calls to ReceiveOne, so checks would
+	// close the connection.
+	left, right := transport.NewPipe(1)
+	defer left.Close()
+	conn := rpc.NewConn(rpc.NewTransport(right), &rpc.Options{
+		KeepAlive:     time.Millisecond,
+		ManualReceive: true,
+	})
+	defer conn.Close()
+
+	select {
+	case <-conn.Done():
+		t.Fatal("keepalive closed connection with ManualReceive set")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
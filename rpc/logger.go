@@ -0,0 +1,34 @@
+package rpc
+
+import "sync/atomic"
+
+// A Logger records events in a Conn that are not returned to any
+// caller, such as a malformed message from the remote vat that the Conn
+// recovered from.  Each method takes a message and a list of
+// alternating keys and values that give its context, in the style of
+// log/slog: a *slog.Logger satisfies Logger.  Every entry has a "conn"
+// key identifying the Conn.
+//
+// Logger methods are called from the Conn's goroutines, so they should
+// be quick to return and must not use the Conn.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// nopLogger is the Logger used when Options.Logger is nil.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+// lastConnID is the ID of the most recently created Conn.
+var lastConnID uint64
+
+func nextConnID() uint64 {
+	return atomic.AddUint64(&lastConnID, 1)
+}
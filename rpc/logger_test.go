@@ -0,0 +1,104 @@
+package rpc_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"capnproto.org/go/capnp/v3/rpc"
+	"capnproto.org/go/capnp/v3/rpc/transport"
+	rpccp "capnproto.org/go/capnp/v3/std/capnp/rpc"
+)
+
+type logEntry struct {
+	level string
+	msg   string
+	attrs map[string]any
+}
+
+// captureLogger records the entries logged to it.
+type captureLogger struct {
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+func (l *captureLogger) log(level, msg string, args []any) {
+	attrs := make(map[string]any)
+	for i := 0; i+1 < len(args); i += 2 {
+		attrs[args[i].(string)] = args[i+1]
+	}
+	l.mu.Lock()
+	l.entries = append(l.entries, logEntry{level, msg, attrs})
+	l.mu.Unlock()
+}
+
+func (l *captureLogger) Debug(msg string, args ...any) { l.log("debug", msg, args) }
+func (l *captureLogger) Info(msg string, args ...any)  { l.log("info", msg, args) }
+func (l *captureLogger) Warn(msg string, args ...any)  { l.log("warn", msg, args) }
+func (l *captureLogger) Error(msg string, args ...any) { l.log("error", msg, args) }
+
+func (l *captureLogger) find(level string) (logEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, e := range l.entries {
+		if e.level == level {
+			return e, true
+		}
+	}
+	return logEntry{}, false
+}
+
+func TestLogger(t *testing.T) {
+	t.Parallel()
+
+	logger := new(captureLogger)
+	left, right := transport.NewPipe(1)
+	p1, p2 := rpc.NewTransport(left), rpc.NewTransport(right)
+	conn := rpc.NewConn(p1, &rpc.Options{
+		ErrorReporter: testErrorReporter{tb: t},
+		Logger:        logger,
+	})
+	defer finishTest(t, conn, p2)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The Conn does not implement provide, so it should warn and reply
+	// with unimplemented.
+	msg, send, release, err := p2.NewMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := msg.NewProvide(); err != nil {
+		t.Fatal(err)
+	}
+	if err := send(); err != nil {
+		t.Fatal(err)
+	}
+	release()
+	reply, release, err := recvMessage(ctx, p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if reply.Which != rpccp.Message_Which_unimplemented {
+		t.Fatalf("received %v; want unimplemented", reply.Which)
+	}
+
+	e, ok := logger.find("warn")
+	if !ok {
+		t.Fatal("no warning logged for unknown message type")
+	}
+	if e.msg != "rpc: unknown message type" {
+		t.Errorf("warning message = %q; want \"rpc: unknown message type\"", e.msg)
+	}
+	if e.attrs["type"] != "provide" {
+		t.Errorf("warning type = %v; want provide", e.attrs["type"])
+	}
+	if _, ok := e.attrs["conn"]; !ok {
+		t.Error("warning does not identify the conn")
+	}
+	if e.attrs["error"] == nil {
+		t.Error("warning has no error")
+	}
+}
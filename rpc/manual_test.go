@@ -0,0 +1,113 @@
+package rpc_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"capnproto.org/go/capnp/v3"
+	"capnproto.org/go/capnp/v3/rpc"
+	testcp "capnproto.org/go/capnp/v3/rpc/internal/testcapnp"
+	"capnproto.org/go/capnp/v3/rpc/transport"
+	rpccp "capnproto.org/go/capnp/v3/std/capnp/rpc"
+)
+
+func TestManualReceive(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var inbound []rpccp.Message_Which
+	p1, p2 := transport.NewPipe(1)
+	client := rpc.NewConn(rpc.NewTransport(p1), &rpc.Options{
+		ErrorReporter: testErrorReporter{tb: t},
+		ManualReceive: true,
+	})
+	server := rpc.NewConn(rpc.NewTransport(p2), &rpc.Options{
+		BootstrapClient: capnp.Client(testcp.PingPong_ServerToClient(pingPongServer{})),
+		ErrorReporter:   testErrorReporter{tb: t},
+		ManualReceive:   true,
+		MessageObserver: func(dir rpc.Direction, msg rpc.Message) {
+			if dir == rpc.Inbound {
+				inbound = append(inbound, msg.Which())
+			}
+		},
+	})
+
+	receiveOne := func(name string, c *rpc.Conn) {
+		t.Helper()
+		if err := c.ReceiveOne(ctx); err != nil {
+			t.Fatalf("%s.ReceiveOne: %v", name, err)
+		}
+	}
+
+	bs := testcp.PingPong(client.Bootstrap(ctx))
+	defer bs.Release()
+	receiveOne("server", server) // bootstrap
+	receiveOne("client", client) // return
+	if err := capnp.Client(bs).Resolve(ctx); err != nil {
+		t.Fatal("Resolve:", err)
+	}
+
+	ans, release := bs.EchoNum(ctx, func(p testcp.PingPong_echoNum_Params) error {
+		p.SetN(42)
+		return nil
+	})
+	defer release()
+	receiveOne("server", server) // finish for bootstrap
+	receiveOne("server", server) // call
+	receiveOne("client", client) // return
+	res, err := ans.Struct()
+	if err != nil {
+		t.Fatal("EchoNum:", err)
+	}
+	if n := res.N(); n != 42 {
+		t.Errorf("EchoNum returned %d; want 42", n)
+	}
+
+	want := []rpccp.Message_Which{
+		rpccp.Message_Which_bootstrap,
+		rpccp.Message_Which_finish,
+		rpccp.Message_Which_call,
+	}
+	if !reflect.DeepEqual(inbound, want) {
+		t.Errorf("server received %v; want %v", inbound, want)
+	}
+
+	// Closing one end sends an abort, which stops the other.
+	release()
+	bs.Release()
+	serverDone := make(chan error, 1)
+	go func() {
+		for {
+			if err := server.ReceiveOne(ctx); err != nil {
+				serverDone <- err
+				return
+			}
+		}
+	}()
+	if err := client.Close(); err != nil {
+		t.Error("client.Close:", err)
+	}
+	if err := <-serverDone; err != rpc.ExcClosed {
+		t.Errorf("server.ReceiveOne after abort = %v; want %v", err, rpc.ExcClosed)
+	}
+	<-server.Done()
+	if err := client.ReceiveOne(ctx); err != rpc.ExcClosed {
+		t.Errorf("client.ReceiveOne after Close = %v; want %v", err, rpc.ExcClosed)
+	}
+}
+
+func TestReceiveOneWithoutManualReceive(t *testing.T) {
+	t.Parallel()
+
+	p1, p2 := transport.NewPipe(1)
+	conn := rpc.NewConn(rpc.NewTransport(p1), nil)
+	defer finishTest(t, conn, rpc.NewTransport(p2))
+
+	if err := conn.ReceiveOne(context.Background()); err == nil {
+		t.Error("ReceiveOne on a Conn without ManualReceive returned nil")
+	}
+}
@@ -0,0 +1,50 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+
+	"capnproto.org/go/capnp/v3"
+	rpccp "capnproto.org/go/capnp/v3/std/capnp/rpc"
+)
+
+// A Message is an RPC protocol message, as passed to
+// Options.MessageObserver.
+type Message = rpccp.Message
+
+// Direction is the direction in which a message travels on a Conn.
+type Direction int
+
+const (
+	// Inbound messages were received from the remote vat.
+	Inbound Direction = iota
+
+	// Outbound messages are sent to the remote vat.
+	Outbound
+)
+
+// String returns "inbound" or "outbound".
+func (d Direction) String() string {
+	switch d {
+	case Inbound:
+		return "inbound"
+	case Outbound:
+		return "outbound"
+	default:
+		return fmt.Sprintf("Direction(%d)", int(d))
+	}
+}
+
+// newMessage is like c.transport.NewMessage, but the returned send
+// function reports the message to the MessageObserver, if any, before
+// sending it.
+func (c *Conn) newMessage(ctx context.Context) (Message, func() error, capnp.ReleaseFunc, error) {
+	msg, send, release, err := c.transport.NewMessage(ctx)
+	if err != nil || c.observer == nil {
+		return msg, send, release, err
+	}
+	return msg, func() error {
+		c.observer(Outbound, msg)
+		return send()
+	}, release, nil
+}
@@ -0,0 +1,90 @@
+package rpc_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"capnproto.org/go/capnp/v3"
+	"capnproto.org/go/capnp/v3/rpc"
+	"capnproto.org/go/capnp/v3/rpc/internal/testcapnp"
+	"capnproto.org/go/capnp/v3/rpc/transport"
+	rpccp "capnproto.org/go/capnp/v3/std/capnp/rpc"
+)
+
+func TestMessageObserver(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu          sync.Mutex
+		seen        []string
+		interfaceID uint64
+	)
+	observe := func(dir rpc.Direction, msg rpc.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch msg.Which() {
+		case rpccp.Message_Which_finish, rpccp.Message_Which_release:
+			// Sent as references are dropped, and not necessarily
+			// before the connection closes.
+			return
+		case rpccp.Message_Which_call:
+			call, err := msg.Call()
+			if err != nil {
+				t.Error("read call:", err)
+			}
+			interfaceID = call.InterfaceId()
+		}
+		seen = append(seen, fmt.Sprintf("%v %v", dir, msg.Which()))
+	}
+
+	ctx := context.Background()
+	left, right := transport.NewPipe(1)
+	srv := rpc.NewConn(rpc.NewTransport(left), &rpc.Options{
+		BootstrapClient: capnp.Client(testcapnp.PingPong_ServerToClient(echoNumServer{})),
+	})
+	defer srv.Close()
+	cli := rpc.NewConn(rpc.NewTransport(right), &rpc.Options{
+		MessageObserver: observe,
+	})
+
+	pp := testcapnp.PingPong(cli.Bootstrap(ctx))
+	if err := pp.Resolve(ctx); err != nil {
+		t.Fatal("Resolve:", err)
+	}
+	if n, err := echoNum(ctx, pp, 42); err != nil || n != 42 {
+		t.Fatalf("EchoNum = %d, %v; want 42, <nil>", n, err)
+	}
+	pp.Release()
+	if err := cli.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{
+		"outbound bootstrap",
+		"inbound return",
+		"outbound call",
+		"inbound return",
+		"outbound abort",
+	}
+	if fmt.Sprint(seen) != fmt.Sprint(want) {
+		t.Errorf("observed messages = %q; want %q", seen, want)
+	}
+	if interfaceID != testcapnp.PingPong_TypeID {
+		t.Errorf("call interface ID = %#x; want %#x", interfaceID, uint64(testcapnp.PingPong_TypeID))
+	}
+}
+
+func TestDirectionString(t *testing.T) {
+	t.Parallel()
+
+	if s := rpc.Inbound.String(); s != "inbound" {
+		t.Errorf("Inbound.String() = %q; want \"inbound\"", s)
+	}
+	if s := rpc.Outbound.String(); s != "outbound" {
+		t.Errorf("Outbound.String() = %q; want \"outbound\"", s)
+	}
+}
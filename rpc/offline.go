@@ -0,0 +1,260 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+
+	"capnproto.org/go/capnp/v3"
+	"capnproto.org/go/capnp/v3/exc"
+	rpccp "capnproto.org/go/capnp/v3/std/capnp/rpc"
+)
+
+// ErrOffline is the cause of the errors returned by capabilities
+// decoded by UnmarshalCall and UnmarshalResult.
+var ErrOffline = errors.New("capability unsupported offline")
+
+// MarshalCall encodes a call as a self-contained byte slice, so that
+// it can be stored and later replayed with UnmarshalCall or ReplayCall
+// without a connection.  The encoding is an RPC Call message.  The
+// capabilities in the arguments are not preserved: their descriptors
+// are recorded as none.
+//
+// MarshalCall calls s.PlaceArgs, so s must not be used to send the
+// call afterwards.
+func MarshalCall(s capnp.Send) ([]byte, error) {
+	msg, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		return nil, rpcerr.Failedf("marshal call: %w", err)
+	}
+	defer msg.ReleaseCaps()
+	m, err := rpccp.NewRootMessage(seg)
+	if err != nil {
+		return nil, rpcerr.Failedf("marshal call: %w", err)
+	}
+	call, err := m.NewCall()
+	if err != nil {
+		return nil, rpcerr.Failedf("marshal call: %w", err)
+	}
+	call.SetInterfaceId(s.Method.InterfaceID)
+	call.SetMethodId(s.Method.MethodID)
+	payload, err := call.NewParams()
+	if err != nil {
+		return nil, rpcerr.Failedf("marshal call: %w", err)
+	}
+	args, err := capnp.NewStruct(seg, s.ArgsSize)
+	if err != nil {
+		return nil, rpcerr.Failedf("marshal call: %w", err)
+	}
+	if err := payload.SetContent(args.ToPtr()); err != nil {
+		return nil, rpcerr.Failedf("marshal call: %w", err)
+	}
+	if s.PlaceArgs != nil {
+		if err := s.PlaceArgs(args); err != nil {
+			return nil, rpcerr.Failedf("place arguments: %w", err)
+		}
+	}
+	if err := setOfflineCapTable(payload, len(msg.CapTable)); err != nil {
+		return nil, rpcerr.Failedf("marshal call: %w", err)
+	}
+	b, err := msg.Marshal()
+	if err != nil {
+		return nil, rpcerr.Failedf("marshal call: %w", err)
+	}
+	return b, nil
+}
+
+// UnmarshalCall decodes a call encoded by MarshalCall.  Sending the
+// returned Send to a capability replays the call.  The capabilities in
+// the arguments return errors wrapping ErrOffline.
+func UnmarshalCall(data []byte) (capnp.Send, error) {
+	m, err := unmarshalOffline(data)
+	if err != nil {
+		return capnp.Send{}, rpcerr.Failedf("unmarshal call: %w", err)
+	}
+	if m.Which() != rpccp.Message_Which_call {
+		return capnp.Send{}, rpcerr.Failedf("unmarshal call: message is a %v", m.Which())
+	}
+	call, err := m.Call()
+	if err != nil {
+		return capnp.Send{}, rpcerr.Failedf("unmarshal call: %w", err)
+	}
+	payload, err := call.Params()
+	if err != nil {
+		return capnp.Send{}, rpcerr.Failedf("unmarshal call: %w", err)
+	}
+	content, err := payload.Content()
+	if err != nil {
+		return capnp.Send{}, rpcerr.Failedf("unmarshal call: %w", err)
+	}
+	args := content.Struct()
+	return capnp.Send{
+		Method: capnp.Method{
+			InterfaceID: call.InterfaceId(),
+			MethodID:    call.MethodId(),
+		},
+		PlaceArgs: func(s capnp.Struct) error {
+			return s.CopyFrom(args)
+		},
+		ArgsSize: args.Size(),
+	}, nil
+}
+
+// ReplayCall sends the call encoded by MarshalCall to c.
+func ReplayCall(ctx context.Context, c capnp.Client, data []byte) (*capnp.Answer, capnp.ReleaseFunc) {
+	s, err := UnmarshalCall(data)
+	if err != nil {
+		return capnp.ErrorAnswer(s.Method, err), func() {}
+	}
+	return c.SendCall(ctx, s)
+}
+
+// MarshalResult encodes the outcome of a call as a self-contained byte
+// slice, either the results or, if err is not nil, the error.  It is
+// typically passed the values returned by Answer.Struct.  The encoding
+// is an RPC Return message.  As with MarshalCall, the capabilities in
+// the results are not preserved.
+func MarshalResult(res capnp.Struct, err error) ([]byte, error) {
+	msg, seg, merr := capnp.NewMessage(capnp.SingleSegment(nil))
+	if merr != nil {
+		return nil, rpcerr.Failedf("marshal result: %w", merr)
+	}
+	defer msg.ReleaseCaps()
+	m, merr := rpccp.NewRootMessage(seg)
+	if merr != nil {
+		return nil, rpcerr.Failedf("marshal result: %w", merr)
+	}
+	ret, merr := m.NewReturn()
+	if merr != nil {
+		return nil, rpcerr.Failedf("marshal result: %w", merr)
+	}
+	if err != nil {
+		e, merr := ret.NewException()
+		if merr != nil {
+			return nil, rpcerr.Failedf("marshal result: %w", merr)
+		}
+		e.SetType(rpccp.Exception_Type(exceptionType(err)))
+		if merr := e.SetReason(err.Error()); merr != nil {
+			return nil, rpcerr.Failedf("marshal result: %w", merr)
+		}
+	} else {
+		payload, merr := ret.NewResults()
+		if merr != nil {
+			return nil, rpcerr.Failedf("marshal result: %w", merr)
+		}
+		if merr := payload.SetContent(res.ToPtr()); merr != nil {
+			return nil, rpcerr.Failedf("marshal result: %w", merr)
+		}
+		if merr := setOfflineCapTable(payload, len(msg.CapTable)); merr != nil {
+			return nil, rpcerr.Failedf("marshal result: %w", merr)
+		}
+	}
+	b, merr := msg.Marshal()
+	if merr != nil {
+		return nil, rpcerr.Failedf("marshal result: %w", merr)
+	}
+	return b, nil
+}
+
+// UnmarshalResult decodes the outcome of a call encoded by
+// MarshalResult, returning the results or the recorded error.  The
+// capabilities in the results return errors wrapping ErrOffline.
+func UnmarshalResult(data []byte) (capnp.Struct, error) {
+	m, err := unmarshalOffline(data)
+	if err != nil {
+		return capnp.Struct{}, rpcerr.Failedf("unmarshal result: %w", err)
+	}
+	if m.Which() != rpccp.Message_Which_return {
+		return capnp.Struct{}, rpcerr.Failedf("unmarshal result: message is a %v", m.Which())
+	}
+	ret, err := m.Return()
+	if err != nil {
+		return capnp.Struct{}, rpcerr.Failedf("unmarshal result: %w", err)
+	}
+	switch ret.Which() {
+	case rpccp.Return_Which_results:
+		payload, err := ret.Results()
+		if err != nil {
+			return capnp.Struct{}, rpcerr.Failedf("unmarshal result: %w", err)
+		}
+		content, err := payload.Content()
+		if err != nil {
+			return capnp.Struct{}, rpcerr.Failedf("unmarshal result: %w", err)
+		}
+		return content.Struct(), nil
+	case rpccp.Return_Which_exception:
+		e, err := ret.Exception()
+		if err != nil {
+			return capnp.Struct{}, rpcerr.Failedf("unmarshal result: %w", err)
+		}
+		reason, err := e.Reason()
+		if err != nil {
+			return capnp.Struct{}, rpcerr.Failedf("unmarshal result: %w", err)
+		}
+		return capnp.Struct{}, exc.New(exc.Type(e.Type()), "", reason)
+	default:
+		return capnp.Struct{}, rpcerr.Failedf("unmarshal result: unhandled return type %v", ret.Which())
+	}
+}
+
+// setOfflineCapTable fills payload's capability table with n empty
+// descriptors.
+func setOfflineCapTable(payload rpccp.Payload, n int) error {
+	if n == 0 {
+		return nil
+	}
+	tab, err := payload.NewCapTable(int32(n))
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		tab.At(i).SetNone()
+	}
+	return nil
+}
+
+// unmarshalOffline decodes a message encoded by MarshalCall or
+// MarshalResult, filling its capability table with error clients.
+func unmarshalOffline(data []byte) (rpccp.Message, error) {
+	msg, err := capnp.Unmarshal(data)
+	if err != nil {
+		return rpccp.Message{}, err
+	}
+	m, err := rpccp.ReadRootMessage(msg)
+	if err != nil {
+		return rpccp.Message{}, err
+	}
+	var payload rpccp.Payload
+	switch m.Which() {
+	case rpccp.Message_Which_call:
+		call, err := m.Call()
+		if err != nil {
+			return rpccp.Message{}, err
+		}
+		payload, err = call.Params()
+		if err != nil {
+			return rpccp.Message{}, err
+		}
+	case rpccp.Message_Which_return:
+		ret, err := m.Return()
+		if err != nil {
+			return rpccp.Message{}, err
+		}
+		if ret.Which() != rpccp.Return_Which_results {
+			return m, nil
+		}
+		payload, err = ret.Results()
+		if err != nil {
+			return rpccp.Message{}, err
+		}
+	default:
+		return m, nil
+	}
+	tab, err := payload.CapTable()
+	if err != nil {
+		return rpccp.Message{}, err
+	}
+	for i := 0; i < tab.Len(); i++ {
+		msg.AddCap(capnp.ErrorClient(rpcerr.Unimplemented(ErrOffline)))
+	}
+	return m, nil
+}
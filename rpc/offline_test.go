@@ -0,0 +1,131 @@
+package rpc_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"capnproto.org/go/capnp/v3"
+	"capnproto.org/go/capnp/v3/exc"
+	"capnproto.org/go/capnp/v3/rpc"
+	testcp "capnproto.org/go/capnp/v3/rpc/internal/testcapnp"
+)
+
+func TestOfflineCall(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	srv := testcp.PingPong_ServerToClient(pingPongServer{})
+	defer srv.Release()
+
+	call, err := rpc.MarshalCall(capnp.Send{
+		Method:   capnp.Method{InterfaceID: testcp.PingPong_TypeID, MethodID: 0},
+		ArgsSize: capnp.ObjectSize{DataSize: 8},
+		PlaceArgs: func(s capnp.Struct) error {
+			testcp.PingPong_echoNum_Params(s).SetN(42)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal("MarshalCall:", err)
+	}
+
+	// Record the result of a live call.
+	send, err := rpc.UnmarshalCall(call)
+	if err != nil {
+		t.Fatal("UnmarshalCall:", err)
+	}
+	if send.Method.InterfaceID != testcp.PingPong_TypeID || send.Method.MethodID != 0 {
+		t.Errorf("UnmarshalCall method = %v; want PingPong.echoNum", &send.Method)
+	}
+	ans, release := capnp.Client(srv).SendCall(ctx, send)
+	golden, err := rpc.MarshalResult(ans.Struct())
+	release()
+	if err != nil {
+		t.Fatal("MarshalResult:", err)
+	}
+
+	// Replay the recorded call and compare against the recording.
+	ans, release = rpc.ReplayCall(ctx, capnp.Client(srv), call)
+	defer release()
+	res, err := ans.Struct()
+	if err != nil {
+		t.Fatal("replayed call:", err)
+	}
+	if n := testcp.PingPong_echoNum_Results(res).N(); n != 42 {
+		t.Errorf("replayed call returned %d; want 42", n)
+	}
+	replayed, err := rpc.MarshalResult(res, nil)
+	if err != nil {
+		t.Fatal("MarshalResult:", err)
+	}
+	if !bytes.Equal(replayed, golden) {
+		t.Error("replayed result differs from recorded result")
+	}
+	want, err := rpc.UnmarshalResult(golden)
+	if err != nil {
+		t.Fatal("UnmarshalResult:", err)
+	}
+	if n := testcp.PingPong_echoNum_Results(want).N(); n != 42 {
+		t.Errorf("recorded result is %d; want 42", n)
+	}
+}
+
+func TestOfflineResultError(t *testing.T) {
+	t.Parallel()
+
+	b, err := rpc.MarshalResult(capnp.Struct{}, exc.New(exc.Overloaded, "", "busy"))
+	if err != nil {
+		t.Fatal("MarshalResult:", err)
+	}
+	_, err = rpc.UnmarshalResult(b)
+	if err == nil {
+		t.Fatal("UnmarshalResult returned nil error; want recorded error")
+	}
+	if exc.TypeOf(err) != exc.Overloaded {
+		t.Errorf("recorded error type = %v; want %v", exc.TypeOf(err), exc.Overloaded)
+	}
+	if _, err := rpc.UnmarshalCall(b); err == nil {
+		t.Error("UnmarshalCall of a result returned nil error")
+	}
+}
+
+func TestOfflineCapability(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	pp := testcp.PingPong_ServerToClient(pingPongServer{})
+	defer pp.Release()
+
+	call, err := rpc.MarshalCall(capnp.Send{
+		Method:   capnp.Method{InterfaceID: testcp.CapArgsTest_TypeID, MethodID: 0},
+		ArgsSize: capnp.ObjectSize{PointerCount: 1},
+		PlaceArgs: func(s capnp.Struct) error {
+			return testcp.CapArgsTest_call_Params(s).SetCap(capnp.Client(pp).AddRef())
+		},
+	})
+	if err != nil {
+		t.Fatal("MarshalCall:", err)
+	}
+	send, err := rpc.UnmarshalCall(call)
+	if err != nil {
+		t.Fatal("UnmarshalCall:", err)
+	}
+
+	msg, seg, _ := capnp.NewMessage(capnp.SingleSegment(nil))
+	defer msg.ReleaseCaps()
+	args, err := capnp.NewRootStruct(seg, send.ArgsSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := send.PlaceArgs(args); err != nil {
+		t.Fatal("PlaceArgs:", err)
+	}
+	c := testcp.PingPong(testcp.CapArgsTest_call_Params(args).Cap())
+	ans, release := c.EchoNum(ctx, nil)
+	defer release()
+	if _, err := ans.Struct(); !errors.Is(err, rpc.ErrOffline) {
+		t.Errorf("call on decoded capability returned %v; want %v", err, rpc.ErrOffline)
+	}
+}
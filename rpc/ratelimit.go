@@ -0,0 +1,58 @@
+package rpc
+
+import (
+	"sync"
+	"time"
+)
+
+// A RateLimiter decides whether a Conn accepts each call that the
+// remote vat makes, so that a peer cannot make calls faster than the
+// application allows.  A *rate.Limiter from golang.org/x/time/rate
+// satisfies RateLimiter.
+type RateLimiter interface {
+	// Allow is called for each incoming call before it is delivered.
+	// If Allow returns false, the call fails with an overloaded
+	// exception and the connection carries on.  Allow is called from
+	// the Conn's receive goroutine, so it should return quickly.
+	Allow() bool
+}
+
+// NewTokenBucket returns a RateLimiter that allows calls at an average
+// of rate per second, with bursts of up to burst calls.  The bucket
+// starts full.
+func NewTokenBucket(rate float64, burst int) RateLimiter {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		now:    time.Now,
+	}
+}
+
+type tokenBucket struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (tb *tokenBucket) Allow() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	now := tb.now()
+	if !tb.last.IsZero() {
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+		if tb.tokens > tb.burst {
+			tb.tokens = tb.burst
+		}
+	}
+	tb.last = now
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
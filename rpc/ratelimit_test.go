@@ -0,0 +1,76 @@
+package rpc_test
+
+import (
+	"context"
+	"testing"
+
+	"capnproto.org/go/capnp/v3"
+	"capnproto.org/go/capnp/v3/exc"
+	"capnproto.org/go/capnp/v3/rpc"
+	testcp "capnproto.org/go/capnp/v3/rpc/internal/testcapnp"
+	"capnproto.org/go/capnp/v3/rpc/transport"
+)
+
+func TestCallRateLimiter(t *testing.T) {
+	t.Parallel()
+
+	const burst = 5
+	p1, p2 := transport.NewPipe(1)
+	srvConn := rpc.NewConn(rpc.NewTransport(p1), &rpc.Options{
+		BootstrapClient: capnp.Client(testcp.PingPong_ServerToClient(pingPongServer{})),
+		ErrorReporter:   testErrorReporter{tb: t},
+		// Refills far too slowly to matter during the test.
+		CallRateLimiter: rpc.NewTokenBucket(0.001, burst),
+	})
+	defer srvConn.Close()
+	cliConn := rpc.NewConn(rpc.NewTransport(p2), &rpc.Options{
+		ErrorReporter: testErrorReporter{tb: t},
+	})
+	defer cliConn.Close()
+
+	ctx := context.Background()
+	pp := testcp.PingPong(cliConn.Bootstrap(ctx))
+	defer pp.Release()
+
+	const n = 4 * burst
+	var futures []testcp.PingPong_echoNum_Results_Future
+	for i := 0; i < n; i++ {
+		i := i
+		f, release := pp.EchoNum(ctx, func(p testcp.PingPong_echoNum_Params) error {
+			p.SetN(int64(i))
+			return nil
+		})
+		defer release()
+		futures = append(futures, f)
+	}
+	ok, overloaded := 0, 0
+	for i, f := range futures {
+		res, err := f.Struct()
+		switch {
+		case err == nil:
+			if res.N() != int64(i) {
+				t.Errorf("EchoNum(%d) = %d", i, res.N())
+			}
+			ok++
+		case exc.TypeOf(err) == exc.Overloaded:
+			overloaded++
+		default:
+			t.Errorf("EchoNum(%d): %v; want overloaded exception", i, err)
+		}
+	}
+	if ok != burst || overloaded != n-burst {
+		t.Errorf("%d calls succeeded and %d were overloaded; want %d and %d", ok, overloaded, burst, n-burst)
+	}
+
+	// The connection is still usable.
+	select {
+	case <-srvConn.Done():
+		t.Fatal("server conn shut down after rejecting calls")
+	default:
+	}
+	boot := cliConn.Bootstrap(ctx)
+	defer boot.Release()
+	if err := boot.Resolve(ctx); err != nil {
+		t.Error("Bootstrap after rejected calls:", err)
+	}
+}
@@ -0,0 +1,290 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"capnproto.org/go/capnp/v3"
+)
+
+// A RetryPolicy controls which calls a client created by
+// NewReconnectingClient replays after a disconnect, and how often.
+type RetryPolicy struct {
+	// MaxAttempts is the largest number of times that a call is made,
+	// including the first attempt.  If zero, calls are made at most
+	// three times.
+	MaxAttempts int
+
+	// Backoff is how long to wait before the first retry.  The wait
+	// doubles after each retry, up to MaxBackoff if it is set.  If
+	// Backoff is zero, calls are retried immediately.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Idempotent reports whether calls to the method are safe to make
+	// more than once.  Calls to other methods fail with the disconnect
+	// error rather than being retried.  If nil, no calls are retried.
+	Idempotent func(capnp.Method) bool
+}
+
+func (p RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts == 0 {
+		return 3
+	}
+	return p.MaxAttempts
+}
+
+// backoff returns how long to wait before the given retry, numbered
+// from 1.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < retry && (p.MaxBackoff == 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff != 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// NewReconnectingClient returns a client that makes calls on a client
+// obtained from dial, typically the bootstrap capability of a new Conn.
+// dial is called for the first call and again after any call fails
+// with a disconnected exception.  Calls to methods that policy reports
+// as idempotent are then replayed on the new client, with their
+// original arguments, until they succeed, fail with another error, or
+// use up policy.MaxAttempts.
+//
+// Calls that arrive through the RecvCall path, such as those from a
+// Conn that exports the returned client, and pipelined calls on the
+// results of a call are never retried.
+func NewReconnectingClient(dial func(context.Context) (capnp.Client, error), policy RetryPolicy) capnp.Client {
+	return capnp.NewClient(&reconnectHook{dial: dial, policy: policy})
+}
+
+// reconnectHook is the ClientHook for NewReconnectingClient.
+type reconnectHook struct {
+	dial   func(context.Context) (capnp.Client, error)
+	policy RetryPolicy
+
+	mu     sync.Mutex
+	client capnp.Client // current client, or null if it must be dialed
+	gen    int          // incremented each time client is dialed
+}
+
+// get returns the current client, dialing a new one if needed, along
+// with its generation.  The caller must not release the client.
+func (h *reconnectHook) get(ctx context.Context) (capnp.Client, int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if (h.client != capnp.Client{}) {
+		return h.client, h.gen, nil
+	}
+	c, err := h.dial(ctx)
+	if err != nil {
+		return capnp.Client{}, 0, rpcerr.Annotate(err, "dial")
+	}
+	h.client = c
+	h.gen++
+	return c, h.gen, nil
+}
+
+// drop discards the client of the given generation after a disconnect,
+// so that the next call dials a new one.
+func (h *reconnectHook) drop(gen int) {
+	h.mu.Lock()
+	if gen != h.gen || (h.client == capnp.Client{}) {
+		h.mu.Unlock()
+		return
+	}
+	c := h.client
+	h.client = capnp.Client{}
+	h.mu.Unlock()
+	c.Release()
+}
+
+// watch drops the client of the given generation if ans fails with a
+// disconnected exception.
+func (h *reconnectHook) watch(ans *capnp.Answer, gen int) {
+	<-ans.Done()
+	if _, err := ans.Struct(); capnp.IsDisconnected(err) {
+		h.drop(gen)
+	}
+}
+
+func (h *reconnectHook) Send(ctx context.Context, s capnp.Send) (*capnp.Answer, capnp.ReleaseFunc) {
+	if h.policy.Idempotent == nil || !h.policy.Idempotent(s.Method) {
+		c, gen, err := h.get(ctx)
+		if err != nil {
+			return capnp.ErrorAnswer(s.Method, err), func() {}
+		}
+		ans, release := c.SendCall(ctx, s)
+		select {
+		case <-ans.Done():
+			// Calls on a closed connection fail immediately, so drop
+			// the client before the next call.
+			h.watch(ans, gen)
+		default:
+			go h.watch(ans, gen)
+		}
+		return ans, release
+	}
+
+	// Keep a copy of the arguments to replay.
+	msg, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		return capnp.ErrorAnswer(s.Method, err), func() {}
+	}
+	args, err := capnp.NewRootStruct(seg, s.ArgsSize)
+	if err == nil && s.PlaceArgs != nil {
+		err = s.PlaceArgs(args)
+	}
+	if err != nil {
+		msg.Reset(nil)
+		return capnp.ErrorAnswer(s.Method, err), func() {}
+	}
+	// Releasing the call before it finishes cancels runCtx, which
+	// cancels the current attempt and stops any further retries.
+	runCtx, cancel := context.WithCancel(ctx)
+	rc := &retryCall{h: h, method: s.Method, args: args, cancel: cancel}
+	rc.ans, rc.release, rc.gen, err = rc.attempt(runCtx)
+	if err != nil {
+		cancel()
+		msg.Reset(nil)
+		return capnp.ErrorAnswer(s.Method, err), func() {}
+	}
+	p := capnp.NewPromise(s.Method, rc)
+	go rc.run(runCtx, p)
+	return p.Answer(), func() {
+		rc.cancel()
+		finish := func() {
+			p.ReleaseClients()
+			rc.mu.Lock()
+			release := rc.release
+			rc.release = nil
+			rc.mu.Unlock()
+			if release != nil {
+				release()
+			}
+			msg.Reset(nil)
+		}
+		select {
+		case <-p.Answer().Done():
+			finish()
+		default:
+			go func() {
+				<-p.Answer().Done()
+				finish()
+			}()
+		}
+	}
+}
+
+func (h *reconnectHook) Recv(ctx context.Context, r capnp.Recv) capnp.PipelineCaller {
+	c, _, err := h.get(ctx)
+	if err != nil {
+		r.Reject(err)
+		return nil
+	}
+	return c.RecvCall(ctx, r)
+}
+
+func (h *reconnectHook) Brand() capnp.Brand {
+	return capnp.Brand{}
+}
+
+func (h *reconnectHook) Shutdown() {
+	h.mu.Lock()
+	c := h.client
+	h.client = capnp.Client{}
+	h.mu.Unlock()
+	c.Release()
+}
+
+// A retryCall is an idempotent call made by a reconnectHook.  It
+// forwards pipelined calls to the answer of its current attempt.
+type retryCall struct {
+	h      *reconnectHook
+	method capnp.Method
+	args   capnp.Struct
+	cancel context.CancelFunc // stops run
+
+	mu      sync.Mutex
+	ans     *capnp.Answer // current attempt
+	release capnp.ReleaseFunc
+	gen     int
+}
+
+// attempt sends the call on the hook's current client.
+func (rc *retryCall) attempt(ctx context.Context) (*capnp.Answer, capnp.ReleaseFunc, int, error) {
+	c, gen, err := rc.h.get(ctx)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	ans, release := c.SendCall(ctx, capnp.Send{
+		Method:   rc.method,
+		ArgsSize: rc.args.Size(),
+		PlaceArgs: func(p capnp.Struct) error {
+			return p.CopyFrom(rc.args)
+		},
+	})
+	return ans, release, gen, nil
+}
+
+// run waits for each attempt to finish, retrying after disconnects as
+// allowed by the policy, and then resolves p with the final result.
+// If ctx is canceled first, run rejects p without waiting further.
+func (rc *retryCall) run(ctx context.Context, p *capnp.Promise) {
+	defer rc.cancel()
+	rc.mu.Lock()
+	ans, gen := rc.ans, rc.gen
+	rc.mu.Unlock()
+	for retry := 1; ; retry++ {
+		select {
+		case <-ans.Done():
+		case <-ctx.Done():
+			p.Reject(ctx.Err())
+			return
+		}
+		res, err := ans.Struct()
+		if !capnp.IsDisconnected(err) || retry >= rc.h.policy.maxAttempts() {
+			p.Resolve(res.ToPtr(), err)
+			return
+		}
+		rc.h.drop(gen)
+		if d := rc.h.policy.backoff(retry); d > 0 {
+			t := time.NewTimer(d)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				p.Reject(ctx.Err())
+				return
+			}
+		}
+		next, release, nextGen, err := rc.attempt(ctx)
+		if err != nil {
+			p.Reject(err)
+			return
+		}
+		rc.mu.Lock()
+		prev := rc.release
+		rc.ans, rc.release, rc.gen = next, release, nextGen
+		rc.mu.Unlock()
+		prev()
+		ans, gen = next, nextGen
+	}
+}
+
+func (rc *retryCall) PipelineSend(ctx context.Context, transform []capnp.PipelineOp, s capnp.Send) (*capnp.Answer, capnp.ReleaseFunc) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.ans.PipelineSend(ctx, transform, s)
+}
+
+func (rc *retryCall) PipelineRecv(ctx context.Context, transform []capnp.PipelineOp, r capnp.Recv) capnp.PipelineCaller {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.ans.PipelineRecv(ctx, transform, r)
+}
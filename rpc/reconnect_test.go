@@ -0,0 +1,195 @@
+package rpc_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"capnproto.org/go/capnp/v3"
+	"capnproto.org/go/capnp/v3/rpc"
+	"capnproto.org/go/capnp/v3/rpc/internal/testcapnp"
+	"capnproto.org/go/capnp/v3/rpc/transport"
+)
+
+// reconnectDialer hands out bootstrap clients of new connections to a
+// PingPong server.
+type reconnectDialer struct {
+	mu    sync.Mutex
+	conns [][2]*rpc.Conn // server, client
+}
+
+func (d *reconnectDialer) dial(ctx context.Context) (capnp.Client, error) {
+	left, right := transport.NewPipe(1)
+	srv := rpc.NewConn(rpc.NewTransport(left), &rpc.Options{
+		BootstrapClient: capnp.Client(testcapnp.PingPong_ServerToClient(echoNumServer{})),
+	})
+	cli := rpc.NewConn(rpc.NewTransport(right), nil)
+	d.mu.Lock()
+	d.conns = append(d.conns, [2]*rpc.Conn{srv, cli})
+	d.mu.Unlock()
+	return cli.Bootstrap(ctx), nil
+}
+
+// disconnect closes the most recent connection.
+func (d *reconnectDialer) disconnect() {
+	d.mu.Lock()
+	c := d.conns[len(d.conns)-1]
+	d.mu.Unlock()
+	c[0].Close()
+	<-c[1].Done()
+}
+
+func (d *reconnectDialer) numDials() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.conns)
+}
+
+func (d *reconnectDialer) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, c := range d.conns {
+		c[1].Close()
+		c[0].Close()
+	}
+}
+
+func echoNum(ctx context.Context, pp testcapnp.PingPong, n int64) (int64, error) {
+	future, release := pp.EchoNum(ctx, func(p testcapnp.PingPong_echoNum_Params) error {
+		p.SetN(n)
+		return nil
+	})
+	defer release()
+	res, err := future.Struct()
+	if err != nil {
+		return 0, err
+	}
+	return res.N(), nil
+}
+
+func TestReconnectingClient(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	var d reconnectDialer
+	defer d.close()
+	pp := testcapnp.PingPong(rpc.NewReconnectingClient(d.dial, rpc.RetryPolicy{
+		Idempotent: func(m capnp.Method) bool {
+			return m.InterfaceID == testcapnp.PingPong_TypeID
+		},
+	}))
+	defer pp.Release()
+
+	if n, err := echoNum(ctx, pp, 1); err != nil || n != 1 {
+		t.Fatalf("first EchoNum = %d, %v; want 1, <nil>", n, err)
+	}
+	d.disconnect()
+	if n, err := echoNum(ctx, pp, 2); err != nil || n != 2 {
+		t.Fatalf("EchoNum after disconnect = %d, %v; want 2, <nil>", n, err)
+	}
+	if got := d.numDials(); got != 2 {
+		t.Errorf("dialed %d times; want 2", got)
+	}
+}
+
+func TestReconnectingClient_NotIdempotent(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	var d reconnectDialer
+	defer d.close()
+	pp := testcapnp.PingPong(rpc.NewReconnectingClient(d.dial, rpc.RetryPolicy{}))
+	defer pp.Release()
+
+	if _, err := echoNum(ctx, pp, 1); err != nil {
+		t.Fatal("first EchoNum:", err)
+	}
+	d.disconnect()
+	if _, err := echoNum(ctx, pp, 2); !capnp.IsDisconnected(err) {
+		t.Fatalf("EchoNum after disconnect: %v; want disconnected", err)
+	}
+	// The failed call causes the next one to use a new connection.
+	if n, err := echoNum(ctx, pp, 3); err != nil || n != 3 {
+		t.Fatalf("EchoNum on new connection = %d, %v; want 3, <nil>", n, err)
+	}
+	if got := d.numDials(); got != 2 {
+		t.Errorf("dialed %d times; want 2", got)
+	}
+}
+
+func TestReconnectingClient_ReleasePending(t *testing.T) {
+	t.Parallel()
+
+	block := make(chan struct{})
+	defer close(block)
+	srv, count := newCountingPingServer(block)
+	defer srv.Release()
+	pp := testcapnp.PingPong(rpc.NewReconnectingClient(func(context.Context) (capnp.Client, error) {
+		return capnp.Client(srv).AddRef(), nil
+	}, rpc.RetryPolicy{
+		Idempotent: func(capnp.Method) bool { return true },
+	}))
+	defer pp.Release()
+
+	future, release := pp.EchoNum(context.Background(), func(p testcapnp.PingPong_echoNum_Params) error {
+		p.SetN(1)
+		return nil
+	})
+	for count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	releaseWithin(t, release)
+	if _, err := future.Struct(); err == nil {
+		t.Error("released call succeeded; want it canceled")
+	}
+}
+
+func TestReconnectingClient_ReleaseRetrying(t *testing.T) {
+	t.Parallel()
+
+	pp := testcapnp.PingPong(rpc.NewReconnectingClient(func(context.Context) (capnp.Client, error) {
+		return capnp.ErrorClient(capnp.Disconnected("backend gone")), nil
+	}, rpc.RetryPolicy{
+		Backoff:    time.Hour,
+		Idempotent: func(capnp.Method) bool { return true },
+	}))
+	defer pp.Release()
+
+	future, release := pp.EchoNum(context.Background(), func(p testcapnp.PingPong_echoNum_Params) error {
+		p.SetN(1)
+		return nil
+	})
+	releaseWithin(t, release)
+	if _, err := future.Struct(); !errors.Is(err, context.Canceled) {
+		t.Errorf("released call: %v; want %v", err, context.Canceled)
+	}
+}
+
+// releaseWithin calls release and fails the test if it does not return
+// promptly.
+func releaseWithin(t *testing.T, release capnp.ReleaseFunc) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		release()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("release blocked on a call that has not finished")
+	}
+}
+
+type echoNumServer struct{}
+
+func (echoNumServer) EchoNum(ctx context.Context, p testcapnp.PingPong_echoNum) error {
+	results, err := p.AllocResults()
+	if err != nil {
+		return err
+	}
+	results.SetN(p.Args().N())
+	return nil
+}
@@ -70,13 +70,31 @@ type Conn struct {
 	er           errReporter
 	abortTimeout time.Duration
 
+	keepAlive        time.Duration // zero if disabled
+	keepAliveTimeout time.Duration
+	keepAliveRecv    chan struct{} // signaled by each received message
+
+	observer func(Direction, Message) // nil if none
+
+	callLimiter RateLimiter // nil if none
+
+	noBootstrapCache bool
+
+	answerTTL time.Duration // zero if answers are kept until finished
+
+	onUnknown func(Message) error // nil if none
+
+	// manualDone receives the error that ends the Conn from ReceiveOne.
+	// It is nil unless Options.ManualReceive is set.
+	manualDone chan error
+
 	// bgctx is a Context that is canceled when shutdown starts.
 	bgctx context.Context
 	// bgcancel cancels bgctx.  Callers MUST hold mu.
 	bgcancel context.CancelFunc
 	// tasks block shutdown.
 	tasks sync.WaitGroup
-	// Only the receive goroutine may call RecvMessage.
+	// Only the receive goroutine, or ReceiveOne, may call RecvMessage.
 	// Only the send goroutine may call NewMessage.
 	transport Transport
 	// mu protects all the following fields in the Conn.
@@ -86,6 +104,10 @@ type Conn struct {
 
 	sender *mpsc.Queue[asyncSend]
 
+	// bootstrapCache refers to the client most recently returned by
+	// Bootstrap, or is nil if caching is disabled.
+	bootstrapCache *capnp.WeakClient
+
 	// Tables
 	questions  []*question
 	questionID idgen
@@ -113,6 +135,81 @@ type Options struct {
 	// before closing the transport.  If zero, then a reasonably short
 	// timeout is used.
 	AbortTimeout time.Duration
+
+	// KeepAlive is how often the Conn checks that the remote vat is
+	// responding.  If no message has arrived since the last check, the
+	// Conn sends a ping that the remote vat echoes back, and if nothing
+	// arrives within KeepAliveTimeout, the Conn is closed as if the
+	// remote vat had disconnected.  If KeepAlive is zero, no checks are
+	// made.  KeepAlive is ignored if ManualReceive is set, since the
+	// Conn cannot tell a silent remote vat from one whose messages
+	// have not been received yet.
+	KeepAlive time.Duration
+
+	// KeepAliveTimeout is how long to wait for the remote vat to respond
+	// to a keepalive check.  If zero, KeepAlive is used.
+	KeepAliveTimeout time.Duration
+
+	// MessageObserver, if not nil, is called with each message that the
+	// Conn receives, before the message is processed, and with each
+	// message that it sends, just before it is sent.  It is useful for
+	// recording or debugging the protocol.  MessageObserver is called
+	// from the Conn's send and receive goroutines, so it should return
+	// quickly and must not use the Conn.  It must not modify msg or
+	// retain it, or anything read from it, after it returns.
+	MessageObserver func(dir Direction, msg Message)
+
+	// CallRateLimiter, if not nil, is asked to allow each call that
+	// the remote vat makes.  Calls that it does not allow fail with an
+	// overloaded exception.  Unlike a server.Admission, which applies
+	// to the calls of a capability, it applies to every call on the
+	// connection.
+	CallRateLimiter RateLimiter
+
+	// Logger, if not nil, records events that the Conn does not return
+	// to a caller, such as malformed messages that it ignored.  Errors
+	// passed to ErrorReporter are logged too.
+	Logger Logger
+
+	// DisableBootstrapCache makes every call to Conn.Bootstrap ask the
+	// remote vat for its bootstrap capability, instead of sharing the
+	// client returned by an earlier call that is still referenced.
+	DisableBootstrapCache bool
+
+	// AnswerTTL, if positive, limits how long the Conn keeps the results
+	// of a call that it has returned to the remote vat, but that the
+	// remote vat has not finished.  When the TTL elapses, the results'
+	// capabilities are released, and any further calls pipelined on the
+	// results fail.  Capabilities that the remote vat received in the
+	// results stay valid.  A well-behaved peer that is slow to send
+	// finish, for instance because it keeps making pipelined calls on
+	// results long after they return, sees those calls fail once the
+	// TTL elapses, so the TTL should be well above the longest time a
+	// legitimate client holds onto an answer.
+	//
+	// An evicted answer's ID stays in use for another TTL, so that a
+	// late finish is accepted.  After that, the ID is freed, and a
+	// finish for it ends the connection like a finish for any other
+	// unknown question.
+	AnswerTTL time.Duration
+
+	// OnUnknownMessage, if not nil, is called with each message that
+	// the Conn does not handle, such as a message type added to the
+	// protocol after this package was written, or a level 3 message
+	// like provide.  If it returns an error, the Conn aborts with that
+	// error.  Otherwise, or if OnUnknownMessage is nil, the Conn replies
+	// with an unimplemented message as the protocol requires, and
+	// carries on.  OnUnknownMessage is called from the Conn's receive
+	// goroutine, so it should return quickly and must not use the Conn.
+	// It must not retain msg, or anything read from it, after it
+	// returns.
+	OnUnknownMessage func(msg Message) error
+
+	// ManualReceive, if true, makes the Conn receive messages only when
+	// ReceiveOne is called, instead of from a goroutine of its own.
+	// This lets a single goroutine drive both ends of a connection, as
+	// in deterministic tests.
+	ManualReceive bool
 }
 
 // ErrorReporter can receive errors from a Conn.  ReportError should be quick
@@ -145,16 +242,41 @@ func NewConn(t Transport, opts *Options) *Conn {
 	}
 	if opts != nil {
 		c.bootstrap = opts.BootstrapClient
-		c.er = errReporter{opts.ErrorReporter}
+		c.er = errReporter{ErrorReporter: opts.ErrorReporter, log: opts.Logger}
 		c.abortTimeout = opts.AbortTimeout
+		c.keepAlive = opts.KeepAlive
+		c.keepAliveTimeout = opts.KeepAliveTimeout
+		c.observer = opts.MessageObserver
+		c.callLimiter = opts.CallRateLimiter
+		c.noBootstrapCache = opts.DisableBootstrapCache
+		c.answerTTL = opts.AnswerTTL
+		c.onUnknown = opts.OnUnknownMessage
+		if opts.ManualReceive {
+			c.manualDone = make(chan error, 1)
+		}
 	}
+	if c.er.log == nil {
+		c.er.log = nopLogger{}
+	}
+	c.er.connID = nextConnID()
 	if c.abortTimeout == 0 {
 		c.abortTimeout = 100 * time.Millisecond
 	}
+	if c.keepAliveTimeout == 0 {
+		c.keepAliveTimeout = c.keepAlive
+	}
 
 	// start background tasks
 	g.Go(c.backgroundTask(c.send))
-	g.Go(c.backgroundTask(c.receive))
+	if c.manualDone != nil {
+		g.Go(c.backgroundTask(c.waitManualReceive))
+	} else {
+		g.Go(c.backgroundTask(c.receive))
+	}
+	if c.keepAlive > 0 && c.manualDone == nil {
+		c.keepAliveRecv = make(chan struct{}, 1)
+		g.Go(c.backgroundTask(c.keepAliveLoop))
+	}
 
 	// monitor background tasks
 	go func() {
@@ -198,18 +320,51 @@ func (c *Conn) backgroundTask(f func() error) func() error {
 
 // Bootstrap returns the remote vat's bootstrap interface.  This creates
 // a new client that the caller is responsible for releasing.
-func (c *Conn) Bootstrap(ctx context.Context) (bc capnp.Client) {
+//
+// Unless Options.DisableBootstrapCache is set, clients returned by
+// Bootstrap share a single import of the bootstrap interface: while any
+// of them is still referenced, Bootstrap returns another reference to
+// it instead of asking the remote vat again, and the import is released
+// along with the last reference.  A bootstrap that failed is not shared:
+// once the shared client has resolved to an error, the next call to
+// Bootstrap asks the remote vat again.  A shared bootstrap is not
+// canceled by ctx: ctx only bounds sending the request.
+func (c *Conn) Bootstrap(ctx context.Context) capnp.Client {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if c.noBootstrapCache {
+		bc, _ := c.newBootstrap(ctx, ctx)
+		return bc
+	}
+	if bc, ok := c.bootstrapCache.AddRef(); ok {
+		if bc.IsValid() && bc.Snapshot().IsErr() == nil {
+			return bc
+		}
+		bc.Release()
+	}
+	// The shared question is canceled by releasing the last reference,
+	// or by the Conn shutting down.
+	bc, ok := c.newBootstrap(ctx, context.Background())
+	if ok {
+		c.bootstrapCache = bc.WeakRef()
+	}
+	return bc
+}
+
+// newBootstrap sends a bootstrap message and returns a client for its
+// answer.  The question is canceled when cancelCtx is done.  ok is
+// false if the Conn is shutting down.  The caller must be holding
+// onto c.mu.
+func (c *Conn) newBootstrap(ctx, cancelCtx context.Context) (bc capnp.Client, ok bool) {
 	// Start a background task to prevent the conn from shutting down
 	// while sending the bootstrap message.
 	if !c.startTask() {
-		return capnp.ErrorClient(rpcerr.Disconnectedf("connection closed"))
+		return capnp.ErrorClient(rpcerr.Disconnectedf("connection closed")), false
 	}
 	defer c.tasks.Done()
 
-	bootCtx, cancel := context.WithCancel(ctx)
+	bootCtx, cancel := context.WithCancel(cancelCtx)
 	q := c.newQuestion(capnp.Method{})
 	bc, q.bootstrapPromise = capnp.NewPromisedClient(bootstrapClient{
 		c:      q.p.Answer().Client().AddRef(),
@@ -242,7 +397,7 @@ func (c *Conn) Bootstrap(ctx context.Context) (bc capnp.Client) {
 		}()
 	})
 
-	return
+	return bc, true
 }
 
 type bootstrapClient struct {
@@ -270,16 +425,25 @@ func (bc bootstrapClient) Shutdown() {
 // Close sends an abort to the remote vat and closes the underlying
 // transport.
 func (c *Conn) Close() error {
+	return c.CloseWithReason(exc.Exception{ // NOTE:  omit "rpc" prefix
+		Type:  exc.Failed,
+		Cause: ErrConnClosed,
+	})
+}
+
+// CloseWithReason is like Close, but sends reason to the remote vat in
+// the abort message.  The capabilities that c exported are released
+// with reason, so servers that implement server.ReasonShutdowner can
+// tell that they were shut down by the connection closing.  If reason
+// is nil, no abort message is sent.
+func (c *Conn) CloseWithReason(reason error) error {
 	c.mu.Lock()
 	defer func() {
 		c.mu.Unlock()
 		<-c.closed
 	}()
 
-	return c.shutdown(exc.Exception{ // NOTE:  omit "rpc" prefix
-		Type:  exc.Failed,
-		Cause: ErrConnClosed,
-	})
+	return c.shutdown(reason)
 }
 
 // Done returns a channel that is closed after the connection is
@@ -298,7 +462,7 @@ func (c *Conn) shutdown(abortErr error) (err error) {
 		c.bgcancel()
 		c.stopTasks()
 		syncutil.Without(&c.mu, c.drainQueue)
-		c.release()
+		c.release(abortErr)
 		c.abort(abortErr)
 
 		if err = c.transport.Close(); err != nil {
@@ -338,8 +502,9 @@ func (c *Conn) drainQueue() {
 }
 
 // Clear all tables, releasing exported clients and unfinished answers.
-// Called by 'shutdown'.  Caller MUST hold c.mu.
-func (c *Conn) release() {
+// The bootstrap and exported clients are released with reason, which
+// may be nil.  Called by 'shutdown'.  Caller MUST hold c.mu.
+func (c *Conn) release(reason error) {
 	exports := c.exports
 	embargoes := c.embargoes
 	answers := c.answers
@@ -353,20 +518,20 @@ func (c *Conn) release() {
 	c.mu.Unlock()
 	defer c.mu.Lock()
 
-	c.releaseBootstrap()
-	c.releaseExports(exports)
+	c.releaseBootstrap(reason)
+	c.releaseExports(exports, reason)
 	c.liftEmbargoes(embargoes)
 	c.releaseAnswers(answers)
 	c.releaseQuestions(questions)
 
 }
 
-func (c *Conn) releaseBootstrap() {
-	c.bootstrap.Release()
+func (c *Conn) releaseBootstrap(reason error) {
+	c.bootstrap.ReleaseWithReason(reason)
 	c.bootstrap = capnp.Client{}
 }
 
-func (c *Conn) releaseExports(exports []*expent) {
+func (c *Conn) releaseExports(exports []*expent, reason error) {
 	for _, e := range exports {
 		if e != nil {
 			metadata := e.client.State().Metadata
@@ -374,7 +539,7 @@ func (c *Conn) releaseExports(exports []*expent) {
 				c.clearExportID(metadata)
 			})
 
-			e.client.Release()
+			e.client.ReleaseWithReason(reason)
 		}
 	}
 }
@@ -390,6 +555,9 @@ func (c *Conn) liftEmbargoes(embargoes []*embargo) {
 func (c *Conn) releaseAnswers(answers map[answerID]*answer) {
 	for _, a := range answers {
 		if a != nil {
+			if a.ttl != nil {
+				a.ttl.Stop()
+			}
 			releaseList(a.resultCapTable).release()
 			a.releaseMsg()
 		}
@@ -419,18 +587,24 @@ func (c *Conn) abort(abortErr error) {
 		ctx, cancel := context.WithTimeout(context.Background(), c.abortTimeout)
 		defer cancel()
 
-		msg, send, release, err := c.transport.NewMessage(ctx)
+		msg, send, release, err := c.newMessage(ctx)
 		if err != nil {
+			c.er.debug("send abort: create message", "error", err)
 			return
 		}
 		defer release()
 
 		// configure & send abort message
-		if abort, err := msg.NewAbort(); err == nil {
+		abort, err := msg.NewAbort()
+		if err == nil {
 			abort.SetType(rpccp.Exception_Type(exc.TypeOf(abortErr)))
-			if err = abort.SetReason(abortErr.Error()); err == nil {
-				send()
-			}
+			err = abort.SetReason(abortErr.Error())
+		}
+		if err == nil {
+			err = send()
+		}
+		if err != nil {
+			c.er.debug("send abort", "error", err)
 		}
 	}
 }
@@ -452,122 +626,214 @@ func (c *Conn) send() error {
 // After receive returns, the connection is shut down.  If receive
 // returns a non-nil error, it is sent to the remove vat as an abort.
 func (c *Conn) receive() error {
-	ctx := c.bgctx
-
 	for {
-		recv, release, err := c.transport.RecvMessage(ctx)
-		if err != nil {
+		if stop, err := c.receiveOne(c.bgctx); stop {
 			return err
 		}
+	}
+}
+
+// ReceiveOne receives and handles a single message from the remote
+// vat.  It may only be called on a Conn created with
+// Options.ManualReceive, and must not be called concurrently with
+// itself.  ReceiveOne blocks until a message arrives, the Conn shuts
+// down, or ctx is done.  Since the transport cannot resume reading a
+// message part of the way through, a Conn whose ReceiveOne is
+// interrupted by ctx shuts down as if the transport had failed.
+//
+// ReceiveOne returns nil once the message is handled.  Otherwise, the
+// Conn is shutting down, and ReceiveOne returns the error that ended
+// it, or ExcClosed if the shutdown was clean, as after an abort from
+// the remote vat or a call to Close.
+func (c *Conn) ReceiveOne(ctx context.Context) error {
+	if c.manualDone == nil {
+		return rpcerr.Failedf("ReceiveOne called without Options.ManualReceive")
+	}
+	var ok bool
+	syncutil.With(&c.mu, func() {
+		ok = c.startTask()
+	})
+	if !ok {
+		return ExcClosed
+	}
+	defer c.tasks.Done()
+
+	// Stop receiving when the Conn shuts down, as the receive
+	// goroutine does.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-c.bgctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	stop, err := c.receiveOne(ctx)
+	if !stop {
+		return nil
+	}
+	select {
+	case c.manualDone <- err:
+	default:
+	}
+	if err == nil {
+		return ExcClosed
+	}
+	return err
+}
+
+// waitManualReceive stands in for receive when Options.ManualReceive
+// is set, returning the error that ReceiveOne stopped with.
+func (c *Conn) waitManualReceive() error {
+	select {
+	case err := <-c.manualDone:
+		return err
+	case <-c.bgctx.Done():
+		return nil
+	}
+}
+
+// receiveOne receives and handles a single message from the transport,
+// which it reads with recvCtx.  It returns stop = true if the Conn must
+// shut down, with err = nil if the shutdown is clean.
+func (c *Conn) receiveOne(recvCtx context.Context) (stop bool, err error) {
+	ctx := c.bgctx
+	recv, release, err := c.transport.RecvMessage(recvCtx)
+	if err != nil {
+		return true, err
+	}
+	if c.observer != nil {
+		c.observer(Inbound, recv)
+	}
+	c.noteAlive()
 
-		switch recv.Which() {
-		case rpccp.Message_Which_unimplemented:
-			// no-op for now to avoid feedback loop
+	switch recv.Which() {
+	case rpccp.Message_Which_unimplemented:
+		// no-op for now to avoid feedback loop
+		c.er.debug("remote vat sent unimplemented")
+		release()
 
-		case rpccp.Message_Which_abort:
+	case rpccp.Message_Which_obsoleteDelete:
+		// A keepalive ping: echo it back like any other message that
+		// is not implemented, but without reporting it.
+		c.sendMessage(ctx, func(m rpccp.Message) error {
 			defer release()
+			return m.SetUnimplemented(recv)
+		}, nil)
 
-			e, err := recv.Abort()
-			if err != nil {
-				c.er.ReportError(fmt.Errorf("read abort: %w", err))
-				return nil
-			}
+	case rpccp.Message_Which_abort:
+		defer release()
 
-			reason, err := e.Reason()
-			if err != nil {
-				c.er.ReportError(fmt.Errorf("read abort: reason: %w", err))
-				return nil
-			}
+		e, err := recv.Abort()
+		if err != nil {
+			c.er.warn("malformed message", fmt.Errorf("read abort: %w", err), "type", recv.Which().String())
+			return true, nil
+		}
 
-			c.er.ReportError(exc.New(exc.Type(e.Type()), "rpc", "remote abort: "+reason))
-			return nil
+		reason, err := e.Reason()
+		if err != nil {
+			c.er.warn("malformed message", fmt.Errorf("read abort: reason: %w", err), "type", recv.Which().String())
+			return true, nil
+		}
 
-		case rpccp.Message_Which_bootstrap:
-			bootstrap, err := recv.Bootstrap()
-			if err != nil {
-				release()
-				c.er.ReportError(fmt.Errorf("read bootstrap: %w", err))
-				continue
-			}
-			qid := answerID(bootstrap.QuestionId())
+		c.er.ReportError(exc.New(exc.Type(e.Type()), "rpc", "remote abort: "+reason))
+		return true, nil
+
+	case rpccp.Message_Which_bootstrap:
+		bootstrap, err := recv.Bootstrap()
+		if err != nil {
 			release()
-			if err := c.handleBootstrap(ctx, qid); err != nil {
-				return err
-			}
+			c.er.warn("malformed message", fmt.Errorf("read bootstrap: %w", err), "type", recv.Which().String())
+			return false, nil
+		}
+		qid := answerID(bootstrap.QuestionId())
+		release()
+		if err := c.handleBootstrap(ctx, qid); err != nil {
+			return true, err
+		}
 
-		case rpccp.Message_Which_call:
-			call, err := recv.Call()
-			if err != nil {
-				release()
-				c.er.ReportError(fmt.Errorf("read call: %w", err))
-				continue
-			}
-			if err := c.handleCall(ctx, call, release); err != nil {
-				return err
-			}
+	case rpccp.Message_Which_call:
+		call, err := recv.Call()
+		if err != nil {
+			release()
+			c.er.warn("malformed message", fmt.Errorf("read call: %w", err), "type", recv.Which().String())
+			return false, nil
+		}
+		if err := c.handleCall(ctx, call, release); err != nil {
+			return true, err
+		}
 
-		case rpccp.Message_Which_return:
-			ret, err := recv.Return()
-			if err != nil {
-				release()
-				c.er.ReportError(fmt.Errorf("read return: %w", err))
-				continue
-			}
-			if err := c.handleReturn(ctx, ret, release); err != nil {
-				return err
-			}
+	case rpccp.Message_Which_return:
+		ret, err := recv.Return()
+		if err != nil {
+			release()
+			c.er.warn("malformed message", fmt.Errorf("read return: %w", err), "type", recv.Which().String())
+			return false, nil
+		}
+		if err := c.handleReturn(ctx, ret, release); err != nil {
+			return true, err
+		}
 
-		case rpccp.Message_Which_finish:
-			fin, err := recv.Finish()
-			if err != nil {
-				release()
-				c.er.ReportError(fmt.Errorf("read finish: %w", err))
-				continue
-			}
-			qid := answerID(fin.QuestionId())
-			releaseResultCaps := fin.ReleaseResultCaps()
+	case rpccp.Message_Which_finish:
+		fin, err := recv.Finish()
+		if err != nil {
 			release()
-			if err := c.handleFinish(ctx, qid, releaseResultCaps); err != nil {
-				return err
-			}
+			c.er.warn("malformed message", fmt.Errorf("read finish: %w", err), "type", recv.Which().String())
+			return false, nil
+		}
+		qid := answerID(fin.QuestionId())
+		releaseResultCaps := fin.ReleaseResultCaps()
+		release()
+		if err := c.handleFinish(ctx, qid, releaseResultCaps); err != nil {
+			return true, err
+		}
 
-		case rpccp.Message_Which_release:
-			rel, err := recv.Release()
-			if err != nil {
-				release()
-				c.er.ReportError(fmt.Errorf("read release: %w", err))
-				continue
-			}
-			id := exportID(rel.Id())
-			count := rel.ReferenceCount()
+	case rpccp.Message_Which_release:
+		rel, err := recv.Release()
+		if err != nil {
 			release()
-			if err := c.handleRelease(ctx, id, count); err != nil {
-				return err
-			}
+			c.er.warn("malformed message", fmt.Errorf("read release: %w", err), "type", recv.Which().String())
+			return false, nil
+		}
+		id := exportID(rel.Id())
+		count := rel.ReferenceCount()
+		release()
+		if err := c.handleRelease(ctx, id, count); err != nil {
+			return true, err
+		}
 
-		case rpccp.Message_Which_disembargo:
-			d, err := recv.Disembargo()
-			if err != nil {
+	case rpccp.Message_Which_disembargo:
+		d, err := recv.Disembargo()
+		if err != nil {
+			release()
+			c.er.warn("malformed message", fmt.Errorf("read disembargo: %w", err), "type", recv.Which().String())
+			return false, nil
+		}
+		err = c.handleDisembargo(ctx, d, release)
+		if err != nil {
+			return true, err
+		}
+
+	default:
+		c.er.warn("unknown message type", fmt.Errorf("unknown message type %v from remote", recv.Which()), "type", recv.Which().String())
+		if c.onUnknown != nil {
+			if err := c.onUnknown(recv); err != nil {
+				which := recv.Which()
 				release()
-				c.er.ReportError(fmt.Errorf("read disembargo: %w", err))
-				continue
-			}
-			err = c.handleDisembargo(ctx, d, release)
-			if err != nil {
-				return err
+				return true, rpcerr.Annotatef(err, "incoming %v message", which)
 			}
-
-		default:
-			c.er.ReportError(fmt.Errorf("unknown message type %v from remote", recv.Which()))
-			c.sendMessage(ctx, func(m rpccp.Message) error {
-				defer release()
-				if err := m.SetUnimplemented(recv); err != nil {
-					return rpcerr.Annotatef(err, "send unimplemented")
-				}
-				return nil
-			}, nil)
 		}
+		c.sendMessage(ctx, func(m rpccp.Message) error {
+			defer release()
+			if err := m.SetUnimplemented(recv); err != nil {
+				return rpcerr.Annotatef(err, "send unimplemented")
+			}
+			return nil
+		}, nil)
 	}
+	return false, nil
 }
 
 func (c *Conn) handleBootstrap(ctx context.Context, id answerID) error {
@@ -671,6 +937,7 @@ func (c *Conn) handleCall(ctx context.Context, call rpccp.Call, releaseCall capn
 	}
 	ret.SetAnswerId(uint32(id))
 	ret.SetReleaseParamCaps(false)
+	allowed := c.callLimiter == nil || c.callLimiter.Allow()
 
 	// Find target and start call.
 	c.mu.Lock()
@@ -691,6 +958,14 @@ func (c *Conn) handleCall(ctx context.Context, call rpccp.Call, releaseCall capn
 		releaseCall()
 		return nil
 	}
+	if !allowed {
+		rl := ans.sendException(capnp.Overloaded("rpc: incoming call: call rate limit exceeded"))
+		c.mu.Unlock()
+		c.er.debug("call rate limit exceeded", "interface", call.InterfaceId(), "method", call.MethodId())
+		rl.release()
+		releaseCall()
+		return nil
+	}
 	released := false
 	releaseArgs := func() {
 		if released {
@@ -777,7 +1052,9 @@ func (c *Conn) handleCall(ctx context.Context, call rpccp.Call, releaseCall capn
 			case !iface.IsValid() || int64(iface.Capability()) >= int64(len(tgtAns.resultCapTable)):
 				tgt = capnp.Client{}
 			default:
-				tgt = tgtAns.resultCapTable[iface.Capability()]
+				// Hold a reference in case the target answer is
+				// evicted before the call is delivered.
+				tgt = tgtAns.resultCapTable[iface.Capability()].AddRef()
 			}
 			c.tasks.Add(1) // will be finished by answer.Return
 			var callCtx context.Context
@@ -789,6 +1066,7 @@ func (c *Conn) handleCall(ctx context.Context, call rpccp.Call, releaseCall capn
 				ReleaseArgs: releaseArgs,
 				Returner:    ans,
 			})
+			tgt.Release()
 			ans.setPipelineCaller(p.method, pcall)
 		} else {
 			// Results not ready, use pipeline caller.
@@ -1466,7 +1744,7 @@ func (c *Conn) startTask() (ok bool) {
 // holding c.mu.  Callers of sendMessage MAY wish to reacquire the
 // c.mu within the callback.
 func (c *Conn) sendMessage(ctx context.Context, f func(rpccp.Message) error, callback func(error)) {
-	msg, send, release, err := c.transport.NewMessage(ctx)
+	msg, send, release, err := c.newMessage(ctx)
 
 	// If errors happen when allocating or building the message, set up dummy send/release
 	// functions so the error handling logic in callback() runs as normal:
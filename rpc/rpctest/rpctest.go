@@ -0,0 +1,75 @@
+// Package rpctest provides utilities for testing code that uses Cap'n
+// Proto RPC.
+package rpctest
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"capnproto.org/go/capnp/v3"
+	"capnproto.org/go/capnp/v3/rpc"
+	"capnproto.org/go/capnp/v3/rpc/transport"
+)
+
+// NewPair connects two Conns with an in-memory pipe, with server as
+// the bootstrap capability of one, and returns the other's bootstrap
+// client.  NewPair steals the reference to server.
+//
+// cleanup releases the client and closes both Conns, reporting any
+// errors to t.  It is registered with t.Cleanup, so calling it is only
+// needed to tear the pair down before the test ends.  It is safe to
+// call more than once.
+func NewPair(t testing.TB, server capnp.Client) (client capnp.Client, cleanup func()) {
+	t.Helper()
+
+	er := &errorReporter{tb: t}
+	p1, p2 := transport.NewPipe(1)
+	srvConn := rpc.NewConn(rpc.NewTransport(p1), &rpc.Options{
+		BootstrapClient: server,
+		ErrorReporter:   er,
+	})
+	cliConn := rpc.NewConn(rpc.NewTransport(p2), &rpc.Options{
+		ErrorReporter: er,
+	})
+	client = cliConn.Bootstrap(context.Background())
+
+	var once sync.Once
+	cleanup = func() {
+		once.Do(func() {
+			er.stop()
+			client.Release()
+			if err := cliConn.Close(); err != nil {
+				t.Error("rpctest: close client conn:", err)
+			}
+			<-srvConn.Done()
+		})
+	}
+	t.Cleanup(cleanup)
+	return client, cleanup
+}
+
+// errorReporter logs the errors of a pair's Conns to a test until
+// the pair is torn down.
+type errorReporter struct {
+	tb testing.TB
+
+	mu      sync.Mutex
+	stopped bool
+}
+
+func (er *errorReporter) ReportError(err error) {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	if !er.stopped {
+		er.tb.Log("rpctest: conn error:", err)
+	}
+}
+
+// stop discards the errors reported from then on, such as those
+// caused by closing the Conns.
+func (er *errorReporter) stop() {
+	er.mu.Lock()
+	er.stopped = true
+	er.mu.Unlock()
+}
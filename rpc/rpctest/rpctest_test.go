@@ -0,0 +1,47 @@
+package rpctest_test
+
+import (
+	"context"
+	"testing"
+
+	"capnproto.org/go/capnp/v3"
+	testcp "capnproto.org/go/capnp/v3/rpc/internal/testcapnp"
+	"capnproto.org/go/capnp/v3/rpc/rpctest"
+)
+
+type echoServer struct{}
+
+func (echoServer) EchoNum(ctx context.Context, call testcp.PingPong_echoNum) error {
+	res, err := call.AllocResults()
+	if err != nil {
+		return err
+	}
+	res.SetN(call.Args().N())
+	return nil
+}
+
+func TestNewPair(t *testing.T) {
+	client, _ := rpctest.NewPair(t, capnp.Client(testcp.PingPong_ServerToClient(echoServer{})))
+	pp := testcp.PingPong(client)
+	f, release := pp.EchoNum(context.Background(), func(p testcp.PingPong_echoNum_Params) error {
+		p.SetN(42)
+		return nil
+	})
+	defer release()
+	res, err := f.Struct()
+	if err != nil {
+		t.Fatal("EchoNum:", err)
+	}
+	if res.N() != 42 {
+		t.Errorf("EchoNum(42) = %d", res.N())
+	}
+}
+
+func TestNewPair_Cleanup(t *testing.T) {
+	client, cleanup := rpctest.NewPair(t, capnp.Client(testcp.PingPong_ServerToClient(echoServer{})))
+	cleanup()
+	cleanup() // safe to call again, and again by t.Cleanup
+	if client.IsValid() {
+		t.Error("client still valid after cleanup")
+	}
+}
@@ -0,0 +1,78 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"capnproto.org/go/capnp/v3"
+)
+
+// Serve accepts connections on lis and serves bootstrap on each of them
+// until lis is closed, at which point Serve closes the connections that
+// it created and returns nil.  If accepting a connection fails for any
+// other reason, Serve closes the connections and returns the error.
+// Serve takes ownership of bootstrap, releasing it when it returns.
+//
+// Each connection is created with NewConn using a copy of opts whose
+// BootstrapClient is set to bootstrap, so errors on the connections are
+// reported to opts.ErrorReporter.  opts may be nil.
+func Serve(lis net.Listener, bootstrap capnp.Client, opts *Options) error {
+	defer bootstrap.Release()
+	var connOpts Options
+	if opts != nil {
+		connOpts = *opts
+	}
+
+	var (
+		mu    sync.Mutex
+		conns = make(map[*Conn]struct{})
+		wg    sync.WaitGroup
+	)
+	defer func() {
+		mu.Lock()
+		open := conns
+		conns = nil
+		mu.Unlock()
+		for c := range open {
+			c.Close()
+		}
+		wg.Wait()
+	}()
+	for {
+		nc, err := lis.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return rpcerr.Annotate(err, "serve")
+		}
+		connOpts.BootstrapClient = bootstrap.AddRef()
+		c := NewConn(NewStreamTransport(nc), &connOpts)
+		mu.Lock()
+		conns[c] = struct{}{}
+		mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-c.Done()
+			mu.Lock()
+			delete(conns, c)
+			mu.Unlock()
+		}()
+	}
+}
+
+// Dial connects to the address on the named network, as with
+// net.Dialer.DialContext, and returns a Conn that uses it.  The
+// connection's bootstrap capability is available from Conn.Bootstrap.
+// opts is passed to NewConn and may be nil.
+func Dial(ctx context.Context, network, addr string, opts *Options) (*Conn, error) {
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, rpcerr.Annotate(err, "dial")
+	}
+	return NewConn(NewStreamTransport(nc), opts), nil
+}
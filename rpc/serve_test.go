@@ -0,0 +1,60 @@
+package rpc_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"capnproto.org/go/capnp/v3"
+	"capnproto.org/go/capnp/v3/rpc"
+	"capnproto.org/go/capnp/v3/rpc/internal/testcapnp"
+)
+
+func TestServeDial(t *testing.T) {
+	t.Parallel()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveDone := make(chan error, 1)
+	go func() {
+		bootstrap := capnp.Client(testcapnp.PingPong_ServerToClient(echoNumServer{}))
+		serveDone <- rpc.Serve(lis, bootstrap, nil)
+	}()
+
+	ctx := context.Background()
+	conn, err := rpc.Dial(ctx, "tcp", lis.Addr().String(), nil)
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	pp := testcapnp.PingPong(conn.Bootstrap(ctx))
+	if n, err := echoNum(ctx, pp, 42); err != nil || n != 42 {
+		t.Errorf("EchoNum = %d, %v; want 42, <nil>", n, err)
+	}
+	pp.Release()
+
+	// Closing the listener stops Serve and closes the connection.
+	if err := lis.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-serveDone; err != nil {
+		t.Error("Serve:", err)
+	}
+	<-conn.Done()
+}
+
+func TestDial_Error(t *testing.T) {
+	t.Parallel()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	if conn, err := rpc.Dial(context.Background(), "tcp", addr, nil); err == nil {
+		conn.Close()
+		t.Error("Dial to closed listener succeeded")
+	}
+}
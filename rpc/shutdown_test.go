@@ -2,8 +2,10 @@ package rpc_test
 
 import (
 	"context"
+	"errors"
 	"net"
 	"testing"
+	"time"
 
 	"capnproto.org/go/capnp/v3"
 	"capnproto.org/go/capnp/v3/rpc"
@@ -58,3 +60,58 @@ func (s dropPingServer) EchoNum(ctx context.Context, p testcapnp.PingPong_echoNu
 	<-ctx.Done()
 	return nil
 }
+
+// TestCloseWithReason verifies that closing a connection with a reason
+// passes the reason to exported servers that implement
+// server.ReasonShutdowner.
+func TestCloseWithReason(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	reasons := make(chan error, 1)
+	left, right := transport.NewPipe(1)
+	serverConn := rpc.NewConn(rpc.NewTransport(left), &rpc.Options{
+		BootstrapClient: capnp.Client(testcapnp.PingPong_ServerToClient(reasonPingServer{reasons})),
+	})
+	clientConn := rpc.NewConn(rpc.NewTransport(right), nil)
+	defer clientConn.Close()
+
+	client := testcapnp.PingPong(clientConn.Bootstrap(ctx))
+	defer client.Release()
+	future, release := client.EchoNum(ctx, func(p testcapnp.PingPong_echoNum_Params) error {
+		p.SetN(42)
+		return nil
+	})
+	defer release()
+	if _, err := future.Struct(); err != nil {
+		t.Fatal("EchoNum:", err)
+	}
+
+	reason := errors.New("going away")
+	serverConn.CloseWithReason(reason)
+	select {
+	case err := <-reasons:
+		if !errors.Is(err, reason) {
+			t.Errorf("Shutdown reason = %v; want %v", err, reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server not shut down after CloseWithReason")
+	}
+}
+
+type reasonPingServer struct {
+	reasons chan<- error
+}
+
+func (s reasonPingServer) EchoNum(ctx context.Context, p testcapnp.PingPong_echoNum) error {
+	results, err := p.AllocResults()
+	if err != nil {
+		return err
+	}
+	results.SetN(p.Args().N())
+	return nil
+}
+
+func (s reasonPingServer) Shutdown(reason error) {
+	s.reasons <- reason
+}
@@ -0,0 +1,65 @@
+package rpc
+
+import (
+	"context"
+	"time"
+
+	"capnproto.org/go/capnp/v3"
+)
+
+// NewTimeoutClient returns a client that makes calls on c with a
+// deadline of d after the call is made.  If the caller's context has an
+// earlier deadline, that deadline is used instead.  A call that
+// outlives its deadline is canceled, which for a call on a Conn fails it
+// with context.DeadlineExceeded.  It takes ownership of c, releasing it
+// when the returned client is released.
+//
+// The deadline applies to calls that arrive through the RecvCall path
+// too, such as those from a Conn that exports the returned client.
+func NewTimeoutClient(c capnp.Client, d time.Duration) capnp.Client {
+	return capnp.NewClient(&timeoutHook{client: c, timeout: d})
+}
+
+// timeoutHook is the ClientHook for NewTimeoutClient.
+type timeoutHook struct {
+	client  capnp.Client
+	timeout time.Duration
+}
+
+func (h *timeoutHook) Send(ctx context.Context, s capnp.Send) (*capnp.Answer, capnp.ReleaseFunc) {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	ans, release := h.client.SendCall(ctx, s)
+	go func() {
+		<-ans.Done()
+		cancel()
+	}()
+	return ans, func() {
+		cancel()
+		release()
+	}
+}
+
+func (h *timeoutHook) Recv(ctx context.Context, r capnp.Recv) capnp.PipelineCaller {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	r.Returner = timeoutReturner{r.Returner, cancel}
+	return h.client.RecvCall(ctx, r)
+}
+
+func (h *timeoutHook) Brand() capnp.Brand {
+	return capnp.Brand{}
+}
+
+func (h *timeoutHook) Shutdown() {
+	h.client.Release()
+}
+
+// timeoutReturner stops a received call's timer when it returns.
+type timeoutReturner struct {
+	capnp.Returner
+	cancel context.CancelFunc
+}
+
+func (r timeoutReturner) Return(e error) {
+	r.Returner.Return(e)
+	r.cancel()
+}
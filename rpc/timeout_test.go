@@ -0,0 +1,97 @@
+package rpc_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"capnproto.org/go/capnp/v3"
+	"capnproto.org/go/capnp/v3/rpc"
+	"capnproto.org/go/capnp/v3/rpc/internal/testcapnp"
+	"capnproto.org/go/capnp/v3/rpc/transport"
+)
+
+// slowEchoServer echoes its argument after a delay.
+type slowEchoServer struct {
+	delay time.Duration
+}
+
+func (s slowEchoServer) EchoNum(ctx context.Context, p testcapnp.PingPong_echoNum) error {
+	p.Ack()
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	results, err := p.AllocResults()
+	if err != nil {
+		return err
+	}
+	results.SetN(p.Args().N())
+	return nil
+}
+
+func TestTimeoutClient(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	left, right := transport.NewPipe(1)
+	srv := rpc.NewConn(rpc.NewTransport(left), &rpc.Options{
+		BootstrapClient: capnp.Client(testcapnp.PingPong_ServerToClient(slowEchoServer{delay: 50 * time.Millisecond})),
+	})
+	defer srv.Close()
+	cli := rpc.NewConn(rpc.NewTransport(right), nil)
+	defer cli.Close()
+	pp := testcapnp.PingPong(cli.Bootstrap(ctx))
+	defer pp.Release()
+
+	if n, err := echoNum(ctx, pp, 1); err != nil || n != 1 {
+		t.Fatalf("EchoNum without timeout = %d, %v; want 1, <nil>", n, err)
+	}
+
+	short := testcapnp.PingPong(rpc.NewTimeoutClient(capnp.Client(pp.AddRef()), 5*time.Millisecond))
+	defer short.Release()
+	if _, err := echoNum(ctx, short, 2); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("EchoNum with short timeout: %v; want deadline exceeded", err)
+	}
+
+	long := testcapnp.PingPong(rpc.NewTimeoutClient(capnp.Client(pp.AddRef()), time.Minute))
+	defer long.Release()
+	if n, err := echoNum(ctx, long, 3); err != nil || n != 3 {
+		t.Errorf("EchoNum with long timeout = %d, %v; want 3, <nil>", n, err)
+	}
+
+	// An earlier deadline on the caller's context wins.
+	callCtx, cancel := context.WithTimeout(ctx, 5*time.Millisecond)
+	defer cancel()
+	if _, err := echoNum(callCtx, long, 4); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("EchoNum with short caller deadline: %v; want deadline exceeded", err)
+	}
+}
+
+func TestTimeoutClient_Release(t *testing.T) {
+	t.Parallel()
+
+	srv := &shutdownEchoServer{done: make(chan struct{})}
+	tc := rpc.NewTimeoutClient(capnp.Client(testcapnp.PingPong_ServerToClient(srv)), time.Second)
+	if _, err := echoNum(context.Background(), testcapnp.PingPong(tc), 1); err != nil {
+		t.Fatal("EchoNum:", err)
+	}
+	tc.Release()
+	select {
+	case <-srv.done:
+	case <-time.After(5 * time.Second):
+		t.Error("wrapped client not shut down after releasing the decorator")
+	}
+}
+
+// shutdownEchoServer closes done when it is shut down.
+type shutdownEchoServer struct {
+	echoNumServer
+	done chan struct{}
+}
+
+func (s *shutdownEchoServer) Shutdown() {
+	close(s.done)
+}
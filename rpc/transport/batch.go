@@ -0,0 +1,138 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	capnp "capnproto.org/go/capnp/v3"
+)
+
+// NewBatchingStream is like NewStream, but buffers outgoing messages and
+// writes them to rwc together, so that many small messages cost a few
+// writes instead of one each.  A batch is written once it holds
+// maxBatch messages or maxDelay after its first message was sent,
+// whichever comes first.  If maxBatch is less than 2 or maxDelay is not
+// positive, every message is written as it is sent.
+//
+// Messages are written in the order they are sent, each with the usual
+// stream framing, so the other end can read them with NewStream or
+// NewBatchingStream alike.  A send returns once its message is
+// buffered: an error writing a batch is returned by the next send.
+// Close writes any buffered messages before closing rwc.
+func NewBatchingStream(rwc io.ReadWriteCloser, maxBatch int, maxDelay time.Duration) Transport {
+	return New(newBatchCodec(rwc, maxBatch, maxDelay))
+}
+
+type batchCodec struct {
+	r   *ctxReader
+	dec *capnp.Decoder
+
+	maxBatch int
+	maxDelay time.Duration
+
+	mu     sync.Mutex // guards the fields below
+	wc     *ctxWriteCloser
+	buf    bytes.Buffer
+	enc    *capnp.Encoder // writes to buf
+	n      int            // number of messages in buf
+	timer  *time.Timer    // flushes buf; nil if not running
+	err    error          // from a failed write of a batch
+	closed bool
+}
+
+func newBatchCodec(rwc io.ReadWriteCloser, maxBatch int, maxDelay time.Duration) *batchCodec {
+	c := &batchCodec{
+		r: &ctxReader{Reader: rwc},
+		wc: &ctxWriteCloser{
+			WriteCloser:         rwc,
+			partialWriteTimeout: 30 * time.Second,
+		},
+		maxBatch: maxBatch,
+		maxDelay: maxDelay,
+	}
+	c.dec = capnp.NewDecoder(c.r)
+	c.enc = capnp.NewEncoder(&c.buf)
+	return c
+}
+
+func (c *batchCodec) Encode(ctx context.Context, m *capnp.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errors.New("batching stream closed")
+	}
+	if c.err != nil {
+		return c.err
+	}
+	if err := c.enc.Encode(m); err != nil {
+		return err
+	}
+	c.n++
+	if c.n >= c.maxBatch || c.maxDelay <= 0 {
+		return c.flush(ctx)
+	}
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.maxDelay, c.flushLater)
+	}
+	return nil
+}
+
+// flushLater writes the buffered messages when a batch's delay expires.
+func (c *batchCodec) flushLater() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.err != nil {
+		return
+	}
+	c.flush(context.Background())
+}
+
+// flush writes the buffered messages.  The caller must be holding c.mu.
+func (c *batchCodec) flush(ctx context.Context) error {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if c.buf.Len() == 0 {
+		return nil
+	}
+	c.wc.setWriteContext(ctx)
+	_, err := c.wc.Write(c.buf.Bytes())
+	c.buf.Reset()
+	c.n = 0
+	if err != nil {
+		c.err = err
+	}
+	return err
+}
+
+func (c *batchCodec) Decode(ctx context.Context) (*capnp.Message, error) {
+	c.r.setReadContext(ctx)
+	return c.dec.Decode()
+}
+
+func (c *batchCodec) SetPartialWriteTimeout(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wc.partialWriteTimeout = d
+}
+
+func (c *batchCodec) Close() error {
+	defer c.r.wait()
+
+	c.mu.Lock()
+	var err error
+	if !c.closed && c.err == nil {
+		err = c.flush(context.Background())
+	}
+	c.closed = true
+	c.mu.Unlock()
+	if cerr := c.wc.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
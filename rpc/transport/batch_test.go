@@ -0,0 +1,124 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	capnp "capnproto.org/go/capnp/v3"
+)
+
+// countingPipe is one end of an in-memory stream that counts the writes
+// made to it.
+type countingPipe struct {
+	io.Reader
+	w *io.PipeWriter
+
+	mu     sync.Mutex
+	writes int
+}
+
+func newCountingPipe() (*countingPipe, io.ReadCloser) {
+	pr, pw := io.Pipe()
+	return &countingPipe{Reader: eofReader{}, w: pw}, pr
+}
+
+func (p *countingPipe) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	p.writes++
+	p.mu.Unlock()
+	return p.w.Write(b)
+}
+
+func (p *countingPipe) Close() error {
+	return p.w.Close()
+}
+
+func (p *countingPipe) numWrites() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.writes
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
+
+func TestBatchingStream(t *testing.T) {
+	t.Parallel()
+
+	const n = 100
+	w, r := newCountingPipe()
+	c := newBatchCodec(w, 16, time.Hour)
+
+	got := make(chan []string, 1)
+	go func() {
+		var texts []string
+		dec := capnp.NewDecoder(r)
+		for {
+			msg, err := dec.Decode()
+			if err != nil {
+				break
+			}
+			p, _ := msg.Root()
+			texts = append(texts, p.Text())
+		}
+		got <- texts
+	}()
+
+	ctx := context.Background()
+	for i := 0; i < n; i++ {
+		if err := c.Encode(ctx, newTestMessage(t, fmt.Sprint(i))); err != nil {
+			t.Fatalf("Encode #%d: %v", i, err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+
+	texts := <-got
+	if len(texts) != n {
+		t.Fatalf("received %d messages; want %d", len(texts), n)
+	}
+	for i, txt := range texts {
+		if txt != fmt.Sprint(i) {
+			t.Fatalf("message #%d = %q; want %q", i, txt, fmt.Sprint(i))
+		}
+	}
+	// Six full batches, and the rest written by Close.
+	if got := w.numWrites(); got != 7 {
+		t.Errorf("%d writes for %d messages; want 7", got, n)
+	}
+}
+
+func TestBatchingStream_Delay(t *testing.T) {
+	t.Parallel()
+
+	w, r := newCountingPipe()
+	c := newBatchCodec(w, 100, 10*time.Millisecond)
+	defer c.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if err := c.Encode(ctx, newTestMessage(t, fmt.Sprint(i))); err != nil {
+			t.Fatalf("Encode #%d: %v", i, err)
+		}
+	}
+	// The delay flushes the partial batch without waiting for Close.
+	dec := capnp.NewDecoder(r)
+	for i := 0; i < 3; i++ {
+		msg, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("Decode #%d: %v", i, err)
+		}
+		if p, _ := msg.Root(); p.Text() != fmt.Sprint(i) {
+			t.Errorf("message #%d = %q; want %q", i, p.Text(), fmt.Sprint(i))
+		}
+	}
+	if got := w.numWrites(); got != 1 {
+		t.Errorf("%d writes for 3 messages; want 1", got)
+	}
+}
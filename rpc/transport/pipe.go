@@ -11,29 +11,31 @@ import (
 
 // NewPipe returns a pair of codecs which communicate over
 // channels, copying messages at the channel boundary.
-// bufSz is the size of the channel buffers.
+// bufSz is the size of the channel buffers.  The codecs are
+// *Pipe values.
 func NewPipe(bufSz int) (c1, c2 Codec) {
 	ch1 := make(chan *capnp.Message, bufSz)
 	ch2 := make(chan *capnp.Message, bufSz)
 
-	c1 = &pipe{
+	c1 = &Pipe{
 		send: ch1, recv: ch2,
 	}
 
-	c2 = &pipe{
+	c2 = &Pipe{
 		send: ch2, recv: ch1,
 	}
 
 	return
 }
 
-type pipe struct {
+// A Pipe is one end of a pair of codecs created by NewPipe.
+type Pipe struct {
 	send    chan<- *capnp.Message
 	recv    <-chan *capnp.Message
 	timeout <-chan time.Time
 }
 
-func (p *pipe) Encode(ctx context.Context, m *capnp.Message) (err error) {
+func (p *Pipe) Encode(ctx context.Context, m *capnp.Message) (err error) {
 	b, err := m.Marshal()
 	if err != nil {
 		return err
@@ -60,7 +62,7 @@ func (p *pipe) Encode(ctx context.Context, m *capnp.Message) (err error) {
 	}
 }
 
-func (p *pipe) Decode(ctx context.Context) (*capnp.Message, error) {
+func (p *Pipe) Decode(ctx context.Context) (*capnp.Message, error) {
 	select {
 	case m, ok := <-p.recv:
 		if !ok {
@@ -74,11 +76,18 @@ func (p *pipe) Decode(ctx context.Context) (*capnp.Message, error) {
 	}
 }
 
-func (p *pipe) SetPartialWriteTimeout(d time.Duration) {
+func (p *Pipe) SetPartialWriteTimeout(d time.Duration) {
 	p.timeout = time.After(d)
 }
 
-func (p *pipe) Close() error {
+func (p *Pipe) Close() error {
 	close(p.send)
 	return nil
 }
+
+// Len returns the number of messages that p has encoded but the other
+// end of the pipe has not yet decoded.  It is safe to call concurrently
+// with Encode and Decode.
+func (p *Pipe) Len() int {
+	return len(p.send)
+}
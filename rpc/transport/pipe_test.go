@@ -4,6 +4,7 @@ import (
 	"context"
 	"io"
 	"testing"
+	"time"
 
 	"capnproto.org/go/capnp/v3"
 	"capnproto.org/go/capnp/v3/rpc/transport"
@@ -34,3 +35,32 @@ func TestPipe(t *testing.T) {
 	require.Nil(t, m)
 	require.ErrorIs(t, err, io.ErrClosedPipe)
 }
+
+func TestPipe_Len(t *testing.T) {
+	t.Parallel()
+
+	const bufSz = 3
+	c1, c2 := transport.NewPipe(bufSz)
+	p1 := c1.(*transport.Pipe)
+	defer p1.Close()
+
+	m, _ := capnp.NewSingleSegmentMessage(nil)
+	for i := 0; i < bufSz; i++ {
+		require.Equal(t, i, p1.Len())
+		require.NoError(t, p1.Encode(context.Background(), m))
+	}
+	require.Equal(t, bufSz, p1.Len())
+	require.Zero(t, c2.(*transport.Pipe).Len(), "other direction should be empty")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := p1.Encode(ctx, m)
+	require.ErrorIs(t, err, context.DeadlineExceeded, "encode should block on full buffer")
+	require.Equal(t, bufSz, p1.Len())
+
+	for i := bufSz; i > 0; i-- {
+		_, err := c2.Decode(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, i-1, p1.Len())
+	}
+}
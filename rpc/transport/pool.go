@@ -0,0 +1,192 @@
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	capnp "capnproto.org/go/capnp/v3"
+)
+
+// A StreamOption configures a transport created by NewStreamWithOptions.
+type StreamOption func(*streamCodec)
+
+// WithBufferPool makes the transport decode received messages into
+// buffers from p, and return each buffer to p when its message is
+// released.  Several transports may share p.  If p is nil, every
+// message gets a newly allocated buffer, as with NewStream.
+//
+// With a pool, a received message's data is reused as soon as the
+// message is released, so nothing read from the message may be used
+// after calling its release function.
+func WithBufferPool(p *BufferPool) StreamOption {
+	return func(c *streamCodec) {
+		c.pool = p
+	}
+}
+
+// NewStreamWithOptions is like NewStream, but configured by opts.
+func NewStreamWithOptions(rwc io.ReadWriteCloser, opts ...StreamOption) Transport {
+	c := newStreamCodec(rwc, basicEncoding{})
+	for _, opt := range opts {
+		opt(c)
+	}
+	return New(c)
+}
+
+const (
+	minPoolClass = 10 // 1 KiB
+	maxPoolClass = 20 // 1 MiB
+
+	// maxPooledMessageSize is the largest message that a pooled
+	// decoder accepts, the same as a capnp.Decoder's default.
+	maxPooledMessageSize = 64 << 20
+)
+
+// A BufferPool holds buffers for the messages received by transports
+// created with WithBufferPool, so that they can be reused instead of
+// allocated for each message.  Buffers are grouped by size, in powers
+// of two from 1 KiB to 1 MiB; larger messages are not pooled.  The zero
+// value is an empty pool.  A BufferPool is safe to use from multiple
+// goroutines.
+type BufferPool struct {
+	classes [maxPoolClass - minPoolClass + 1]sync.Pool
+}
+
+// NewBufferPool returns an empty BufferPool.
+func NewBufferPool() *BufferPool {
+	return new(BufferPool)
+}
+
+// poolClass returns the index of the smallest class that holds n
+// bytes, or -1 if n is too large to pool.
+func poolClass(n int) int {
+	for i := 0; i <= maxPoolClass-minPoolClass; i++ {
+		if n <= 1<<(minPoolClass+i) {
+			return i
+		}
+	}
+	return -1
+}
+
+// get returns a message with a buffer of at least n bytes.
+func (p *BufferPool) get(n int) *pooledMessage {
+	class := poolClass(n)
+	if class < 0 {
+		return &pooledMessage{buf: make([]byte, n), class: -1, inUse: true}
+	}
+	pm, _ := p.classes[class].Get().(*pooledMessage)
+	if pm == nil {
+		pm = &pooledMessage{
+			pool:  p,
+			buf:   make([]byte, 1<<(minPoolClass+class)),
+			class: class,
+		}
+		pm.arena.pm = pm
+	}
+	pm.inUse = true
+	return pm
+}
+
+// A pooledMessage is a decoded message and the buffer that holds its
+// segments.  Its parts are reused together.
+type pooledMessage struct {
+	msg   capnp.Message
+	arena poolArena
+	segs  [][]byte
+	buf   []byte
+
+	pool  *BufferPool // nil if not pooled
+	class int
+	inUse bool
+}
+
+// poolArena is the arena of a pooledMessage.
+type poolArena struct {
+	capnp.MultiSegmentArena
+	pm *pooledMessage
+}
+
+// release returns pm to its pool.  The message must have been reset.
+func (pm *pooledMessage) release() {
+	if !pm.inUse {
+		return
+	}
+	pm.inUse = false
+	for i := range pm.segs {
+		pm.segs[i] = nil
+	}
+	pm.segs = pm.segs[:0]
+	pm.arena.MultiSegmentArena = nil
+	if pm.pool != nil {
+		pm.pool.classes[pm.class].Put(pm)
+	}
+}
+
+// releaseMessage releases a message received by a transport, returning
+// its buffer to the pool that it came from, if any.  It must be called
+// at most once per receive: afterwards, the message may belong to
+// another receive.
+func releaseMessage(msg *capnp.Message) {
+	arena := msg.Arena
+	msg.Reset(nil)
+	if pa, ok := arena.(*poolArena); ok {
+		pa.pm.release()
+	}
+}
+
+// decode reads a message in the stream format from r into a buffer
+// from p.  hdr is used to hold the segment table.
+func (p *BufferPool) decode(r io.Reader, hdr *[]byte) (*capnp.Message, error) {
+	if cap(*hdr) < 8 {
+		*hdr = make([]byte, 8)
+	}
+	b := (*hdr)[:8]
+	if n, err := io.ReadFull(r, b); err == io.EOF && n == 0 {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, fmt.Errorf("decode: read header: %w", err)
+	}
+	maxSeg := binary.LittleEndian.Uint32(b)
+	if maxSeg >= 512 {
+		// Let DecodeStreamHeader report the error.
+		_, _, err := capnp.DecodeStreamHeader(b)
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	hdrSize := int((maxSeg+2)*4+7) &^ 7
+	if cap(*hdr) < hdrSize {
+		*hdr = append((*hdr)[:8], make([]byte, hdrSize-8)...)
+	}
+	b = (*hdr)[:hdrSize]
+	if _, err := io.ReadFull(r, b[8:]); err != nil {
+		return nil, fmt.Errorf("decode: read header: %w", err)
+	}
+	sizes, _, err := capnp.DecodeStreamHeader(b)
+	if err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	var total int
+	for _, sz := range sizes {
+		total += int(sz)
+	}
+	if total > maxPooledMessageSize {
+		return nil, fmt.Errorf("decode: message too large")
+	}
+
+	pm := p.get(total)
+	data := pm.buf[:total]
+	if _, err := io.ReadFull(r, data); err != nil {
+		pm.release()
+		return nil, fmt.Errorf("decode: read segments: %w", err)
+	}
+	for _, sz := range sizes {
+		// Limit the capacity so that growing a segment cannot write
+		// into the next one.
+		pm.segs = append(pm.segs, data[:sz:sz])
+		data = data[sz:]
+	}
+	pm.arena.MultiSegmentArena = pm.segs
+	pm.msg.Reset(&pm.arena)
+	return &pm.msg, nil
+}
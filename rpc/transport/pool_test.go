@@ -0,0 +1,186 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	capnp "capnproto.org/go/capnp/v3"
+	rpccp "capnproto.org/go/capnp/v3/std/capnp/rpc"
+)
+
+// repeatStream is a stream that reads the same bytes over and over and
+// discards writes.
+type repeatStream struct {
+	data []byte
+	off  int
+}
+
+func (s *repeatStream) Read(p []byte) (int, error) {
+	n := copy(p, s.data[s.off:])
+	s.off = (s.off + n) % len(s.data)
+	return n, nil
+}
+
+func (s *repeatStream) Write(p []byte) (int, error) { return len(p), nil }
+func (s *repeatStream) Close() error                { return nil }
+
+func TestBufferPool(t *testing.T) {
+	reason := strings.Repeat("x", 3000)
+	msg, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rmsg, err := rpccp.NewRootMessage(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	abort, err := rmsg.NewAbort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := abort.SetReason(reason); err != nil {
+		t.Fatal(err)
+	}
+	data, err := msg.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	recv := func(tr Transport) func() {
+		return func() {
+			m, release, err := tr.RecvMessage(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Which() != rpccp.Message_Which_abort {
+				t.Fatalf("received %v; want abort", m.Which())
+			}
+			release()
+		}
+	}
+
+	plain := NewStream(&repeatStream{data: data})
+	defer plain.Close()
+	pooled := NewStreamWithOptions(&repeatStream{data: data}, WithBufferPool(NewBufferPool()))
+	defer pooled.Close()
+
+	// Received messages must decode the same with and without a pool.
+	m, release, err := pooled.RecvMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := m.Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := a.Reason(); got != reason {
+		t.Errorf("pooled abort reason has length %d; want %d", len(got), len(reason))
+	}
+	release()
+	release() // must be safe to call again
+
+	plainAllocs := testing.AllocsPerRun(100, recv(plain))
+	pooledAllocs := testing.AllocsPerRun(100, recv(pooled))
+	t.Logf("allocations per message: %.1f without pool, %.1f with pool", plainAllocs, pooledAllocs)
+	if pooledAllocs >= plainAllocs {
+		t.Errorf("pooled decode made %.1f allocations per message; want fewer than the %.1f without a pool", pooledAllocs, plainAllocs)
+	}
+}
+
+func TestBufferPool_DoubleRelease(t *testing.T) {
+	t.Parallel()
+
+	msg, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rpccp.NewRootMessage(seg); err != nil {
+		t.Fatal(err)
+	}
+	data, err := msg.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := NewStreamWithOptions(&repeatStream{data: data}, WithBufferPool(NewBufferPool()))
+	defer tr.Close()
+	ctx := context.Background()
+	_, release1, err := tr.RecvMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release1()
+
+	// The second receive may reuse the first's message.  Releasing the
+	// first again must leave it alone.
+	m2, release2, err := tr.RecvMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release2()
+	release1()
+	if _, err := m2.Message().Segment(0); err != nil {
+		t.Fatal("second message was reset by releasing the first twice:", err)
+	}
+	if m2.Which() != rpccp.Message_Which_unimplemented {
+		t.Errorf("second message is a %v; want unimplemented", m2.Which())
+	}
+	m3, release3, err := tr.RecvMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release3()
+	b2, _ := m2.Message().Segment(0)
+	b3, _ := m3.Message().Segment(0)
+	if &b2.Data()[0] == &b3.Data()[0] {
+		t.Error("held message's buffer was handed to another receive")
+	}
+}
+
+func TestBufferPool_Shared(t *testing.T) {
+	t.Parallel()
+
+	msg, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rpccp.NewRootMessage(seg); err != nil {
+		t.Fatal(err)
+	}
+	data, err := msg.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two transports sharing a pool must not receive into the same
+	// buffer while both messages are held.
+	pool := NewBufferPool()
+	t1 := NewStreamWithOptions(&repeatStream{data: data}, WithBufferPool(pool))
+	defer t1.Close()
+	t2 := NewStreamWithOptions(&repeatStream{data: data}, WithBufferPool(pool))
+	defer t2.Close()
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		m1, release1, err := t1.RecvMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m2, release2, err := t2.RecvMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b1, _ := m1.Message().Segment(0)
+		b2, _ := m2.Message().Segment(0)
+		if &b1.Data()[0] == &b2.Data()[0] {
+			t.Fatal("messages held at the same time share a buffer")
+		}
+		if !bytes.Equal(b1.Data(), b2.Data()) {
+			t.Error("messages from the same bytes differ")
+		}
+		release1()
+		release2()
+	}
+}
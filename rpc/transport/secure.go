@@ -0,0 +1,201 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	capnp "capnproto.org/go/capnp/v3"
+)
+
+// A NonceSource supplies the nonces that a codec created by
+// NewSecureCodec seals messages with.
+type NonceSource interface {
+	// NextNonce returns a nonce of n bytes.  Each nonce must be greater,
+	// in lexicographic byte order, than the one before it, and must not
+	// be used with the same key by any other sender, including the other
+	// end of the connection.  NextNonce returns an error once it cannot
+	// produce another nonce.
+	NextNonce(n int) ([]byte, error)
+}
+
+// NewCounterNonces returns a NonceSource that produces nonces made of
+// prefix followed by a big-endian counter that starts at zero.  The
+// counter fills the rest of each nonce, which must be at least 8 bytes
+// longer than prefix.  The two ends of a connection that share a key
+// must use different prefixes.
+func NewCounterNonces(prefix []byte) NonceSource {
+	return &counterNonces{prefix: append([]byte(nil), prefix...)}
+}
+
+type counterNonces struct {
+	mu     sync.Mutex
+	prefix []byte
+	next   uint64
+	done   bool
+}
+
+func (c *counterNonces) NextNonce(n int) ([]byte, error) {
+	if n < len(c.prefix)+8 {
+		return nil, fmt.Errorf("nonce size %d too small for %d-byte prefix", n, len(c.prefix))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return nil, errors.New("nonces exhausted")
+	}
+	nonce := make([]byte, n)
+	copy(nonce, c.prefix)
+	binary.BigEndian.PutUint64(nonce[n-8:], c.next)
+	c.next++
+	c.done = c.next == 0
+	return nonce, nil
+}
+
+// A SecureRole identifies which end of a connection a codec created
+// by NewSecureCodec is on.  The two ends must use different roles.
+type SecureRole uint8
+
+// Roles for NewSecureCodec.  Which end takes which role is up to the
+// caller, e.g. the end that dialed the connection is the initiator.
+const (
+	SecureInitiator SecureRole = 1 + iota
+	SecureResponder
+)
+
+// peer returns the role of the other end of the connection.
+func (r SecureRole) peer() SecureRole {
+	if r == SecureInitiator {
+		return SecureResponder
+	}
+	return SecureInitiator
+}
+
+// NewSecureCodec returns a codec that encrypts the messages it encodes
+// with aead before passing them to c, and decrypts the messages it
+// decodes from c.  Each message is sealed with a fresh nonce from
+// nonces, which is sent in front of the ciphertext.  Wrap the result
+// with New to get a Transport.
+//
+// Each message is authenticated along with the role of its sender, so
+// a message sent by one end is never accepted by that same end, e.g.
+// if an attacker reflects it back.  Decode fails if a message does not
+// authenticate or if its nonce is not greater than the previous
+// message's, which rejects replayed and reordered messages.  After such
+// a failure, every later call to Decode fails too.  Encode fails once
+// nonces is exhausted, so a nonce is never reused.
+//
+// NewSecureCodec only provides confidentiality and integrity of the
+// messages: it does not exchange keys or authenticate the peer.  It
+// panics if role is not SecureInitiator or SecureResponder.
+func NewSecureCodec(c Codec, aead cipher.AEAD, role SecureRole, nonces NonceSource) Codec {
+	if role != SecureInitiator && role != SecureResponder {
+		panic(fmt.Sprintf("transport: invalid secure role %d", role))
+	}
+	return &secureCodec{
+		c:       c,
+		aead:    aead,
+		nonces:  nonces,
+		sendAAD: []byte{byte(role)},
+		recvAAD: []byte{byte(role.peer())},
+	}
+}
+
+type secureCodec struct {
+	c      Codec
+	aead   cipher.AEAD
+	nonces NonceSource
+
+	// sendAAD and recvAAD are the additional data that messages are
+	// sealed and opened with: the role of their sender.
+	sendAAD []byte
+	recvAAD []byte
+
+	// encMu orders the nonces of encoded messages as they are sent.
+	encMu sync.Mutex
+
+	// Used only by Decode.
+	lastNonce []byte
+	decErr    error
+}
+
+func (sc *secureCodec) Encode(ctx context.Context, m *capnp.Message) error {
+	plain, err := m.Marshal()
+	if err != nil {
+		return fmt.Errorf("secure codec: %w", err)
+	}
+
+	sc.encMu.Lock()
+	defer sc.encMu.Unlock()
+	nonce, err := sc.nonces.NextNonce(sc.aead.NonceSize())
+	if err != nil {
+		return fmt.Errorf("secure codec: %w", err)
+	}
+	sealed := sc.aead.Seal(nonce, nonce, plain, sc.sendAAD)
+	outer, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		return fmt.Errorf("secure codec: %w", err)
+	}
+	data, err := capnp.NewData(seg, sealed)
+	if err != nil {
+		return fmt.Errorf("secure codec: %w", err)
+	}
+	if err := outer.SetRoot(data.ToPtr()); err != nil {
+		return fmt.Errorf("secure codec: %w", err)
+	}
+	return sc.c.Encode(ctx, outer)
+}
+
+func (sc *secureCodec) Decode(ctx context.Context) (*capnp.Message, error) {
+	if sc.decErr != nil {
+		return nil, sc.decErr
+	}
+	outer, err := sc.c.Decode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer outer.Reset(nil)
+	root, err := outer.Root()
+	if err != nil {
+		return nil, fmt.Errorf("secure codec: %w", err)
+	}
+	sealed := root.Data()
+	n := sc.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, sc.fail(errors.New("message too short"))
+	}
+	nonce := sealed[:n]
+	if sc.lastNonce != nil && bytes.Compare(nonce, sc.lastNonce) <= 0 {
+		return nil, sc.fail(errors.New("nonce not increasing"))
+	}
+	plain, err := sc.aead.Open(nil, nonce, sealed[n:], sc.recvAAD)
+	if err != nil {
+		return nil, sc.fail(err)
+	}
+	sc.lastNonce = append(sc.lastNonce[:0], nonce...)
+	msg, err := capnp.Unmarshal(plain)
+	if err != nil {
+		return nil, fmt.Errorf("secure codec: %w", err)
+	}
+	return msg, nil
+}
+
+// fail records an authentication failure, after which Decode always
+// fails.
+func (sc *secureCodec) fail(err error) error {
+	sc.decErr = transporterr.Failedf("secure codec: reject message: %v", err)
+	return sc.decErr
+}
+
+func (sc *secureCodec) SetPartialWriteTimeout(d time.Duration) {
+	sc.c.SetPartialWriteTimeout(d)
+}
+
+func (sc *secureCodec) Close() error {
+	return sc.c.Close()
+}
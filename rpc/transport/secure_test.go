@@ -0,0 +1,222 @@
+package transport
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+
+	capnp "capnproto.org/go/capnp/v3"
+)
+
+func newTestAEAD(t *testing.T) cipher.AEAD {
+	block, err := aes.NewCipher(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+// newSecurePipe returns a pair of secure codecs over a pipe.
+func newSecurePipe(t *testing.T) (c1, c2 Codec) {
+	p1, p2 := NewPipe(1)
+	aead := newTestAEAD(t)
+	c1 = NewSecureCodec(p1, aead, SecureInitiator, NewCounterNonces([]byte{1}))
+	c2 = NewSecureCodec(p2, aead, SecureResponder, NewCounterNonces([]byte{2}))
+	return c1, c2
+}
+
+func TestSecureCodec(t *testing.T) {
+	t.Parallel()
+
+	testTransport(t, func() (t1, t2 Transport, err error) {
+		c1, c2 := newSecurePipe(t)
+		return New(c1), New(c2), nil
+	})
+}
+
+// tamperCodec passes messages through to a Codec, after calling
+// tamper on the data at the root of each message it encodes.
+type tamperCodec struct {
+	Codec
+	tamper func(data []byte)
+}
+
+func (tc tamperCodec) Encode(ctx context.Context, m *capnp.Message) error {
+	root, err := m.Root()
+	if err != nil {
+		return err
+	}
+	tc.tamper(root.Data())
+	return tc.Codec.Encode(ctx, m)
+}
+
+func newTestMessage(t *testing.T, text string) *capnp.Message {
+	msg, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	txt, err := capnp.NewText(seg, text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.SetRoot(txt.ToPtr()); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestSecureCodec_Tamper(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	p1, p2 := NewPipe(2)
+	aead := newTestAEAD(t)
+	flip := false
+	c1 := NewSecureCodec(tamperCodec{p1, func(data []byte) {
+		if flip {
+			data[len(data)-1] ^= 0x01
+		}
+	}}, aead, SecureInitiator, NewCounterNonces([]byte{1}))
+	c2 := NewSecureCodec(p2, aead, SecureResponder, NewCounterNonces([]byte{2}))
+
+	if err := c1.Encode(ctx, newTestMessage(t, "untouched")); err != nil {
+		t.Fatal("Encode:", err)
+	}
+	msg, err := c2.Decode(ctx)
+	if err != nil {
+		t.Fatal("Decode:", err)
+	}
+	if p, _ := msg.Root(); p.Text() != "untouched" {
+		t.Errorf("decoded %q; want \"untouched\"", p.Text())
+	}
+
+	flip = true
+	if err := c1.Encode(ctx, newTestMessage(t, "tampered")); err != nil {
+		t.Fatal("Encode:", err)
+	}
+	if _, err := c2.Decode(ctx); err == nil {
+		t.Error("Decode of tampered message succeeded")
+	}
+
+	flip = false
+	if err := c1.Encode(ctx, newTestMessage(t, "after")); err != nil {
+		t.Fatal("Encode:", err)
+	}
+	if _, err := c2.Decode(ctx); err == nil {
+		t.Error("Decode after tampered message succeeded; want codec to stay failed")
+	}
+}
+
+func TestSecureCodec_Replay(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	p1, p2 := NewPipe(2)
+	aead := newTestAEAD(t)
+	var captured []byte
+	c1 := NewSecureCodec(tamperCodec{p1, func(data []byte) {
+		captured = append([]byte(nil), data...)
+	}}, aead, SecureInitiator, NewCounterNonces([]byte{1}))
+	c2 := NewSecureCodec(p2, aead, SecureResponder, NewCounterNonces([]byte{2}))
+
+	if err := c1.Encode(ctx, newTestMessage(t, "once")); err != nil {
+		t.Fatal("Encode:", err)
+	}
+	if _, err := c2.Decode(ctx); err != nil {
+		t.Fatal("Decode:", err)
+	}
+
+	// Send the same sealed message again, bypassing the secure codec.
+	replay, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := capnp.NewData(seg, captured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replay.SetRoot(data.ToPtr()); err != nil {
+		t.Fatal(err)
+	}
+	if err := p1.Encode(ctx, replay); err != nil {
+		t.Fatal("Encode:", err)
+	}
+	if _, err := c2.Decode(ctx); err == nil {
+		t.Error("Decode of replayed message succeeded")
+	}
+}
+
+func TestSecureCodec_Reflect(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	p1, p2 := NewPipe(2)
+	aead := newTestAEAD(t)
+	var captured []byte
+	// c2 has not decoded a message yet, so no nonce check rejects the
+	// reflected message: only its sender's role does.
+	c1 := NewSecureCodec(p1, aead, SecureInitiator, NewCounterNonces([]byte{1}))
+	c2 := NewSecureCodec(tamperCodec{p2, func(data []byte) {
+		captured = append([]byte(nil), data...)
+	}}, aead, SecureResponder, NewCounterNonces([]byte{2}))
+
+	if err := c2.Encode(ctx, newTestMessage(t, "to c1")); err != nil {
+		t.Fatal("Encode:", err)
+	}
+	if _, err := c1.Decode(ctx); err != nil {
+		t.Fatal("Decode:", err)
+	}
+
+	// Send c2's sealed message back to c2, bypassing the secure codec.
+	reflect, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := capnp.NewData(seg, captured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reflect.SetRoot(data.ToPtr()); err != nil {
+		t.Fatal(err)
+	}
+	if err := p1.Encode(ctx, reflect); err != nil {
+		t.Fatal("Encode:", err)
+	}
+	if _, err := c2.Decode(ctx); err == nil {
+		t.Error("Decode of reflected message succeeded")
+	}
+}
+
+func TestCounterNonces(t *testing.T) {
+	t.Parallel()
+
+	src := NewCounterNonces([]byte{0xaa})
+	first, err := src.NextNonce(12)
+	if err != nil {
+		t.Fatal("NextNonce:", err)
+	}
+	second, err := src.NextNonce(12)
+	if err != nil {
+		t.Fatal("NextNonce:", err)
+	}
+	if first[0] != 0xaa || string(first) >= string(second) {
+		t.Errorf("nonces %x then %x; want increasing with prefix aa", first, second)
+	}
+	if _, err := src.NextNonce(8); err == nil {
+		t.Error("NextNonce(8) with 1-byte prefix succeeded")
+	}
+
+	c := src.(*counterNonces)
+	c.next = 1<<64 - 1
+	if _, err := src.NextNonce(12); err != nil {
+		t.Fatal("NextNonce of last counter:", err)
+	}
+	if _, err := src.NextNonce(12); err == nil {
+		t.Error("NextNonce after counter wrapped succeeded")
+	}
+}
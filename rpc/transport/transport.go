@@ -172,10 +172,19 @@ func (s *transport) RecvMessage(ctx context.Context) (rpccp.Message, capnp.Relea
 	}
 	rmsg, err := rpccp.ReadRootMessage(msg)
 	if err != nil {
+		releaseMessage(msg)
 		err = transporterr.Annotate(fmt.Errorf("receive: %w", err), "stream transport")
 		return rpccp.Message{}, nil, err
 	}
-	return rmsg, func() { msg.Reset(nil) }, nil
+	// A pooled message is reused by a later receive, so releasing it
+	// again must not touch it.
+	released := false
+	return rmsg, func() {
+		if !released {
+			released = true
+			releaseMessage(msg)
+		}
+	}, nil
 }
 
 // Close closes the underlying ReadWriteCloser.  It is not safe to call
@@ -198,6 +207,9 @@ type streamCodec struct {
 
 	wc  *ctxWriteCloser
 	enc *capnp.Encoder
+
+	pool *BufferPool // if non-nil, used instead of dec
+	hdr  []byte
 }
 
 func newStreamCodec(rwc io.ReadWriteCloser, f streamEncoding) *streamCodec {
@@ -222,6 +234,9 @@ func (c *streamCodec) Encode(ctx context.Context, m *capnp.Message) error {
 
 func (c *streamCodec) Decode(ctx context.Context) (*capnp.Message, error) {
 	c.r.setReadContext(ctx)
+	if c.pool != nil {
+		return c.pool.decode(c.r, &c.hdr)
+	}
 	return c.dec.Decode()
 }
 
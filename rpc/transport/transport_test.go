@@ -189,6 +189,23 @@ func TestTCPStreamTransport(t *testing.T) {
 
 		testTCPStreamTransport(t, NewPackedStream)
 	})
+
+	t.Run("Pooled", func(t *testing.T) {
+		t.Parallel()
+
+		pool := NewBufferPool()
+		testTCPStreamTransport(t, func(rwc io.ReadWriteCloser) Transport {
+			return NewStreamWithOptions(rwc, WithBufferPool(pool))
+		})
+	})
+
+	t.Run("Batching", func(t *testing.T) {
+		t.Parallel()
+
+		testTCPStreamTransport(t, func(rwc io.ReadWriteCloser) Transport {
+			return NewBatchingStream(rwc, 4, time.Millisecond)
+		})
+	})
 }
 
 func testTCPStreamTransport(t *testing.T, newTransport func(io.ReadWriteCloser) Transport) {
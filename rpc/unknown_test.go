@@ -0,0 +1,119 @@
+package rpc_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"capnproto.org/go/capnp/v3"
+	"capnproto.org/go/capnp/v3/rpc"
+	"capnproto.org/go/capnp/v3/rpc/transport"
+	rpccp "capnproto.org/go/capnp/v3/std/capnp/rpc"
+)
+
+// unknownWhich is a message type that the protocol does not define.
+const unknownWhich rpccp.Message_Which = 200
+
+// sendUnknownMessage sends a message of type unknownWhich on p.
+func sendUnknownMessage(ctx context.Context, t *testing.T, p rpc.Transport) {
+	t.Helper()
+	msg, send, release, err := p.NewMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	capnp.Struct(msg).SetUint16(0, uint16(unknownWhich))
+	if err := send(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOnUnknownMessage(t *testing.T) {
+	t.Parallel()
+
+	seen := make(chan rpccp.Message_Which, 1)
+	left, right := transport.NewPipe(1)
+	p1, p2 := rpc.NewTransport(left), rpc.NewTransport(right)
+	conn := rpc.NewConn(p1, &rpc.Options{
+		ErrorReporter: testErrorReporter{tb: t},
+		OnUnknownMessage: func(msg rpc.Message) error {
+			seen <- msg.Which()
+			return nil
+		},
+	})
+	defer finishTest(t, conn, p2)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sendUnknownMessage(ctx, t, p2)
+	select {
+	case which := <-seen:
+		if which != unknownWhich {
+			t.Errorf("OnUnknownMessage called with type %v; want %v", which, unknownWhich)
+		}
+	case <-ctx.Done():
+		t.Fatal("OnUnknownMessage not called")
+	}
+	rmsg, release, err := recvMessage(ctx, p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if rmsg.Which != rpccp.Message_Which_unimplemented {
+		t.Fatalf("received %v; want unimplemented", rmsg.Which)
+	}
+
+	// The conn keeps working.
+	err = sendMessage(ctx, p2, &rpcMessage{
+		Which:     rpccp.Message_Which_bootstrap,
+		Bootstrap: &rpcBootstrap{QuestionID: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rmsg, release, err = recvMessage(ctx, p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if rmsg.Which != rpccp.Message_Which_return {
+		t.Errorf("received %v after unknown message; want return", rmsg.Which)
+	}
+}
+
+func TestOnUnknownMessage_Abort(t *testing.T) {
+	t.Parallel()
+
+	left, right := transport.NewPipe(1)
+	p1, p2 := rpc.NewTransport(left), rpc.NewTransport(right)
+	defer p2.Close()
+	conn := rpc.NewConn(p1, &rpc.Options{
+		ErrorReporter: testErrorReporter{tb: t},
+		OnUnknownMessage: func(rpc.Message) error {
+			return errors.New("not allowed here")
+		},
+	})
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sendUnknownMessage(ctx, t, p2)
+	rmsg, release, err := recvMessage(ctx, p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if rmsg.Which != rpccp.Message_Which_abort {
+		t.Fatalf("received %v; want abort", rmsg.Which)
+	}
+	if !strings.Contains(rmsg.Abort.Reason, "not allowed here") {
+		t.Errorf("abort reason = %q; want it to contain the hook's error", rmsg.Abort.Reason)
+	}
+	select {
+	case <-conn.Done():
+	case <-ctx.Done():
+		t.Fatal("conn not shut down after OnUnknownMessage error")
+	}
+}
@@ -31,6 +31,63 @@ func (s *Segment) Data() []byte {
 	return s.data
 }
 
+// Uint8 returns the byte at offset off in the segment's data, or an
+// error if off is out of bounds.  Unlike the accessors of Struct and
+// List, it does not panic on corrupt input, so it is suited to
+// low-level tools that parse segments directly.
+func (s *Segment) Uint8(off uint32) (uint8, error) {
+	b, err := s.primitive(off, 1, "uint8")
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// Uint16 returns the little-endian 16-bit value at offset off in the
+// segment's data.  It returns an error if the value is out of bounds or
+// if off is not a multiple of 2, since Cap'n Proto aligns every value
+// to its size.
+func (s *Segment) Uint16(off uint32) (uint16, error) {
+	b, err := s.primitive(off, 2, "uint16")
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(b), nil
+}
+
+// Uint32 returns the little-endian 32-bit value at offset off in the
+// segment's data.  It returns an error if the value is out of bounds or
+// if off is not a multiple of 4.
+func (s *Segment) Uint32(off uint32) (uint32, error) {
+	b, err := s.primitive(off, 4, "uint32")
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+// Uint64 returns the little-endian 64-bit value at offset off in the
+// segment's data.  It returns an error if the value is out of bounds or
+// if off is not a multiple of 8.
+func (s *Segment) Uint64(off uint32) (uint64, error) {
+	b, err := s.primitive(off, 8, "uint64")
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+// primitive returns the sz bytes at off, checking bounds and alignment.
+func (s *Segment) primitive(off uint32, sz Size, typ string) ([]byte, error) {
+	if off%uint32(sz) != 0 {
+		return nil, errorf("read %s at offset %d: misaligned", typ, off)
+	}
+	if !s.regionInBounds(address(off), sz) {
+		return nil, errorf("read %s at offset %d: out of bounds (segment is %d bytes)", typ, off, len(s.data))
+	}
+	return s.slice(address(off), sz), nil
+}
+
 func (s *Segment) inBounds(addr address) bool {
 	return addr < address(len(s.data))
 }
@@ -69,19 +126,37 @@ func (s *Segment) readRawPointer(addr address) rawPointer {
 	return rawPointer(s.readUint64(addr))
 }
 
+// readOnly reports whether the segment's message is read-only.  The
+// write methods panic with ErrReadOnly if it is.
+func (s *Segment) readOnly() bool {
+	return s.msg != nil && s.msg.readOnly
+}
+
 func (s *Segment) writeUint8(addr address, val uint8) {
+	if s.readOnly() {
+		panic(ErrReadOnly)
+	}
 	s.slice(addr, 1)[0] = val
 }
 
 func (s *Segment) writeUint16(addr address, val uint16) {
+	if s.readOnly() {
+		panic(ErrReadOnly)
+	}
 	binary.LittleEndian.PutUint16(s.slice(addr, 2), val)
 }
 
 func (s *Segment) writeUint32(addr address, val uint32) {
+	if s.readOnly() {
+		panic(ErrReadOnly)
+	}
 	binary.LittleEndian.PutUint32(s.slice(addr, 4), val)
 }
 
 func (s *Segment) writeUint64(addr address, val uint64) {
+	if s.readOnly() {
+		panic(ErrReadOnly)
+	}
 	binary.LittleEndian.PutUint64(s.slice(addr, 8), val)
 }
 
@@ -112,6 +187,14 @@ func (s *Segment) lookupSegment(id SegmentID) (*Segment, error) {
 	return s.msg.Segment(id)
 }
 
+// depthLimit returns the depth limit for objects created in s.
+func (s *Segment) depthLimit() uint {
+	if s == nil || s.msg == nil {
+		return maxDepth
+	}
+	return s.msg.depthLimit()
+}
+
 func (s *Segment) readPtr(paddr address, depthLimit uint) (ptr Ptr, err error) {
 	s, base, val, err := s.resolveFarPointer(paddr)
 	if err != nil {
@@ -121,7 +204,7 @@ func (s *Segment) readPtr(paddr address, depthLimit uint) (ptr Ptr, err error) {
 		return Ptr{}, nil
 	}
 	if depthLimit == 0 {
-		return Ptr{}, errorf("read pointer: depth limit reached")
+		return Ptr{}, annotatef(ErrDepthLimit, "read pointer")
 	}
 	switch val.pointerType() {
 	case structPointer:
@@ -286,6 +369,9 @@ func (s *Segment) resolveFarPointer(paddr address) (dst *Segment, base address,
 }
 
 func (s *Segment) writePtr(off address, src Ptr, forceCopy bool) error {
+	if s.readOnly() {
+		return ErrReadOnly
+	}
 	if !src.IsValid() {
 		s.writeRawPointer(off, 0)
 		return nil
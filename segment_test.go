@@ -846,3 +846,54 @@ func catchPanic(f func()) (err error) {
 	f()
 	return nil
 }
+
+func TestSegmentPrimitiveReaders(t *testing.T) {
+	seg := &Segment{data: []byte{
+		0xef, 0xcd, 0xab, 0x89, 0x67, 0x45, 0x23, 0x01,
+		0x11, 0x22, 0x33, 0x44,
+	}}
+	u8 := func(off uint32) (uint64, error) { v, err := seg.Uint8(off); return uint64(v), err }
+	u16 := func(off uint32) (uint64, error) { v, err := seg.Uint16(off); return uint64(v), err }
+	u32 := func(off uint32) (uint64, error) { v, err := seg.Uint32(off); return uint64(v), err }
+	tests := []struct {
+		name string
+		read func(off uint32) (uint64, error)
+		off  uint32
+		val  uint64
+		ok   bool
+	}{
+		{"Uint8", u8, 0, 0xef, true},
+		{"Uint8", u8, 11, 0x44, true},
+		{"Uint8", u8, 12, 0, false},
+		{"Uint16", u16, 2, 0x89ab, true},
+		{"Uint16", u16, 10, 0x4433, true},
+		{"Uint16", u16, 1, 0, false},
+		{"Uint16", u16, 12, 0, false},
+		{"Uint32", u32, 4, 0x01234567, true},
+		{"Uint32", u32, 8, 0x44332211, true},
+		{"Uint32", u32, 2, 0, false},
+		{"Uint32", u32, 12, 0, false},
+		{"Uint32", u32, 0xfffffffc, 0, false},
+		{"Uint64", seg.Uint64, 0, 0x0123456789abcdef, true},
+		{"Uint64", seg.Uint64, 4, 0, false},
+		{"Uint64", seg.Uint64, 8, 0, false},
+		{"Uint64", seg.Uint64, 0xfffffff8, 0, false},
+	}
+	for _, test := range tests {
+		var val uint64
+		var readErr error
+		if err := catchPanic(func() { val, readErr = test.read(test.off) }); err != nil {
+			t.Errorf("%s(%d) panicked: %v", test.name, test.off, err)
+			continue
+		}
+		if !test.ok {
+			if readErr == nil {
+				t.Errorf("%s(%d) = %#x, <nil>; want error", test.name, test.off, val)
+			}
+			continue
+		}
+		if readErr != nil || val != test.val {
+			t.Errorf("%s(%d) = %#x, %v; want %#x, <nil>", test.name, test.off, val, readErr, test.val)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"capnproto.org/go/capnp/v3"
+)
+
+// An Admission decides whether a Server accepts each call, so that an
+// overloaded server can shed calls instead of queuing them.
+type Admission interface {
+	// Admit is called for each call before it is queued for delivery.
+	// If Admit returns an error, the call fails with it and the method
+	// is not called.  The error should be an overloaded exception,
+	// such as one returned by capnp.Overloaded, so that callers know
+	// to back off and retry.
+	//
+	// The call's Method and Args may be used, but it must not be
+	// retained.  Admit may be called from multiple goroutines.
+	Admit(ctx context.Context, call *Call) error
+}
+
+// A DoneAdmission is an Admission that is told when each call that it
+// admitted has returned, e.g. to count calls in flight.
+type DoneAdmission interface {
+	Admission
+	Done(call *Call)
+}
+
+// SetAdmission sets the admission policy that srv checks calls against
+// before delivering them.  Without one, every call is accepted.  If a
+// also implements DoneAdmission, its Done method is called after each
+// admitted call returns.  SetAdmission must be called before srv
+// receives any calls.
+func (srv *Server) SetAdmission(a Admission) {
+	srv.admission = a
+	srv.admissionDone, _ = a.(DoneAdmission)
+}
+
+// A Limiter is an Admission that rejects calls with an overloaded
+// exception while too many admitted calls are in flight or while the
+// process uses too much memory.  A call is in flight from when it is
+// admitted until it returns, including while it waits in the server's
+// queue.  The zero value admits every call.  A Limiter may be shared by
+// several servers, in which case the limits apply to their calls
+// together.
+type Limiter struct {
+	// MaxInFlight is the largest number of calls that may be in
+	// flight, or zero for no limit.
+	MaxInFlight int
+
+	// MemoryUsage, if not nil, reports the process's current memory
+	// use in bytes, e.g. from runtime/metrics.  Calls are rejected
+	// while it exceeds MaxMemory.  It is called for every call, so it
+	// should be cheap.
+	MemoryUsage func() uint64
+	MaxMemory   uint64
+
+	mu       sync.Mutex
+	inFlight int
+}
+
+// Admit checks the call against the limits, counting it as in flight if
+// it is admitted.
+func (l *Limiter) Admit(ctx context.Context, call *Call) error {
+	if l.MemoryUsage != nil {
+		if n := l.MemoryUsage(); n > l.MaxMemory {
+			return capnp.Overloaded(fmt.Sprintf("server: memory use %d exceeds %d bytes", n, l.MaxMemory))
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.MaxInFlight > 0 && l.inFlight >= l.MaxInFlight {
+		return capnp.Overloaded(fmt.Sprintf("server: %d calls in flight", l.inFlight))
+	}
+	l.inFlight++
+	return nil
+}
+
+// Done counts an admitted call as no longer in flight.
+func (l *Limiter) Done(call *Call) {
+	l.mu.Lock()
+	l.inFlight--
+	l.mu.Unlock()
+}
+
+// InFlight returns the number of admitted calls that have not returned.
+func (l *Limiter) InFlight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inFlight
+}
@@ -80,10 +80,12 @@ func (aq *answerQueue) fulfill(s capnp.Struct) {
 		embargoes[i].alloc = ent.Returner
 		embargoes[i].returned = make(chan struct{})
 		embargoes[i].pcall = recv(ent.ctx, ent.path.transform(), capnp.Recv{
-			Method:      ent.Method,
-			Args:        ent.Args,
-			ReleaseArgs: ent.ReleaseArgs,
-			Returner:    &embargoes[i],
+			Method:           ent.Method,
+			Args:             ent.Args,
+			ReleaseArgs:      ent.ReleaseArgs,
+			Returner:         &embargoes[i],
+			Metadata:         ent.Metadata,
+			ResponseMetadata: ent.ResponseMetadata,
 		})
 		aq.bases[i+1].recv = (&embargoes[i]).recv
 	}
@@ -177,8 +179,10 @@ func (qc queueCaller) PipelineRecv(ctx context.Context, transform []capnp.Pipeli
 func (qc queueCaller) PipelineSend(ctx context.Context, transform []capnp.PipelineOp, s capnp.Send) (*capnp.Answer, capnp.ReleaseFunc) {
 	ret := new(structReturner)
 	r := capnp.Recv{
-		Method:   s.Method,
-		Returner: ret,
+		Method:           s.Method,
+		Returner:         ret,
+		Metadata:         s.Metadata,
+		ResponseMetadata: s.ResponseMetadata,
 	}
 	if s.PlaceArgs != nil {
 		var err error
@@ -213,13 +217,17 @@ type structReturner struct {
 }
 
 func (sr *structReturner) AllocResults(sz capnp.ObjectSize) (capnp.Struct, error) {
+	return sr.allocResultsHint(sz, 0)
+}
+
+func (sr *structReturner) allocResultsHint(sz capnp.ObjectSize, hint capnp.Size) (capnp.Struct, error) {
 	defer sr.mu.Unlock()
 	sr.mu.Lock()
 	if sr.alloced {
 		return capnp.Struct{}, newError("multiple calls to AllocResults")
 	}
 	sr.alloced = true
-	s, err := newBlankStruct(sz)
+	s, err := newSizedStruct(sz, hint)
 	if err != nil {
 		return capnp.Struct{}, errorf("alloc results: %v", err)
 	}
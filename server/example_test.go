@@ -1,9 +1,11 @@
 package server_test
 
 import (
+	"context"
 	"fmt"
 
 	"capnproto.org/go/capnp/v3"
+	"capnproto.org/go/capnp/v3/flowcontrol"
 	"capnproto.org/go/capnp/v3/server"
 )
 
@@ -16,3 +18,60 @@ func ExampleIsServer() {
 	// Output:
 	// Client is a server, got brand: 42
 }
+
+func ExampleStreamMethod() {
+	// A capability with two methods:
+	//
+	//	interface Summer {
+	//	  add @0 (n :Int64) -> stream;
+	//	  total @1 () -> (total :Int64);
+	//	}
+	add := capnp.Method{InterfaceID: 0xd5e2b4a5e7c2f3a1, MethodID: 0, MethodName: "add"}
+	total := capnp.Method{InterfaceID: 0xd5e2b4a5e7c2f3a1, MethodID: 1, MethodName: "total"}
+
+	var sum int64
+	sm := &server.StreamMethod{
+		Method: add,
+		Handle: func(ctx context.Context, call *server.Call) error {
+			sum += int64(call.Args().Uint64(0))
+			return nil
+		},
+		End: total,
+		Finish: func(ctx context.Context, call *server.Call) error {
+			res, err := call.AllocResults(capnp.ObjectSize{DataSize: 8})
+			if err != nil {
+				return err
+			}
+			res.SetUint64(0, uint64(sum))
+			sum = 0
+			return nil
+		},
+	}
+	c := capnp.NewClient(server.New(sm.Methods(nil), nil, nil))
+	defer c.Release()
+	c.SetFlowLimiter(flowcontrol.NewFixedLimiter(1 << 10))
+
+	ctx := context.Background()
+	for i := int64(1); i <= 4; i++ {
+		n := i
+		_, release := c.SendCall(ctx, capnp.Send{
+			Method:   add,
+			ArgsSize: capnp.ObjectSize{DataSize: 8},
+			PlaceArgs: func(args capnp.Struct) error {
+				args.SetUint64(0, uint64(n))
+				return nil
+			},
+		})
+		defer release()
+	}
+	ans, release := c.SendCall(ctx, capnp.Send{Method: total})
+	defer release()
+	res, err := ans.Struct()
+	if err != nil {
+		fmt.Println("error:", err)
+		return
+	}
+	fmt.Println("total:", int64(res.Uint64(0)))
+	// Output:
+	// total: 10
+}
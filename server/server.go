@@ -17,6 +17,15 @@ import (
 type Method struct {
 	capnp.Method
 	Impl func(context.Context, *Call) error
+
+	// ResultSize is an estimate of the size in bytes of the method's
+	// results, including the objects they point to.  If it is not zero,
+	// results built in memory, as for a call on a local client, are
+	// allocated in a buffer of this size, so that a method whose results
+	// have a predictable size does not grow its message repeatedly.  It
+	// is only a hint: larger results still fit, and returners that
+	// cannot preallocate, such as an rpc.Conn's, ignore it.
+	ResultSize capnp.Size
 }
 
 // Call holds the state of an ongoing capability method call.
@@ -41,6 +50,12 @@ func (c *Call) Args() capnp.Struct {
 	return c.recv.Args
 }
 
+// Method returns the interface and method IDs of the method being
+// called, along with any names known to the server.
+func (c *Call) Method() capnp.Method {
+	return c.method.Method
+}
+
 // AllocResults allocates the results struct.  It is an error to call
 // AllocResults more than once.
 func (c *Call) AllocResults(sz capnp.ObjectSize) (capnp.Struct, error) {
@@ -49,10 +64,28 @@ func (c *Call) AllocResults(sz capnp.ObjectSize) (capnp.Struct, error) {
 	}
 	var err error
 	c.alloced = true
-	c.results, err = c.recv.Returner.AllocResults(sz)
+	if h, ok := c.recv.Returner.(resultSizeHinter); ok && c.method.ResultSize > 0 {
+		c.results, err = h.allocResultsHint(sz, c.method.ResultSize)
+	} else {
+		c.results, err = c.recv.Returner.AllocResults(sz)
+	}
 	return c.results, err
 }
 
+// SetResults allocates the results struct with the same size as src
+// and copies src into it, including any capabilities that it refers
+// to.  Together with Args and Method, this lets a proxy forward a call
+// to another capability and return its results without knowing the
+// interface's schema.  It is an error to call SetResults after
+// AllocResults or more than once.
+func (c *Call) SetResults(src capnp.Struct) error {
+	results, err := c.AllocResults(src.Size())
+	if err != nil {
+		return err
+	}
+	return results.CopyFrom(src)
+}
+
 // Ack is a function that is called to acknowledge the delivery of the
 // RPC call, allowing other RPC methods to be called on the server.
 // After the first call, subsequent calls to Ack do nothing.
@@ -63,8 +96,11 @@ func (c *Call) AllocResults(sz capnp.ObjectSize) (capnp.Struct, error) {
 // the server will not return an Answer until the delivery is
 // acknowledged, failure to acknowledge a call before waiting on an
 // RPC may cause deadlocks.
+//
+// On a server that is ordered (see Server.SetOrdered), Ack does
+// nothing: the next call waits for this one to return.
 func (c *Call) Ack() {
-	if c.acked {
+	if c.acked || c.srv.ordered {
 		return
 	}
 	c.acked = true
@@ -76,6 +112,25 @@ type Shutdowner interface {
 	Shutdown()
 }
 
+// ReasonShutdowner is like Shutdowner, but its Shutdown method is told
+// why the server is being shut down.  The reason is nil when the last
+// reference to the capability is released normally, and is the
+// connection's error when the capability is released because the
+// rpc.Conn that exported it was closed or aborted.
+type ReasonShutdowner interface {
+	Shutdown(reason error)
+}
+
+// A RefHolder is a server implementation that holds references to
+// other capabilities.  If the brand passed to New is a RefHolder, the
+// Server reports its references to capnp.DetectClientCycle.
+type RefHolder interface {
+	// Refs returns the clients that the implementation holds.  The
+	// caller does not own the returned clients and must not release
+	// them.
+	Refs() []capnp.Client
+}
+
 // A Server is a locally implemented interface.  It implements the
 // capnp.ClientHook interface.
 type Server struct {
@@ -83,6 +138,10 @@ type Server struct {
 	brand    interface{}
 	shutdown Shutdowner
 
+	// reasonShutdown is used instead of shutdown if the brand is a
+	// ReasonShutdowner.
+	reasonShutdown ReasonShutdowner
+
 	// Cancels handleCallsCtx
 	cancelHandleCalls context.CancelFunc
 
@@ -99,10 +158,28 @@ type Server struct {
 	// Calls are inserted into this queue, to be handled
 	// by a goroutine running handleCalls()
 	callQueue *mpsc.Queue[*Call]
+
+	// fallback handles calls to methods not in methods.  May be nil.
+	fallback FallbackFunc
+
+	// admission is checked before each call is queued.  May be nil.
+	// admissionDone is admission if it is a DoneAdmission.
+	admission     Admission
+	admissionDone DoneAdmission
+
+	// ordered is set by SetOrdered.
+	ordered bool
 }
 
+// A FallbackFunc handles a call to a method that a Server does not
+// implement, identified by its interface and method IDs.  It is called
+// in the same way as a Method's Impl.
+type FallbackFunc func(ctx context.Context, interfaceID uint64, methodID uint16, call *Call) error
+
 // New returns a client hook that makes calls to a set of methods.
-// If shutdown is nil then the server's shutdown is a no-op.  The server
+// If shutdown is nil and brand implements ReasonShutdowner, then brand
+// is shut down with the reason; otherwise if shutdown is nil then the
+// server's shutdown is a no-op.  The server
 // guarantees message delivery order by blocking each call on the
 // return or acknowledgment of the previous call.  See Call.Ack for more
 // details.
@@ -117,17 +194,65 @@ func New(methods []Method, brand interface{}, shutdown Shutdowner) *Server {
 		cancelHandleCalls: cancel,
 		handleCallsCtx:    ctx,
 	}
+	if shutdown == nil {
+		srv.reasonShutdown, _ = brand.(ReasonShutdowner)
+	}
 	copy(srv.methods, methods)
 	sort.Sort(srv.methods)
 	go srv.handleCalls(ctx)
 	return srv
 }
 
+// SetFallback sets a function to handle calls to methods that srv does
+// not implement, e.g. to implement interfaces that are not known until
+// run time.  Without a fallback, such calls fail with an unimplemented
+// exception.  SetFallback must be called before srv receives any calls.
+func (srv *Server) SetFallback(f FallbackFunc) {
+	srv.fallback = f
+}
+
+// SetOrdered sets whether srv runs its method calls one at a time, in
+// the order they arrive, on a single goroutine.  An ordered server's
+// methods may use the server's state without locking it, because no
+// two of them run at once.
+//
+// Ordering covers the whole duration of every call, including
+// long-running and streaming calls: Call.Ack has no effect, so a call
+// that waits on something keeps the calls behind it waiting too, and a
+// method that waits on a call to its own server deadlocks.
+// SetOrdered must be called before srv receives any calls.
+func (srv *Server) SetOrdered(ordered bool) {
+	srv.ordered = ordered
+}
+
+// lookup returns the method that implements m, or nil if there is none.
+func (srv *Server) lookup(m capnp.Method) *Method {
+	if mm := srv.methods.find(m); mm != nil {
+		return mm
+	}
+	if srv.fallback == nil {
+		return nil
+	}
+	fallback := srv.fallback
+	return &Method{
+		Method: m,
+		Impl: func(ctx context.Context, call *Call) error {
+			return fallback(ctx, m.InterfaceID, m.MethodID, call)
+		},
+	}
+}
+
+// unimplemented returns the error for a call to a method that a
+// Server does not implement.
+func unimplemented(m capnp.Method) error {
+	return capnp.Unimplemented(fmt.Sprintf("method %d of interface %#x not implemented", m.MethodID, m.InterfaceID))
+}
+
 // Send starts a method call.
 func (srv *Server) Send(ctx context.Context, s capnp.Send) (*capnp.Answer, capnp.ReleaseFunc) {
-	mm := srv.methods.find(s.Method)
+	mm := srv.lookup(s.Method)
 	if mm == nil {
-		return capnp.ErrorAnswer(s.Method, capnp.Unimplemented("unimplemented")), func() {}
+		return capnp.ErrorAnswer(s.Method, unimplemented(s.Method)), func() {}
 	}
 	args, err := sendArgsToStruct(s)
 	if err != nil {
@@ -143,15 +268,17 @@ func (srv *Server) Send(ctx context.Context, s capnp.Send) (*capnp.Answer, capnp
 				args = capnp.Struct{}
 			}
 		},
-		Returner: ret,
+		Returner:         ret,
+		Metadata:         s.Metadata,
+		ResponseMetadata: s.ResponseMetadata,
 	}))
 }
 
 // Recv starts a method call.
 func (srv *Server) Recv(ctx context.Context, r capnp.Recv) capnp.PipelineCaller {
-	mm := srv.methods.find(r.Method)
+	mm := srv.lookup(r.Method)
 	if mm == nil {
-		r.Reject(capnp.Unimplemented("unimplemented"))
+		r.Reject(unimplemented(r.Method))
 		return nil
 	}
 	return srv.start(ctx, mm, r)
@@ -203,7 +330,7 @@ func (srv *Server) handleCalls(ctx context.Context) {
 func (srv *Server) handleCall(ctx context.Context, c *Call) {
 	defer srv.wg.Done()
 
-	err := c.method.Impl(ctx, c)
+	err := c.method.Impl(capnp.ContextWithCallMetadata(ctx, c.recv), c)
 
 	c.recv.ReleaseArgs()
 	if err == nil {
@@ -211,21 +338,32 @@ func (srv *Server) handleCall(ctx context.Context, c *Call) {
 	} else {
 		c.aq.reject(err)
 	}
+	if srv.admissionDone != nil {
+		// Before returning, so that a caller that has seen the
+		// result sees the updated admission state.
+		srv.admissionDone.Done(c)
+	}
 	c.recv.Returner.Return(err)
 }
 
 func (srv *Server) start(ctx context.Context, m *Method, r capnp.Recv) capnp.PipelineCaller {
-	srv.wg.Add(1)
-
-	aq := newAnswerQueue(r.Method)
-	srv.callQueue.Send(&Call{
+	c := &Call{
 		ctx:    ctx,
 		method: m,
 		recv:   r,
-		aq:     aq,
 		srv:    srv,
-	})
-	return aq
+	}
+	if srv.admission != nil {
+		if err := srv.admission.Admit(ctx, c); err != nil {
+			r.Reject(err)
+			return nil
+		}
+	}
+	srv.wg.Add(1)
+
+	c.aq = newAnswerQueue(r.Method)
+	srv.callQueue.Send(c)
+	return c.aq
 }
 
 // Brand returns a value that will match IsServer.
@@ -233,13 +371,38 @@ func (srv *Server) Brand() capnp.Brand {
 	return capnp.Brand{Value: serverBrand{srv.brand}}
 }
 
+// IsLocal returns true.  It marks clients of srv as local for
+// capnp.Client.IsLocal.
+func (srv *Server) IsLocal() bool {
+	return true
+}
+
+// Refs returns the clients held by the brand passed to New, if it is a
+// RefHolder, and nil otherwise.  It lets capnp.DetectClientCycle follow
+// references through srv.
+func (srv *Server) Refs() []capnp.Client {
+	if rh, ok := srv.brand.(RefHolder); ok {
+		return rh.Refs()
+	}
+	return nil
+}
+
 // Shutdown waits for ongoing calls to finish and calls Shutdown on the
 // Shutdowner passed into NewServer.  Shutdown must not be called more
 // than once.
 func (srv *Server) Shutdown() {
+	srv.ShutdownWithReason(nil)
+}
+
+// ShutdownWithReason is like Shutdown, but passes reason to the brand
+// if it is a ReasonShutdowner.  It is called by
+// capnp.Client.ReleaseWithReason.
+func (srv *Server) ShutdownWithReason(reason error) {
 	srv.cancelHandleCalls()
 	srv.wg.Wait()
-	if srv.shutdown != nil {
+	if srv.reasonShutdown != nil {
+		srv.reasonShutdown.Shutdown(reason)
+	} else if srv.shutdown != nil {
 		srv.shutdown.Shutdown()
 	}
 }
@@ -273,7 +436,18 @@ func sendArgsToStruct(s capnp.Send) (capnp.Struct, error) {
 }
 
 func newBlankStruct(sz capnp.ObjectSize) (capnp.Struct, error) {
-	_, seg, err := capnp.NewMessage(capnp.MultiSegment(nil))
+	return newSizedStruct(sz, 0)
+}
+
+// newSizedStruct is like newBlankStruct, but places the struct in a
+// message whose first segment can hold hint bytes.
+func newSizedStruct(sz capnp.ObjectSize, hint capnp.Size) (capnp.Struct, error) {
+	var arena capnp.Arena = capnp.MultiSegment(nil)
+	if hint > 0 {
+		// Leave room for the root pointer.
+		arena = capnp.MultiSegment([][]byte{make([]byte, 0, hint+8)})
+	}
+	_, seg, err := capnp.NewMessage(arena)
 	if err != nil {
 		return capnp.Struct{}, err
 	}
@@ -324,6 +498,23 @@ type resultsAllocer interface {
 	AllocResults(capnp.ObjectSize) (capnp.Struct, error)
 }
 
+// resultSizeHinter is implemented by Returners that can preallocate
+// results for Method.ResultSize.
+type resultSizeHinter interface {
+	allocResultsHint(sz capnp.ObjectSize, hint capnp.Size) (capnp.Struct, error)
+}
+
+// NewException returns an error of the given type with err as its
+// cause.  When a method returns the error, the type is sent to the
+// caller, who can test for it with functions like capnp.IsOverloaded.
+// NewException returns nil if err is nil.
+func NewException(errType capnp.ExceptionType, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exc.Exception{Type: errType, Cause: err}
+}
+
 func newError(msg string) error {
 	return exc.New(exc.Failed, "capnp server", msg)
 }
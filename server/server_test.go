@@ -6,6 +6,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"capnproto.org/go/capnp/v3"
 	air "capnproto.org/go/capnp/v3/internal/aircraftlib"
@@ -168,6 +169,84 @@ func TestServerShutdown(t *testing.T) {
 	}
 }
 
+func TestServerReasonShutdown(t *testing.T) {
+	reasons := make(chan error, 2)
+	echo := air.Echo_ServerToClient(reasonEchoImpl{reasons})
+	echo.Release()
+	assert.NoError(t, <-reasons, "Release should pass a nil reason")
+
+	echo = air.Echo_ServerToClient(reasonEchoImpl{reasons})
+	reason := errors.New("connection lost")
+	capnp.Client(echo).ReleaseWithReason(reason)
+	assert.ErrorIs(t, <-reasons, reason, "ReleaseWithReason should pass its reason")
+}
+
+type reasonEchoImpl struct {
+	reasons chan<- error
+}
+
+func (reasonEchoImpl) Echo(ctx context.Context, call air.Echo_echo) error {
+	return nil
+}
+
+func (echo reasonEchoImpl) Shutdown(reason error) {
+	echo.reasons <- reason
+}
+
+func TestDetectClientCycle(t *testing.T) {
+	a, b, c := new(holdingEchoImpl), new(holdingEchoImpl), new(holdingEchoImpl)
+	ca := capnp.Client(air.Echo_ServerToClient(a))
+	defer ca.Release()
+	cb := capnp.Client(air.Echo_ServerToClient(b))
+	defer cb.Release()
+	cc := capnp.Client(air.Echo_ServerToClient(c))
+	defer cc.Release()
+
+	// c -> a -> b, with no cycle yet.
+	c.refs = []capnp.Client{ca.AddRef()}
+	a.refs = []capnp.Client{cb.AddRef()}
+	cycle, ok := capnp.DetectClientCycle(cc)
+	assert.False(t, ok, "should not report a cycle in a chain")
+	assert.Nil(t, cycle)
+
+	// b -> a closes a cycle that is reachable from c.
+	b.refs = []capnp.Client{ca.AddRef()}
+	cycle, ok = capnp.DetectClientCycle(cc)
+	assert.True(t, ok, "should report a cycle")
+	assert.Equal(t, []capnp.ClientID{ca.Identity(), cb.Identity()}, cycle)
+
+	// Leaves do not need to implement Refs.
+	echo := capnp.Client(air.Echo_ServerToClient(echoImpl{}))
+	defer echo.Release()
+	_, ok = capnp.DetectClientCycle(echo)
+	assert.False(t, ok, "should not report a cycle for a server without refs")
+
+	// Releasing b's reference breaks the cycle.
+	b.release()
+	_, ok = capnp.DetectClientCycle(cc)
+	assert.False(t, ok, "should not report a cycle once broken")
+	c.release()
+	a.release()
+}
+
+// holdingEchoImpl is an echo server that holds references to other
+// capabilities.
+type holdingEchoImpl struct {
+	echoImpl
+	refs []capnp.Client
+}
+
+func (h *holdingEchoImpl) Refs() []capnp.Client {
+	return h.refs
+}
+
+func (h *holdingEchoImpl) release() {
+	for _, c := range h.refs {
+		c.Release()
+	}
+	h.refs = nil
+}
+
 type blockingEchoImpl struct {
 	wait <-chan struct{}
 }
@@ -344,3 +423,378 @@ func (c *callSeqBlockN) GetNumber(ctx context.Context, p air.CallSequence_getNum
 		return ctx.Err()
 	}
 }
+
+func TestStreamMethodError(t *testing.T) {
+	t.Parallel()
+
+	push := capnp.Method{InterfaceID: 0xd5e2b4a5e7c2f3a1, MethodID: 0}
+	end := capnp.Method{InterfaceID: 0xd5e2b4a5e7c2f3a1, MethodID: 1}
+	var handled, finished int
+	sm := &server.StreamMethod{
+		Method: push,
+		Handle: func(ctx context.Context, call *server.Call) error {
+			handled++
+			if handled == 2 {
+				return errors.New("stream broke")
+			}
+			return nil
+		},
+		End: end,
+		Finish: func(ctx context.Context, call *server.Call) error {
+			finished++
+			return nil
+		},
+	}
+	c := capnp.NewClient(server.New(sm.Methods(nil), nil, nil))
+	defer c.Release()
+
+	ctx := context.Background()
+	send := func(m capnp.Method) error {
+		ans, release := c.SendCall(ctx, capnp.Send{Method: m})
+		defer release()
+		_, err := ans.Struct()
+		return err
+	}
+	assert.NoError(t, send(push), "First streamed call succeeds")
+	assert.Error(t, send(push), "Second streamed call fails")
+	assert.Error(t, send(push), "Streamed call after failure fails")
+	assert.Error(t, send(end), "Ending a broken stream fails")
+	assert.Equal(t, 2, handled, "Handle is not called after failure")
+	assert.Equal(t, 0, finished, "Finish is not called for a broken stream")
+
+	assert.NoError(t, send(push), "New stream starts after end")
+	assert.NoError(t, send(end), "New stream ends successfully")
+	assert.Equal(t, 1, finished, "Finish is called for the new stream")
+}
+
+func TestCallMetadata(t *testing.T) {
+	traceMethod := capnp.Method{InterfaceID: 0xa7ace, MethodID: 0, InterfaceName: "Tracer", MethodName: "trace"}
+	type observed struct {
+		in      capnp.CallMetadata
+		replied bool
+	}
+	obs := make(chan observed, 1)
+	srv := server.New([]server.Method{{
+		Method: traceMethod,
+		Impl: func(ctx context.Context, call *server.Call) error {
+			in := capnp.IncomingCallMetadata(ctx)
+			replied := capnp.SetResponseMetadata(ctx, "trace-id", in["trace-id"])
+			obs <- observed{in, replied}
+			return nil
+		},
+	}}, nil, nil)
+	c := capnp.NewClient(srv)
+	defer c.Release()
+
+	t.Run("Echo", func(t *testing.T) {
+		resp := capnp.CallMetadata{}
+		ans, release := c.SendCall(context.Background(), capnp.Send{
+			Method:           traceMethod,
+			Metadata:         capnp.CallMetadata{"trace-id": "abc123"},
+			ResponseMetadata: resp,
+		})
+		defer release()
+		_, err := ans.Struct()
+		assert.NoError(t, err)
+
+		o := <-obs
+		assert.Equal(t, "abc123", o.in["trace-id"], "server should see client metadata")
+		assert.True(t, o.replied, "server should be able to set response metadata")
+		assert.Equal(t, capnp.CallMetadata{"trace-id": "abc123"}, resp, "client should see response metadata")
+	})
+	t.Run("None", func(t *testing.T) {
+		ans, release := c.SendCall(context.Background(), capnp.Send{Method: traceMethod})
+		defer release()
+		_, err := ans.Struct()
+		assert.NoError(t, err)
+
+		o := <-obs
+		assert.Nil(t, o.in, "server should see no metadata")
+		assert.False(t, o.replied, "response metadata should be discarded")
+	})
+}
+
+func TestUnknownInterface(t *testing.T) {
+	// The server hosts Echo, but not the interface being called.
+	echo := air.Echo_ServerToClient(echoImpl{})
+	defer echo.Release()
+	method := capnp.Method{InterfaceID: 0xdeadbeef01, MethodID: 7}
+
+	ans, release := capnp.Client(echo).SendCall(context.Background(), capnp.Send{Method: method})
+	defer release()
+	_, err := ans.Struct()
+	if assert.Error(t, err) {
+		assert.True(t, capnp.IsUnimplemented(err), "error should be unimplemented: %v", err)
+		assert.Contains(t, err.Error(), "0xdeadbeef01", "error should name interface ID")
+		assert.Contains(t, err.Error(), "method 7", "error should name method ID")
+	}
+}
+
+func TestServerFallback(t *testing.T) {
+	srv := air.Echo_NewServer(echoImpl{})
+	srv.SetFallback(func(ctx context.Context, interfaceID uint64, methodID uint16, call *server.Call) error {
+		res, err := call.AllocResults(capnp.ObjectSize{DataSize: 16})
+		if err != nil {
+			return err
+		}
+		res.SetUint64(0, interfaceID)
+		res.SetUint16(8, methodID)
+		return nil
+	})
+	c := capnp.NewClient(srv)
+	defer c.Release()
+
+	t.Run("Dynamic", func(t *testing.T) {
+		ans, release := c.SendCall(context.Background(), capnp.Send{
+			Method: capnp.Method{InterfaceID: 0xdeadbeef01, MethodID: 7},
+		})
+		defer release()
+		res, err := ans.Struct()
+		if assert.NoError(t, err) {
+			assert.Equal(t, uint64(0xdeadbeef01), res.Uint64(0), "fallback should receive interface ID")
+			assert.Equal(t, uint16(7), res.Uint16(8), "fallback should receive method ID")
+		}
+	})
+	t.Run("Static", func(t *testing.T) {
+		echo := air.Echo(c.AddRef())
+		defer echo.Release()
+		ans, finish := echo.Echo(context.Background(), func(p air.Echo_echo_Params) error {
+			return p.SetIn("foo")
+		})
+		defer finish()
+		res, err := ans.Struct()
+		if assert.NoError(t, err) {
+			out, err := res.Out()
+			assert.NoError(t, err)
+			assert.Equal(t, "foofoo", out, "implemented methods should bypass fallback")
+		}
+	})
+}
+
+func TestServerProxy(t *testing.T) {
+	backend := capnp.Client(air.Echo_ServerToClient(echoImpl{}))
+	defer backend.Release()
+
+	// The proxy knows nothing about the Echo interface.
+	proxy := server.New(nil, nil, nil)
+	proxy.SetFallback(func(ctx context.Context, interfaceID uint64, methodID uint16, call *server.Call) error {
+		args := call.Args()
+		ans, release := backend.SendCall(ctx, capnp.Send{
+			Method:   call.Method(),
+			ArgsSize: args.Size(),
+			PlaceArgs: func(p capnp.Struct) error {
+				return p.CopyFrom(args)
+			},
+		})
+		defer release()
+		res, err := ans.Struct()
+		if err != nil {
+			return err
+		}
+		return call.SetResults(res)
+	})
+	echo := air.Echo(capnp.NewClient(proxy))
+	defer echo.Release()
+
+	ans, finish := echo.Echo(context.Background(), func(p air.Echo_echo_Params) error {
+		return p.SetIn("foo")
+	})
+	defer finish()
+	res, err := ans.Struct()
+	if assert.NoError(t, err) {
+		out, err := res.Out()
+		assert.NoError(t, err)
+		assert.Equal(t, "foofoo", out, "should return backend's results")
+	}
+}
+
+// overlapEchoImpl records the most calls to Echo that ran at once.
+type overlapEchoImpl struct {
+	mu      sync.Mutex
+	active  int
+	maxSeen int
+}
+
+func (e *overlapEchoImpl) Echo(ctx context.Context, call air.Echo_echo) error {
+	e.mu.Lock()
+	e.active++
+	if e.active > e.maxSeen {
+		e.maxSeen = e.active
+	}
+	e.mu.Unlock()
+
+	// Acking would let the next call start on an unordered server.
+	call.Ack()
+	time.Sleep(time.Millisecond)
+
+	e.mu.Lock()
+	e.active--
+	e.mu.Unlock()
+	return echoImpl{}.Echo(ctx, call)
+}
+
+func TestServerOrdered(t *testing.T) {
+	t.Parallel()
+
+	impl := new(overlapEchoImpl)
+	srv := air.Echo_NewServer(impl)
+	srv.SetOrdered(true)
+	echo := air.Echo(capnp.NewClient(srv))
+	defer echo.Release()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ans, release := echo.Echo(context.Background(), func(p air.Echo_echo_Params) error {
+				return p.SetIn("x")
+			})
+			defer release()
+			if _, err := ans.Struct(); err != nil {
+				t.Error("Echo:", err)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, impl.maxSeen, "most calls running at once")
+}
+
+func TestServerAdmission(t *testing.T) {
+	wait := make(chan struct{})
+	srv := air.Echo_NewServer(blockingEchoImpl{wait: wait})
+	lim := &server.Limiter{MaxInFlight: 2}
+	srv.SetAdmission(lim)
+	echo := air.Echo(capnp.NewClient(srv))
+	defer echo.Release()
+
+	call := func() (air.Echo_echo_Results_Future, capnp.ReleaseFunc) {
+		return echo.Echo(context.Background(), func(p air.Echo_echo_Params) error {
+			return p.SetIn("foo")
+		})
+	}
+	ans1, finish1 := call()
+	defer finish1()
+	ans2, finish2 := call()
+	defer finish2()
+	ans3, finish3 := call()
+	defer finish3()
+	if _, err := ans3.Struct(); !capnp.IsOverloaded(err) {
+		t.Errorf("call over limit: %v; want overloaded", err)
+	}
+	if n := lim.InFlight(); n != 2 {
+		t.Errorf("InFlight() = %d; want 2", n)
+	}
+
+	close(wait)
+	for i, ans := range []air.Echo_echo_Results_Future{ans1, ans2} {
+		if _, err := ans.Struct(); err != nil {
+			t.Errorf("admitted call #%d: %v", i+1, err)
+		}
+	}
+	if n := lim.InFlight(); n != 0 {
+		t.Errorf("InFlight() = %d after calls returned; want 0", n)
+	}
+	ans4, finish4 := call()
+	defer finish4()
+	if _, err := ans4.Struct(); err != nil {
+		t.Errorf("call after load dropped: %v", err)
+	}
+}
+
+func TestServerAdmission_Memory(t *testing.T) {
+	var mu sync.Mutex
+	usage := uint64(100)
+	srv := air.Echo_NewServer(echoImpl{})
+	srv.SetAdmission(&server.Limiter{
+		MemoryUsage: func() uint64 {
+			mu.Lock()
+			defer mu.Unlock()
+			return usage
+		},
+		MaxMemory: 1000,
+	})
+	echo := air.Echo(capnp.NewClient(srv))
+	defer echo.Release()
+
+	call := func() error {
+		ans, finish := echo.Echo(context.Background(), func(p air.Echo_echo_Params) error {
+			return p.SetIn("foo")
+		})
+		defer finish()
+		_, err := ans.Struct()
+		return err
+	}
+	if err := call(); err != nil {
+		t.Errorf("call under memory limit: %v", err)
+	}
+	mu.Lock()
+	usage = 2000
+	mu.Unlock()
+	if err := call(); !capnp.IsOverloaded(err) {
+		t.Errorf("call over memory limit: %v; want overloaded", err)
+	}
+}
+
+func TestResultSizeHint(t *testing.T) {
+	listMethod := capnp.Method{InterfaceID: 0xa110c, MethodID: 0, InterfaceName: "Lister", MethodName: "list"}
+	const (
+		n    = 256
+		text = "a sixty-byte string, padded out to fill most of eight words."
+	)
+	// The results struct, the pointer list, and the texts with their
+	// NUL terminators padded to words.
+	const size = 8 + n*8 + n*64
+
+	newClient := func(hint capnp.Size) (capnp.Client, func() capnp.ArenaStats) {
+		var stats capnp.ArenaStats
+		srv := server.New([]server.Method{{
+			Method:     listMethod,
+			ResultSize: hint,
+			Impl: func(ctx context.Context, call *server.Call) error {
+				res, err := call.AllocResults(capnp.ObjectSize{PointerCount: 1})
+				if err != nil {
+					return err
+				}
+				l, err := capnp.NewTextList(res.Segment(), n)
+				if err != nil {
+					return err
+				}
+				for i := 0; i < n; i++ {
+					if err := l.Set(i, text); err != nil {
+						return err
+					}
+				}
+				if err := res.SetPtr(0, l.ToPtr()); err != nil {
+					return err
+				}
+				stats = res.Message().ArenaStats()
+				return nil
+			},
+		}}, nil, nil)
+		return capnp.NewClient(srv), func() capnp.ArenaStats { return stats }
+	}
+	call := func(c capnp.Client) {
+		ans, release := c.SendCall(context.Background(), capnp.Send{Method: listMethod})
+		defer release()
+		_, err := ans.Struct()
+		assert.NoError(t, err)
+	}
+
+	plain, plainStats := newClient(0)
+	defer plain.Release()
+	hinted, hintedStats := newClient(size)
+	defer hinted.Release()
+
+	plainAllocs := testing.AllocsPerRun(10, func() { call(plain) })
+	hintedAllocs := testing.AllocsPerRun(10, func() { call(hinted) })
+	assert.Greater(t, plainStats().Segments, 1, "results without a hint should grow the arena")
+	assert.Equal(t, 1, hintedStats().Segments, "results with an accurate hint should fit in one segment")
+	assert.Less(t, hintedAllocs, plainAllocs, "hint should avoid allocations")
+	t.Logf("allocations per call: %v without hint, %v with hint", plainAllocs, hintedAllocs)
+
+	small, smallStats := newClient(64)
+	defer small.Release()
+	call(small)
+	assert.Greater(t, smallStats().Segments, 1, "results larger than the hint should grow the arena")
+}
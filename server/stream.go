@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	"capnproto.org/go/capnp/v3"
+)
+
+// A StreamMethod implements the server side of a Cap'n Proto stream: a
+// sequence of calls to a streaming method (one declared as "-> stream")
+// followed by a call to a method that ends the stream.
+//
+// Calls to a Server are delivered one at a time, and StreamMethod does
+// not acknowledge a streamed call until Handle returns, so a client using
+// a FlowLimiter is slowed down to the rate at which Handle consumes its
+// calls.  The context passed to Handle and Finish is cancelled if the
+// call is cancelled or the server is shut down, e.g. because the client
+// disconnected mid-stream.
+//
+// As in the C++ implementation, once Handle returns an error the stream
+// is broken: subsequent streamed calls and the ending call fail with the
+// same error, without calling Handle or Finish.  After the ending call
+// returns, a new stream may begin.
+type StreamMethod struct {
+	// Method is the streaming method.  Handle is called once for each
+	// call to it.
+	Method capnp.Method
+	Handle func(context.Context, *Call) error
+
+	// End is the method that ends the stream.  Finish is called when it
+	// is called, after every preceding streamed call has been handled,
+	// and may allocate results.
+	End    capnp.Method
+	Finish func(context.Context, *Call) error
+
+	mu  sync.Mutex
+	err error // first error returned by Handle in the current stream
+}
+
+// Methods appends the Methods that implement sm's streaming and ending
+// methods to a slice.  The returned Methods are bound to sm, so sm must
+// not be copied afterward.
+func (sm *StreamMethod) Methods(methods []Method) []Method {
+	return append(methods,
+		Method{Method: sm.Method, Impl: sm.handle},
+		Method{Method: sm.End, Impl: sm.finish},
+	)
+}
+
+func (sm *StreamMethod) handle(ctx context.Context, call *Call) error {
+	if err := sm.streamErr(); err != nil {
+		return err
+	}
+	err := sm.Handle(ctx, call)
+	if err != nil {
+		sm.mu.Lock()
+		if sm.err == nil {
+			sm.err = err
+		}
+		sm.mu.Unlock()
+	}
+	return err
+}
+
+func (sm *StreamMethod) finish(ctx context.Context, call *Call) error {
+	defer func() {
+		sm.mu.Lock()
+		sm.err = nil
+		sm.mu.Unlock()
+	}()
+	if err := sm.streamErr(); err != nil {
+		return err
+	}
+	return sm.Finish(ctx, call)
+}
+
+func (sm *StreamMethod) streamErr() error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.err
+}
@@ -1,5 +1,7 @@
 package capnp
 
+import "io"
+
 // Struct is a pointer to a struct.
 type Struct StructKind
 
@@ -28,7 +30,7 @@ func NewStruct(s *Segment, sz ObjectSize) (Struct, error) {
 		seg:        seg,
 		off:        addr,
 		size:       sz,
-		depthLimit: maxDepth,
+		depthLimit: seg.depthLimit(),
 	}, nil
 }
 
@@ -101,7 +103,10 @@ func (p Struct) readSize() Size {
 	return p.size.totalSize()
 }
 
-// Ptr returns the i'th pointer in the struct.
+// Ptr returns the i'th pointer in the struct.  If i is beyond the
+// struct's pointer section, Ptr returns a null pointer and no error:
+// the struct may have been written with an older version of its
+// schema, and fields added since then read as their defaults.
 func (p Struct) Ptr(i uint16) (Ptr, error) {
 	if p.seg == nil || i >= p.size.PointerCount {
 		return Ptr{}, nil
@@ -118,14 +123,37 @@ func (p Struct) HasPtr(i uint16) bool {
 	return p.seg.readRawPointer(p.pointerAddress(i)) != 0
 }
 
-// SetPtr sets the i'th pointer in the struct to src.
+// SetPtr sets the i'th pointer in the struct to src.  It returns an
+// error if the struct is invalid or i is beyond its pointer section.
+//
+// If src is in a different message, or is an element of a struct list,
+// its target is deep-copied into p's message, and capabilities in the
+// copy are added to the cap table of p's message.  Otherwise the
+// new pointer refers to src's target without copying it.
 func (p Struct) SetPtr(i uint16, src Ptr) error {
-	if p.seg == nil || i >= p.size.PointerCount {
-		panic("capnp: set field outside struct boundaries")
+	if p.seg == nil {
+		return errorf("set pointer %d: invalid struct", i)
+	}
+	if i >= p.size.PointerCount {
+		return errorf("set pointer %d: out of bounds of struct with %d pointers", i, p.size.PointerCount)
 	}
 	return p.seg.writePtr(p.pointerAddress(i), src, false)
 }
 
+// DataField returns the Data stored in the i'th pointer, or nil if the
+// pointer is null or is not a Data (byte list) pointer.
+//
+// No copy is made: the returned slice aliases the message's segment.
+// Writing to it modifies the message, and it must not be used after
+// the message is reset or its arena is reused.
+func (p Struct) DataField(i uint16) ([]byte, error) {
+	ptr, err := p.Ptr(i)
+	if err != nil {
+		return nil, err
+	}
+	return ptr.Data(), nil
+}
+
 // SetText sets the i'th pointer to a newly allocated text or null if v is empty.
 func (p Struct) SetText(i uint16, v string) error {
 	if v == "" {
@@ -167,6 +195,42 @@ func (p Struct) SetData(i uint16, v []byte) error {
 	return p.SetPtr(i, d.ToPtr())
 }
 
+// SetDataFromReader sets the i'th pointer to a newly allocated data of
+// size bytes read from r.  The bytes are read directly into the
+// message, without an intermediate buffer.  If r has fewer than size
+// bytes, SetDataFromReader returns an error and leaves the pointer
+// unchanged, but the allocated space stays in the message.
+func (p Struct) SetDataFromReader(i uint16, r io.Reader, size int) error {
+	if size < 0 || size >= 1<<29 {
+		return errorf("set data from reader: size %d out of range", size)
+	}
+	d, err := NewUInt8List(p.seg, int32(size))
+	if err != nil {
+		return annotatef(err, "set data from reader")
+	}
+	if _, err := io.ReadFull(r, d.seg.slice(d.off, Size(size))); err != nil {
+		return annotatef(err, "set data from reader")
+	}
+	return p.SetPtr(i, d.ToPtr())
+}
+
+// SetTextFromReader is like SetDataFromReader, but sets the i'th
+// pointer to a text of size bytes read from r.  The bytes should not
+// contain a NUL; the terminating NUL is added.
+func (p Struct) SetTextFromReader(i uint16, r io.Reader, size int) error {
+	if size < 0 || size >= 1<<29-1 {
+		return errorf("set text from reader: size %d out of range", size)
+	}
+	t, err := NewUInt8List(p.seg, int32(size+1))
+	if err != nil {
+		return annotatef(err, "set text from reader")
+	}
+	if _, err := io.ReadFull(r, t.seg.slice(t.off, Size(size))); err != nil {
+		return annotatef(err, "set text from reader")
+	}
+	return p.SetPtr(i, t.ToPtr())
+}
+
 func (p Struct) pointerAddress(i uint16) address {
 	// Struct already had bounds check
 	ptrStart, _ := p.off.addSize(p.size.DataSize)
@@ -246,6 +310,31 @@ func (p Struct) Uint64(off DataOffset) uint64 {
 	return p.seg.readUint64(addr)
 }
 
+// Which returns the discriminant of the union whose discriminant is at
+// discriminantOffset, which is the ordinal of the union member that is
+// set.  discriminantOffset is in multiples of 16 bits, as in a schema's
+// struct node.  If the discriminant is outside the struct's data
+// section, Which returns 0, the default.
+func (p Struct) Which(discriminantOffset uint32) uint16 {
+	v, _ := p.Discriminant(discriminantOffset)
+	return v
+}
+
+// Discriminant returns the raw 16-bit discriminant at
+// discriminantOffset, in multiples of 16 bits.  ok is false if the
+// discriminant is outside the struct's data section, as it is for a
+// struct written with an older version of the schema.
+func (p Struct) Discriminant(discriminantOffset uint32) (v uint16, ok bool) {
+	if discriminantOffset >= 1<<18 {
+		return 0, false
+	}
+	addr, ok := p.dataAddress(DataOffset(discriminantOffset*2), 2)
+	if !ok {
+		return 0, false
+	}
+	return p.seg.readUint16(addr), true
+}
+
 // SetUint8 sets the 8-bit integer that is off bytes from the start of the struct to v.
 func (p Struct) SetUint8(off DataOffset, v uint8) {
 	addr, ok := p.dataAddress(off, 1)
@@ -282,6 +371,51 @@ func (p Struct) SetUint64(off DataOffset, v uint64) {
 	p.seg.writeUint64(addr, v)
 }
 
+// Trim returns p without its trailing zero data words and null
+// pointers, which read the same as fields beyond the end of the struct.
+// If the data section shrinks, the remaining pointers are moved down to
+// follow it, and the space that p no longer uses is zeroed.  If p is the
+// last object in its segment, the space is also returned to the segment
+// for later allocations.
+//
+// Trim does not update pointers to p: store the returned struct with
+// SetPtr or SetRoot in place of p.  Any other pointer to p, or any
+// Struct value that refers to it, reads p incorrectly after Trim.
+// Structs that are list elements cannot be resized and are returned
+// unchanged.  Trim returns ErrReadOnly if p would shrink but its message
+// is read-only.
+func (p Struct) Trim() (Struct, error) {
+	if p.seg == nil || p.flags&isListMember != 0 {
+		return p, nil
+	}
+	sz := canonicalStructSize(p)
+	if sz == p.size {
+		return p, nil
+	}
+	if p.seg.readOnly() {
+		return Struct{}, ErrReadOnly
+	}
+	t := p
+	t.size = sz
+	if sz.DataSize < p.size.DataSize && sz.PointerCount > 0 {
+		src := p
+		src.size.PointerCount = sz.PointerCount
+		if err := moveStruct(t, src); err != nil {
+			return Struct{}, annotatef(err, "trim struct")
+		}
+	}
+	start, _ := t.off.addSize(sz.totalSize())
+	end, _ := p.off.addSize(p.size.totalSize())
+	unused := p.seg.data[start:end]
+	for i := range unused {
+		unused[i] = 0
+	}
+	if int(end) == len(p.seg.data) {
+		p.seg.data = p.seg.data[:start]
+	}
+	return t, nil
+}
+
 // structFlags is a bitmask of flags for a pointer.
 type structFlags uint8
 
@@ -295,6 +429,9 @@ func copyStruct(dst, src Struct) error {
 	if dst.seg == nil {
 		panic("copy struct into invalid pointer")
 	}
+	if dst.seg.readOnly() {
+		return ErrReadOnly
+	}
 	if src.seg == nil {
 		return nil
 	}
@@ -0,0 +1,271 @@
+package capnp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestStructDiscriminant(t *testing.T) {
+	// The discriminant of a union at bits [128, 144), as in
+	//
+	//	struct Shape {
+	//	  area @0 :Float64;
+	//	  union {
+	//	    circle @1 :Float64;
+	//	    square @2 :Float64;
+	//	  }
+	//	}
+	//
+	// TestStructWhich checks Which against generated unions.
+	const discriminantOffset = 8
+	_, seg, err := NewMessage(SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStruct(seg, ObjectSize{DataSize: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := s.Discriminant(discriminantOffset); !ok || got != 0 {
+		t.Errorf("new struct Discriminant = %d, %t; want 0, true", got, ok)
+	}
+
+	// A struct from an older schema without the union.
+	old, err := NewStruct(seg, ObjectSize{DataSize: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := old.Discriminant(discriminantOffset); ok || got != 0 {
+		t.Errorf("short struct Discriminant = %d, %t; want 0, false", got, ok)
+	}
+	if got := old.Which(discriminantOffset); got != 0 {
+		t.Errorf("short struct Which = %d; want 0", got)
+	}
+	if _, ok := s.Discriminant(1 << 31); ok {
+		t.Error("Discriminant(1<<31) ok = true; want false")
+	}
+}
+
+func TestStructTrim(t *testing.T) {
+	msg, seg, err := NewMessage(SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	txt, err := NewText(seg, "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Fields after the first word and pointer are left at their defaults.
+	s, err := NewStruct(seg, ObjectSize{DataSize: 24, PointerCount: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetUint64(0, 42)
+	if err := s.SetPtr(0, txt.ToPtr()); err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.SetRoot(s.ToPtr()); err != nil {
+		t.Fatal(err)
+	}
+	before, err := msg.TotalSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trimmed, err := s.Trim()
+	if err != nil {
+		t.Fatal("Trim:", err)
+	}
+	if want := (ObjectSize{DataSize: 8, PointerCount: 1}); trimmed.Size() != want {
+		t.Errorf("trimmed size = %v; want %v", trimmed.Size(), want)
+	}
+	if err := msg.SetRoot(trimmed.ToPtr()); err != nil {
+		t.Fatal(err)
+	}
+	after, err := msg.TotalSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := before - 32; after != want {
+		t.Errorf("TotalSize after Trim = %d; want %d (was %d)", after, want, before)
+	}
+
+	data, err := msg.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg2, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp, err := msg2.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := rp.Struct()
+	if got := root.Uint64(0); got != 42 {
+		t.Errorf("field 0 = %d; want 42", got)
+	}
+	if got := root.Uint64(16); got != 0 {
+		t.Errorf("trimmed field = %d; want 0", got)
+	}
+	p, err := root.Ptr(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Text(); got != "hi" {
+		t.Errorf("pointer 0 text = %q; want \"hi\"", got)
+	}
+	if p, err := root.Ptr(2); err != nil || p.IsValid() {
+		t.Errorf("trimmed pointer = %v, %v; want null", p, err)
+	}
+
+	// Trimming again has no effect.
+	again, err := trimmed.Trim()
+	if err != nil || again.Size() != trimmed.Size() {
+		t.Errorf("second Trim = %v, %v; want size %v", again.Size(), err, trimmed.Size())
+	}
+}
+
+func TestStructPtr(t *testing.T) {
+	_, seg, err := NewMessage(SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewRootStruct(seg, ObjectSize{PointerCount: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	txt, err := NewText(seg, "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetPtr(1, txt.ToPtr()); err != nil {
+		t.Fatal("SetPtr(1):", err)
+	}
+	if p, err := s.Ptr(1); err != nil || p.Text() != "hi" {
+		t.Errorf("Ptr(1) = %q, %v; want \"hi\", <nil>", p.Text(), err)
+	}
+	if p, err := s.Ptr(0); err != nil || p.IsValid() {
+		t.Errorf("Ptr(0) = %v, %v; want null, <nil>", p, err)
+	}
+	// Past the pointer section reads as null, for schema evolution.
+	if p, err := s.Ptr(2); err != nil || p.IsValid() {
+		t.Errorf("Ptr(2) = %v, %v; want null, <nil>", p, err)
+	}
+
+	if err := s.SetPtr(2, txt.ToPtr()); err == nil {
+		t.Error("SetPtr(2) on struct with 2 pointers did not return an error")
+	}
+	if err := (Struct{}).SetPtr(0, txt.ToPtr()); err == nil {
+		t.Error("SetPtr(0) on invalid struct did not return an error")
+	}
+}
+
+func TestStructSetPtr_OtherMessage(t *testing.T) {
+	_, seg1, err := NewMessage(SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, seg2, err := NewMessage(SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := NewRootStruct(seg1, ObjectSize{PointerCount: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := NewText(seg2, "copied")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.SetPtr(0, src.ToPtr()); err != nil {
+		t.Fatal("SetPtr:", err)
+	}
+	p, err := dst.Ptr(0)
+	if err != nil {
+		t.Fatal("Ptr:", err)
+	}
+	if p.Segment().Message() != seg1.Message() {
+		t.Error("pointer from another message was not copied into the struct's message")
+	}
+	if p.Text() != "copied" {
+		t.Errorf("copied text = %q; want \"copied\"", p.Text())
+	}
+}
+
+func TestStructSetDataFromReader(t *testing.T) {
+	const size = 1 << 20
+	src := make([]byte, size)
+	for i := range src {
+		src[i] = byte(i * 7)
+	}
+	// Leave room for the root struct and the data, so that the message
+	// doesn't grow while setting it.
+	buf := make([]byte, 0, size+64)
+	msg, seg, err := NewMessage(SingleSegment(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := NewRootStruct(seg, ObjectSize{PointerCount: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := root.SetDataFromReader(0, bytes.NewReader(src), size); err != nil {
+		t.Fatal("SetDataFromReader:", err)
+	}
+	p, err := root.Ptr(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p.Data(), src) {
+		t.Error("data field does not match source")
+	}
+
+	// Reading the data allocates nothing besides the message's own
+	// space: there is no intermediate copy of the blob.
+	var r bytes.Reader
+	allocs := testing.AllocsPerRun(10, func() {
+		msg.Reset(SingleSegment(buf[:0]))
+		seg, _ := msg.Segment(0)
+		root, err := NewRootStruct(seg, ObjectSize{PointerCount: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Reset(src)
+		if err := root.SetDataFromReader(0, &r, size); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs > 1 {
+		t.Errorf("SetDataFromReader made %.0f allocations per run; want at most 1, for the arena", allocs)
+	}
+
+	if err := root.SetDataFromReader(0, bytes.NewReader(src[:10]), 11); err == nil {
+		t.Error("SetDataFromReader with short reader succeeded")
+	}
+}
+
+func TestStructSetTextFromReader(t *testing.T) {
+	t.Parallel()
+
+	_, seg, err := NewMessage(SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := NewRootStruct(seg, ObjectSize{PointerCount: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := root.SetTextFromReader(0, strings.NewReader("hello, world"), 5); err != nil {
+		t.Fatal("SetTextFromReader:", err)
+	}
+	p, err := root.Ptr(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Text(); got != "hello" {
+		t.Errorf("text field = %q; want \"hello\"", got)
+	}
+}
@@ -0,0 +1,155 @@
+package capnp
+
+// UnmarshalChecked reads an unpacked serialized stream into a message,
+// like Unmarshal, and then validates every pointer reachable from the
+// root.  Unmarshal defers these checks until the fields are accessed,
+// whereas UnmarshalChecked fails up front if any pointer lands outside
+// of its segment, any struct or list extends past the end of its
+// segment, or any two objects overlap.  The returned error names the
+// segment and byte offset of the first offending pointer.
+//
+// Validation reads each word of the message at most once, so it does
+// not count against the message's read traversal limit.
+func UnmarshalChecked(data []byte) (*Message, error) {
+	msg, err := Unmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateMessage(msg); err != nil {
+		return nil, annotatef(err, "unmarshal")
+	}
+	return msg, nil
+}
+
+// validateMessage walks every object reachable from msg's root pointer.
+func validateMessage(msg *Message) error {
+	s, err := msg.Segment(0)
+	if err != nil {
+		return annotatef(err, "validate")
+	}
+	if !s.regionInBounds(0, wordSize) {
+		return errorf("validate: segment 0 is too short for root pointer")
+	}
+	v := &validator{claimed: make(map[SegmentID][]uint64)}
+	if err := v.claim(s, 0, wordSize); err != nil {
+		return annotatef(err, "validate")
+	}
+	if err := v.ptr(s, 0, msg.depthLimit()); err != nil {
+		return annotatef(err, "validate")
+	}
+	return nil
+}
+
+// A validator records which words of a message are occupied by objects
+// that it has already visited, so that overlapping objects (and
+// pointer cycles) are detected.
+type validator struct {
+	claimed map[SegmentID][]uint64 // bitmap of words, by segment
+}
+
+// claim marks the words in [addr, addr+sz) as occupied, failing if any
+// of them are already occupied.  The region must be in bounds.
+func (v *validator) claim(s *Segment, addr address, sz Size) error {
+	bits := v.claimed[s.id]
+	if bits == nil {
+		bits = make([]uint64, (len(s.data)/int(wordSize)+63)/64)
+		v.claimed[s.id] = bits
+	}
+	start := int(addr / address(wordSize))
+	end := start + int(sz.padToWord()/wordSize)
+	for i := start; i < end; i++ {
+		if bits[i/64]&(1<<uint(i%64)) != 0 {
+			return errorf("segment %d offset %d: overlaps another object", s.id, i*int(wordSize))
+		}
+		bits[i/64] |= 1 << uint(i%64)
+	}
+	return nil
+}
+
+// ptr validates the pointer stored at paddr in s and the object it
+// references.
+func (v *validator) ptr(s *Segment, paddr address, depthLimit uint) error {
+	raw := s.readRawPointer(paddr)
+	if raw == 0 {
+		return nil
+	}
+	if depthLimit == 0 {
+		return annotatef(ErrDepthLimit, "segment %d offset %d", s.id, paddr)
+	}
+	switch raw.pointerType() {
+	case farPointer:
+		if dst, err := s.lookupSegment(raw.farSegment()); err == nil && dst.regionInBounds(raw.farAddress(), wordSize) {
+			if err := v.claim(dst, raw.farAddress(), wordSize); err != nil {
+				return annotatef(err, "segment %d offset %d: far pointer landing pad", s.id, paddr)
+			}
+		}
+	case doubleFarPointer:
+		if pad, err := s.lookupSegment(raw.farSegment()); err == nil && pad.regionInBounds(raw.farAddress(), wordSize*2) {
+			if err := v.claim(pad, raw.farAddress(), wordSize*2); err != nil {
+				return annotatef(err, "segment %d offset %d: double-far pointer landing pad", s.id, paddr)
+			}
+		}
+	}
+	dst, base, val, err := s.resolveFarPointer(paddr)
+	if err != nil {
+		return annotatef(err, "segment %d offset %d", s.id, paddr)
+	}
+	switch val.pointerType() {
+	case structPointer:
+		sp, err := dst.readStructPtr(base, val)
+		if err != nil {
+			return annotatef(err, "segment %d offset %d", s.id, paddr)
+		}
+		if err := v.claim(dst, sp.off, sp.size.totalSize()); err != nil {
+			return annotatef(err, "segment %d offset %d: struct", s.id, paddr)
+		}
+		return v.pointerSection(dst, sp.off.addSizeUnchecked(sp.size.DataSize), int32(sp.size.PointerCount), depthLimit-1)
+	case listPointer:
+		lp, err := dst.readListPtr(base, val)
+		if err != nil {
+			return annotatef(err, "segment %d offset %d", s.id, paddr)
+		}
+		// readListPtr has checked that the list fits in the segment.
+		addr, _ := val.offset().resolve(base)
+		lsize, _ := val.totalListSize()
+		if lp.flags&isCompositeList != 0 {
+			tsize := lp.size.totalSize().timesUnchecked(lp.length)
+			if tsize > lsize-wordSize {
+				return errorf("segment %d offset %d: composite list elements exceed list size", s.id, paddr)
+			}
+		}
+		if err := v.claim(dst, addr, lsize); err != nil {
+			return annotatef(err, "segment %d offset %d: list", s.id, paddr)
+		}
+		switch {
+		case lp.flags&isCompositeList != 0:
+			for i := int32(0); i < lp.length; i++ {
+				elem := lp.off.addSizeUnchecked(lp.size.totalSize().timesUnchecked(i))
+				ptrs := elem.addSizeUnchecked(lp.size.DataSize)
+				if err := v.pointerSection(dst, ptrs, int32(lp.size.PointerCount), depthLimit-1); err != nil {
+					return err
+				}
+			}
+		case val.listType() == pointerList:
+			return v.pointerSection(dst, lp.off, lp.length, depthLimit-1)
+		}
+		return nil
+	case otherPointer:
+		if val.otherPointerType() != 0 {
+			return errorf("segment %d offset %d: unknown pointer type", s.id, paddr)
+		}
+		return nil
+	default:
+		return errorf("segment %d offset %d: far pointer landing pad is a far pointer", s.id, paddr)
+	}
+}
+
+// pointerSection validates n consecutive pointers starting at addr.
+func (v *validator) pointerSection(s *Segment, addr address, n int32, depthLimit uint) error {
+	for i := int32(0); i < n; i++ {
+		if err := v.ptr(s, addr.addSizeUnchecked(wordSize.timesUnchecked(i)), depthLimit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
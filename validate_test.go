@@ -0,0 +1,197 @@
+package capnp
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// rawStream builds an unpacked stream from segments given as words.
+func rawStream(segs ...[]uint64) []byte {
+	hdrLen := (4 + 4*len(segs) + 7) &^ 7
+	b := make([]byte, hdrLen)
+	binary.LittleEndian.PutUint32(b, uint32(len(segs)-1))
+	for i, s := range segs {
+		binary.LittleEndian.PutUint32(b[4+4*i:], uint32(len(s)))
+	}
+	for _, s := range segs {
+		for _, w := range s {
+			var buf [8]byte
+			binary.LittleEndian.PutUint64(buf[:], w)
+			b = append(b, buf[:]...)
+		}
+	}
+	return b
+}
+
+func TestUnmarshalChecked(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		segs [][]uint64
+		err  string // substring of error, empty for success
+	}{
+		{
+			name: "null root",
+			segs: [][]uint64{{0}},
+		},
+		{
+			name: "struct",
+			segs: [][]uint64{{
+				0x0001000100000000, // struct, offset 0, 1 data word, 1 pointer
+				0xdeadbeef,
+				0x0000000a00000005, // list of bytes, offset 1, 1 element
+				0,
+				0x2a,
+			}},
+		},
+		{
+			name: "far pointer",
+			segs: [][]uint64{
+				{0x0000000100000002}, // far pointer to segment 1, offset 0
+				{
+					0x0000000100000000, // landing pad: struct, 1 data word
+					0xdeadbeef,
+				},
+			},
+		},
+		{
+			name: "struct out of bounds",
+			segs: [][]uint64{{
+				0x0000000200000000, // struct, offset 0, 2 data words
+				0xdeadbeef,
+			}},
+			err: "segment 0 offset 0: struct pointer: invalid address",
+		},
+		{
+			name: "list out of bounds",
+			segs: [][]uint64{{
+				0x0001000000000000, // struct, offset 0, 1 pointer
+				0x0000002200000005, // list of 4 bytes, offset 1, past the end
+			}},
+			err: "segment 0 offset 8: list pointer: address out of bounds",
+		},
+		{
+			name: "overlapping structs",
+			segs: [][]uint64{{
+				0x0002000000000000, // struct, offset 0, 2 pointers
+				0x0000000100000004, // struct, offset 1, 1 data word
+				0x0000000100000000, // struct, offset 0, 1 data word: same word
+				0xdeadbeef,
+			}},
+			err: "segment 0 offset 16: struct: segment 0 offset 24: overlaps another object",
+		},
+		{
+			name: "pointer cycle",
+			segs: [][]uint64{{
+				0x0001000000000000, // struct, offset 0, 1 pointer
+				0x00010000fffffffc, // struct, offset -1, 1 pointer: itself
+			}},
+			err: "segment 0 offset 8: struct: segment 0 offset 8: overlaps another object",
+		},
+		{
+			name: "composite list elements exceed word count",
+			segs: [][]uint64{{
+				0x0000000f00000001, // composite list, offset 0, 1 word
+				0x0000000100000008, // tag: 2 elements, 1 data word each
+				0,
+				0,
+			}},
+			err: "segment 0 offset 0: composite list elements exceed list size",
+		},
+		{
+			name: "far pointer to missing segment",
+			segs: [][]uint64{{0x0000000500000002}},
+			err:  "segment 0 offset 0: far pointer",
+		},
+		{
+			name: "far pointer landing pad out of bounds",
+			segs: [][]uint64{
+				{0x000000010000002a}, // far pointer to segment 1, offset 5
+				{0},
+			},
+			err: "segment 0 offset 0: far pointer: address out of bounds",
+		},
+		{
+			name: "shared landing pad",
+			segs: [][]uint64{
+				{
+					0x0002000000000000, // struct, offset 0, 2 pointers
+					0x0000000100000002, // far pointer to segment 1, offset 0
+					0x0000000100000002, // far pointer to segment 1, offset 0
+				},
+				{
+					0x0000000000000000, // landing pad: struct, offset 0, empty
+				},
+			},
+			err: "segment 0 offset 16: far pointer landing pad: segment 1 offset 0: overlaps another object",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			data := rawStream(test.segs...)
+			if _, err := Unmarshal(data); err != nil {
+				t.Fatal("Unmarshal:", err)
+			}
+			msg, err := UnmarshalChecked(data)
+			if test.err == "" {
+				if err != nil {
+					t.Fatal("UnmarshalChecked:", err)
+				}
+				if _, err := msg.Root(); err != nil {
+					t.Error("Root:", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("UnmarshalChecked succeeded; want error containing %q", test.err)
+			}
+			if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("UnmarshalChecked error = %q; want to contain %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestUnmarshalChecked_Marshaled(t *testing.T) {
+	t.Parallel()
+
+	msg, seg, err := NewMessage(MultiSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := NewRootStruct(seg, ObjectSize{PointerCount: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewCompositeList(seg, ObjectSize{DataSize: 8, PointerCount: 1}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < l.Len(); i++ {
+		txt, err := NewText(seg, "hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Struct(i).SetPtr(0, txt.ToPtr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := root.SetPtr(0, l.ToPtr()); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.SetPtr(1, NewInterface(seg, 0).ToPtr()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := msg.Marshal()
+	if err != nil {
+		t.Fatal("Marshal:", err)
+	}
+	if _, err := UnmarshalChecked(data); err != nil {
+		t.Error("UnmarshalChecked:", err)
+	}
+}
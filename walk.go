@@ -0,0 +1,114 @@
+package capnp
+
+import "errors"
+
+// SkipChildren is used as a return value from the visit function passed
+// to Walk to indicate that the objects that the visited pointer's
+// target points to are to be skipped.  It is not returned as an error
+// by Walk.
+var SkipChildren = errors.New("skip children")
+
+// Walk calls visit for root and for every pointer reachable from it,
+// in depth-first order: an object's pointers are visited in index
+// order, each followed by the pointers of its target.  The pointers of
+// a struct list's elements are visited in element order.  Null pointers
+// are not visited.
+//
+// Each struct and list is descended into at most once, so a message
+// whose pointers form a cycle or share a target is walked in time
+// proportional to its size.  visit is still called for every pointer
+// that is reached, including ones to an already-visited target.
+//
+// If visit returns SkipChildren, Walk does not descend into the
+// pointer's target.  Any other error stops the walk, and Walk returns
+// it.  Walk also stops with an error if a pointer cannot be read, e.g.
+// because the message exceeds its traversal limit.
+func Walk(root Ptr, visit func(p Ptr) error) error {
+	w := walker{visit: visit, seen: make(map[walkKey]struct{})}
+	return w.walk(root)
+}
+
+type walker struct {
+	visit func(Ptr) error
+	seen  map[walkKey]struct{}
+}
+
+// walkKey identifies the target of a pointer.
+type walkKey struct {
+	seg  *Segment
+	off  address
+	list bool
+}
+
+func (w *walker) walk(p Ptr) error {
+	if !p.IsValid() {
+		return nil
+	}
+	if err := w.visit(p); err == SkipChildren {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	switch p.flags.ptrType() {
+	case structPtrType:
+		s := p.Struct()
+		if !w.mark(walkKey{seg: s.seg, off: s.off}) {
+			return nil
+		}
+		return w.walkStruct(s)
+	case listPtrType:
+		l := p.List()
+		if !w.mark(walkKey{seg: l.seg, off: l.off, list: true}) {
+			return nil
+		}
+		return w.walkList(l)
+	default:
+		return nil
+	}
+}
+
+// mark records k as seen and reports whether it was new.
+func (w *walker) mark(k walkKey) bool {
+	if _, ok := w.seen[k]; ok {
+		return false
+	}
+	w.seen[k] = struct{}{}
+	return true
+}
+
+func (w *walker) walkStruct(s Struct) error {
+	for i := uint16(0); i < s.size.PointerCount; i++ {
+		p, err := s.Ptr(i)
+		if err != nil {
+			return annotatef(err, "walk: struct pointer %d", i)
+		}
+		if err := w.walk(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *walker) walkList(l List) error {
+	if l.flags&isBitList != 0 || l.size.PointerCount == 0 {
+		return nil
+	}
+	if l.flags&isCompositeList == 0 {
+		for i := 0; i < l.Len(); i++ {
+			p, err := PointerList(l).At(i)
+			if err != nil {
+				return annotatef(err, "walk: list element %d", i)
+			}
+			if err := w.walk(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i := 0; i < l.Len(); i++ {
+		if err := w.walkStruct(l.Struct(i)); err != nil {
+			return annotatef(err, "walk: list element %d", i)
+		}
+	}
+	return nil
+}
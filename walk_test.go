@@ -0,0 +1,148 @@
+package capnp
+
+import (
+	"errors"
+	"testing"
+)
+
+// newWalkMessage returns a root struct with a struct list in pointer 0,
+// whose two elements each hold a text, and a pointer list in pointer 1
+// holding one text and one null pointer.
+func newWalkMessage(t *testing.T) Struct {
+	_, seg, err := NewMessage(SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := NewRootStruct(seg, ObjectSize{PointerCount: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, err := NewCompositeList(seg, ObjectSize{DataSize: 8, PointerCount: 1}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < sl.Len(); i++ {
+		if err := sl.Struct(i).SetText(0, "elem"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := root.SetPtr(0, sl.ToPtr()); err != nil {
+		t.Fatal(err)
+	}
+	pl, err := NewPointerList(seg, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txt, err := NewText(seg, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.Set(0, txt.ToPtr()); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.SetPtr(1, pl.ToPtr()); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestWalk(t *testing.T) {
+	root := newWalkMessage(t)
+	var structs, lists int
+	err := Walk(root.ToPtr(), func(p Ptr) error {
+		switch {
+		case p.Struct().IsValid():
+			structs++
+		case p.List().IsValid():
+			lists++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Walk:", err)
+	}
+	// The root struct; the struct list, the pointer list, and three texts.
+	if structs != 1 || lists != 5 {
+		t.Errorf("Walk visited %d structs and %d lists; want 1 and 5", structs, lists)
+	}
+}
+
+func TestWalk_SkipChildren(t *testing.T) {
+	root := newWalkMessage(t)
+	n := 0
+	err := Walk(root.ToPtr(), func(p Ptr) error {
+		n++
+		if l := p.List(); l.IsValid() && l.flags&isCompositeList != 0 {
+			return SkipChildren
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Walk:", err)
+	}
+	// The root struct, the struct list, the pointer list, and its text.
+	if n != 4 {
+		t.Errorf("Walk visited %d pointers; want 4", n)
+	}
+}
+
+func TestWalk_Error(t *testing.T) {
+	root := newWalkMessage(t)
+	errStop := errors.New("stop")
+	n := 0
+	err := Walk(root.ToPtr(), func(p Ptr) error {
+		n++
+		if n == 2 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop {
+		t.Errorf("Walk returned %v; want %v", err, errStop)
+	}
+	if n != 2 {
+		t.Errorf("Walk visited %d pointers after error; want 2", n)
+	}
+}
+
+func TestWalk_Cycle(t *testing.T) {
+	_, seg, err := NewMessage(SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := NewRootStruct(seg, ObjectSize{PointerCount: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := NewStruct(seg, ObjectSize{PointerCount: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// root -> root and root -> child -> root.
+	if err := root.SetPtr(0, root.ToPtr()); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.SetPtr(0, root.ToPtr()); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.SetPtr(1, child.ToPtr()); err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	err = Walk(root.ToPtr(), func(p Ptr) error {
+		n++
+		if n > 100 {
+			return errors.New("walk did not terminate")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Walk:", err)
+	}
+	// The root, its pointer to itself, its pointer to the child, and
+	// the child's pointer to the root.
+	if n != 4 {
+		t.Errorf("Walk visited %d pointers; want 4", n)
+	}
+}